@@ -0,0 +1,241 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/SphrGhfri/chatroom_golang_nats/pkg/logger"
+	"github.com/SphrGhfri/chatroom_golang_nats/service"
+)
+
+// RequireToken lets a request through only if it carries the admin token as a bearer token
+func RequireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// createRoomRequest is a room record with the password of a password room
+type createRoomRequest struct {
+	domain.Room
+	Password string `json:"password"`
+}
+
+// HandleCreateRoom creates a persistent room from a JSON room record with a name
+// and optionally a topic, description, visibility, password, announcement-only flag
+// and capacity
+func HandleCreateRoom(chatService service.ChatService, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req createRoomRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid room", http.StatusBadRequest)
+			return
+		}
+
+		room, err := chatService.CreateRoom(r.Context(), domain.Room{
+			Name:             req.Name,
+			Topic:            req.Topic,
+			Description:      req.Description,
+			CreatedBy:        req.CreatedBy,
+			Visibility:       req.Visibility,
+			AnnouncementOnly: req.AnnouncementOnly,
+			MaxMembers:       req.MaxMembers,
+		}, req.Password)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		log.WithFields(map[string]interface{}{"room": room.Name}).Infof("Room created through admin API")
+		writeJSON(w, http.StatusCreated, room)
+	}
+}
+
+// HandleGetRoom returns the record of a room
+func HandleGetRoom(chatService service.ChatService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := chatService.GetRoomInfo(r.Context(), r.PathValue("name"), "")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, room)
+	}
+}
+
+// HandleDeleteRoom makes a persistent room ad-hoc again
+func HandleDeleteRoom(chatService service.ChatService, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if err := chatService.DeleteRoom(r.Context(), name); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.WithFields(map[string]interface{}{"room": name}).Infof("Room deleted through admin API")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// roleRequest names the role to give a user
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+// HandleAssignRole gives a user a role in a room, e.g. to let them post to an
+// announcement-only room
+func HandleAssignRole(chatService service.ChatService, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req roleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid role", http.StatusBadRequest)
+			return
+		}
+
+		room, username := r.PathValue("name"), r.PathValue("username")
+		if err := chatService.AssignRole(r.Context(), room, username, req.Role); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.WithFields(map[string]interface{}{
+			"room":     room,
+			"username": username,
+			"role":     req.Role,
+		}).Infof("Room role assigned through admin API")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// announcementOnlyRequest tells whether a room should be announcement-only
+type announcementOnlyRequest struct {
+	AnnouncementOnly bool `json:"announcement_only"`
+}
+
+// HandleSetAnnouncementOnly makes an existing room announcement-only or lets everyone
+// post to it again
+func HandleSetAnnouncementOnly(chatService service.ChatService, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req announcementOnlyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		room := r.PathValue("name")
+		if err := chatService.SetAnnouncementOnly(r.Context(), room, req.AnnouncementOnly); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.WithFields(map[string]interface{}{
+			"room":              room,
+			"announcement_only": req.AnnouncementOnly,
+		}).Infof("Room announcement-only changed through admin API")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleBan bans a username or an IP address from the server, from a JSON ban with
+// either of them and optionally a reason and a duration in seconds. Sessions of a
+// banned user are ended.
+func HandleBan(chatService service.ChatService, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req domain.ServerBan
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid ban", http.StatusBadRequest)
+			return
+		}
+
+		ban, err := chatService.BanFromServer(r.Context(), req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		log.WithFields(map[string]interface{}{
+			"username": ban.Username,
+			"ip":       ban.IP,
+		}).Infof("Banned from server through admin API")
+		writeJSON(w, http.StatusCreated, ban)
+	}
+}
+
+// HandleLiftUserBan lifts the server ban of a username
+func HandleLiftUserBan(chatService service.ChatService, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if err := chatService.LiftServerBan(r.Context(), name, ""); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.WithFields(map[string]interface{}{"username": name}).Infof("Server ban lifted through admin API")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleLiftIPBan lifts the server ban of an IP address
+func HandleLiftIPBan(chatService service.ChatService, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := r.PathValue("ip")
+		if err := chatService.LiftServerBan(r.Context(), "", ip); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.WithFields(map[string]interface{}{"ip": ip}).Infof("Server ban lifted through admin API")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// disconnectRequest optionally gives the reason shown to a disconnected user
+type disconnectRequest struct {
+	Reason string `json:"reason"`
+}
+
+// HandleDisconnectUser ends every session of a user on every server
+func HandleDisconnectUser(chatService service.ChatService, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req disconnectRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Reason == "" {
+			req.Reason = "Disconnected by an administrator"
+		}
+
+		name := r.PathValue("name")
+		if err := chatService.DisconnectUser(r.Context(), name, req.Reason); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.WithFields(map[string]interface{}{"username": name}).Infof("User disconnected through admin API")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError maps domain errors to HTTP status codes
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, domain.ErrInvalidRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, domain.ErrRoomNotFound), errors.Is(err, domain.ErrBanNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, domain.ErrRoomExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,132 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/SphrGhfri/chatroom_golang_nats/pkg/logger"
+	"github.com/SphrGhfri/chatroom_golang_nats/service"
+)
+
+// HandleUpload stores a file sent as the "file" field of a multipart form for the
+// room in the "room" field, and responds with the attachment to reference in messages
+func HandleUpload(fileService service.FileService, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := authenticate(w, r, fileService)
+		if !ok {
+			return
+		}
+		reqLog := log.WithFields(map[string]interface{}{
+			"username":    username,
+			"remote_addr": r.RemoteAddr,
+		})
+
+		// Leave room for the multipart framing around the file itself
+		r.Body = http.MaxBytesReader(w, r.Body, fileService.MaxSize()+1<<20)
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "multipart form required", http.StatusBadRequest)
+			return
+		}
+
+		// The room must come before the file, which is streamed to storage as it arrives
+		var room string
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				http.Error(w, "file required", http.StatusBadRequest)
+				return
+			}
+
+			switch part.FormName() {
+			case "room":
+				value, _ := io.ReadAll(io.LimitReader(part, 256))
+				room = strings.TrimSpace(string(value))
+			case "file":
+				if room == "" {
+					http.Error(w, "room required before file", http.StatusBadRequest)
+					return
+				}
+				att, err := fileService.Upload(r.Context(), username, room, part.FileName(), part)
+				if err != nil {
+					reqLog.Warnf("Upload rejected: %v", err)
+					writeError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(att)
+				return
+			}
+		}
+	}
+}
+
+// inlineTypes are the MIME types browsers may display in place. Anything else,
+// including SVG and HTML, which can carry scripts, is only offered as a download.
+var inlineTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
+
+// HandleDownload serves an attachment to members of the room it was uploaded to
+func HandleDownload(fileService service.FileService, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := authenticate(w, r, fileService)
+		if !ok {
+			return
+		}
+
+		att, file, err := fileService.Open(r.Context(), username, r.PathValue("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer file.Close()
+
+		disposition := "attachment"
+		if inlineTypes[att.MimeType] {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", att.MimeType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": att.Name}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		http.ServeContent(w, r, att.Name, time.Time{}, file)
+	}
+}
+
+// authenticate resolves the session token in the Authorization header to a username
+func authenticate(w http.ResponseWriter, r *http.Request, fileService service.FileService) (string, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	username, err := fileService.Authenticate(r.Context(), token)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	return username, true
+}
+
+// writeError maps file service errors to HTTP status codes
+func writeError(w http.ResponseWriter, err error) {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.Is(err, domain.ErrFileTooLarge), errors.As(err, &maxBytes):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, domain.ErrFileTypeBlocked):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, domain.ErrNotPermitted):
+		http.Error(w, "not a member of the room", http.StatusForbidden)
+	case errors.Is(err, domain.ErrAttachmentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
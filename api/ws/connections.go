@@ -0,0 +1,82 @@
+package ws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// cleanupTimeout bounds how long ending or detaching a closed client's session may take
+const cleanupTimeout = 5 * time.Second
+
+// Connections tracks the open clients of a server, so that they can be closed and
+// their sessions ended when it shuts down
+type Connections struct {
+	mu      sync.Mutex
+	clients map[*Client]struct{}
+	closed  bool
+	done    sync.WaitGroup // Clients whose cleanup has not finished
+}
+
+func NewConnections() *Connections {
+	return &Connections{clients: make(map[*Client]struct{})}
+}
+
+// closing reports whether Close has begun
+func (cs *Connections) closing() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.closed
+}
+
+// add tracks a client until remove is called. It reports false once Close has begun.
+func (cs *Connections) add(c *Client) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return false
+	}
+	cs.clients[c] = struct{}{}
+	cs.done.Add(1)
+	return true
+}
+
+// remove stops tracking a client once its session has been cleaned up
+func (cs *Connections) remove(c *Client) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, tracked := cs.clients[c]; tracked {
+		delete(cs.clients, c)
+		cs.done.Done()
+	}
+}
+
+// Close closes every client with a going away close frame and waits until their
+// sessions have been ended, or ctx is done. New clients are turned away.
+func (cs *Connections) Close(ctx context.Context) error {
+	cs.mu.Lock()
+	cs.closed = true
+	clients := make([]*Client, 0, len(cs.clients))
+	for c := range cs.clients {
+		clients = append(clients, c)
+	}
+	cs.mu.Unlock()
+
+	for _, c := range clients {
+		c.close(websocket.CloseGoingAway, "server shutting down")
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		cs.done.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -2,8 +2,15 @@ package ws
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
 	"github.com/SphrGhfri/chatroom_golang_nats/pkg/logger"
@@ -24,31 +31,80 @@ type Client struct {
 	ctx         context.Context
 	cancel      context.CancelFunc
 	username    string
+	ip          string // Address the connection came from
 	currentRoom string
+	roomMu      sync.Mutex // currentRoom also changes when the user is kicked
+	session     domain.Session
+	echo        bool // Deliver this connection's own messages back as delivery confirmation
 	chatService service.ChatService
 	logger      logger.Logger
+	writeMu     sync.Mutex  // gorilla/websocket allows only one concurrent writer
+	terminated  atomic.Bool // Closed by the server on an admin's request or shutdown; the session is not resumable
+	connections *Connections
+
+	watching     map[string]struct{} // Users whose presence this connection watches; only used by readPump
+	globalWatch  bool                // Presence frames of the global room's users are delivered; only used by readPump
+	presenceMu   sync.Mutex
+	lastPresence map[string]string // ID of the last presence frame delivered per user
 }
 
+const (
+	// maxCloseReasonLength is the most a close frame can carry besides its status code
+	maxCloseReasonLength = 123
+
+	// maxWatchedUsers bounds the number of users a connection can watch the presence of
+	maxWatchedUsers = 100
+)
+
 // === Core WebSocket Handler Functions ===
 
-// HandleWebSocket is the main WebSocket connection handler
-func HandleWebSocket(chatService service.ChatService, rootCtx context.Context, log logger.Logger) http.HandlerFunc {
+// HandleWebSocket is the main WebSocket connection handler. Open clients are tracked in
+// connections.
+func HandleWebSocket(chatService service.ChatService, connections *Connections, ipHeader string, rootCtx context.Context, log logger.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Create client-specific context
 		clientCtx, clientCancel := context.WithCancel(rootCtx)
 
 		username := r.URL.Query().Get("username")
+		resumeToken := r.URL.Query().Get("resume_token")
+		echo := r.URL.Query().Get("echo") == "true"
+		ip := clientIP(r, ipHeader)
 		clientLog := log.WithFields(map[string]interface{}{
 			"username":    username,
 			"remote_addr": r.RemoteAddr,
+			"client_ip":   ip,
 		})
 
+		if connections.closing() {
+			http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+			clientCancel()
+			return
+		}
+
 		if username == "" {
 			clientLog.Warnf("Missing username in connection request")
 			http.Error(w, "username required", http.StatusBadRequest)
 			clientCancel()
 			return
 		}
+		if !domain.ValidName(username) {
+			clientLog.Warnf("Invalid username in connection request")
+			http.Error(w, "username cannot contain '.', '*', '>' or whitespace", http.StatusBadRequest)
+			clientCancel()
+			return
+		}
+
+		if err := chatService.CheckServerBan(clientCtx, username, ip); err != nil {
+			if errors.Is(err, domain.ErrServerBanned) {
+				clientLog.Warnf("Rejected banned connection: %v", err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+			} else {
+				clientLog.Errorf("Failed to check server ban: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+			clientCancel()
+			return
+		}
 
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -57,18 +113,30 @@ func HandleWebSocket(chatService service.ChatService, rootCtx context.Context, l
 			return
 		}
 
-		// Check username with client context
-		if err := checkUsernameExists(clientCtx, username, chatService, clientLog, conn); err != nil {
-			sendErrorMessageAndClose(conn, err.Error())
+		client := newClient(clientCtx, clientCancel, conn, username, chatService, clientLog)
+		client.echo = echo
+		client.ip = ip
+		client.connections = connections
+		if !connections.add(client) {
+			sendErrorMessageAndClose(conn, "Server is shutting down")
 			clientCancel()
 			return
 		}
 
-		client := newClient(clientCtx, clientCancel, conn, username, chatService, clientLog)
+		if resumeToken != "" {
+			err := client.resume(resumeToken)
+			if err == nil {
+				go client.readPump()
+				return
+			}
+			clientLog.Infof("Could not resume session, starting a new one: %v", err)
+		}
+
 		if err := client.initialize(); err != nil {
 			clientLog.Errorf("Failed to initialize client: %v", err)
 			sendErrorMessageAndClose(conn, "Failed to initialize connection")
 			clientCancel()
+			connections.remove(client)
 			return
 		}
 
@@ -78,23 +146,47 @@ func HandleWebSocket(chatService service.ChatService, rootCtx context.Context, l
 
 // readPump handles incoming WebSocket messages
 func (c *Client) readPump() {
+	closedByClient := false
 	defer func() {
+		// The client's context is cancelled when the server shuts down, and the
+		// session must still be cleaned up
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(c.ctx), cleanupTimeout)
+		defer cancel()
+		for username := range c.watching {
+			c.chatService.UnwatchPresence(ctx, username, c.session.ConnID)
+		}
+		if c.globalWatch {
+			c.chatService.UnwatchGlobalPresence(ctx, c.session.ConnID)
+		}
+		c.session.Room = c.getCurrentRoom()
+		if closedByClient || c.terminated.Load() {
+			c.chatService.EndSession(ctx, c.session)
+		} else {
+			// Connection dropped: keep the session resumable for the grace period
+			c.chatService.DetachSession(ctx, c.session)
+		}
 		c.cancel() // Cancel client context
-		c.chatService.RemoveActiveUser(c.ctx, c.username)
-		c.chatService.LeaveRoom(c.ctx, c.currentRoom, c.username)
 		c.conn.Close()
+		c.connections.remove(c)
 	}()
 
+	c.chatService.TouchSession(c.ctx, c.session)
 	for {
 		var msg domain.ChatMessage
 		if err := c.conn.ReadJSON(&msg); err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+			closedByClient = websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure)
+			if !closedByClient {
 				c.logger.Errorf("read error: %v", err)
 			}
 			break
 		}
 
 		msg.Sender = c.username
+		msg.ConnID = c.session.ConnID
+		if msg.Type != domain.MessageTypeAck {
+			// Acks are sent automatically on delivery and do not show the user is there
+			c.chatService.TouchSession(c.ctx, c.session)
+		}
 
 		switch msg.Type {
 		case domain.MessageTypeList:
@@ -102,11 +194,44 @@ func (c *Client) readPump() {
 		case domain.MessageTypeRooms:
 			c.handleListRooms()
 		case domain.MessageTypeJoin:
-			c.handleJoinRoom(msg.Room)
+			c.handleJoinRoom(msg)
 		case domain.MessageTypeLeave:
 			c.handleLeaveRoom()
 		case domain.MessageTypeChat:
 			c.handleChatMessage(msg)
+		case domain.MessageTypeAck:
+			c.handleAck(msg)
+		case domain.MessageTypeTypingStart, domain.MessageTypeTypingStop:
+			c.handleTyping(msg)
+		case domain.MessageTypeMarkRead:
+			c.handleMarkRead(msg)
+		case domain.MessageTypeEdit, domain.MessageTypeDelete:
+			c.handleMessageChange(msg)
+		case domain.MessageTypeAddReaction, domain.MessageTypeRemoveReaction:
+			c.handleReaction(msg)
+		case domain.MessageTypeGetHistory:
+			c.handleGetHistory(msg)
+		case domain.MessageTypeGetThread:
+			c.handleGetThread(msg)
+		case domain.MessageTypeRoomInfo:
+			c.handleRoomInfo(msg)
+		case domain.MessageTypeSetTopic:
+			c.handleSetTopic(msg)
+		case domain.MessageTypeSetSlowMode:
+			c.handleSetSlowMode(msg)
+		case domain.MessageTypeSetRole:
+			c.handleSetRole(msg)
+		case domain.MessageTypeKick, domain.MessageTypeBan, domain.MessageTypeMute,
+			domain.MessageTypeUnban, domain.MessageTypeUnmute:
+			c.handleModeration(msg)
+		case domain.MessageTypeCreateRoom:
+			c.handleCreateRoom(msg)
+		case domain.MessageTypeInvite:
+			c.handleInvite(msg)
+		case domain.MessageTypeWatchPresence, domain.MessageTypeUnwatchPresence:
+			c.handleWatchPresence(msg)
+		case domain.MessageTypeSetStatus:
+			c.handleSetStatus(msg)
 		}
 	}
 }
@@ -123,37 +248,62 @@ func newClient(ctx context.Context, cancel context.CancelFunc, conn *websocket.C
 		currentRoom: "global",
 		chatService: chatService,
 		logger:      log,
+
+		watching:     make(map[string]struct{}),
+		lastPresence: make(map[string]string),
 	}
 }
 
-// initialize sets up the client's initial state
+// initialize sets up the client's initial state.
+// A user may hold several sessions at once, e.g. on different devices.
 func (c *Client) initialize() error {
-	if err := c.chatService.AddActiveUser(c.ctx, c.username); err != nil {
+	session, err := c.chatService.StartSession(c.ctx, c.username, c.ip)
+	if err != nil {
+		return fmt.Errorf("failed to start session: %w", err)
+	}
+	c.session = session
+	// Send the resume token before any room traffic
+	c.sendSession()
+
+	if err := c.chatService.AddActiveUser(c.ctx, c.username, c.session.ConnID); err != nil {
+		c.chatService.EndSession(c.ctx, c.session)
 		return fmt.Errorf("failed to add active user: %w", err)
 	}
 
-	if err := c.chatService.JoinRoom(c.ctx, "global", c.username, c.handleMessage); err != nil {
-		c.chatService.RemoveActiveUser(c.ctx, c.username)
+	if err := c.chatService.SubscribeUser(c.ctx, c.username, c.session.ConnID, c.handleUserMessage); err != nil {
+		c.chatService.EndSession(c.ctx, c.session)
+		return err
+	}
+
+	if err := c.chatService.JoinRoom(c.ctx, "global", c.username, c.session.ConnID, c.handleRoomMessage); err != nil {
+		c.chatService.EndSession(c.ctx, c.session)
 		return fmt.Errorf("failed to join global room: %w", err)
 	}
+	c.sendJoined()
 
 	return nil
 }
 
-// checkUsernameExists verifies if the username is already in use
-func checkUsernameExists(ctx context.Context, username string, chatService service.ChatService, logger logger.Logger, conn *websocket.Conn) error {
-	exists, err := chatService.IsUserActive(ctx, username)
+// resume re-attaches the client to a dropped session and replays what it missed
+func (c *Client) resume(token string) error {
+	session, err := c.chatService.ResumeSession(c.ctx, token, c.username, c.ip)
 	if err != nil {
-		logger.Errorf("failed to check username existence: %v", err)
-		return fmt.Errorf("internal server error")
+		return err
 	}
+	c.session = session
+	c.setCurrentRoom(session.Room)
+	c.sendSession()
 
-	if exists {
-		logger.Infof("username %s is already taken", username)
-		sendErrorMessageAndClose(conn, "username already exists")
-		return fmt.Errorf("username already exists")
+	if err := c.chatService.RestoreSession(c.ctx, session, c.handleRoomMessage); err != nil {
+		c.chatService.EndSession(c.ctx, session)
+		c.setCurrentRoom("global")
+		return fmt.Errorf("failed to restore session: %w", err)
+	}
+	if err := c.chatService.SubscribeUser(c.ctx, c.username, session.ConnID, c.handleUserMessage); err != nil {
+		c.chatService.EndSession(c.ctx, session)
+		c.setCurrentRoom("global")
+		return err
 	}
-
 	return nil
 }
 
@@ -161,17 +311,508 @@ func checkUsernameExists(ctx context.Context, username string, chatService servi
 
 // handleMessage sends a message to the WebSocket client
 func (c *Client) handleMessage(msg domain.ChatMessage) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	if err := c.conn.WriteJSON(msg); err != nil {
 		c.logger.Errorf("failed to write message to websocket: %v", err)
 	}
 }
 
+// handleRoomMessage delivers a room message unless it is this connection's own echo
+func (c *Client) handleRoomMessage(msg domain.ChatMessage) {
+	if msg.ConnID == c.session.ConnID && !c.echo {
+		return
+	}
+	if msg.Type == domain.MessageTypePresence && c.seenPresence(msg) {
+		return
+	}
+	c.handleMessage(msg)
+}
+
+// handlePresenceMessage delivers a presence frame of a watched user
+func (c *Client) handlePresenceMessage(msg domain.ChatMessage) {
+	if c.seenPresence(msg) {
+		return
+	}
+	c.handleMessage(msg)
+}
+
+// handleGlobalPresenceMessage delivers a presence frame of a user in the global room
+// while this connection is in it too
+func (c *Client) handleGlobalPresenceMessage(msg domain.ChatMessage) {
+	if c.getCurrentRoom() != "global" || c.seenPresence(msg) {
+		return
+	}
+	c.handleMessage(msg)
+}
+
+// seenPresence reports whether a presence frame was delivered already. A watched
+// user in the same room sends each frame both to the room and to their watchers.
+func (c *Client) seenPresence(msg domain.ChatMessage) bool {
+	if msg.Presence == nil || msg.ID == "" {
+		return false
+	}
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	if c.lastPresence[msg.Presence.Username] == msg.ID {
+		return true
+	}
+	c.lastPresence[msg.Presence.Username] = msg.ID
+	return false
+}
+
+// handleUserMessage delivers a message addressed to the user. A connection in a
+// room the user was kicked or banned from moves to the global room, or at least
+// leaves the room if that fails.
+func (c *Client) handleUserMessage(msg domain.ChatMessage) {
+	if msg.Type == domain.MessageTypeDisconnect {
+		if msg.ConnID == "" || msg.ConnID == c.session.ConnID {
+			c.terminate(msg.Content)
+		}
+		return
+	}
+	c.handleMessage(msg)
+	if msg.Type != domain.MessageTypeKick && msg.Type != domain.MessageTypeBan {
+		return
+	}
+	if msg.Room != c.getCurrentRoom() || msg.Room == "global" {
+		return
+	}
+	if err := c.chatService.SwitchRoom(c.ctx, msg.Room, "global", c.username, c.session.ConnID, "", c.handleRoomMessage); err != nil {
+		// The connection must not stay in the room, even if it cannot get into global
+		c.logger.Errorf("failed to return to global room, leaving %s: %v", msg.Room, err)
+		if err := c.chatService.LeaveRoom(c.ctx, msg.Room, c.username, c.session.ConnID); err != nil {
+			c.logger.Errorf("failed to leave room: %v", err)
+		}
+		c.sendRequestError(err)
+		return
+	}
+	c.setCurrentRoom("global")
+	c.sendJoined()
+}
+
+// terminate closes the connection with a policy violation close frame carrying the
+// reason. The session ends instead of staying resumable.
+func (c *Client) terminate(reason string) {
+	c.logger.Infof("Disconnecting client: %s", reason)
+	c.close(websocket.ClosePolicyViolation, reason)
+}
+
+// close closes the connection with a close frame of code carrying the reason.
+// The session ends instead of staying resumable.
+func (c *Client) close(code int, reason string) {
+	c.terminated.Store(true)
+
+	for len(reason) > maxCloseReasonLength {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason)-size]
+	}
+	// WriteControl may be called concurrently with the other writers
+	if err := c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second)); err != nil {
+		c.logger.Errorf("failed to send close frame: %v", err)
+	}
+	c.conn.Close()
+}
+
 // handleChatMessage processes and publishes chat messages
 func (c *Client) handleChatMessage(msg domain.ChatMessage) {
-	msg.Room = c.currentRoom
+	msg.Room = c.getCurrentRoom()
 	if err := c.chatService.PublishMessage(c.ctx, msg); err != nil {
 		c.logger.Errorf("failed to publish message: %v", err)
+		c.sendRequestError(err)
+	}
+}
+
+// handleTyping relays typing indicators to the current room
+func (c *Client) handleTyping(msg domain.ChatMessage) {
+	var err error
+	if msg.Type == domain.MessageTypeTypingStart {
+		err = c.chatService.StartTyping(c.ctx, c.getCurrentRoom(), c.username, c.session.ConnID)
+	} else {
+		err = c.chatService.StopTyping(c.ctx, c.getCurrentRoom(), c.username, c.session.ConnID)
+	}
+	if err != nil {
+		c.logger.Errorf("failed to relay typing indicator: %v", err)
+	}
+}
+
+// handleMarkRead records how far the user has read a room, the current one by default
+func (c *Client) handleMarkRead(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
+	}
+	if err := c.chatService.MarkRead(c.ctx, room, c.username, c.session.ConnID, msg.ID); err != nil {
+		c.logger.Errorf("failed to mark messages as read: %v", err)
+	}
+}
+
+// handleMessageChange edits or deletes a message in the given room, the current one by default
+func (c *Client) handleMessageChange(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
+	}
+	if msg.ID == "" || (msg.Type == domain.MessageTypeEdit && msg.Content == "") {
+		c.sendError(domain.ErrorCodeInvalidRequest, "A message ID and, for edits, new content are required")
+		return
+	}
+
+	var err error
+	if msg.Type == domain.MessageTypeEdit {
+		err = c.chatService.EditMessage(c.ctx, room, c.username, c.session.ConnID, msg.ID, msg.Content)
+	} else {
+		err = c.chatService.DeleteMessage(c.ctx, room, c.username, c.session.ConnID, msg.ID)
+	}
+	if err != nil {
+		c.logger.Errorf("failed to change message %s: %v", msg.ID, err)
+		c.sendRequestError(err)
+	}
+}
+
+// handleReaction adds or removes a reaction to a message in the given room, the current one by default
+func (c *Client) handleReaction(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
+	}
+	if msg.ID == "" || msg.Emoji == "" {
+		c.sendError(domain.ErrorCodeInvalidRequest, "A message ID and an emoji are required")
+		return
+	}
+
+	var err error
+	if msg.Type == domain.MessageTypeAddReaction {
+		err = c.chatService.AddReaction(c.ctx, room, c.username, c.session.ConnID, msg.ID, msg.Emoji)
+	} else {
+		err = c.chatService.RemoveReaction(c.ctx, room, c.username, c.session.ConnID, msg.ID, msg.Emoji)
+	}
+	if err != nil {
+		c.logger.Errorf("failed to change reaction on message %s: %v", msg.ID, err)
+		c.sendRequestError(err)
+	}
+}
+
+// handleGetHistory sends a page of stored messages of the given room, the current one by default.
+// An ID asks for the messages before it.
+func (c *Client) handleGetHistory(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
+	}
+	messages, err := c.chatService.GetHistory(c.ctx, room, c.username, msg.ID)
+	if err != nil {
+		c.logger.Errorf("failed to get history: %v", err)
+		c.sendRequestError(err)
+		return
+	}
+	c.handleMessage(domain.ChatMessage{
+		Type:     domain.MessageTypeHistory,
+		Room:     room,
+		Messages: messages,
+	})
+}
+
+// handleGetThread sends the thread of a message in the given room, the current one by default
+func (c *Client) handleGetThread(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
+	}
+	if msg.ID == "" {
+		c.sendError(domain.ErrorCodeInvalidRequest, "A message ID is required")
+		return
+	}
+	messages, err := c.chatService.GetThread(c.ctx, room, c.username, msg.ID)
+	if err != nil {
+		c.logger.Errorf("failed to get thread: %v", err)
+		c.sendRequestError(err)
+		return
+	}
+	c.handleMessage(domain.ChatMessage{
+		Type:     domain.MessageTypeThread,
+		Room:     room,
+		ThreadID: messages[0].ID,
+		Messages: messages,
+	})
+}
+
+// handleRoomInfo sends the record of a room, the current one by default
+func (c *Client) handleRoomInfo(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
+	}
+	info, err := c.chatService.GetRoomInfo(c.ctx, room, c.username)
+	if err != nil {
+		c.logger.Errorf("failed to get room info: %v", err)
+		c.sendRequestError(err)
+		return
+	}
+	c.handleMessage(domain.ChatMessage{
+		Type:     domain.MessageTypeRoomInfo,
+		Room:     room,
+		RoomInfo: &info,
+	})
+}
+
+// handleSetTopic changes the topic of a room, the current one by default
+func (c *Client) handleSetTopic(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
+	}
+	if err := c.chatService.SetTopic(c.ctx, room, c.username, c.session.ConnID, msg.Content); err != nil {
+		c.logger.Errorf("failed to set topic: %v", err)
+		c.sendRequestError(err)
+	}
+}
+
+// handleSetSlowMode sets the slow mode of a room, the current one by default
+func (c *Client) handleSetSlowMode(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
 	}
+	if msg.RoomInfo == nil {
+		c.sendError(domain.ErrorCodeInvalidRequest, "A room_info object with slow_mode is required")
+		return
+	}
+	if err := c.chatService.SetSlowMode(c.ctx, room, c.username, c.session.ConnID, msg.RoomInfo.SlowMode); err != nil {
+		c.logger.Errorf("failed to set slow mode: %v", err)
+		c.sendRequestError(err)
+	}
+}
+
+// handleSetRole gives the user named in the role object a role in a room, the current one by default
+func (c *Client) handleSetRole(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
+	}
+	if msg.Role == nil {
+		c.sendError(domain.ErrorCodeInvalidRequest, "A role object is required")
+		return
+	}
+	if err := c.chatService.SetRole(c.ctx, room, c.username, c.session.ConnID, *msg.Role); err != nil {
+		c.logger.Errorf("failed to set role: %v", err)
+		c.sendRequestError(err)
+	}
+}
+
+// handleWatchPresence starts or stops delivering the presence frames of the user in
+// the presence object. A new watch is answered with the user's current presence.
+// Without a user but with the global room, it is the presence frames of the global
+// room's users, delivered while the connection is in it.
+func (c *Client) handleWatchPresence(msg domain.ChatMessage) {
+	if msg.Presence == nil && msg.Room == "global" {
+		c.handleWatchGlobalPresence(msg)
+		return
+	}
+	if msg.Presence == nil || msg.Presence.Username == "" {
+		c.sendError(domain.ErrorCodeInvalidRequest, "A presence object with a username is required")
+		return
+	}
+	username := msg.Presence.Username
+
+	if msg.Type == domain.MessageTypeUnwatchPresence {
+		if err := c.chatService.UnwatchPresence(c.ctx, username, c.session.ConnID); err != nil {
+			c.logger.Errorf("failed to unwatch presence: %v", err)
+		}
+		delete(c.watching, username)
+		return
+	}
+
+	if _, ok := c.watching[username]; !ok && len(c.watching) >= maxWatchedUsers {
+		c.sendError(domain.ErrorCodeInvalidRequest, fmt.Sprintf("Cannot watch more than %d users", maxWatchedUsers))
+		return
+	}
+	presence, err := c.chatService.WatchPresence(c.ctx, username, c.session.ConnID, c.handlePresenceMessage)
+	if err != nil {
+		c.logger.Errorf("failed to watch presence: %v", err)
+		c.sendRequestError(err)
+		return
+	}
+	c.watching[username] = struct{}{}
+	c.handleMessage(domain.ChatMessage{
+		Type:      domain.MessageTypePresence,
+		Sender:    username,
+		Presence:  &presence,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// handleWatchGlobalPresence starts or stops delivering the presence frames of the
+// global room's users. A new watch is answered with the room's users and their statuses.
+func (c *Client) handleWatchGlobalPresence(msg domain.ChatMessage) {
+	if msg.Type == domain.MessageTypeUnwatchPresence {
+		if err := c.chatService.UnwatchGlobalPresence(c.ctx, c.session.ConnID); err != nil {
+			c.logger.Errorf("failed to unwatch presence of global room: %v", err)
+		}
+		c.globalWatch = false
+		return
+	}
+
+	if err := c.chatService.WatchGlobalPresence(c.ctx, c.session.ConnID, c.handleGlobalPresenceMessage); err != nil {
+		c.logger.Errorf("failed to watch presence of global room: %v", err)
+		c.sendRequestError(err)
+		return
+	}
+	c.globalWatch = true
+	c.handleListRoomMembers("global")
+}
+
+// handleSetStatus chooses the user's status and custom text from the presence object
+// and answers with the user's resulting presence
+func (c *Client) handleSetStatus(msg domain.ChatMessage) {
+	if msg.Presence == nil || msg.Presence.Status == "" {
+		c.sendError(domain.ErrorCodeInvalidRequest, "A presence object with a status is required")
+		return
+	}
+	presence, err := c.chatService.SetStatus(c.ctx, c.username, *msg.Presence)
+	if err != nil {
+		c.logger.Errorf("failed to set status: %v", err)
+		c.sendRequestError(err)
+		return
+	}
+	c.handleMessage(domain.ChatMessage{
+		Type:      domain.MessageTypePresence,
+		Sender:    c.username,
+		Presence:  &presence,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// handleModeration kicks, bans, mutes, unbans or unmutes the user named in the
+// moderation object in a room, the current one by default
+func (c *Client) handleModeration(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
+	}
+	if msg.Moderation == nil {
+		c.sendError(domain.ErrorCodeInvalidRequest, "A moderation object is required")
+		return
+	}
+
+	var err error
+	switch msg.Type {
+	case domain.MessageTypeKick:
+		err = c.chatService.Kick(c.ctx, room, c.username, c.session.ConnID, *msg.Moderation)
+	case domain.MessageTypeBan:
+		err = c.chatService.Ban(c.ctx, room, c.username, c.session.ConnID, *msg.Moderation)
+	case domain.MessageTypeUnban:
+		err = c.chatService.Unban(c.ctx, room, c.username, c.session.ConnID, *msg.Moderation)
+	case domain.MessageTypeUnmute:
+		err = c.chatService.Unmute(c.ctx, room, c.username, c.session.ConnID, *msg.Moderation)
+	default:
+		err = c.chatService.Mute(c.ctx, room, c.username, c.session.ConnID, *msg.Moderation)
+	}
+	if err != nil {
+		c.logger.Errorf("failed to %s user: %v", msg.Type, err)
+		c.sendRequestError(err)
+	}
+}
+
+// handleCreateRoom creates a persistent room named by the room field. A room_info
+// object in the request can set its topic, description, visibility, capacity and
+// whether it is announcement-only; password rooms take their password from the
+// password field.
+func (c *Client) handleCreateRoom(msg domain.ChatMessage) {
+	room := domain.Room{Name: msg.Room, CreatedBy: c.username}
+	if msg.RoomInfo != nil {
+		room.Topic = msg.RoomInfo.Topic
+		room.Description = msg.RoomInfo.Description
+		room.Visibility = msg.RoomInfo.Visibility
+		room.AnnouncementOnly = msg.RoomInfo.AnnouncementOnly
+		room.MaxMembers = msg.RoomInfo.MaxMembers
+	}
+	created, err := c.chatService.CreateRoom(c.ctx, room, msg.Password)
+	if err != nil {
+		c.logger.Errorf("failed to create room: %v", err)
+		c.sendRequestError(err)
+		return
+	}
+	c.handleMessage(domain.ChatMessage{
+		Type:     domain.MessageTypeRoomInfo,
+		Room:     created.Name,
+		RoomInfo: &created,
+	})
+}
+
+// handleInvite invites the user named in the invite object to a room, the current one
+// by default, or without a username answers with a new shareable invite token
+func (c *Client) handleInvite(msg domain.ChatMessage) {
+	room := msg.Room
+	if room == "" {
+		room = c.getCurrentRoom()
+	}
+	if msg.Invite == nil {
+		c.sendError(domain.ErrorCodeInvalidRequest, "An invite object is required")
+		return
+	}
+
+	if msg.Invite.Username != "" {
+		if err := c.chatService.InviteUser(c.ctx, room, c.username, msg.Invite.Username); err != nil {
+			c.logger.Errorf("failed to invite user: %v", err)
+			c.sendRequestError(err)
+			return
+		}
+		c.sendSystemMessage(fmt.Sprintf("Invited %s to %s", msg.Invite.Username, room))
+		return
+	}
+
+	invite, err := c.chatService.CreateInvite(c.ctx, room, c.username, msg.Invite.MaxUses, time.Duration(msg.Invite.ExpiresIn)*time.Second)
+	if err != nil {
+		c.logger.Errorf("failed to create invite: %v", err)
+		c.sendRequestError(err)
+		return
+	}
+	c.handleMessage(domain.ChatMessage{
+		Type:   domain.MessageTypeInvite,
+		Room:   room,
+		Invite: &invite,
+	})
+}
+
+// handleAck records the last message the client has received
+func (c *Client) handleAck(msg domain.ChatMessage) {
+	if err := c.chatService.AckMessage(c.ctx, c.session.Token, msg.ID); err != nil {
+		c.logger.Errorf("failed to acknowledge message: %v", err)
+	}
+}
+
+// sendSession tells the client its resume token and current room
+func (c *Client) sendSession() {
+	c.handleMessage(domain.ChatMessage{
+		Type:        domain.MessageTypeSession,
+		Room:        c.getCurrentRoom(),
+		ResumeToken: c.session.Token,
+	})
+}
+
+// getCurrentRoom returns the room the connection is in
+func (c *Client) getCurrentRoom() string {
+	c.roomMu.Lock()
+	defer c.roomMu.Unlock()
+	return c.currentRoom
+}
+
+// setCurrentRoom records the room the connection is in
+func (c *Client) setCurrentRoom(room string) {
+	c.roomMu.Lock()
+	defer c.roomMu.Unlock()
+	c.currentRoom = room
+}
+
+// sendJoined confirms to the client which room it is now in
+func (c *Client) sendJoined() {
+	c.handleMessage(domain.ChatMessage{
+		Type:    domain.MessageTypeJoined,
+		Content: fmt.Sprintf("Joined room: %s", c.getCurrentRoom()),
+		Room:    c.getCurrentRoom(),
+	})
 }
 
 // sendSystemMessage sends system notifications to the client
@@ -182,6 +823,70 @@ func (c *Client) sendSystemMessage(content string) {
 	})
 }
 
+// sendError tells the client why a request was rejected
+func (c *Client) sendError(code, content string) {
+	c.handleMessage(domain.ChatMessage{
+		Type:    domain.MessageTypeError,
+		Code:    code,
+		Content: content,
+	})
+}
+
+// sendRequestError reports a rejected request to the client if the error is one it can act on
+func (c *Client) sendRequestError(err error) {
+	var slowMode *domain.SlowModeError
+	switch {
+	case errors.As(err, &slowMode):
+		// Round up so the client never retries too early
+		retryAfter := int64((slowMode.RetryAfter + time.Second - 1) / time.Second)
+		c.handleMessage(domain.ChatMessage{
+			Type:       domain.MessageTypeError,
+			Code:       domain.ErrorCodeSlowMode,
+			Content:    fmt.Sprintf("Slow mode is on, wait %d seconds", retryAfter),
+			RetryAfter: retryAfter,
+		})
+	case errors.Is(err, domain.ErrNotPermitted):
+		c.sendError(domain.ErrorCodeNotPermitted, "You are not permitted to do that")
+	case errors.Is(err, domain.ErrMessageNotFound):
+		c.sendError(domain.ErrorCodeNotFound, "Message not found")
+	case errors.Is(err, domain.ErrAttachmentNotFound):
+		c.sendError(domain.ErrorCodeNotFound, "Attachment not found")
+	case errors.Is(err, domain.ErrRoomNotFound):
+		c.sendError(domain.ErrorCodeNotFound, "Room not found")
+	case errors.Is(err, domain.ErrRoomExists):
+		c.sendError(domain.ErrorCodeAlreadyExists, "Room already exists")
+	case errors.Is(err, domain.ErrRoomFull):
+		c.sendError(domain.ErrorCodeRoomFull, "Room is full")
+	case errors.Is(err, domain.ErrInviteInvalid):
+		c.sendError(domain.ErrorCodeNotPermitted, "Invite is invalid or expired")
+	case errors.Is(err, domain.ErrBanned):
+		c.sendError(domain.ErrorCodeNotPermitted, "You are banned from this room")
+	case errors.Is(err, domain.ErrMuted):
+		c.sendError(domain.ErrorCodeNotPermitted, "You are muted in this room")
+	case errors.Is(err, domain.ErrInvalidRequest):
+		c.sendError(domain.ErrorCodeInvalidRequest, "Invalid request")
+	}
+}
+
+// clientIP returns the IP address a request came from. Behind a reverse proxy that
+// header names, e.g. X-Forwarded-For, it is the last address the proxy appended;
+// without the header, or if it holds no valid address, it is the peer's address.
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if values := r.Header.Values(header); len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // sendErrorMessageAndClose sends an error message and closes the connection
 func sendErrorMessageAndClose(conn *websocket.Conn, errMsg string) {
 	errorMessage := domain.ChatMessage{
@@ -194,22 +899,41 @@ func sendErrorMessageAndClose(conn *websocket.Conn, errMsg string) {
 
 // === Room Management Functions ===
 
-// handleJoinRoom processes room join requests
-func (c *Client) handleJoinRoom(newRoom string) {
-	if err := c.chatService.SwitchRoom(c.ctx, c.currentRoom, newRoom, c.username, c.handleMessage); err != nil {
+// handleJoinRoom processes room join requests. An invite token used for a join that
+// fails is given back.
+func (c *Client) handleJoinRoom(msg domain.ChatMessage) {
+	newRoom := msg.Room
+	var redeemed bool
+	if msg.Invite != nil && msg.Invite.Token != "" {
+		var err error
+		if redeemed, err = c.chatService.RedeemInvite(c.ctx, newRoom, c.username, msg.Invite.Token); err != nil {
+			c.logger.Errorf("failed to redeem invite: %v", err)
+			c.sendRequestError(err)
+			return
+		}
+	}
+	if err := c.chatService.SwitchRoom(c.ctx, c.getCurrentRoom(), newRoom, c.username, c.session.ConnID, msg.Password, c.handleRoomMessage); err != nil {
 		c.logger.Errorf("failed to switch room: %v", err)
+		if redeemed {
+			if err := c.chatService.ReturnInvite(c.ctx, newRoom, c.username, msg.Invite.Token); err != nil {
+				c.logger.Errorf("failed to return invite: %v", err)
+			}
+		}
+		c.sendRequestError(err)
 		return
 	}
-	c.currentRoom = newRoom
+	c.setCurrentRoom(newRoom)
+	c.sendJoined()
 }
 
 // handleLeaveRoom processes room leave requests
 func (c *Client) handleLeaveRoom() {
-	if err := c.chatService.SwitchRoom(c.ctx, c.currentRoom, "global", c.username, c.handleMessage); err != nil {
+	if err := c.chatService.SwitchRoom(c.ctx, c.getCurrentRoom(), "global", c.username, c.session.ConnID, "", c.handleRoomMessage); err != nil {
 		c.logger.Errorf("failed to return to global: %v", err)
 		return
 	}
-	c.currentRoom = "global"
+	c.setCurrentRoom("global")
+	c.sendJoined()
 }
 
 // === List/Query Functions ===
@@ -223,14 +947,20 @@ func (c *Client) handleListCommand(msg domain.ChatMessage) {
 	}
 }
 
-// handleListRoomMembers retrieves and sends room member list
+// handleListRoomMembers retrieves and sends room member list. The members of a
+// private room are only listed to each other.
 func (c *Client) handleListRoomMembers(room string) {
+	if _, err := c.chatService.GetRoomInfo(c.ctx, room, c.username); err != nil {
+		c.logger.Errorf("failed to look up room: %v", err)
+		c.sendRequestError(err)
+		return
+	}
 	users, err := c.chatService.ListRoomMembers(c.ctx, room)
 	if err != nil {
 		c.logger.Errorf("failed to list room members: %v", err)
 		return
 	}
-	c.sendSystemMessage(fmt.Sprintf("Users in room %s: %v", room, users))
+	c.sendUserList(fmt.Sprintf("Users in room %s", room), users)
 }
 
 // handleListActiveUsers retrieves and sends active users list
@@ -240,15 +970,56 @@ func (c *Client) handleListActiveUsers() {
 		c.logger.Errorf("failed to list active users: %v", err)
 		return
 	}
-	c.sendSystemMessage(fmt.Sprintf("Active users: %v", users))
+	c.sendUserList("Active users", users)
 }
 
-// handleListRooms retrieves and sends available rooms list
+// sendUserList sends the users with their statuses, leaving out invisible ones
+func (c *Client) sendUserList(title string, users []string) {
+	statuses, err := c.chatService.UserStatuses(c.ctx, c.username, users)
+	if err != nil {
+		c.logger.Errorf("failed to read user statuses: %v", err)
+		return
+	}
+
+	names := make([]string, len(statuses))
+	for i, presence := range statuses {
+		names[i] = fmt.Sprintf("%s (%s)", presence.Username, presence.Status)
+		if presence.Text != "" {
+			names[i] = fmt.Sprintf("%s (%s: %s)", presence.Username, presence.Status, presence.Text)
+		}
+	}
+	c.handleMessage(domain.ChatMessage{
+		Type:    domain.MessageTypeSystem,
+		Content: fmt.Sprintf("%s: %v", title, names),
+		Users:   statuses,
+	})
+}
+
+// handleListRooms retrieves and sends available rooms list with the user's unread counts
 func (c *Client) handleListRooms() {
-	rooms, err := c.chatService.ListAllRooms(c.ctx)
+	rooms, err := c.chatService.ListRooms(c.ctx, c.username)
 	if err != nil {
 		c.logger.Errorf("failed to list rooms: %v", err)
 		return
 	}
-	c.sendSystemMessage(fmt.Sprintf("Available rooms: %v", rooms))
+
+	names := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		name := fmt.Sprintf("%s [%d]", room.Name, room.Members)
+		if room.Visibility == domain.RoomPassword || room.Visibility == domain.RoomPrivate {
+			name += " (" + room.Visibility + ")"
+		}
+		if room.AnnouncementOnly {
+			name += " (announcements)"
+		}
+		if room.Unread > 0 {
+			name += fmt.Sprintf(" (%d unread)", room.Unread)
+		}
+		names = append(names, name)
+	}
+	c.handleMessage(domain.ChatMessage{
+		Type:    domain.MessageTypeSystem,
+		Content: fmt.Sprintf("Available rooms: %s", strings.Join(names, ", ")),
+		Rooms:   rooms,
+	})
 }
@@ -4,12 +4,18 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/SphrGhfri/chatroom_golang_nats/api/admin"
+	"github.com/SphrGhfri/chatroom_golang_nats/api/files"
 	"github.com/SphrGhfri/chatroom_golang_nats/pkg/logger"
 	"github.com/SphrGhfri/chatroom_golang_nats/service"
 )
 
 type WSConfig struct {
 	ChatService service.ChatService
+	FileService service.FileService // Optional; enables file upload and download
+	AdminToken  string              // Optional; enables the admin API under /admin
+	Connections *Connections        // Optional; tracks open clients so they can be closed on shutdown
+	IPHeader    string              // Optional; header a trusted reverse proxy puts the client's address in
 	RootCtx     context.Context
 }
 
@@ -17,6 +23,28 @@ func SetupWebSocketRoutes(cfg WSConfig) http.Handler {
 	mux := http.NewServeMux()
 	// Get logger from context for websocket module
 	log := logger.FromContext(cfg.RootCtx).WithModule("websocket")
-	mux.HandleFunc("/ws", HandleWebSocket(cfg.ChatService, cfg.RootCtx, log))
+	if cfg.Connections == nil {
+		cfg.Connections = NewConnections()
+	}
+	mux.HandleFunc("/ws", HandleWebSocket(cfg.ChatService, cfg.Connections, cfg.IPHeader, cfg.RootCtx, log))
+
+	if cfg.FileService != nil {
+		filesLog := logger.FromContext(cfg.RootCtx).WithModule("files")
+		mux.HandleFunc("POST /upload", files.HandleUpload(cfg.FileService, filesLog))
+		mux.HandleFunc("GET /files/{id}", files.HandleDownload(cfg.FileService, filesLog))
+	}
+
+	if cfg.AdminToken != "" {
+		adminLog := logger.FromContext(cfg.RootCtx).WithModule("admin")
+		mux.HandleFunc("POST /admin/rooms", admin.RequireToken(cfg.AdminToken, admin.HandleCreateRoom(cfg.ChatService, adminLog)))
+		mux.HandleFunc("GET /admin/rooms/{name}", admin.RequireToken(cfg.AdminToken, admin.HandleGetRoom(cfg.ChatService)))
+		mux.HandleFunc("DELETE /admin/rooms/{name}", admin.RequireToken(cfg.AdminToken, admin.HandleDeleteRoom(cfg.ChatService, adminLog)))
+		mux.HandleFunc("PUT /admin/rooms/{name}/roles/{username}", admin.RequireToken(cfg.AdminToken, admin.HandleAssignRole(cfg.ChatService, adminLog)))
+		mux.HandleFunc("PUT /admin/rooms/{name}/announcement_only", admin.RequireToken(cfg.AdminToken, admin.HandleSetAnnouncementOnly(cfg.ChatService, adminLog)))
+		mux.HandleFunc("POST /admin/bans", admin.RequireToken(cfg.AdminToken, admin.HandleBan(cfg.ChatService, adminLog)))
+		mux.HandleFunc("DELETE /admin/bans/users/{name}", admin.RequireToken(cfg.AdminToken, admin.HandleLiftUserBan(cfg.ChatService, adminLog)))
+		mux.HandleFunc("DELETE /admin/bans/ips/{ip}", admin.RequireToken(cfg.AdminToken, admin.HandleLiftIPBan(cfg.ChatService, adminLog)))
+		mux.HandleFunc("POST /admin/users/{name}/disconnect", admin.RequireToken(cfg.AdminToken, admin.HandleDisconnectUser(cfg.ChatService, adminLog)))
+	}
 	return mux
 }
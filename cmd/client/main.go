@@ -2,12 +2,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,51 +29,276 @@ type MessageType string
 
 // Message types for client-server communication
 const (
-	MessageTypeChat          MessageType = "chat_message"
-	MessageTypeUsers         MessageType = "list_users"
-	MessageTypeUsersResponse MessageType = "list_users_response"
-	MessageTypeRooms         MessageType = "list_rooms"
-	MessageTypeRoomsResponse MessageType = "list_rooms_response"
-	MessageTypeJoin          MessageType = "join_room"
-	MessageTypeLeave         MessageType = "leave_room"
-	MessageTypeUserExists    MessageType = "username_exists"
+	MessageTypeChat           MessageType = "chat_message"
+	MessageTypeUsers          MessageType = "list_users"
+	MessageTypeUsersResponse  MessageType = "list_users_response"
+	MessageTypeRooms          MessageType = "list_rooms"
+	MessageTypeRoomsResponse  MessageType = "list_rooms_response"
+	MessageTypeJoin           MessageType = "join_room"
+	MessageTypeLeave          MessageType = "leave_room"
+	MessageTypeUserExists     MessageType = "username_exists"
+	MessageTypeSession        MessageType = "session"
+	MessageTypeAck            MessageType = "ack"
+	MessageTypeJoined         MessageType = "room_joined"
+	MessageTypeTypingStart    MessageType = "typing_start"
+	MessageTypeTypingStop     MessageType = "typing_stop"
+	MessageTypeMarkRead       MessageType = "mark_read"
+	MessageTypeReadReceipt    MessageType = "read_receipt"
+	MessageTypeEdit           MessageType = "edit_message"
+	MessageTypeDelete         MessageType = "delete_message"
+	MessageTypeError          MessageType = "error"
+	MessageTypeAddReaction    MessageType = "add_reaction"
+	MessageTypeRemoveReaction MessageType = "remove_reaction"
+	MessageTypeGetHistory     MessageType = "get_history"
+	MessageTypeHistory        MessageType = "history"
+	MessageTypeGetThread      MessageType = "get_thread"
+	MessageTypeThread         MessageType = "thread"
+	MessageTypeMention        MessageType = "mention"
+	MessageTypeMentionWarning MessageType = "mention_warning"
+	MessageTypeSetTopic       MessageType = "set_topic"
+	MessageTypeSetSlowMode    MessageType = "set_slow_mode"
+	MessageTypeRoomInfo       MessageType = "room_info"
+	MessageTypeCreateRoom     MessageType = "create_room"
+	MessageTypeInvite         MessageType = "invite"
+	MessageTypeSetRole        MessageType = "set_role"
+	MessageTypeKick           MessageType = "kick"
+	MessageTypeBan            MessageType = "ban"
+	MessageTypeMute           MessageType = "mute"
+	MessageTypeUnban          MessageType = "unban"
+	MessageTypeUnmute         MessageType = "unmute"
+	MessageTypePresence       MessageType = "presence"
+	MessageTypeWatchPresence  MessageType = "watch_presence"
+	MessageTypeUnwatch        MessageType = "unwatch_presence"
+	MessageTypeSetStatus      MessageType = "set_status"
 )
 
+// Reconnect settings used when the connection drops unexpectedly
+const (
+	reconnectAttempts = 5
+	reconnectDelay    = 2 * time.Second
+)
+
+// recentMessages is the number of messages kept to quote the parents of replies
+const recentMessages = 500
+
+// markReadDelay is how long displayed messages are collected before the latest
+// one of each room is marked read
+const markReadDelay = time.Second
+
 // ChatMessage represents the structure of messages exchanged between client and server
 type ChatMessage struct {
-	Type      string `json:"type"`
-	Sender    string `json:"sender,omitempty"`
-	Content   string `json:"content,omitempty"`
-	Timestamp string `json:"timestamp,omitempty"`
-	Room      string `json:"room,omitempty"`
+	Type        string        `json:"type"`
+	ID          string        `json:"id,omitempty"`
+	Sender      string        `json:"sender,omitempty"`
+	Content     string        `json:"content,omitempty"`
+	Timestamp   string        `json:"timestamp,omitempty"`
+	Room        string        `json:"room,omitempty"`
+	ResumeToken string        `json:"resume_token,omitempty"`
+	Edited      bool          `json:"edited,omitempty"`
+	Deleted     bool          `json:"deleted,omitempty"`
+	Code        string        `json:"code,omitempty"`
+	Emoji       string        `json:"emoji,omitempty"`
+	Reactions   []Reaction    `json:"reactions,omitempty"`
+	Messages    []ChatMessage `json:"messages,omitempty"`
+	ReplyTo     string        `json:"reply_to,omitempty"`
+	ThreadID    string        `json:"thread_id,omitempty"`
+	ReplyCount  int64         `json:"reply_count,omitempty"`
+	Mentions    []string      `json:"mentions,omitempty"`
+	Attachments []Attachment  `json:"attachments,omitempty"`
+	RoomInfo    *RoomInfo     `json:"room_info,omitempty"`
+	Password    string        `json:"password,omitempty"`
+	Invite      *Invite       `json:"invite,omitempty"`
+	Role        *RoleGrant    `json:"role,omitempty"`
+	Moderation  *Moderation   `json:"moderation,omitempty"`
+	Presence    *Presence     `json:"presence,omitempty"`
+}
+
+// Presence is the status of a user with their custom text
+type Presence struct {
+	Username  string `json:"username"`
+	Status    string `json:"status,omitempty"`
+	Text      string `json:"text,omitempty"`
+	ExpiresIn int64  `json:"expires_in,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// Moderation is a kick, ban or mute of a user
+type Moderation struct {
+	Username string `json:"username"`
+	Duration int64  `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Until    string `json:"until,omitempty"`
+}
+
+// RoleGrant gives a user a role in a room
+type RoleGrant struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// Invite is an invitation to a private or invite-only room
+type Invite struct {
+	Token     string `json:"token,omitempty"`
+	Username  string `json:"username,omitempty"`
+	MaxUses   int64  `json:"max_uses,omitempty"`
+	ExpiresIn int64  `json:"expires_in,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// RoomInfo is the record of a room
+type RoomInfo struct {
+	Name        string `json:"name"`
+	Topic       string `json:"topic,omitempty"`
+	Description string `json:"description,omitempty"`
+	CreatedBy   string `json:"created_by,omitempty"`
+	CreatedAt   string `json:"created_at,omitempty"`
+	Persistent  bool   `json:"persistent,omitempty"`
+	Visibility  string `json:"visibility,omitempty"`
+	Members     int64  `json:"members"`
+
+	AnnouncementOnly bool              `json:"announcement_only,omitempty"`
+	SlowMode         int64             `json:"slow_mode,omitempty"`
+	MaxMembers       int64             `json:"max_members,omitempty"`
+	Roles            map[string]string `json:"roles,omitempty"`
+}
+
+// Attachment is an uploaded file referenced by a chat message
+type Attachment struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	MimeType string `json:"mime_type,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+// Reaction is the tally of one emoji on a message
+type Reaction struct {
+	Emoji   string `json:"emoji"`
+	Count   int64  `json:"count"`
+	Reacted bool   `json:"reacted,omitempty"`
 }
 
 // Client represents a chat client instance with its connection and state
 type Client struct {
 	conn        *websocket.Conn
+	addr        string
 	username    string
 	currentRoom string
+	resumeToken string
+	typing      map[string]bool // Users currently typing in the current room
+	watching    map[string]bool // Users whose presence we watch, watched again after a reconnect
+	recent      map[string]ChatMessage
+	recentOrder []string
+	unread      map[string]string // Latest displayed message per room, marked read after markReadDelay
+	readTimer   *time.Timer
 	done        chan struct{}
 	mutex       sync.Mutex
+	connMutex   sync.Mutex // Guards conn and serializes writes
 }
 
 // NewClient creates and initializes a new chat client
-func NewClient(conn *websocket.Conn, username string) *Client {
+func NewClient(conn *websocket.Conn, addr, username string) *Client {
 	return &Client{
 		conn:        conn,
+		addr:        addr,
 		username:    username,
 		currentRoom: "global",
+		typing:      make(map[string]bool),
+		watching:    make(map[string]bool),
+		recent:      make(map[string]ChatMessage),
+		unread:      make(map[string]string),
 		done:        make(chan struct{}),
 	}
 }
 
+// send writes a message to the server
+func (c *Client) send(msg ChatMessage) error {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	return c.conn.WriteJSON(msg)
+}
+
+// close sends a close frame so the server ends the session instead of keeping it resumable
+func (c *Client) close() {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	c.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.conn.Close()
+}
+
 // setCurrentRoom safely updates the client's current room
 func (c *Client) setCurrentRoom(room string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	if c.currentRoom != room {
+		c.typing = make(map[string]bool)
+	}
 	c.currentRoom = room
 }
 
+// remember keeps a message so replies to it can quote it
+func (c *Client) remember(msg ChatMessage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, known := c.recent[msg.ID]; !known {
+		c.recentOrder = append(c.recentOrder, msg.ID)
+		if len(c.recentOrder) > recentMessages {
+			delete(c.recent, c.recentOrder[0])
+			c.recentOrder = c.recentOrder[1:]
+		}
+	}
+	c.recent[msg.ID] = msg
+}
+
+// quoteParent renders a short quote of the message a reply refers to
+func (c *Client) quoteParent(id string) string {
+	c.mutex.Lock()
+	parent, known := c.recent[id]
+	c.mutex.Unlock()
+
+	if !known {
+		return fmt.Sprintf("  ↱ #%s", id)
+	}
+	if parent.Deleted {
+		return fmt.Sprintf("  ↱ #%s (message deleted)", id)
+	}
+	content := []rune(parent.Content)
+	if len(content) > 40 {
+		content = append(content[:40], '…')
+	}
+	return fmt.Sprintf("  ↱ %s: %s", parent.Sender, string(content))
+}
+
+// formatReply renders a message, indented under a quote of its parent if it is a reply
+func (c *Client) formatReply(msg ChatMessage, line string) string {
+	if msg.ReplyTo == "" {
+		return line
+	}
+	return c.quoteParent(msg.ReplyTo) + "\n    " + line
+}
+
+// getCurrentRoom safely reads the client's current room
+func (c *Client) getCurrentRoom() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.currentRoom
+}
+
+// setTyping records whether a user is typing and reports whether that changed
+func (c *Client) setTyping(user string, typing bool) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.typing[user] == typing {
+		return false
+	}
+	if typing {
+		c.typing[user] = true
+	} else {
+		delete(c.typing, user)
+	}
+	return true
+}
+
 // main initializes and runs the chat client
 func main() {
 	// Setup command line flags
@@ -73,14 +307,14 @@ func main() {
 
 	// Initialize client connection
 	username := promptUsername()
-	conn := connectWebSocket(*addr, username)
+	conn := connectWebSocket(*addr, username, "")
 	if conn == nil {
 		os.Exit(1)
 	}
-	defer conn.Close()
 
 	// Create and start client
-	client := NewClient(conn, username)
+	client := NewClient(conn, *addr, username)
+	defer client.close()
 	printHelp()
 
 	// Start message reader in background
@@ -98,18 +332,29 @@ func promptUsername() string {
 	return strings.TrimSpace(scanner.Text())
 }
 
-// connectWebSocket establishes a WebSocket connection with the chat server
-func connectWebSocket(addr, username string) *websocket.Conn {
+// connectWebSocket establishes a WebSocket connection with the chat server.
+// Own messages are echoed back so the client learns their IDs.
+func connectWebSocket(addr, username, resumeToken string) *websocket.Conn {
+	query := url.Values{"username": {username}, "echo": {"true"}}
+	if resumeToken != "" {
+		query.Set("resume_token", resumeToken)
+	}
 	u := url.URL{
 		Scheme:   "ws",
 		Host:     addr,
 		Path:     "/ws",
-		RawQuery: "username=" + url.QueryEscape(username),
+		RawQuery: query.Encode(),
 	}
 	log.Printf("Connecting to %s", u.String())
 
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	conn, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusForbidden {
+			// Banned from the server; the body gives the reason
+			body, _ := io.ReadAll(resp.Body)
+			log.Printf("Connection refused: %s", strings.TrimSpace(string(body)))
+			return nil
+		}
 		log.Printf("Failed to connect: %v", err)
 		return nil
 	}
@@ -121,12 +366,26 @@ func connectWebSocket(addr, username string) *websocket.Conn {
 func (c *Client) readMessages() {
 	defer close(c.done)
 	for {
-		_, data, err := c.conn.ReadMessage()
+		c.connMutex.Lock()
+		conn := c.conn
+		c.connMutex.Unlock()
+
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				log.Printf("Read error: %v", err)
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return
 			}
-			return
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code == websocket.ClosePolicyViolation {
+				// Disconnected or banned by an administrator; reconnecting would not help
+				fmt.Printf("\nDisconnected by the server: %s\n", closeErr.Text)
+				return
+			}
+			log.Printf("Read error: %v", err)
+			if !c.reconnect() {
+				return
+			}
+			continue
 		}
 
 		var msg ChatMessage
@@ -136,22 +395,296 @@ func (c *Client) readMessages() {
 		}
 
 		c.displayMessage(msg)
+		if MessageType(msg.Type) == MessageTypeChat && msg.ID != "" {
+			// Displayed messages count as received and read
+			c.send(ChatMessage{Type: string(MessageTypeAck), ID: msg.ID})
+			c.markRead(msg.Room, msg.ID)
+		}
+	}
+}
+
+// markRead marks a displayed message read. Messages are collected for markReadDelay
+// and only the latest one of each room is sent.
+func (c *Client) markRead(room, id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.unread[room] = id
+	if c.readTimer == nil {
+		c.readTimer = time.AfterFunc(markReadDelay, c.flushRead)
+	}
+}
+
+// flushRead sends mark_read for the latest displayed message of each room
+func (c *Client) flushRead() {
+	c.mutex.Lock()
+	unread := c.unread
+	c.unread = make(map[string]string)
+	c.readTimer = nil
+	c.mutex.Unlock()
+
+	for room, id := range unread {
+		c.send(ChatMessage{Type: string(MessageTypeMarkRead), ID: id, Room: room})
+	}
+}
+
+// reconnect dials the server again and resumes the session with the resume token
+func (c *Client) reconnect() bool {
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		time.Sleep(reconnectDelay)
+		log.Printf("Reconnecting (attempt %d/%d)...", attempt, reconnectAttempts)
+
+		conn := connectWebSocket(c.addr, c.username, c.resumeToken)
+		if conn == nil {
+			continue
+		}
+
+		c.connMutex.Lock()
+		c.conn.Close()
+		c.conn = conn
+		c.connMutex.Unlock()
+		c.rewatch()
+		return true
+	}
+	log.Printf("Giving up after %d reconnect attempts", reconnectAttempts)
+	return false
+}
+
+// setWatching records whether we watch a user's presence
+func (c *Client) setWatching(user string, watch bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if watch {
+		c.watching[user] = true
+	} else {
+		delete(c.watching, user)
 	}
 }
 
+// rewatch asks a new connection for the presence of the users we watch
+func (c *Client) rewatch() {
+	c.mutex.Lock()
+	users := make([]string, 0, len(c.watching))
+	for user := range c.watching {
+		users = append(users, user)
+	}
+	c.mutex.Unlock()
+	for _, user := range users {
+		c.send(watchMessage(user))
+	}
+}
+
+// watchMessage asks for the presence of a user, or of the global room's users if user is empty
+func watchMessage(user string) ChatMessage {
+	if user == "" {
+		return ChatMessage{Type: string(MessageTypeWatchPresence), Room: "global"}
+	}
+	return ChatMessage{Type: string(MessageTypeWatchPresence), Presence: &Presence{Username: user}}
+}
+
 // displayMessage formats and displays received messages to the user
 func (c *Client) displayMessage(msg ChatMessage) {
 	switch MessageType(msg.Type) {
 	case MessageTypeChat:
-		fmt.Printf("\n[%s][%s] %s\n", msg.Timestamp, msg.Sender, msg.Content)
+		c.setTyping(msg.Sender, false)
+		line := formatChatMessage(msg)
+		if msg.Sender == c.username && !msg.Deleted {
+			line = fmt.Sprintf("[Sent to %s] #%s %s%s%s", msg.Room, msg.ID, msg.Content, editedSuffix(msg), formatAttachments(msg.Attachments))
+		}
+		fmt.Printf("\n%s\n", c.formatReply(msg, line))
+		c.remember(msg)
+	case MessageTypeEdit, MessageTypeDelete:
+		c.remember(msg)
+		fmt.Printf("\n%s\n", formatChatMessage(msg))
+	case MessageTypeAddReaction, MessageTypeRemoveReaction:
+		verb := "reacted"
+		if MessageType(msg.Type) == MessageTypeRemoveReaction {
+			verb = "took back"
+		}
+		fmt.Printf("\n[System] %s %s %s on #%s%s\n", msg.Sender, verb, msg.Emoji, msg.ID, formatReactions(msg.Reactions))
+	case MessageTypeHistory:
+		fmt.Printf("\n[History of %s]\n", msg.Room)
+		for _, m := range msg.Messages {
+			c.remember(m)
+			fmt.Println(c.formatReply(m, formatChatMessage(m)))
+		}
+	case MessageTypeThread:
+		fmt.Printf("\n[Thread #%s in %s]\n", msg.ThreadID, msg.Room)
+		for i, m := range msg.Messages {
+			c.remember(m)
+			if i == 0 {
+				fmt.Println(formatChatMessage(m))
+			} else {
+				fmt.Println("    " + formatChatMessage(m))
+			}
+		}
+	case MessageTypeMention:
+		// Mentions in the current room are already on screen
+		if msg.Room == c.getCurrentRoom() {
+			return
+		}
+		fmt.Printf("\n[Mention] %s mentioned you in %s: %s\n", msg.Sender, msg.Room, msg.Content)
+	case MessageTypeMentionWarning:
+		fmt.Printf("\n[System] Mentioned users are not in %s and may not see #%s: %s\n",
+			msg.Room, msg.ID, strings.Join(msg.Mentions, ", "))
+	case MessageTypeError:
+		fmt.Printf("\n[Error] %s\n", msg.Content)
+	case MessageTypeRoomInfo:
+		fmt.Printf("\n%s\n", formatRoomInfo(msg.RoomInfo))
+	case MessageTypeKick, MessageTypeBan:
+		verb := "kicked from"
+		if MessageType(msg.Type) == MessageTypeBan {
+			verb = "banned from"
+		}
+		line := fmt.Sprintf("[Moderation] %s %s %s", msg.Sender, verb, msg.Room)
+		if msg.Moderation != nil && msg.Moderation.Until != "" {
+			line += " until " + msg.Moderation.Until
+		}
+		if msg.Moderation != nil && msg.Moderation.Reason != "" {
+			line += ": " + msg.Moderation.Reason
+		}
+		fmt.Printf("\n%s\n", line)
+	case MessageTypeUnban:
+		fmt.Printf("\n[Moderation] %s lifted your ban from %s\n", msg.Sender, msg.Room)
+	case MessageTypeInvite:
+		if msg.Invite != nil && msg.Invite.Token != "" {
+			uses := "unlimited uses"
+			if msg.Invite.MaxUses > 0 {
+				uses = fmt.Sprintf("%d uses", msg.Invite.MaxUses)
+			}
+			fmt.Printf("\n[Invite] /accept %s %s (%s, expires %s)\n", msg.Room, msg.Invite.Token, uses, msg.Invite.ExpiresAt)
+		} else {
+			fmt.Printf("\n[Invite] %s, /join %s to accept\n", msg.Content, msg.Room)
+		}
 	case MessageTypeUsersResponse, MessageTypeRoomsResponse, MessageTypeUserExists:
 		fmt.Printf("\n[System] %s\n", msg.Content)
+	case MessageTypeTypingStart:
+		// Repeated notifications and our own indicator are not shown
+		if msg.Sender == c.username || !c.setTyping(msg.Sender, true) {
+			return
+		}
+		fmt.Printf("\n[%s is typing…]\n", msg.Sender)
+	case MessageTypeTypingStop:
+		c.setTyping(msg.Sender, false)
+		return
+	case MessageTypeReadReceipt:
+		return
+	case MessageTypePresence:
+		if msg.Presence == nil {
+			return
+		}
+		p := msg.Presence
+		status := p.Status
+		if p.Text != "" {
+			status += ": " + p.Text
+		}
+		if p.ExpiresAt != "" {
+			status += " (until " + p.ExpiresAt + ")"
+		}
+		if p.Username != c.username {
+			fmt.Printf("\n[Presence] %s is %s\n", p.Username, status)
+		} else if msg.ID == "" {
+			// Our own announcements are not shown, only the answer to /status
+			fmt.Printf("\n[Presence] You are %s\n", status)
+		}
+	case MessageTypeJoined:
+		c.setCurrentRoom(msg.Room)
+		fmt.Printf("\n[System] %s\n", msg.Content)
+	case MessageTypeSession:
+		if c.resumeToken != "" && c.resumeToken != msg.ResumeToken {
+			fmt.Printf("\n[System] Session could not be resumed, started a new one in %s\n", msg.Room)
+		}
+		c.resumeToken = msg.ResumeToken
+		c.setCurrentRoom(msg.Room)
+		return
 	default:
 		fmt.Printf("\n[Info] %s\n", msg.Content)
 	}
 	fmt.Print("> ")
 }
 
+// formatChatMessage renders a chat message with its ID, or a tombstone if it was deleted
+func formatChatMessage(msg ChatMessage) string {
+	if msg.Deleted {
+		return fmt.Sprintf("[%s] #%s (message deleted)", msg.Sender, msg.ID)
+	}
+	line := fmt.Sprintf("[%s][%s] #%s %s%s%s", msg.Timestamp, msg.Sender, msg.ID, msg.Content, editedSuffix(msg), formatReactions(msg.Reactions))
+	if msg.ReplyCount > 0 {
+		line += fmt.Sprintf(" [%d replies]", msg.ReplyCount)
+	}
+	return line + formatAttachments(msg.Attachments)
+}
+
+// formatAttachments lists attached files with the IDs to download them by
+func formatAttachments(attachments []Attachment) string {
+	var b strings.Builder
+	for _, att := range attachments {
+		fmt.Fprintf(&b, "\n    📎 %s (%s, %d bytes) -> /download %s", att.Name, att.MimeType, att.Size, att.ID)
+	}
+	return b.String()
+}
+
+// formatRoomInfo renders the record of a room
+func formatRoomInfo(room *RoomInfo) string {
+	if room == nil {
+		return "[Room] unknown"
+	}
+	topic := room.Topic
+	if topic == "" {
+		topic = "(no topic)"
+	}
+	members := fmt.Sprintf("%d", room.Members)
+	if room.MaxMembers > 0 {
+		members += fmt.Sprintf("/%d", room.MaxMembers)
+	}
+	line := fmt.Sprintf("[Room %s] %s\n    %s members, created by %s at %s", room.Name, topic, members, room.CreatedBy, room.CreatedAt)
+	if room.Persistent {
+		line += " (persistent)"
+	}
+	if room.Visibility != "" && room.Visibility != "public" {
+		line += fmt.Sprintf(" (%s)", room.Visibility)
+	}
+	if room.AnnouncementOnly {
+		line += " (announcements)"
+	}
+	if room.SlowMode > 0 {
+		line += fmt.Sprintf(" (slow mode: %ds)", room.SlowMode)
+	}
+	if room.Description != "" {
+		line += "\n    " + room.Description
+	}
+	users := make([]string, 0, len(room.Roles))
+	for user := range room.Roles {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		line += fmt.Sprintf("\n    %s: %s", user, room.Roles[user])
+	}
+	return line
+}
+
+// formatReactions renders reaction tallies, marking the ones we reacted with
+func formatReactions(reactions []Reaction) string {
+	if len(reactions) == 0 {
+		return ""
+	}
+	parts := make([]string, len(reactions))
+	for i, r := range reactions {
+		parts[i] = fmt.Sprintf("%s %d", r.Emoji, r.Count)
+		if r.Reacted {
+			parts[i] += "*"
+		}
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+func editedSuffix(msg ChatMessage) string {
+	if msg.Edited {
+		return " (edited)"
+	}
+	return ""
+}
+
 // handleInput processes user input and handles command execution
 func (c *Client) handleInput() {
 	scanner := bufio.NewScanner(os.Stdin)
@@ -200,28 +733,303 @@ func (c *Client) handleCommand(fields []string) error {
 		if len(fields) == 2 {
 			msg.Room = fields[1]
 		}
-		return c.conn.WriteJSON(msg)
+		return c.send(msg)
 
 	case "/rooms":
-		return c.conn.WriteJSON(ChatMessage{Type: string(MessageTypeRooms)})
+		return c.send(ChatMessage{Type: string(MessageTypeRooms)})
 
 	case "/join":
-		if len(fields) < 2 {
-			return fmt.Errorf("usage: /join <roomName>")
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("usage: /join <roomName> [password]")
 		}
-		c.setCurrentRoom(fields[1])
-		return c.conn.WriteJSON(ChatMessage{
-			Type: string(MessageTypeJoin),
-			Room: fields[1],
-		})
+		msg := ChatMessage{Type: string(MessageTypeJoin), Room: fields[1]}
+		if len(fields) == 3 {
+			msg.Password = fields[2]
+		}
+		return c.send(msg)
 
 	case "/leave":
-		msg := ChatMessage{
+		return c.send(ChatMessage{
 			Type: string(MessageTypeLeave),
 			Room: c.currentRoom,
+		})
+
+	case "/edit":
+		if len(fields) < 3 {
+			return fmt.Errorf("usage: /edit <id> <new message>")
+		}
+		return c.send(ChatMessage{
+			Type:    string(MessageTypeEdit),
+			ID:      strings.TrimPrefix(fields[1], "#"),
+			Content: strings.Join(fields[2:], " "),
+			Room:    c.currentRoom,
+		})
+
+	case "/react", "/unreact":
+		if len(fields) != 3 {
+			return fmt.Errorf("usage: %s <id> <emoji>", cmd)
+		}
+		msgType := MessageTypeAddReaction
+		if cmd == "/unreact" {
+			msgType = MessageTypeRemoveReaction
+		}
+		return c.send(ChatMessage{
+			Type:  string(msgType),
+			ID:    strings.TrimPrefix(fields[1], "#"),
+			Emoji: fields[2],
+			Room:  c.currentRoom,
+		})
+
+	case "/reply":
+		if len(fields) < 3 {
+			return fmt.Errorf("usage: /reply <id> <message>")
+		}
+		return c.send(ChatMessage{
+			Type:      string(MessageTypeChat),
+			Sender:    c.username,
+			Content:   strings.Join(fields[2:], " "),
+			Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+			Room:      c.currentRoom,
+			ReplyTo:   strings.TrimPrefix(fields[1], "#"),
+		})
+
+	case "/thread":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: /thread <id>")
+		}
+		return c.send(ChatMessage{
+			Type: string(MessageTypeGetThread),
+			ID:   strings.TrimPrefix(fields[1], "#"),
+			Room: c.currentRoom,
+		})
+
+	case "/history":
+		msg := ChatMessage{Type: string(MessageTypeGetHistory), Room: c.currentRoom}
+		if len(fields) == 2 {
+			msg.ID = strings.TrimPrefix(fields[1], "#")
+		}
+		return c.send(msg)
+
+	case "/topic":
+		return c.send(ChatMessage{
+			Type:    string(MessageTypeSetTopic),
+			Content: strings.Join(fields[1:], " "),
+			Room:    c.getCurrentRoom(),
+		})
+
+	case "/slow":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: /slow <seconds> (0 turns slow mode off)")
+		}
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid seconds: %s", fields[1])
 		}
-		c.setCurrentRoom("global")
-		return c.conn.WriteJSON(msg)
+		return c.send(ChatMessage{
+			Type:     string(MessageTypeSetSlowMode),
+			Room:     c.getCurrentRoom(),
+			RoomInfo: &RoomInfo{SlowMode: seconds},
+		})
+
+	case "/create":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: /create <room> [announce] [private | invite | password <pw>] [description]")
+		}
+		msg := ChatMessage{Type: string(MessageTypeCreateRoom), Room: fields[1], RoomInfo: &RoomInfo{}}
+		rest := fields[2:]
+		if len(rest) > 0 && rest[0] == "announce" {
+			msg.RoomInfo.AnnouncementOnly = true
+			rest = rest[1:]
+		}
+		if len(rest) > 0 && (rest[0] == "private" || rest[0] == "invite") {
+			msg.RoomInfo.Visibility = rest[0]
+			rest = rest[1:]
+		} else if len(rest) > 1 && rest[0] == "password" {
+			msg.RoomInfo.Visibility = "password"
+			msg.Password = rest[1]
+			rest = rest[2:]
+		}
+		msg.RoomInfo.Description = strings.Join(rest, " ")
+		return c.send(msg)
+
+	case "/invite":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: /invite <user>")
+		}
+		return c.send(ChatMessage{
+			Type:   string(MessageTypeInvite),
+			Room:   c.getCurrentRoom(),
+			Invite: &Invite{Username: fields[1]},
+		})
+
+	case "/invitelink":
+		if len(fields) > 3 {
+			return fmt.Errorf("usage: /invitelink [max_uses] [hours]")
+		}
+		invite := &Invite{}
+		if len(fields) > 1 {
+			uses, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid max_uses: %s", fields[1])
+			}
+			invite.MaxUses = uses
+		}
+		if len(fields) > 2 {
+			hours, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid hours: %s", fields[2])
+			}
+			invite.ExpiresIn = hours * 3600
+		}
+		return c.send(ChatMessage{
+			Type:   string(MessageTypeInvite),
+			Room:   c.getCurrentRoom(),
+			Invite: invite,
+		})
+
+	case "/accept":
+		if len(fields) != 3 {
+			return fmt.Errorf("usage: /accept <room> <token>")
+		}
+		return c.send(ChatMessage{
+			Type:   string(MessageTypeJoin),
+			Room:   fields[1],
+			Invite: &Invite{Token: fields[2]},
+		})
+
+	case "/role":
+		if len(fields) != 3 {
+			return fmt.Errorf("usage: /role <user> <owner|moderator|member|read_only>")
+		}
+		return c.send(ChatMessage{
+			Type: string(MessageTypeSetRole),
+			Room: c.getCurrentRoom(),
+			Role: &RoleGrant{Username: fields[1], Role: fields[2]},
+		})
+
+	case "/kick":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: /kick <user> [reason]")
+		}
+		return c.send(ChatMessage{
+			Type:       string(MessageTypeKick),
+			Room:       c.getCurrentRoom(),
+			Moderation: &Moderation{Username: fields[1], Reason: strings.Join(fields[2:], " ")},
+		})
+
+	case "/ban", "/mute":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: %s <user> [minutes] [reason]", cmd)
+		}
+		m := &Moderation{Username: fields[1]}
+		rest := fields[2:]
+		if len(rest) > 0 {
+			if minutes, err := strconv.ParseInt(rest[0], 10, 64); err == nil {
+				m.Duration = minutes * 60
+				rest = rest[1:]
+			}
+		}
+		m.Reason = strings.Join(rest, " ")
+		msgType := MessageTypeBan
+		if cmd == "/mute" {
+			msgType = MessageTypeMute
+		}
+		return c.send(ChatMessage{
+			Type:       string(msgType),
+			Room:       c.getCurrentRoom(),
+			Moderation: m,
+		})
+
+	case "/unban", "/unmute":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: %s <user>", cmd)
+		}
+		msgType := MessageTypeUnban
+		if cmd == "/unmute" {
+			msgType = MessageTypeUnmute
+		}
+		return c.send(ChatMessage{
+			Type:       string(msgType),
+			Room:       c.getCurrentRoom(),
+			Moderation: &Moderation{Username: fields[1]},
+		})
+
+	case "/watch", "/unwatch":
+		if len(fields) > 2 {
+			return fmt.Errorf("usage: %s [user]", cmd)
+		}
+		// Without a user, the presence of everyone in the global room
+		user := ""
+		if len(fields) == 2 {
+			user = fields[1]
+		}
+		msg := watchMessage(user)
+		if cmd == "/unwatch" {
+			msg.Type = string(MessageTypeUnwatch)
+		}
+		c.setWatching(user, cmd == "/watch")
+		return c.send(msg)
+
+	case "/status":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: /status <online|away|busy|invisible> [duration] [text]")
+		}
+		p := &Presence{Status: fields[1]}
+		rest := fields[2:]
+		if len(rest) > 0 {
+			if d, err := time.ParseDuration(rest[0]); err == nil {
+				p.ExpiresIn = int64(d.Seconds())
+				rest = rest[1:]
+			}
+		}
+		p.Text = strings.Join(rest, " ")
+		return c.send(ChatMessage{Type: string(MessageTypeSetStatus), Presence: p})
+
+	case "/info":
+		msg := ChatMessage{Type: string(MessageTypeRoomInfo), Room: c.getCurrentRoom()}
+		if len(fields) == 2 {
+			msg.Room = fields[1]
+		}
+		return c.send(msg)
+
+	case "/upload":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: /upload <path> [message]")
+		}
+		room := c.getCurrentRoom()
+		att, err := c.uploadFile(fields[1], room)
+		if err != nil {
+			return err
+		}
+		return c.send(ChatMessage{
+			Type:        string(MessageTypeChat),
+			Sender:      c.username,
+			Content:     strings.Join(fields[2:], " "),
+			Timestamp:   time.Now().Format("2006-01-02 15:04:05"),
+			Room:        room,
+			Attachments: []Attachment{{ID: att.ID}},
+		})
+
+	case "/download":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: /download <id>")
+		}
+		path, err := c.downloadFile(fields[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[System] Saved %s\n", path)
+		return nil
+
+	case "/delete":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: /delete <id>")
+		}
+		return c.send(ChatMessage{
+			Type: string(MessageTypeDelete),
+			ID:   strings.TrimPrefix(fields[1], "#"),
+			Room: c.currentRoom,
+		})
 
 	default:
 		return fmt.Errorf("unknown command: %s", cmd)
@@ -238,16 +1046,89 @@ func (c *Client) sendChatMessage(content string) error {
 		Room:      c.currentRoom,
 	}
 
-	if err := c.conn.WriteJSON(msg); err != nil {
+	// The confirmation is printed when the server echoes the message back with its ID
+	if err := c.send(msg); err != nil {
 		return fmt.Errorf("failed to send message: %w", err)
 	}
+	return nil
+}
 
-	if c.currentRoom == "global" {
-		fmt.Printf("[Sent to GLOBAL] %s\n", content)
-	} else {
-		fmt.Printf("[Sent to %s] %s\n", c.currentRoom, content)
+// uploadFile sends a file to the server for a room, authenticated by the session's resume token
+func (c *Client) uploadFile(path, room string) (Attachment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Attachment{}, err
 	}
-	return nil
+	defer file.Close()
+
+	// The room field must precede the file
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("room", room)
+	part, err := form.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return Attachment{}, err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return Attachment{}, err
+	}
+	form.Close()
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+c.addr+"/upload", &body)
+	if err != nil {
+		return Attachment{}, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+c.resumeToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Attachment{}, fmt.Errorf("upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		reason, _ := io.ReadAll(resp.Body)
+		return Attachment{}, fmt.Errorf("upload failed: %s", strings.TrimSpace(string(reason)))
+	}
+
+	var att Attachment
+	if err := json.NewDecoder(resp.Body).Decode(&att); err != nil {
+		return Attachment{}, err
+	}
+	return att, nil
+}
+
+// downloadFile saves an attachment in the working directory under its original name
+func (c *Client) downloadFile(id string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+c.addr+"/files/"+url.PathEscape(id), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.resumeToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		reason, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("download failed: %s", strings.TrimSpace(string(reason)))
+	}
+
+	name := id
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = filepath.Base(params["filename"])
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		return "", err
+	}
+	return name, nil
 }
 
 // printHelp displays available commands and their usage
@@ -258,8 +1139,34 @@ Available Commands:
     /users          -> list all active users
     /users <room>   -> list users in specific room
     /rooms          -> list all active rooms
-    /join <room>    -> join or switch to a room
+    /join <room> [password] -> join or switch to a room
     /leave          -> leave current room (returns to global)
+    /edit <id> <msg> -> edit one of your messages
+    /delete <id>    -> delete one of your messages
+    /react <id> <emoji>   -> react to a message
+    /unreact <id> <emoji> -> take back a reaction
+    /reply <id> <msg> -> reply to a message
+    /thread <id>    -> show a message with all replies to it
+    /history        -> show recent messages of the current room
+    /history <id>   -> show the messages before <id>
+    /topic [text]   -> set the topic of the current room, or clear it
+    /slow <seconds> -> set slow mode of the current room, 0 turns it off
+    /create <room> [announce] [private | invite | password <pw>] [desc] -> create a persistent room
+    /invite <user>  -> invite a user to the current private or invite-only room
+    /invitelink [max_uses] [hours] -> create a shareable invite token
+    /accept <room> <token> -> join a private or invite-only room with a token
+    /info [room]    -> show topic, creator, member count and roles of a room
+    /role <user> <role> -> make a user owner, moderator, member or read_only
+    /kick <user> [reason] -> remove a user from the current room
+    /ban <user> [minutes] [reason] -> keep a user out of the current room
+    /mute <user> [minutes] [reason] -> stop a user from posting for a while
+    /unban <user>   -> let a banned user back into the current room
+    /unmute <user>  -> let a muted user post again
+    /watch [user]   -> get told when a user, or anyone in the global room, goes online, away or offline
+    /unwatch [user] -> stop watching a user's presence, or the global room's
+    /status <online|away|busy|invisible> [duration] [text] -> set your status, e.g. /status busy 1h in a meeting
+    /upload <path> [msg] -> share a file in the current room
+    /download <id>  -> save an attachment to the current directory
     
 Just type your message to chat in the current room
 Current room is shown in your message confirmations
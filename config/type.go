@@ -6,4 +6,41 @@ type Config struct {
 	LogFile  string `mapstructure:"log_file"`
 	NATSURL  string `mapstructure:"nats_url"`
 	RedisURL string `mapstructure:"redis_url"`
+
+	// ResumeGraceSeconds is how long a dropped client can resume its session
+	ResumeGraceSeconds int `mapstructure:"resume_grace_seconds"`
+
+	// RoomIdleSeconds is how long an empty ad-hoc room is kept; 0 drops it right away
+	RoomIdleSeconds int `mapstructure:"room_idle_seconds"`
+
+	// PresenceDelaySeconds is how long presence changes are coalesced before they are announced
+	PresenceDelaySeconds int `mapstructure:"presence_delay_seconds"`
+
+	// AutoAwaySeconds is how long a connection can go without frames before its user turns away
+	AutoAwaySeconds int `mapstructure:"auto_away_seconds"`
+
+	// RoomCapacity is the default maximum number of members of a room; 0 is unlimited
+	RoomCapacity int64 `mapstructure:"room_capacity"`
+
+	// NodeTimeoutSeconds is how long a server that stopped sending heartbeats is kept
+	// before the other servers clean up its connections
+	NodeTimeoutSeconds int `mapstructure:"node_timeout_seconds"`
+
+	// ClientIPHeader is the header a trusted reverse proxy puts the client's address in,
+	// e.g. X-Forwarded-For; empty uses the connection's address. Clients can forge it,
+	// so set it only if every connection comes through such a proxy.
+	ClientIPHeader string `mapstructure:"client_ip_header"`
+
+	// AdminToken enables the admin API for bearers of this token; empty disables it
+	AdminToken string `mapstructure:"admin_token"`
+
+	// GlobalAnnouncementOnly lets only moderators post to the global room;
+	// GlobalAnnouncers are made its moderators on startup
+	GlobalAnnouncementOnly bool     `mapstructure:"global_announcement_only"`
+	GlobalAnnouncers       []string `mapstructure:"global_announcers"`
+
+	// Uploaded files are stored in UploadDir; empty values fall back to defaults
+	UploadDir          string   `mapstructure:"upload_dir"`
+	MaxUploadBytes     int64    `mapstructure:"max_upload_bytes"`
+	AllowedUploadTypes []string `mapstructure:"allowed_upload_types"`
 }
@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/SphrGhfri/chatroom_golang_nats/api/ws"
 	"github.com/SphrGhfri/chatroom_golang_nats/config"
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
 	"github.com/SphrGhfri/chatroom_golang_nats/internal/nats"
 	"github.com/SphrGhfri/chatroom_golang_nats/internal/redis"
 	"github.com/SphrGhfri/chatroom_golang_nats/pkg/logger"
@@ -25,6 +27,7 @@ type App struct {
 	redisClient *redis.RedisClient
 	chatService service.ChatService
 	httpServer  *http.Server
+	connections *ws.Connections
 	rootCtx     context.Context
 	cancel      context.CancelFunc
 }
@@ -54,20 +57,45 @@ func NewApp(cfg config.Config) (*App, error) {
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	// TODO: Improve logic for handling existing users in a distributed server setup
-	err = redisClient.FlushAll(rootCtx)
+	// Redis is shared with the other servers and holds persistent rooms, roles and bans,
+	// so it is not cleared on startup. The connections of a server that went away
+	// without closing them are cleaned up by the others once its heartbeat lapses.
+
+	// Initialize chat service
+	chatService := service.NewChatService(rootCtx, natsClient, redisClient, service.ChatConfig{
+		ResumeGracePeriod: time.Duration(cfg.ResumeGraceSeconds) * time.Second,
+		RoomIdleTimeout:   time.Duration(cfg.RoomIdleSeconds) * time.Second,
+		RoomCapacity:      cfg.RoomCapacity,
+		PresenceDelay:     time.Duration(cfg.PresenceDelaySeconds) * time.Second,
+		AwayTimeout:       time.Duration(cfg.AutoAwaySeconds) * time.Second,
+		NodeTimeout:       time.Duration(cfg.NodeTimeoutSeconds) * time.Second,
+	})
+
+	if cfg.GlobalAnnouncementOnly {
+		if err := setupGlobalAnnouncements(rootCtx, chatService, cfg.GlobalAnnouncers); err != nil {
+			rootCancel()
+			natsClient.Close()
+			redisClient.Close()
+			return nil, fmt.Errorf("failed to make global room announcement-only: %w", err)
+		}
+	}
+
+	// Initialize file service for attachments
+	fileService, err := service.NewFileService(rootCtx, redisClient, service.FileConfig{
+		Dir:          cfg.UploadDir,
+		MaxSize:      cfg.MaxUploadBytes,
+		AllowedTypes: cfg.AllowedUploadTypes,
+	})
 	if err != nil {
 		rootCancel()
 		natsClient.Close()
 		redisClient.Close()
-		return nil, fmt.Errorf("failed to flush Redis: %w", err)
+		return nil, fmt.Errorf("failed to initialize file storage: %w", err)
 	}
 
-	// Initialize chat service
-	chatService := service.NewChatService(rootCtx, natsClient, redisClient)
-
 	// Create HTTP server
-	httpServer := createHTTPServer(rootCtx, cfg.Port, chatService)
+	connections := ws.NewConnections()
+	httpServer := createHTTPServer(rootCtx, cfg, chatService, fileService, connections)
 
 	app := &App{
 		cfg:         cfg,
@@ -76,6 +104,7 @@ func NewApp(cfg config.Config) (*App, error) {
 		redisClient: redisClient,
 		chatService: chatService,
 		httpServer:  httpServer,
+		connections: connections,
 		rootCtx:     rootCtx,
 		cancel:      rootCancel,
 	}
@@ -84,14 +113,37 @@ func NewApp(cfg config.Config) (*App, error) {
 	return app, nil
 }
 
-func createHTTPServer(ctx context.Context, port int, chatService service.ChatService) *http.Server {
+// setupGlobalAnnouncements makes the global room a persistent announcement-only room
+// without an owner, in which the announcers are moderators. Another server may have
+// set it up already, or made it persistent without being announcement-only.
+func setupGlobalAnnouncements(ctx context.Context, chatService service.ChatService, announcers []string) error {
+	_, err := chatService.CreateRoom(ctx, domain.Room{Name: "global", AnnouncementOnly: true}, "")
+	if err != nil && !errors.Is(err, domain.ErrRoomExists) {
+		return err
+	}
+	if err := chatService.SetAnnouncementOnly(ctx, "global", true); err != nil {
+		return err
+	}
+	for _, username := range announcers {
+		if err := chatService.AssignRole(ctx, "global", username, domain.RoleModerator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createHTTPServer(ctx context.Context, cfg config.Config, chatService service.ChatService, fileService service.FileService, connections *ws.Connections) *http.Server {
 	wsConfig := ws.WSConfig{
 		ChatService: chatService,
+		FileService: fileService,
+		AdminToken:  cfg.AdminToken,
+		Connections: connections,
+		IPHeader:    cfg.ClientIPHeader,
 		RootCtx:     ctx,
 	}
 
 	return &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
 		Handler: ws.SetupWebSocketRoutes(wsConfig),
 	}
 }
@@ -131,9 +183,6 @@ func (a *App) Stop() error {
 
 	log.Infof("Initiating graceful shutdown")
 
-	// Cancel root context first
-	a.cancel()
-
 	// Create shutdown timeout context
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -144,6 +193,18 @@ func (a *App) Stop() error {
 		}).Errorf("HTTP server shutdown error")
 	}
 
+	// End the sessions of open clients while Redis and NATS are still connected; the
+	// others' are cleaned up by the remaining servers once this one's heartbeat lapses
+	log.Infof("Closing client connections")
+	if err := a.connections.Close(ctx); err != nil {
+		log.WithFields(map[string]interface{}{
+			"error": err.Error(),
+		}).Errorf("Client connections shutdown error")
+	}
+
+	// Cancelling the root context stops the background work and closes the clients
+	a.cancel()
+
 	log.Infof("Closing NATS connection")
 	a.natsClient.Close()
 
@@ -0,0 +1,22 @@
+package domain
+
+import "errors"
+
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrFileTooLarge       = errors.New("file too large")
+	ErrFileTypeBlocked    = errors.New("file type not allowed")
+)
+
+// Attachment is an uploaded file that can be attached to chat messages of a room
+type Attachment struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	MimeType string `json:"mime_type,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+
+	// Not exposed to clients
+	Hash     string `json:"-"` // SHA-256 of the content, names the stored file
+	Room     string `json:"-"` // Room the file was uploaded to; only its members may download it
+	Uploader string `json:"-"`
+}
@@ -3,18 +3,125 @@ package domain
 type MessageType string
 
 const (
-	MessageTypeChat   MessageType = "chat_message"
-	MessageTypeSystem MessageType = "system_message"
-	MessageTypeList   MessageType = "list_users"
-	MessageTypeRooms  MessageType = "list_rooms"
-	MessageTypeJoin   MessageType = "join_room"
-	MessageTypeLeave  MessageType = "leave_room"
+	MessageTypeChat    MessageType = "chat_message"
+	MessageTypeSystem  MessageType = "system_message"
+	MessageTypeList    MessageType = "list_users"
+	MessageTypeRooms   MessageType = "list_rooms"
+	MessageTypeJoin    MessageType = "join_room"
+	MessageTypeLeave   MessageType = "leave_room"
+	MessageTypeSession MessageType = "session"
+	MessageTypeAck     MessageType = "ack"
+	MessageTypeJoined  MessageType = "room_joined"
+
+	// Typing indicators are relayed to the room but never stored
+	MessageTypeTypingStart MessageType = "typing_start"
+	MessageTypeTypingStop  MessageType = "typing_stop"
+
+	// Read receipts: mark_read from a client, read_receipt broadcast to the room
+	MessageTypeMarkRead    MessageType = "mark_read"
+	MessageTypeReadReceipt MessageType = "read_receipt"
+
+	// Edits and deletions of a stored chat message, relayed to the room as update events
+	MessageTypeEdit   MessageType = "edit_message"
+	MessageTypeDelete MessageType = "delete_message"
+
+	// Reactions on a stored chat message, relayed to the room with the new tallies
+	MessageTypeAddReaction    MessageType = "add_reaction"
+	MessageTypeRemoveReaction MessageType = "remove_reaction"
+
+	// get_history requests stored messages of a room, answered with a history frame
+	MessageTypeGetHistory MessageType = "get_history"
+	MessageTypeHistory    MessageType = "history"
+
+	// get_thread requests a root message with its replies, answered with a thread frame
+	MessageTypeGetThread MessageType = "get_thread"
+	MessageTypeThread    MessageType = "thread"
+
+	// A mention notifies a mentioned user wherever they are; a mention_warning tells
+	// the sender which mentioned users are not in the room
+	MessageTypeMention        MessageType = "mention"
+	MessageTypeMentionWarning MessageType = "mention_warning"
+
+	// set_topic changes the topic of a room; room_info requests a room's record and answers it
+	MessageTypeSetTopic MessageType = "set_topic"
+	MessageTypeRoomInfo MessageType = "room_info"
+
+	// set_slow_mode sets the slow mode of a room from room_info.slow_mode
+	MessageTypeSetSlowMode MessageType = "set_slow_mode"
+
+	// create_room creates a persistent room, answered with its room_info
+	MessageTypeCreateRoom MessageType = "create_room"
+
+	// invite invites a user to an invite-only room or requests a shareable invite token.
+	// Invited users and token requesters receive an invite frame.
+	MessageTypeInvite MessageType = "invite"
+
+	// set_role gives a user a role in a room; the room is told with a system message
+	MessageTypeSetRole MessageType = "set_role"
+
+	// Moderation requests. The room is told with a system message, and kicked
+	// and banned users receive the request frame and are moved to the global room.
+	// unban and unmute lift a ban or mute early; unbanned users receive the frame.
+	MessageTypeKick   MessageType = "kick"
+	MessageTypeBan    MessageType = "ban"
+	MessageTypeMute   MessageType = "mute"
+	MessageTypeUnban  MessageType = "unban"
+	MessageTypeUnmute MessageType = "unmute"
+
+	// presence frames tell of a user going online, away or offline. They reach the user's
+	// rooms and the connections watching the user with watch_presence. Connections in the
+	// global room only get those of its users after a watch_presence with that room.
+	MessageTypePresence        MessageType = "presence"
+	MessageTypeWatchPresence   MessageType = "watch_presence"
+	MessageTypeUnwatchPresence MessageType = "unwatch_presence"
+
+	// set_status chooses the user's status and custom text from presence, answered
+	// with a presence frame of the user's resulting status
+	MessageTypeSetStatus MessageType = "set_status"
+
+	// MessageTypeDisconnect tells every connection of a user to close, or only ConnID if
+	// set; Content is the reason. It is not sent to clients, which get a close frame with
+	// the reason instead. As a control message it carries an IP ban in ServerBan.
+	MessageTypeDisconnect MessageType = "disconnect"
+
+	// MessageTypeError reports a rejected request to the client; Code says why
+	MessageTypeError MessageType = "error"
 )
 
 type ChatMessage struct {
-	Type      MessageType `json:"type"`
-	Sender    string      `json:"sender,omitempty"`
-	Content   string      `json:"content,omitempty"`
-	Timestamp string      `json:"timestamp,omitempty"`
-	Room      string      `json:"room,omitempty"`
+	Type        MessageType   `json:"type"`
+	ID          string        `json:"id,omitempty"`
+	ConnID      string        `json:"conn_id,omitempty"` // Connection the message originated from
+	Sender      string        `json:"sender,omitempty"`
+	Content     string        `json:"content,omitempty"`
+	Timestamp   string        `json:"timestamp,omitempty"`
+	Room        string        `json:"room,omitempty"`
+	ResumeToken string        `json:"resume_token,omitempty"`
+	Rooms       []RoomSummary `json:"rooms,omitempty"` // list_rooms response
+	Users       []Presence    `json:"users,omitempty"` // list_users response
+	Edited      bool          `json:"edited,omitempty"`
+	Deleted     bool          `json:"deleted,omitempty"`     // Tombstone of a deleted message
+	Code        string        `json:"code,omitempty"`        // Error code of an error frame
+	RetryAfter  int64         `json:"retry_after,omitempty"` // Seconds to wait after a slow_mode error
+	Emoji       string        `json:"emoji,omitempty"`       // Emoji of add_reaction/remove_reaction
+	Reactions   []Reaction    `json:"reactions,omitempty"`
+	Messages    []ChatMessage `json:"messages,omitempty"`  // history and thread responses
+	ReplyTo     string        `json:"reply_to,omitempty"`  // Message this one replies to
+	ThreadID    string        `json:"thread_id,omitempty"` // Root message of the reply's thread
+	ReplyCount  int64         `json:"reply_count,omitempty"`
+	Mentions    []string      `json:"mentions,omitempty"` // Mentioned usernames, MentionRoom or MentionHere
+	Attachments []Attachment  `json:"attachments,omitempty"`
+	RoomInfo    *Room         `json:"room_info,omitempty"`  // room_info responses, room changes and create_room and set_slow_mode requests
+	Password    string        `json:"password,omitempty"`   // Room password of join_room and create_room requests
+	Invite      *Invite       `json:"invite,omitempty"`     // invite frames, and the token of join_room requests
+	Role        *RoleGrant    `json:"role,omitempty"`       // set_role requests and role change announcements
+	Moderation  *Moderation   `json:"moderation,omitempty"` // kick, ban and mute requests and announcements
+	Presence    *Presence     `json:"presence,omitempty"`   // presence frames and watch_presence/unwatch_presence requests
+	ServerBan   *ServerBan    `json:"server_ban,omitempty"` // IP bans sent to every server to close their connections
 }
+
+// Mentions that address the whole room rather than a user
+const (
+	MentionRoom = "room"
+	MentionHere = "here"
+)
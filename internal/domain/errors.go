@@ -0,0 +1,23 @@
+package domain
+
+import "errors"
+
+var (
+	ErrNotPermitted    = errors.New("not permitted")
+	ErrMessageNotFound = errors.New("message not found")
+	ErrInvalidRequest  = errors.New("invalid request")
+)
+
+// Error codes sent to clients in error frames
+const (
+	ErrorCodeNotPermitted   = "not_permitted"
+	ErrorCodeNotFound       = "not_found"
+	ErrorCodeInvalidRequest = "invalid_request"
+	ErrorCodeAlreadyExists  = "already_exists"
+	ErrorCodeSlowMode       = "slow_mode"
+	ErrorCodeRoomFull       = "room_full"
+
+	// ErrorCodeMessagesDropped tells a client that fell behind that it missed messages
+	// of Room, or of a watched user's presence if Room is empty
+	ErrorCodeMessagesDropped = "messages_dropped"
+)
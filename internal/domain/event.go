@@ -0,0 +1,39 @@
+package domain
+
+// EventVersion is the version of the Event schema, whose JSON Schema per event type
+// is in schemas/events/v<version>. It is part of every event's subject and payload;
+// fields are only added within a version, never changed or removed.
+const EventVersion = 1
+
+type EventType string
+
+// Domain events. User events concern a user's presence on the server,
+// room events a room's lifecycle and its members.
+const (
+	EventUserConnected    EventType = "user_connected"    // First connection of a user
+	EventUserDisconnected EventType = "user_disconnected" // Last connection of a user is gone
+
+	EventUserJoinedRoom EventType = "user_joined_room" // First connection of a user to a room
+	EventUserLeftRoom   EventType = "user_left_room"   // Last connection of a user to a room is gone
+	EventRoomCreated    EventType = "room_created"     // Persistent room created, or ad-hoc room created by a join
+	EventRoomDeleted    EventType = "room_deleted"     // Room dropped with its record
+	EventTopicChanged   EventType = "topic_changed"
+)
+
+// Event is a structured record of something that happened on the chat server,
+// published for other services to react to
+type Event struct {
+	Version   int       `json:"version"` // EventVersion
+	ID        string    `json:"id"`
+	Type      EventType `json:"type"`
+	Timestamp string    `json:"timestamp"`
+	Username  string    `json:"username,omitempty"`  // User the event is about, or who caused it
+	Room      string    `json:"room,omitempty"`      // Set exactly for room events
+	Topic     string    `json:"topic,omitempty"`     // New topic of topic_changed, empty if cleared
+	RoomInfo  *Room     `json:"room_info,omitempty"` // Record of a created room
+}
+
+// IsRoomEvent reports whether an event is about a room rather than a user
+func (e Event) IsRoomEvent() bool {
+	return e.Room != ""
+}
@@ -0,0 +1,15 @@
+package domain
+
+import "errors"
+
+var ErrInviteInvalid = errors.New("invite is invalid or expired")
+
+// Invite is an invitation to a private or invite-only room: either for a named user, or a
+// shareable token that can be redeemed by anyone until it expires or is used up
+type Invite struct {
+	Token     string `json:"token,omitempty"`
+	Username  string `json:"username,omitempty"`   // Invited user
+	MaxUses   int64  `json:"max_uses,omitempty"`   // Redemptions allowed; 0 for unlimited
+	ExpiresIn int64  `json:"expires_in,omitempty"` // Requested lifetime in seconds
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
@@ -0,0 +1,29 @@
+package domain
+
+import "errors"
+
+var (
+	ErrBanned       = errors.New("banned from room")
+	ErrMuted        = errors.New("muted in room")
+	ErrServerBanned = errors.New("banned from server")
+	ErrBanNotFound  = errors.New("ban not found")
+)
+
+// Moderation is a kick, ban or mute of a user in a room. Requests name the user,
+// and bans and mutes can last Duration seconds; announcements also carry Until.
+type Moderation struct {
+	Username string `json:"username"`
+	Duration int64  `json:"duration,omitempty"` // Seconds; 0 bans until lifted or mutes for the default time
+	Reason   string `json:"reason,omitempty"`
+	Until    string `json:"until,omitempty"`
+}
+
+// ServerBan keeps a username or an IP address off the whole server for Duration
+// seconds, or until lifted if it is 0. Exactly one of Username and IP is set.
+type ServerBan struct {
+	Username string `json:"username,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Duration int64  `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Until    string `json:"until,omitempty"`
+}
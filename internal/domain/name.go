@@ -0,0 +1,12 @@
+package domain
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ValidName reports whether a username or room name can be used. Names are tokens of
+// NATS subjects, so they cannot contain dots, the wildcards * and > or whitespace.
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ".*>") && !strings.ContainsFunc(name, unicode.IsSpace)
+}
@@ -0,0 +1,30 @@
+package domain
+
+// Presence statuses. A user is away while all their connections have dropped and
+// wait to be resumed or have been idle, unless they chose a status with set_status.
+// Invisible users appear offline to everyone else.
+const (
+	PresenceOnline    = "online"
+	PresenceAway      = "away"
+	PresenceBusy      = "busy"
+	PresenceInvisible = "invisible"
+	PresenceOffline   = "offline"
+)
+
+// Presence is the status of a user, in presence frames, watch_presence responses,
+// list_users responses and set_status requests
+type Presence struct {
+	Username  string `json:"username"`
+	Status    string `json:"status,omitempty"`
+	Text      string `json:"text,omitempty"`       // Custom status text
+	ExpiresIn int64  `json:"expires_in,omitempty"` // Seconds until a status set with set_status lapses; zero keeps it
+	ExpiresAt string `json:"expires_at,omitempty"` // When the chosen status and text lapse
+}
+
+// Public returns the presence as other users see it: invisible users are offline
+func (p Presence) Public() Presence {
+	if p.Status == PresenceInvisible {
+		return Presence{Username: p.Username, Status: PresenceOffline}
+	}
+	return p
+}
@@ -0,0 +1,8 @@
+package domain
+
+// Reaction is the tally of one emoji on a message
+type Reaction struct {
+	Emoji   string `json:"emoji"`
+	Count   int64  `json:"count"`
+	Reacted bool   `json:"reacted,omitempty"` // The requesting user is among the reactors
+}
@@ -0,0 +1,35 @@
+package domain
+
+// Room roles, from most to least privileged. Users without a role are members;
+// read-only users can follow a room but not post to it.
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+	RoleReadOnly  = "read_only"
+)
+
+// roleRanks orders the roles; a higher rank is more privileged
+var roleRanks = map[string]int{
+	RoleReadOnly:  1,
+	RoleMember:    2,
+	RoleModerator: 3,
+	RoleOwner:     4,
+}
+
+// ValidRole reports whether role is one of the room roles
+func ValidRole(role string) bool {
+	return roleRanks[role] > 0
+}
+
+// RoleRank returns how privileged a role is, 0 for unknown roles
+func RoleRank(role string) int {
+	return roleRanks[role]
+}
+
+// RoleGrant gives a user a role in a room. set_role requests carry it, and so do
+// the system messages announcing the change.
+type RoleGrant struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
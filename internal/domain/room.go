@@ -0,0 +1,60 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrRoomExists   = errors.New("room already exists")
+	ErrSlowMode     = errors.New("slow mode cooldown")
+	ErrRoomFull     = errors.New("room is full")
+)
+
+// SlowModeError rejects a message sent before the sender's slow mode cooldown is over.
+// It matches ErrSlowMode.
+type SlowModeError struct {
+	RetryAfter time.Duration
+}
+
+func (e *SlowModeError) Error() string {
+	return fmt.Sprintf("%v: retry after %s", ErrSlowMode, e.RetryAfter)
+}
+
+func (e *SlowModeError) Unwrap() error { return ErrSlowMode }
+
+// Room visibilities. Private rooms are listed only to their members;
+// password rooms need the room's password to join and invite-only rooms an invitation.
+const (
+	RoomPublic   = "public"
+	RoomPrivate  = "private"
+	RoomPassword = "password"
+	RoomInvite   = "invite"
+)
+
+// Room is the record of a room. Members is counted when the room is read.
+// Persistent rooms are kept when empty; ad-hoc rooms go away once idle.
+type Room struct {
+	Name        string `json:"name"`
+	Topic       string `json:"topic,omitempty"`
+	Description string `json:"description,omitempty"`
+	CreatedBy   string `json:"created_by,omitempty"`
+	CreatedAt   string `json:"created_at,omitempty"`
+	Persistent  bool   `json:"persistent,omitempty"`
+	Visibility  string `json:"visibility,omitempty"` // RoomPublic if empty
+	Members     int64  `json:"members"`
+
+	AnnouncementOnly bool  `json:"announcement_only,omitempty"` // Only owners and moderators can post
+	SlowMode         int64 `json:"slow_mode,omitempty"`         // Seconds each user must wait between messages; 0 is off
+	MaxMembers       int64 `json:"max_members,omitempty"`       // Capacity of a persistent room; 0 uses the server default
+
+	Roles map[string]string `json:"roles,omitempty"` // Users with a role other than member, in room_info responses
+}
+
+// RoomSummary describes a room in a list_rooms response
+type RoomSummary struct {
+	Room
+	Unread int64 `json:"unread"` // Stored messages after the requesting user's read marker
+}
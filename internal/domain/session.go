@@ -0,0 +1,19 @@
+package domain
+
+import "errors"
+
+// ErrSessionNotFound is returned when a resume token is unknown, expired or already in use
+var ErrSessionNotFound = errors.New("session not found or expired")
+
+// Session is the resumable state of a client connection.
+// ConnID identifies the connection across resumes and tags every message it publishes.
+// LastAck is the ID of the last message the client acknowledged.
+// Node is the server the connection is on, or was on when it dropped.
+type Session struct {
+	Token    string
+	ConnID   string
+	Username string
+	Room     string
+	LastAck  string
+	Node     string
+}
@@ -11,11 +11,12 @@ import (
 
 // NATSClient handles NATS connection and subscriptions
 type NATSClient struct {
-	Conn       *nats.Conn
-	SubMapping map[string]*nats.Subscription // Stores active subscriptions by room:username
-	mu         sync.RWMutex                  // Protects concurrent access to SubMapping
-	logger     logger.Logger                 // Logger for NATS operations
-	ctx        context.Context
+	Conn        *nats.Conn
+	SubMapping  map[string]*nats.Subscription     // Stores the shared NATS subscription of each subject
+	subscribers map[string]map[string]*subscriber // Local subscribers of each subject by subscriber ID
+	mu          sync.RWMutex                      // Protects concurrent access to SubMapping and subscribers
+	logger      logger.Logger                     // Logger for NATS operations
+	ctx         context.Context
 }
 
 // NewNATSClient creates a new NATS client with persistent connection
@@ -38,10 +39,11 @@ func NewNATSClient(ctx context.Context, url string) (*NATSClient, error) {
 	}()
 
 	client := &NATSClient{
-		Conn:       nc,
-		SubMapping: make(map[string]*nats.Subscription),
-		logger:     log,
-		ctx:        ctx,
+		Conn:        nc,
+		SubMapping:  make(map[string]*nats.Subscription),
+		subscribers: make(map[string]map[string]*subscriber),
+		logger:      log,
+		ctx:         ctx,
 	}
 
 	return client, nil
@@ -55,5 +57,12 @@ func (c *NATSClient) Close() {
 	for _, sub := range c.SubMapping {
 		sub.Unsubscribe()
 	}
+	for _, subs := range c.subscribers {
+		for _, s := range subs {
+			close(s.done)
+		}
+	}
+	c.SubMapping = make(map[string]*nats.Subscription)
+	c.subscribers = make(map[string]map[string]*subscriber)
 	c.Conn.Close()
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/SphrGhfri/chatroom_golang_nats/pkg/logger"
 )
 
 // PublishRoom broadcasts a message to all subscribers in a specific room
@@ -18,9 +19,78 @@ func (c *NATSClient) PublishRoom(ctx context.Context, roomName string, msg domai
 		"msg_type": msg.Type,
 	})
 
-	// Format the subject to match subscription pattern
-	subject := fmt.Sprintf("chat.room.%s", roomName)
+	log.Infof("Publishing message to room")
+	// Publish to all subscribers in the room
+	return c.publish(log, roomSubject(roomName), msg)
+}
 
+// PublishUser delivers a message to every connection of a user, on any server
+// Uses subject format "chat.user.<username>"
+func (c *NATSClient) PublishUser(ctx context.Context, username string, msg domain.ChatMessage) error {
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"sender":   msg.Sender,
+		"msg_type": msg.Type,
+	})
+
+	log.Infof("Publishing message to user")
+	return c.publish(log, userSubject(username), msg)
+}
+
+// PublishPresence delivers a presence frame of a user to the connections watching them
+// Uses subject format "chat.presence.<username>"
+func (c *NATSClient) PublishPresence(ctx context.Context, username string, msg domain.ChatMessage) error {
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"msg_type": msg.Type,
+	})
+
+	log.Infof("Publishing presence")
+	return c.publish(log, presenceSubject(username), msg)
+}
+
+// PublishRoomPresence delivers a presence frame of a user in a room to the connections
+// that asked for the presence frames of its users
+// Uses subject format "chat.room_presence.<room>"
+func (c *NATSClient) PublishRoomPresence(ctx context.Context, roomName string, msg domain.ChatMessage) error {
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     roomName,
+		"msg_type": msg.Type,
+	})
+
+	log.Infof("Publishing room presence")
+	return c.publish(log, roomPresenceSubject(roomName), msg)
+}
+
+// PublishControl sends a control message to the chat service on every server,
+// e.g. to act on a user's connections wherever they are connected
+// Uses subject "chat.control"
+func (c *NATSClient) PublishControl(ctx context.Context, msg domain.ChatMessage) error {
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"sender":   msg.Sender,
+		"msg_type": msg.Type,
+	})
+
+	log.Infof("Publishing control message")
+	return c.publish(log, controlSubject, msg)
+}
+
+// PublishEvent publishes a domain event for other services. Room events use subject
+// "chat.events.v<version>.room.<room>.<type>", user events
+// "chat.events.v<version>.user.<username>.<type>".
+func (c *NATSClient) PublishEvent(ctx context.Context, event domain.Event) error {
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"event":    event.Type,
+		"room":     event.Room,
+		"username": event.Username,
+	})
+
+	log.Infof("Publishing event")
+	return c.publish(log, eventSubject(event), event)
+}
+
+// publish JSON encodes a message and publishes it on a subject
+func (c *NATSClient) publish(log logger.Logger, subject string, msg interface{}) error {
 	// Serialize message to JSON for transmission
 	data, err := json.Marshal(msg)
 	if err != nil {
@@ -28,8 +98,6 @@ func (c *NATSClient) PublishRoom(ctx context.Context, roomName string, msg domai
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	log.Infof("Publishing message to room")
-	// Publish to all subscribers in the room
 	if err := c.Conn.Publish(subject, data); err != nil {
 		log.Errorf("Failed to publish message: %v", err)
 		return fmt.Errorf("failed to publish message: %w", err)
@@ -37,3 +105,34 @@ func (c *NATSClient) PublishRoom(ctx context.Context, roomName string, msg domai
 
 	return nil
 }
+
+// controlSubject carries control messages between servers
+const controlSubject = "chat.control"
+
+// roomSubject formats the subject of a chat room
+func roomSubject(roomName string) string {
+	return fmt.Sprintf("chat.room.%s", roomName)
+}
+
+// presenceSubject formats the subject of a user's presence frames
+func presenceSubject(username string) string {
+	return fmt.Sprintf("chat.presence.%s", username)
+}
+
+// roomPresenceSubject formats the subject of the presence frames of a room's users
+func roomPresenceSubject(roomName string) string {
+	return fmt.Sprintf("chat.room_presence.%s", roomName)
+}
+
+// eventSubject formats the subject of a domain event
+func eventSubject(event domain.Event) string {
+	if event.IsRoomEvent() {
+		return fmt.Sprintf("chat.events.v%d.room.%s.%s", event.Version, event.Room, event.Type)
+	}
+	return fmt.Sprintf("chat.events.v%d.user.%s.%s", event.Version, event.Username, event.Type)
+}
+
+// userSubject formats the subject of messages addressed to a user
+func userSubject(username string) string {
+	return fmt.Sprintf("chat.user.%s", username)
+}
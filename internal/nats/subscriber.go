@@ -4,80 +4,259 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
 	"github.com/nats-io/nats.go"
 )
 
-// SubscribeRoom subscribes a user to a specific chat room
-// and filters out their own messages to prevent echo
-// subKey format: "roomName:username" is used to track unique subscriptions
-func (c *NATSClient) SubscribeRoom(ctx context.Context, roomName, username string, handleFunc func(domain.ChatMessage)) error {
+// subscriberBuffer is how many messages may queue up for a slow local subscriber
+// of a room or presence subject before further messages are dropped for it
+const subscriberBuffer = 64
+
+// subscriber is a local consumer of a subject's messages.
+// Each subscriber runs its handler on its own goroutine, so one slow
+// connection cannot hold up delivery to the rest of the room.
+type subscriber struct {
+	mu      sync.Mutex
+	queue   []*domain.ChatMessage // Decoded messages are shared read-only between subscribers
+	limit   int                   // Most queued messages before dropping; zero never drops
+	dropped int                   // Messages dropped since the handler was last told
+	room    string                // Room of a room subject, for the drop notice
+	ready   chan struct{}
+	done    chan struct{}
+}
+
+// newSubscriber starts a subscriber for a subject. Control and user messages are
+// never dropped; for other subjects, the handler is told how many it missed.
+func newSubscriber(subject string, handleFunc func(domain.ChatMessage)) *subscriber {
+	s := &subscriber{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	if subject != controlSubject && !strings.HasPrefix(subject, userSubject("")) {
+		s.limit = subscriberBuffer
+		s.room = strings.TrimPrefix(subject, roomSubject(""))
+		if s.room == subject {
+			s.room = ""
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-s.ready:
+			}
+			s.mu.Lock()
+			msgs, dropped := s.queue, s.dropped
+			s.queue, s.dropped = nil, 0
+			s.mu.Unlock()
+
+			for _, msg := range msgs {
+				handleFunc(*msg)
+			}
+			if dropped > 0 {
+				handleFunc(domain.ChatMessage{
+					Type:    domain.MessageTypeError,
+					Code:    domain.ErrorCodeMessagesDropped,
+					Room:    s.room,
+					Content: fmt.Sprintf("%d messages were dropped because the connection fell behind", dropped),
+				})
+			}
+		}
+	}()
+	return s
+}
+
+// offer queues a message for the subscriber. It reports false if the message was dropped.
+func (s *subscriber) offer(msg *domain.ChatMessage) bool {
+	s.mu.Lock()
+	if s.limit > 0 && len(s.queue) >= s.limit {
+		s.dropped++
+		s.mu.Unlock()
+		return false
+	}
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// SubscribeRoom registers a local subscriber for a chat room.
+// The process holds a single NATS subscription per room; incoming messages are
+// decoded once and fanned out to every local subscriber of that room.
+// subscriberID identifies the subscriber within the room (e.g. the connection ID).
+func (c *NATSClient) SubscribeRoom(ctx context.Context, roomName, subscriberID string, handleFunc func(domain.ChatMessage)) error {
+	// Create NATS subject using room name (e.g., "chat.room.general")
+	return c.subscribe(ctx, roomSubject(roomName), subscriberID, handleFunc)
+}
+
+// UnsubscribeRoom removes a local subscriber from a specific room
+// If the subscription doesn't exist, it returns nil
+// The shared NATS subscription is closed once the room has no local subscribers left
+func (c *NATSClient) UnsubscribeRoom(ctx context.Context, roomName, subscriberID string) error {
+	return c.unsubscribe(ctx, roomSubject(roomName), subscriberID)
+}
+
+// SubscribeUser registers a local subscriber for messages addressed to a user.
+// Every connection of the user subscribes, so each of them receives the message.
+func (c *NATSClient) SubscribeUser(ctx context.Context, username, subscriberID string, handleFunc func(domain.ChatMessage)) error {
+	return c.subscribe(ctx, userSubject(username), subscriberID, handleFunc)
+}
+
+// UnsubscribeUser removes a local subscriber from a user's messages
+func (c *NATSClient) UnsubscribeUser(ctx context.Context, username, subscriberID string) error {
+	return c.unsubscribe(ctx, userSubject(username), subscriberID)
+}
+
+// SubscribePresence registers a local subscriber for the presence frames of a user
+func (c *NATSClient) SubscribePresence(ctx context.Context, username, subscriberID string, handleFunc func(domain.ChatMessage)) error {
+	return c.subscribe(ctx, presenceSubject(username), subscriberID, handleFunc)
+}
+
+// UnsubscribePresence removes a local subscriber from a user's presence frames
+func (c *NATSClient) UnsubscribePresence(ctx context.Context, username, subscriberID string) error {
+	return c.unsubscribe(ctx, presenceSubject(username), subscriberID)
+}
+
+// SubscribeRoomPresence registers a local subscriber for the presence frames of a room's users
+func (c *NATSClient) SubscribeRoomPresence(ctx context.Context, roomName, subscriberID string, handleFunc func(domain.ChatMessage)) error {
+	return c.subscribe(ctx, roomPresenceSubject(roomName), subscriberID, handleFunc)
+}
+
+// UnsubscribeRoomPresence removes a local subscriber from the presence frames of a room's users
+func (c *NATSClient) UnsubscribeRoomPresence(ctx context.Context, roomName, subscriberID string) error {
+	return c.unsubscribe(ctx, roomPresenceSubject(roomName), subscriberID)
+}
+
+// SubscribeControl registers a local subscriber for control messages sent with PublishControl
+func (c *NATSClient) SubscribeControl(ctx context.Context, subscriberID string, handleFunc func(domain.ChatMessage)) error {
+	return c.subscribe(ctx, controlSubject, subscriberID, handleFunc)
+}
+
+// RoomConnections returns the IDs of a user's local subscribers that are also
+// subscribed to a room, i.e. the user's connections to the room on this server
+func (c *NATSClient) RoomConnections(roomName, username string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var ids []string
+	for id := range c.subscribers[userSubject(username)] {
+		if _, ok := c.subscribers[roomSubject(roomName)][id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Subscribers returns the number of local subscribers of a room
+func (c *NATSClient) Subscribers(roomName string) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.subscribers[roomSubject(roomName)])
+}
+
+// IsRoomSubscriber reports whether a local subscriber is subscribed to a room
+func (c *NATSClient) IsRoomSubscriber(roomName, subscriberID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.subscribers[roomSubject(roomName)][subscriberID]
+	return ok
+}
+
+// subscribe adds a local subscriber to a subject, opening the shared
+// NATS subscription for the subject if it is the first one
+func (c *NATSClient) subscribe(ctx context.Context, subject, subscriberID string, handleFunc func(domain.ChatMessage)) error {
 	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
-		"room":     roomName,
-		"username": username,
+		"subject":    subject,
+		"subscriber": subscriberID,
 	})
 
-	// Lock to prevent concurrent modification of subscription map
+	// Lock to prevent concurrent modification of subscription maps
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Create NATS subject using room name (e.g., "chat.room.general")
-	subject := fmt.Sprintf("chat.room.%s", roomName)
-	// Create unique subscription key to track user's room subscription
-	subKey := fmt.Sprintf("%s:%s", roomName, username)
-
-	// Prevent duplicate subscriptions for same user in same room
-	if _, exists := c.SubMapping[subKey]; exists {
-		log.Infof("User already subscribed to room")
+	// Prevent duplicate subscriptions for same subscriber on the same subject
+	if _, exists := c.subscribers[subject][subscriberID]; exists {
+		log.Infof("Already subscribed")
 		return nil
 	}
 
-	log.Infof("Subscribing user to room")
-	// Create subscription with message handler
-	sub, err := c.Conn.Subscribe(subject, func(msg *nats.Msg) {
-		// Decode incoming message
-		var chatMsg domain.ChatMessage
-		if err := json.Unmarshal(msg.Data, &chatMsg); err != nil {
-			log.Errorf("Failed to unmarshal message: %v", err)
-			return // Skip invalid messages
-		}
-		// Only process messages from other users
-		if chatMsg.Sender != username {
-			handleFunc(chatMsg)
+	// First local subscriber opens the shared NATS subscription
+	if _, exists := c.SubMapping[subject]; !exists {
+		sub, err := c.Conn.Subscribe(subject, func(msg *nats.Msg) {
+			c.dispatch(subject, msg)
+		})
+		if err != nil {
+			log.Errorf("Failed to subscribe: %v", err)
+			return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
 		}
-	})
-	if err != nil {
-		log.Errorf("Failed to subscribe to room: %v", err)
-		return fmt.Errorf("failed to subscribe to room %s: %w", roomName, err)
+		c.SubMapping[subject] = sub
+		c.subscribers[subject] = make(map[string]*subscriber)
+		log.Infof("Opened shared subscription")
 	}
 
-	c.SubMapping[subKey] = sub
-	log.Infof("Successfully subscribed to room")
+	c.subscribers[subject][subscriberID] = newSubscriber(subject, handleFunc)
+	log.Infof("Successfully subscribed")
 	return nil
 }
 
-// UnsubscribeRoom removes a user's subscription from a specific room
-// If the subscription doesn't exist, it returns nil
-// This ensures clean removal from both NATS server and local mapping
-func (c *NATSClient) UnsubscribeRoom(ctx context.Context, roomName, username string) error {
+// dispatch decodes a message once and hands it to every local subscriber of its subject
+func (c *NATSClient) dispatch(subject string, msg *nats.Msg) {
+	var chatMsg domain.ChatMessage
+	if err := json.Unmarshal(msg.Data, &chatMsg); err != nil {
+		c.logger.Errorf("Failed to unmarshal message on %s: %v", subject, err)
+		return // Skip invalid messages
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for id, s := range c.subscribers[subject] {
+		if !s.offer(&chatMsg) {
+			c.logger.Warnf("Dropping message for slow subscriber %s on %s", id, subject)
+		}
+	}
+}
+
+// unsubscribe removes a local subscriber and closes the shared
+// NATS subscription once the subject has no local subscribers left
+func (c *NATSClient) unsubscribe(ctx context.Context, subject, subscriberID string) error {
 	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
-		"room":     roomName,
-		"username": username,
+		"subject":    subject,
+		"subscriber": subscriberID,
 	})
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	subKey := fmt.Sprintf("%s:%s", roomName, username)
-	if sub, exists := c.SubMapping[subKey]; exists {
-		log.Infof("Unsubscribing from room")
+	s, exists := c.subscribers[subject][subscriberID]
+	if !exists {
+		return nil
+	}
+
+	log.Infof("Unsubscribing")
+	close(s.done)
+	delete(c.subscribers[subject], subscriberID)
+
+	if len(c.subscribers[subject]) > 0 {
+		return nil
+	}
+
+	delete(c.subscribers, subject)
+	if sub, ok := c.SubMapping[subject]; ok {
+		delete(c.SubMapping, subject)
 		if err := sub.Unsubscribe(); err != nil {
 			log.Errorf("Failed to unsubscribe: %v", err)
 			return fmt.Errorf("failed to unsubscribe: %w", err)
 		}
-		delete(c.SubMapping, subKey)
-		log.Infof("Successfully unsubscribed from room")
+		log.Infof("Closed shared subscription")
 	}
 	return nil
 }
@@ -94,11 +273,17 @@ func (c *NATSClient) CleanupSubscriptions() {
 	})
 
 	log.Infof("Cleaning up all subscriptions")
-	for room, sub := range c.SubMapping {
+	for subject, sub := range c.SubMapping {
 		if err := sub.Unsubscribe(); err != nil {
-			log.Errorf("Failed to unsubscribe from %s: %v", room, err)
+			log.Errorf("Failed to unsubscribe from %s: %v", subject, err)
+		}
+		delete(c.SubMapping, subject)
+	}
+	for subject, subs := range c.subscribers {
+		for _, s := range subs {
+			close(s.done)
 		}
-		delete(c.SubMapping, room)
+		delete(c.subscribers, subject)
 	}
 	log.Infof("Subscription cleanup completed")
 }
@@ -0,0 +1,56 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+)
+
+func attachmentKey(id string) string { return "attachment:" + id }
+
+// SaveAttachment stores the metadata of an uploaded file
+func (r *RedisClient) SaveAttachment(ctx context.Context, att domain.Attachment) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"attachment_id": att.ID,
+		"room":          att.Room,
+		"action":        "save_attachment",
+	})
+
+	log.Infof("Saving attachment")
+	if err := r.client.HSet(ctx, attachmentKey(att.ID),
+		"name", att.Name,
+		"mime_type", att.MimeType,
+		"size", att.Size,
+		"hash", att.Hash,
+		"room", att.Room,
+		"uploader", att.Uploader,
+	).Err(); err != nil {
+		log.Errorf("Failed to save attachment: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetAttachment returns the metadata of an uploaded file, or domain.ErrAttachmentNotFound
+func (r *RedisClient) GetAttachment(ctx context.Context, id string) (domain.Attachment, error) {
+	res, err := r.client.HGetAll(ctx, attachmentKey(id)).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to get attachment: %v", err)
+		return domain.Attachment{}, err
+	}
+	if len(res) == 0 {
+		return domain.Attachment{}, domain.ErrAttachmentNotFound
+	}
+
+	size, _ := strconv.ParseInt(res["size"], 10, 64)
+	return domain.Attachment{
+		ID:       id,
+		Name:     res["name"],
+		MimeType: res["mime_type"],
+		Size:     size,
+		Hash:     res["hash"],
+		Room:     res["room"],
+		Uploader: res["uploader"],
+	}, nil
+}
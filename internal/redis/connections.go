@@ -0,0 +1,259 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+// addUserConnScript records a connection and marks the user active.
+// Returns 1 if this is the user's first connection.
+var addUserConnScript = redis.NewScript(`
+redis.call('SADD', KEYS[1], ARGV[2])
+return redis.call('SADD', KEYS[2], ARGV[1])
+`)
+
+// removeUserConnScript forgets a connection and marks the user inactive
+// once no connections are left. Returns 1 if the user went inactive.
+var removeUserConnScript = redis.NewScript(`
+redis.call('SREM', KEYS[1], ARGV[2])
+if redis.call('SCARD', KEYS[1]) > 0 then return 0 end
+return redis.call('SREM', KEYS[2], ARGV[1])
+`)
+
+// roomConnLua holds the Lua shared by the scripts that add, remove and move room
+// connections. A room is passed as a table of its keys: the user's connections in
+// the room, its members, all_rooms, its record, its roles and the rooms of the user.
+//
+// room_full reports whether a user who is not a member yet is turned away because the
+// room has reached its max_members, or default_limit if it sets none; 0 is unlimited.
+//
+// join_room adds a connection to a room, the user to its members and the room to the
+// user's rooms, creating the room's record if it is new, with the user as its creator
+// and owner if owner is '1'. It returns whether the user was not in the room yet and
+// whether it was created.
+//
+// leave_room removes a connection from a room. The user leaves the room, and the room
+// the user's rooms, with their last connection. Once an ad-hoc room has no members it
+// is dropped with its record and roles, or, if deadline is a time in Unix milliseconds,
+// left to idle in the idle_rooms set until then. Persistent rooms are never dropped. It
+// returns whether the user left the room, whether it was left to idle and whether it
+// was dropped.
+const roomConnLua = `
+local function room_full(room, username, default_limit)
+	if redis.call('SISMEMBER', room[2], username) == 1 then return false end
+	local limit = tonumber(redis.call('HGET', room[4], 'max_members') or '0') or 0
+	if limit <= 0 then limit = tonumber(default_limit) end
+	return limit > 0 and redis.call('SCARD', room[2]) >= limit
+end
+
+local function join_room(room, conn_id, username, name, created_at, owner)
+	redis.call('SADD', room[1], conn_id)
+	local joined = redis.call('SADD', room[2], username)
+	redis.call('SADD', room[6], name)
+	redis.call('SADD', room[3], name)
+	if redis.call('EXISTS', room[4]) == 1 then return joined, 0 end
+	local creator = ''
+	if owner == '1' then
+		creator = username
+		redis.call('HSET', room[5], creator, 'owner')
+	end
+	redis.call('HSET', room[4], 'created_by', creator, 'created_at', created_at)
+	return joined, 1
+end
+
+local function leave_room(room, idle_rooms, conn_id, username, name, deadline)
+	redis.call('SREM', room[1], conn_id)
+	if redis.call('SCARD', room[1]) > 0 then return 0, 0, 0 end
+	local left = redis.call('SREM', room[2], username)
+	redis.call('SREM', room[6], name)
+	if redis.call('SCARD', room[2]) > 0 or redis.call('HGET', room[4], 'persistent') == '1' then
+		return left, 0, 0
+	end
+	if deadline ~= '0' then
+		redis.call('ZADD', idle_rooms, deadline, name)
+		return left, 1, 0
+	end
+	redis.call('SREM', room[3], name)
+	redis.call('DEL', room[4], room[5])
+	return left, 0, 1
+end
+`
+
+// addRoomConnScript joins a connection to the room in KEYS[1..6] with join_room, with
+// ARGV[5] as the default capacity and ARGV[6] telling whether the user owns the room
+// if they create it. Returns whether the user was not in the room yet, -1 if the room
+// is full, and whether the room was created.
+var addRoomConnScript = redis.NewScript(roomConnLua + `
+local room = {KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5], KEYS[6]}
+if room_full(room, ARGV[2], ARGV[5]) then return {-1, 0} end
+local joined, created = join_room(room, ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[6])
+return {joined, created}
+`)
+
+// removeRoomConnScript takes a connection out of the room in KEYS[1..6] with
+// leave_room, with idle_rooms in KEYS[7] and the idle deadline, or '0', in ARGV[4].
+// Returns whether the user left the room, whether it was left to idle, and whether
+// the room was dropped.
+var removeRoomConnScript = redis.NewScript(roomConnLua + `
+local room = {KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5], KEYS[6]}
+local left, idle, dropped = leave_room(room, KEYS[7], ARGV[1], ARGV[2], ARGV[3], ARGV[4])
+return {left, idle, dropped}
+`)
+
+// switchRoomConnScript moves a connection from one room (KEYS[1..6]) to another
+// (KEYS[7..12]) in one step, so the user is never seen in both rooms or in neither.
+// The old room is left as with removeRoomConnScript, with idle_rooms in KEYS[13], and
+// the new one joined as with addRoomConnScript. A full new room leaves both rooms
+// untouched. Returns whether the user joined the new room, -1 if it is full, and
+// whether it was created, then whether they left the old room, whether it was left
+// to idle and whether it was dropped.
+var switchRoomConnScript = redis.NewScript(roomConnLua + `
+local from = {KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5], KEYS[6]}
+local to = {KEYS[7], KEYS[8], KEYS[9], KEYS[10], KEYS[11], KEYS[12]}
+if room_full(to, ARGV[2], ARGV[6]) then return {-1, 0, 0, 0, 0} end
+local left, idle, dropped = leave_room(from, KEYS[13], ARGV[1], ARGV[2], ARGV[3], ARGV[5])
+local joined, created = join_room(to, ARGV[1], ARGV[2], ARGV[4], ARGV[7], ARGV[8])
+return {joined, created, left, idle, dropped}
+`)
+
+// RoomChange reports what adding or removing a connection did to a room
+type RoomChange struct {
+	Joined  bool // The user joined the room with the connection
+	Left    bool // The user left the room with the connection
+	Created bool // The room's record was created
+	Dropped bool // The room was dropped with its record
+	Idle    bool // The room was left empty to idle until ExpireIdleRooms drops it
+}
+
+func userConnsKey(username string) string       { return "user_conns:" + username }
+func roomConnsKey(room, username string) string { return "room_conns:" + room + ":" + username }
+func userRoomsKey(username string) string       { return "user_rooms:" + username }
+
+// roomConnKeys are the keys of a room as roomConnLua takes them, for a user's connections
+func roomConnKeys(room, username string) []string {
+	return []string{roomConnsKey(room, username), "room:" + room, "all_rooms", roomInfoKey(room), roomRolesKey(room), userRoomsKey(username)}
+}
+
+// AddUserConnection tracks a connection of a user in presence.
+// It reports whether this is the user's first connection.
+func (r *RedisClient) AddUserConnection(ctx context.Context, username, connID string) (bool, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"conn_id":  connID,
+		"action":   "add_user_connection",
+	})
+
+	log.Infof("Adding user connection")
+	first, err := addUserConnScript.Run(ctx, r.client, []string{userConnsKey(username), "active_users"}, username, connID).Int()
+	if err != nil {
+		log.Errorf("Failed to add user connection: %v", err)
+		return false, err
+	}
+	return first == 1, nil
+}
+
+// RemoveUserConnection removes a connection of a user from presence.
+// It reports whether it was the user's last connection.
+func (r *RedisClient) RemoveUserConnection(ctx context.Context, username, connID string) (bool, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"conn_id":  connID,
+		"action":   "remove_user_connection",
+	})
+
+	log.Infof("Removing user connection")
+	last, err := removeUserConnScript.Run(ctx, r.client, []string{userConnsKey(username), "active_users"}, username, connID).Int()
+	if err != nil {
+		log.Errorf("Failed to remove user connection: %v", err)
+		return false, err
+	}
+	return last == 1, nil
+}
+
+// AddRoomConnection adds a connection of a user to a room. New members are only let
+// into a room below its capacity: its own, or limit if it has none; 0 is unlimited.
+// If the room is created, the user becomes its owner when owner is set. It reports
+// whether the user joined the room with this connection and whether the room was
+// created, and returns domain.ErrRoomFull if the room is full.
+func (r *RedisClient) AddRoomConnection(ctx context.Context, room, username, connID string, limit int64, owner bool) (RoomChange, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     room,
+		"username": username,
+		"conn_id":  connID,
+		"action":   "add_room_connection",
+	})
+
+	log.Infof("Adding connection to room")
+	keys := roomConnKeys(room, username)
+	createdAt := time.Now().Format("2006-01-02 15:04:05")
+	ownerFlag := "0"
+	if owner {
+		ownerFlag = "1"
+	}
+	res, err := addRoomConnScript.Run(ctx, r.client, keys, connID, username, room, createdAt, limit, ownerFlag).Int64Slice()
+	if err != nil {
+		log.Errorf("Failed to add connection to room: %v", err)
+		return RoomChange{}, err
+	}
+	if res[0] == -1 {
+		return RoomChange{}, domain.ErrRoomFull
+	}
+	return RoomChange{Joined: res[0] == 1, Created: res[1] == 1}, nil
+}
+
+// RemoveRoomConnection removes a connection of a user from a room. It reports whether
+// the user left the room with this connection. An ad-hoc room left empty is dropped,
+// unless idleTimeout is set: then it stays until ExpireIdleRooms runs that much later.
+func (r *RedisClient) RemoveRoomConnection(ctx context.Context, room, username, connID string, idleTimeout time.Duration) (RoomChange, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     room,
+		"username": username,
+		"conn_id":  connID,
+		"action":   "remove_room_connection",
+	})
+
+	log.Infof("Removing connection from room")
+	keys := append(roomConnKeys(room, username), idleRoomsKey)
+	res, err := removeRoomConnScript.Run(ctx, r.client, keys, connID, username, room, idleDeadline(idleTimeout)).Int64Slice()
+	if err != nil {
+		log.Errorf("Failed to remove connection from room: %v", err)
+		return RoomChange{}, err
+	}
+	return RoomChange{Left: res[0] == 1, Idle: res[1] == 1, Dropped: res[2] == 1}, nil
+}
+
+// SwitchRoomConnection moves a connection of a user from oldRoom to newRoom atomically.
+// oldRoom is left as with RemoveRoomConnection and newRoom joined as with
+// AddRoomConnection; it reports what happened to each. If newRoom is full it returns
+// domain.ErrRoomFull and the connection stays in oldRoom.
+func (r *RedisClient) SwitchRoomConnection(ctx context.Context, oldRoom, newRoom, username, connID string, limit int64, owner bool, idleTimeout time.Duration) (RoomChange, RoomChange, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"old_room": oldRoom,
+		"new_room": newRoom,
+		"username": username,
+		"conn_id":  connID,
+		"action":   "switch_room_connection",
+	})
+
+	log.Infof("Moving connection to another room")
+	keys := append(append(roomConnKeys(oldRoom, username), roomConnKeys(newRoom, username)...), idleRoomsKey)
+	createdAt := time.Now().Format("2006-01-02 15:04:05")
+	ownerFlag := "0"
+	if owner {
+		ownerFlag = "1"
+	}
+	res, err := switchRoomConnScript.Run(ctx, r.client, keys, connID, username, oldRoom, newRoom, idleDeadline(idleTimeout), limit, createdAt, ownerFlag).Int64Slice()
+	if err != nil {
+		log.Errorf("Failed to move connection to another room: %v", err)
+		return RoomChange{}, RoomChange{}, err
+	}
+	if res[0] == -1 {
+		return RoomChange{}, RoomChange{}, domain.ErrRoomFull
+	}
+	left := RoomChange{Left: res[2] == 1, Idle: res[3] == 1, Dropped: res[4] == 1}
+	joined := RoomChange{Joined: res[0] == 1, Created: res[1] == 1}
+	return left, joined, nil
+}
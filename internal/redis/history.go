@@ -0,0 +1,253 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+// messageSeqKey holds the cluster-wide message ID counter
+const messageSeqKey = "message_seq"
+
+// appendHistoryScript stores a message in the room history, adds it to the
+// thread KEYS[3] of root ARGV[4] if given, and trims the history to the most
+// recent ARGV[3] entries in a single round trip. It returns the IDs of the
+// trimmed messages, or nil without storing anything if the root is gone.
+var appendHistoryScript = redis.NewScript(`
+if KEYS[3] and redis.call('HEXISTS', KEYS[2], ARGV[4]) == 0 then return nil end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+if KEYS[3] then
+	redis.call('ZADD', KEYS[3], ARGV[1], ARGV[1])
+end
+local stale = redis.call('ZRANGE', KEYS[1], 0, -tonumber(ARGV[3]) - 1)
+if #stale > 0 then
+	redis.call('ZREM', KEYS[1], unpack(stale))
+	redis.call('HDEL', KEYS[2], unpack(stale))
+end
+return stale
+`)
+
+func historyKey(room string) string  { return "history:" + room }
+func messagesKey(room string) string { return "messages:" + room }
+
+// AppendHistory assigns the message a cluster-wide, ordered ID and stores it
+// in the room history, keeping at most limit messages per room. Replies return
+// domain.ErrMessageNotFound if the root of their thread is no longer stored.
+func (r *RedisClient) AppendHistory(ctx context.Context, msg domain.ChatMessage, limit int) (domain.ChatMessage, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":   msg.Room,
+		"action": "append_history",
+	})
+
+	seq, err := r.client.Incr(ctx, messageSeqKey).Result()
+	if err != nil {
+		log.Errorf("Failed to allocate message ID: %v", err)
+		return msg, err
+	}
+	msg.ID = strconv.FormatInt(seq, 10)
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("Failed to marshal message: %v", err)
+		return msg, err
+	}
+
+	log.Infof("Appending message %s to history", msg.ID)
+	keys := []string{historyKey(msg.Room), messagesKey(msg.Room)}
+	if msg.ThreadID != "" {
+		keys = append(keys, threadKey(msg.Room, msg.ThreadID))
+	}
+	stale, err := appendHistoryScript.Run(ctx, r.client, keys, msg.ID, data, limit, msg.ThreadID).StringSlice()
+	if err == redis.Nil {
+		return msg, domain.ErrMessageNotFound
+	}
+	if err != nil {
+		log.Errorf("Failed to append message to history: %v", err)
+		return msg, err
+	}
+
+	// Reactions and threads of trimmed messages are dropped with them
+	if len(stale) > 0 {
+		staleKeys := make([]string, 0, 3*len(stale))
+		for _, id := range stale {
+			staleKeys = append(staleKeys, reactionsKey(msg.Room, id), reactorsKey(msg.Room, id), threadKey(msg.Room, id))
+		}
+		if err := r.client.Del(ctx, staleKeys...).Err(); err != nil {
+			log.Errorf("Failed to drop details of trimmed messages: %v", err)
+		}
+	}
+	return msg, nil
+}
+
+// HistorySince returns up to limit messages of a room with an ID greater than afterID, oldest first.
+func (r *RedisClient) HistorySince(ctx context.Context, room, afterID string, limit int) ([]domain.ChatMessage, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     room,
+		"after_id": afterID,
+		"action":   "history_since",
+	})
+
+	min := "-inf"
+	if afterID != "" {
+		min = "(" + afterID
+	}
+
+	log.Infof("Retrieving room history")
+	ids, err := r.client.ZRangeByScore(ctx, historyKey(room), &redis.ZRangeBy{
+		Min:   min,
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		log.Errorf("Failed to retrieve history IDs: %v", err)
+		return nil, err
+	}
+	return r.loadMessages(ctx, room, ids)
+}
+
+// HistoryBefore returns up to limit of the most recent messages of a room with an ID
+// lower than beforeID, or the most recent ones if beforeID is empty, oldest first.
+func (r *RedisClient) HistoryBefore(ctx context.Context, room, beforeID string, limit int) ([]domain.ChatMessage, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":      room,
+		"before_id": beforeID,
+		"action":    "history_before",
+	})
+
+	max := "+inf"
+	if beforeID != "" {
+		max = "(" + beforeID
+	}
+
+	log.Infof("Retrieving room history")
+	ids, err := r.client.ZRevRangeByScore(ctx, historyKey(room), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   max,
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		log.Errorf("Failed to retrieve history IDs: %v", err)
+		return nil, err
+	}
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return r.loadMessages(ctx, room, ids)
+}
+
+// GetMessage returns a stored message of a room, or domain.ErrMessageNotFound
+func (r *RedisClient) GetMessage(ctx context.Context, room, messageID string) (domain.ChatMessage, error) {
+	messages, err := r.loadMessages(ctx, room, []string{messageID})
+	if err != nil {
+		return domain.ChatMessage{}, err
+	}
+	if len(messages) == 0 {
+		return domain.ChatMessage{}, domain.ErrMessageNotFound
+	}
+	return messages[0], nil
+}
+
+// CurrentMessageID returns the ID of the most recently stored message, or "0" if there is none.
+func (r *RedisClient) CurrentMessageID(ctx context.Context) (string, error) {
+	id, err := r.client.Get(ctx, messageSeqKey).Result()
+	if err == redis.Nil {
+		return "0", nil
+	}
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to read message sequence: %v", err)
+		return "", err
+	}
+	return id, nil
+}
+
+// updateMessageRetries bounds how often UpdateMessage retries after a concurrent write
+const updateMessageRetries = 5
+
+// UpdateMessage applies update to a stored message of a room and stores the result.
+// It returns domain.ErrMessageNotFound if the message is not (or no longer) in the history,
+// and any error returned by update without storing anything.
+func (r *RedisClient) UpdateMessage(ctx context.Context, room, messageID string, update func(*domain.ChatMessage) error) (domain.ChatMessage, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":       room,
+		"message_id": messageID,
+		"action":     "update_message",
+	})
+
+	key := messagesKey(room)
+	var updated domain.ChatMessage
+	txf := func(tx *redis.Tx) error {
+		data, err := tx.HGet(ctx, key, messageID).Result()
+		if err == redis.Nil {
+			return domain.ErrMessageNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg domain.ChatMessage
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			return err
+		}
+		if err := update(&msg); err != nil {
+			return err
+		}
+		newData, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, messageID, newData)
+			return nil
+		})
+		updated = msg
+		return err
+	}
+
+	log.Infof("Updating stored message")
+	for i := 0; i < updateMessageRetries; i++ {
+		err := r.client.Watch(ctx, txf, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to update message: %v", err)
+			return domain.ChatMessage{}, err
+		}
+		return updated, nil
+	}
+	log.Errorf("Failed to update message: too much contention")
+	return domain.ChatMessage{}, redis.TxFailedErr
+}
+
+// loadMessages fetches stored messages by ID, skipping any that were trimmed meanwhile
+func (r *RedisClient) loadMessages(ctx context.Context, room string, ids []string) ([]domain.ChatMessage, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	values, err := r.client.HMGet(ctx, messagesKey(room), ids...).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to load messages: %v", err)
+		return nil, err
+	}
+
+	messages := make([]domain.ChatMessage, 0, len(values))
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var msg domain.ChatMessage
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			r.logger.WithContext(ctx).Errorf("Failed to unmarshal stored message: %v", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+// redeemInviteScript uses up one redemption of invite token KEYS[1] for room ARGV[1] and
+// adds user ARGV[2] to the room's allowlist. Users on the allowlist already use nothing up.
+// Used-up tokens are kept until they expire, so a redemption can be returned.
+// Returns 0 if the token is unknown, expired, used up or for another room, 1 if the
+// user was allowed already and 2 if a redemption was used up.
+var redeemInviteScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'room') ~= ARGV[1] then return 0 end
+if redis.call('SISMEMBER', KEYS[2], ARGV[2]) == 1 then return 1 end
+local max = tonumber(redis.call('HGET', KEYS[1], 'max_uses')) or 0
+local uses = tonumber(redis.call('HGET', KEYS[1], 'uses')) or 0
+if max > 0 and uses >= max then return 0 end
+redis.call('HINCRBY', KEYS[1], 'uses', 1)
+redis.call('SADD', KEYS[2], ARGV[2])
+return 2
+`)
+
+// returnInviteScript takes user ARGV[1] off the allowlist KEYS[2] and gives the
+// redemption back to invite token KEYS[1], if it has not expired meanwhile
+var returnInviteScript = redis.NewScript(`
+if redis.call('SREM', KEYS[2], ARGV[1]) == 0 then return 0 end
+if redis.call('EXISTS', KEYS[1]) == 1 then redis.call('HINCRBY', KEYS[1], 'uses', -1) end
+return 1
+`)
+
+func inviteKey(token string) string     { return "invite:" + token }
+func roomAllowedKey(room string) string { return "room_allowed:" + room }
+
+// AllowRoomMember adds a user to the allowlist of a private or invite-only room
+func (r *RedisClient) AllowRoomMember(ctx context.Context, room, username string) error {
+	if err := r.client.SAdd(ctx, roomAllowedKey(room), username).Err(); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to allow room member: %v", err)
+		return err
+	}
+	return nil
+}
+
+// IsRoomAllowed reports whether a user is on the allowlist of a private or invite-only room
+func (r *RedisClient) IsRoomAllowed(ctx context.Context, room, username string) (bool, error) {
+	allowed, err := r.client.SIsMember(ctx, roomAllowedKey(room), username).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to check room allowlist: %v", err)
+		return false, err
+	}
+	return allowed, nil
+}
+
+// CreateInvite stores an invite token for a room that expires after ttl.
+// maxUses limits how often it can be redeemed; 0 means unlimited.
+func (r *RedisClient) CreateInvite(ctx context.Context, token, room, createdBy string, maxUses int64, ttl time.Duration) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":       room,
+		"created_by": createdBy,
+		"action":     "create_invite",
+	})
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, inviteKey(token), "room", room, "created_by", createdBy, "max_uses", maxUses, "uses", 0)
+		pipe.Expire(ctx, inviteKey(token), ttl)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to create invite: %v", err)
+		return err
+	}
+	return nil
+}
+
+// RedeemInvite uses an invite token to put a user on the room's allowlist. It reports
+// whether a redemption was used up, which ReturnInvite can give back, and returns
+// domain.ErrInviteInvalid if the token cannot be used for the room.
+func (r *RedisClient) RedeemInvite(ctx context.Context, token, room, username string) (bool, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     room,
+		"username": username,
+		"action":   "redeem_invite",
+	})
+
+	redeemed, err := redeemInviteScript.Run(ctx, r.client, []string{inviteKey(token), roomAllowedKey(room)}, room, username).Int()
+	if err != nil {
+		log.Errorf("Failed to redeem invite: %v", err)
+		return false, err
+	}
+	if redeemed == 0 {
+		return false, domain.ErrInviteInvalid
+	}
+	return redeemed == 2, nil
+}
+
+// ReturnInvite undoes a redemption of an invite token: the user leaves the room's
+// allowlist and the token can be used once more
+func (r *RedisClient) ReturnInvite(ctx context.Context, token, room, username string) error {
+	if err := returnInviteScript.Run(ctx, r.client, []string{inviteKey(token), roomAllowedKey(room)}, username).Err(); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to return invite: %v", err)
+		return err
+	}
+	return nil
+}
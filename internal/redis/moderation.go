@@ -0,0 +1,67 @@
+package redis
+
+import (
+	"context"
+	"time"
+)
+
+func roomBanKey(room, username string) string  { return "room_ban:" + room + ":" + username }
+func roomMuteKey(room, username string) string { return "room_mute:" + room + ":" + username }
+
+// BanUser bans a user from a room for ttl, or until lifted if ttl is 0
+func (r *RedisClient) BanUser(ctx context.Context, room, username, reason string, ttl time.Duration) error {
+	if err := r.client.Set(ctx, roomBanKey(room, username), reason, ttl).Err(); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to ban user: %v", err)
+		return err
+	}
+	return nil
+}
+
+// IsBanned reports whether a user is banned from a room
+func (r *RedisClient) IsBanned(ctx context.Context, room, username string) (bool, error) {
+	n, err := r.client.Exists(ctx, roomBanKey(room, username)).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to check ban: %v", err)
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// MuteUser stops a user from posting to a room for ttl
+func (r *RedisClient) MuteUser(ctx context.Context, room, username string, ttl time.Duration) error {
+	if err := r.client.Set(ctx, roomMuteKey(room, username), 1, ttl).Err(); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to mute user: %v", err)
+		return err
+	}
+	return nil
+}
+
+// IsMuted reports whether a user is muted in a room
+func (r *RedisClient) IsMuted(ctx context.Context, room, username string) (bool, error) {
+	n, err := r.client.Exists(ctx, roomMuteKey(room, username)).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to check mute: %v", err)
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// UnbanUser lifts a user's ban from a room. It reports whether the user was banned.
+func (r *RedisClient) UnbanUser(ctx context.Context, room, username string) (bool, error) {
+	n, err := r.client.Del(ctx, roomBanKey(room, username)).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to unban user: %v", err)
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// UnmuteUser lifts a user's mute in a room. It reports whether the user was muted.
+func (r *RedisClient) UnmuteUser(ctx context.Context, room, username string) (bool, error) {
+	n, err := r.client.Del(ctx, roomMuteKey(room, username)).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to unmute user: %v", err)
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,181 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Every server is a node. While it runs it keeps node:<id> alive and records its
+// connections in node_conns:<id>, so that once its heartbeat lapses the other nodes
+// can clean up after the connections it never closed.
+
+// takeNodeConnScript takes connection ARGV[1] off node ARGV[2] in KEYS[1] and deletes
+// its session ARGV[3] in KEYS[2], unless it is on another node, and its entry in the
+// user's sessions in KEYS[3]. Returns 0 if the connection moved to another node.
+var takeNodeConnScript = redis.NewScript(`
+if redis.call('HDEL', KEYS[1], ARGV[1]) == 0 then return 0 end
+local node = redis.call('HGET', KEYS[2], 'node')
+if node and node ~= ARGV[2] then return 1 end
+redis.call('DEL', KEYS[2])
+redis.call('SREM', KEYS[3], ARGV[3])
+return 1
+`)
+
+const nodesKey = "nodes"
+
+func nodeKey(node string) string      { return "node:" + node }
+func nodeConnsKey(node string) string { return "node_conns:" + node }
+func nodeSweepKey(node string) string { return "node_sweep:" + node }
+
+// NodeConn is a connection recorded under the node serving it
+type NodeConn struct {
+	ConnID   string
+	Token    string // Token of the connection's session
+	Username string
+}
+
+// nodeConnValue is how a connection's session and user are stored under its node.
+// Tokens contain no spaces.
+func nodeConnValue(token, username string) string { return token + " " + username }
+
+// Heartbeat marks a node alive for ttl
+func (r *RedisClient) Heartbeat(ctx context.Context, node string, ttl time.Duration) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, nodesKey, node)
+		pipe.Set(ctx, nodeKey(node), 1, ttl)
+		return nil
+	})
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to record node heartbeat: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ExpiredNodes returns the nodes whose heartbeat has lapsed
+func (r *RedisClient) ExpiredNodes(ctx context.Context) ([]string, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"action": "expired_nodes",
+	})
+
+	nodes, err := r.client.SMembers(ctx, nodesKey).Result()
+	if err != nil {
+		log.Errorf("Failed to list nodes: %v", err)
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	pipe := r.client.Pipeline()
+	alive := make([]*redis.IntCmd, len(nodes))
+	for i, node := range nodes {
+		alive[i] = pipe.Exists(ctx, nodeKey(node))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to check nodes: %v", err)
+		return nil, err
+	}
+
+	var expired []string
+	for i, node := range nodes {
+		if alive[i].Val() == 0 {
+			expired = append(expired, node)
+		}
+	}
+	return expired, nil
+}
+
+// ClaimNodeSweep reserves cleaning up after an expired node for ttl, so only one
+// node sweeps it at a time. It reports whether the sweep was reserved.
+func (r *RedisClient) ClaimNodeSweep(ctx context.Context, node string, ttl time.Duration) (bool, error) {
+	claimed, err := r.client.SetNX(ctx, nodeSweepKey(node), 1, ttl).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to claim sweep of node %s: %v", node, err)
+		return false, err
+	}
+	return claimed, nil
+}
+
+// NodeConnections returns the connections recorded under a node
+func (r *RedisClient) NodeConnections(ctx context.Context, node string) ([]NodeConn, error) {
+	fields, err := r.client.HGetAll(ctx, nodeConnsKey(node)).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to list connections of node %s: %v", node, err)
+		return nil, err
+	}
+	conns := make([]NodeConn, 0, len(fields))
+	for connID, value := range fields {
+		token, username, _ := strings.Cut(value, " ")
+		conns = append(conns, NodeConn{ConnID: connID, Token: token, Username: username})
+	}
+	return conns, nil
+}
+
+// TakeNodeConnection takes a connection off an expired node and deletes its session,
+// leaving its presence and rooms to the caller. It reports false if the session was
+// resumed on another node meanwhile.
+func (r *RedisClient) TakeNodeConnection(ctx context.Context, node string, conn NodeConn) (bool, error) {
+	keys := []string{nodeConnsKey(node), sessionKey(conn.Token), userSessionsKey(conn.Username)}
+	taken, err := takeNodeConnScript.Run(ctx, r.client, keys, conn.ConnID, node, conn.Token).Int()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to take connection off node %s: %v", node, err)
+		return false, err
+	}
+	return taken == 1, nil
+}
+
+// UntrackConnection forgets a connection of a node once it is cleaned up
+func (r *RedisClient) UntrackConnection(ctx context.Context, node, connID string) error {
+	if node == "" {
+		return nil
+	}
+	if err := r.client.HDel(ctx, nodeConnsKey(node), connID).Err(); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to untrack connection: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ForgetNode drops an expired node whose connections have all been cleaned up
+func (r *RedisClient) ForgetNode(ctx context.Context, node string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, nodesKey, node)
+		pipe.Del(ctx, nodeConnsKey(node), nodeSweepKey(node))
+		return nil
+	})
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to forget node %s: %v", node, err)
+		return err
+	}
+	return nil
+}
+
+// ConnectionRooms returns the rooms a connection of a user is in
+func (r *RedisClient) ConnectionRooms(ctx context.Context, username, connID string) ([]string, error) {
+	rooms, err := r.UserRooms(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	pipe := r.client.Pipeline()
+	in := make([]*redis.BoolCmd, len(rooms))
+	for i, room := range rooms {
+		in[i] = pipe.SIsMember(ctx, roomConnsKey(room, username), connID)
+	}
+	if len(rooms) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			r.logger.WithContext(ctx).Errorf("Failed to check rooms of connection: %v", err)
+			return nil, err
+		}
+	}
+
+	var joined []string
+	for i, room := range rooms {
+		if in[i].Val() {
+			joined = append(joined, room)
+		}
+	}
+	return joined, nil
+}
@@ -0,0 +1,248 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+// announcePresenceScript records ARGV[1] as the presence last announced for a user;
+// offline users, sent empty, are not kept. Returns 1 if it differs from the previous one.
+var announcePresenceScript = redis.NewScript(`
+local prev = redis.call('GET', KEYS[1]) or ''
+if prev == ARGV[1] then return 0 end
+if ARGV[1] == '' then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// setSessionIdleScript marks a session idle or active if it still exists
+var setSessionIdleScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+if ARGV[1] == '1' then
+	redis.call('HSET', KEYS[1], 'idle', '1')
+else
+	redis.call('HDEL', KEYS[1], 'idle')
+end
+return 1
+`)
+
+func presenceKey(username string) string   { return "presence:" + username }
+func userStatusKey(username string) string { return "user_status:" + username }
+
+// SetUserStatus stores the status and custom text a user chose, replacing the previous
+// ones. They lapse after ttl unless it is zero. Online without text just clears them.
+func (r *RedisClient) SetUserStatus(ctx context.Context, username, status, text string, ttl time.Duration) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"status":   status,
+		"action":   "set_user_status",
+	})
+
+	key := userStatusKey(username)
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		if status == domain.PresenceOnline && text == "" {
+			return nil
+		}
+		fields := []interface{}{"status", status, "text", text}
+		if ttl > 0 {
+			fields = append(fields, "expires_at", time.Now().Add(ttl).Format("2006-01-02 15:04:05"))
+		}
+		pipe.HSet(ctx, key, fields...)
+		if ttl > 0 {
+			pipe.PExpire(ctx, key, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to set user status: %v", err)
+		return err
+	}
+	return nil
+}
+
+// SetSessionIdle marks a session idle, so its user turns away once all their
+// attached sessions are, or active again
+func (r *RedisClient) SetSessionIdle(ctx context.Context, token string, idle bool) error {
+	flag := "0"
+	if idle {
+		flag = "1"
+	}
+	if err := setSessionIdleScript.Run(ctx, r.client, []string{sessionKey(token)}, flag).Err(); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to mark session idle: %v", err)
+		return err
+	}
+	return nil
+}
+
+// UserPresence returns the presence of a user. Without connections they are offline.
+// Otherwise a status they chose with its text applies, or else they are away if all
+// their sessions are detached or idle and online if not.
+func (r *RedisClient) UserPresence(ctx context.Context, username string) (domain.Presence, error) {
+	presences, err := r.UserPresences(ctx, []string{username})
+	if err != nil {
+		return domain.Presence{}, err
+	}
+	return presences[0], nil
+}
+
+// UserPresences returns the presence of each user as with UserPresence, in the same
+// order, in two pipelined round trips however many users there are
+func (r *RedisClient) UserPresences(ctx context.Context, usernames []string) ([]domain.Presence, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"users":  len(usernames),
+		"action": "user_presences",
+	})
+
+	pipe := r.client.Pipeline()
+	active := make([]*redis.BoolCmd, len(usernames))
+	chosen := make([]*redis.MapStringStringCmd, len(usernames))
+	tokens := make([]*redis.StringSliceCmd, len(usernames))
+	for i, username := range usernames {
+		active[i] = pipe.SIsMember(ctx, "active_users", username)
+		chosen[i] = pipe.HGetAll(ctx, userStatusKey(username))
+		tokens[i] = pipe.SMembers(ctx, userSessionsKey(username))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to read user presences: %v", err)
+		return nil, err
+	}
+
+	presences := make([]domain.Presence, len(usernames))
+	states := make([][]*redis.SliceCmd, len(usernames))
+	pipe = r.client.Pipeline()
+	for i, username := range usernames {
+		presences[i] = domain.Presence{Username: username, Status: domain.PresenceOffline}
+		if !active[i].Val() {
+			continue
+		}
+		status := chosen[i].Val()
+		presences[i].Text = status["text"]
+		presences[i].ExpiresAt = status["expires_at"]
+		switch status["status"] {
+		case domain.PresenceAway, domain.PresenceBusy, domain.PresenceInvisible:
+			presences[i].Status = status["status"]
+			continue
+		}
+		presences[i].Status = domain.PresenceOnline
+		for _, token := range tokens[i].Val() {
+			states[i] = append(states[i], pipe.HMGet(ctx, sessionKey(token), "state", "idle"))
+		}
+	}
+	if pipe.Len() == 0 {
+		return presences, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.Errorf("Failed to read session states: %v", err)
+		return nil, err
+	}
+
+	for i := range presences {
+		for _, state := range states[i] {
+			fields := state.Val()
+			if len(fields) < 2 || fields[0] == nil {
+				continue
+			}
+			if fields[0] == sessionAttached && fields[1] == nil {
+				presences[i].Status = domain.PresenceOnline
+				break
+			}
+			presences[i].Status = domain.PresenceAway
+		}
+	}
+	return presences, nil
+}
+
+// IsInvisible reports whether a user chose to appear offline
+func (r *RedisClient) IsInvisible(ctx context.Context, username string) (bool, error) {
+	status, err := r.client.HGet(ctx, userStatusKey(username), "status").Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to read user status: %v", err)
+		return false, err
+	}
+	return status == domain.PresenceInvisible, nil
+}
+
+// InvisibleMembers returns the members of each room who chose to appear offline
+func (r *RedisClient) InvisibleMembers(ctx context.Context, rooms []string) (map[string][]string, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"rooms":  len(rooms),
+		"action": "invisible_members",
+	})
+	if len(rooms) == 0 {
+		return nil, nil
+	}
+
+	pipe := r.client.Pipeline()
+	members := make([]*redis.StringSliceCmd, len(rooms))
+	for i, room := range rooms {
+		members[i] = pipe.SMembers(ctx, "room:"+room)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to list room members: %v", err)
+		return nil, err
+	}
+
+	statuses := make(map[string]*redis.StringCmd)
+	pipe = r.client.Pipeline()
+	for _, cmd := range members {
+		for _, username := range cmd.Val() {
+			if _, ok := statuses[username]; !ok {
+				statuses[username] = pipe.HGet(ctx, userStatusKey(username), "status")
+			}
+		}
+	}
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.Errorf("Failed to read member statuses: %v", err)
+		return nil, err
+	}
+
+	invisible := make(map[string][]string)
+	for i, room := range rooms {
+		for _, username := range members[i].Val() {
+			if statuses[username].Val() == domain.PresenceInvisible {
+				invisible[room] = append(invisible[room], username)
+			}
+		}
+	}
+	return invisible, nil
+}
+
+// AnnouncePresence records presence as the last one announced for a user.
+// It reports whether it changed since the previous announcement.
+func (r *RedisClient) AnnouncePresence(ctx context.Context, presence domain.Presence) (bool, error) {
+	var announced string
+	if presence.Status != domain.PresenceOffline {
+		announced = strings.Join([]string{presence.Status, presence.Text, presence.ExpiresAt}, "\n")
+	}
+	changed, err := announcePresenceScript.Run(ctx, r.client, []string{presenceKey(presence.Username)}, announced).Int()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to record presence of %s: %v", presence.Username, err)
+		return false, err
+	}
+	return changed == 1, nil
+}
+
+// UserRooms returns the rooms a user is a member of, from the index the room
+// connection scripts keep of each user's rooms
+func (r *RedisClient) UserRooms(ctx context.Context, username string) ([]string, error) {
+	rooms, err := r.client.SMembers(ctx, userRoomsKey(username)).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to list rooms of user: %v", err)
+		return nil, err
+	}
+	return rooms, nil
+}
@@ -0,0 +1,149 @@
+package redis
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+// addReactionScript records that ARGV[3] reacted with ARGV[2] to stored message ARGV[1].
+// Returns -1 if the message is not stored or was deleted, otherwise 1 if the reaction is new.
+var addReactionScript = redis.NewScript(`
+local data = redis.call('HGET', KEYS[1], ARGV[1])
+if not data or cjson.decode(data).deleted then return -1 end
+if redis.call('SADD', KEYS[3], ARGV[2] .. ' ' .. ARGV[3]) == 0 then return 0 end
+redis.call('HINCRBY', KEYS[2], ARGV[2], 1)
+return 1
+`)
+
+// removeReactionScript takes back a reaction. Returns 1 if there was one.
+var removeReactionScript = redis.NewScript(`
+if redis.call('SREM', KEYS[2], ARGV[1] .. ' ' .. ARGV[2]) == 0 then return 0 end
+if redis.call('HINCRBY', KEYS[1], ARGV[1], -1) <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// Tallies per emoji, and the set of "<emoji> <username>" entries behind them
+func reactionsKey(room, messageID string) string { return "reactions:" + room + ":" + messageID }
+func reactorsKey(room, messageID string) string  { return "reactors:" + room + ":" + messageID }
+
+// AddReaction records a user's emoji reaction to a stored message.
+// It reports whether the reaction is new, and returns domain.ErrMessageNotFound
+// if the message is not in the room's history or was deleted.
+func (r *RedisClient) AddReaction(ctx context.Context, room, messageID, emoji, username string) (bool, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":       room,
+		"message_id": messageID,
+		"username":   username,
+		"action":     "add_reaction",
+	})
+
+	keys := []string{messagesKey(room), reactionsKey(room, messageID), reactorsKey(room, messageID)}
+	added, err := addReactionScript.Run(ctx, r.client, keys, messageID, emoji, username).Int()
+	if err != nil {
+		log.Errorf("Failed to add reaction: %v", err)
+		return false, err
+	}
+	if added < 0 {
+		return false, domain.ErrMessageNotFound
+	}
+	return added == 1, nil
+}
+
+// RemoveReaction takes back a user's emoji reaction. It reports whether there was one.
+func (r *RedisClient) RemoveReaction(ctx context.Context, room, messageID, emoji, username string) (bool, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":       room,
+		"message_id": messageID,
+		"username":   username,
+		"action":     "remove_reaction",
+	})
+
+	keys := []string{reactionsKey(room, messageID), reactorsKey(room, messageID)}
+	removed, err := removeReactionScript.Run(ctx, r.client, keys, emoji, username).Int()
+	if err != nil {
+		log.Errorf("Failed to remove reaction: %v", err)
+		return false, err
+	}
+	return removed == 1, nil
+}
+
+// ClearReactions drops every reaction to a message
+func (r *RedisClient) ClearReactions(ctx context.Context, room, messageID string) error {
+	if err := r.client.Del(ctx, reactionsKey(room, messageID), reactorsKey(room, messageID)).Err(); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to clear reactions: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Reactions returns the reaction tallies of messages keyed by message ID, most used first.
+// Reacted is set on the emojis username reacted with; pass "" to leave it unset.
+func (r *RedisClient) Reactions(ctx context.Context, room string, messageIDs []string, username string) (map[string][]domain.Reaction, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":   room,
+		"action": "reactions",
+	})
+
+	result := make(map[string][]domain.Reaction, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	pipe := r.client.Pipeline()
+	tallies := make([]*redis.MapStringStringCmd, len(messageIDs))
+	for i, id := range messageIDs {
+		tallies[i] = pipe.HGetAll(ctx, reactionsKey(room, id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to load reactions: %v", err)
+		return nil, err
+	}
+
+	// One membership check per emoji on each message
+	reacted := make(map[string]map[string]*redis.BoolCmd)
+	if username != "" {
+		pipe = r.client.Pipeline()
+		for i, id := range messageIDs {
+			for emoji := range tallies[i].Val() {
+				if reacted[id] == nil {
+					reacted[id] = make(map[string]*redis.BoolCmd)
+				}
+				reacted[id][emoji] = pipe.SIsMember(ctx, reactorsKey(room, id), emoji+" "+username)
+			}
+		}
+		if len(reacted) > 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				log.Errorf("Failed to load own reactions: %v", err)
+				return nil, err
+			}
+		}
+	}
+
+	for i, id := range messageIDs {
+		tally := tallies[i].Val()
+		if len(tally) == 0 {
+			continue
+		}
+
+		reactions := make([]domain.Reaction, 0, len(tally))
+		for emoji, count := range tally {
+			n, _ := strconv.ParseInt(count, 10, 64)
+			own, checked := reacted[id][emoji]
+			reactions = append(reactions, domain.Reaction{Emoji: emoji, Count: n, Reacted: checked && own.Val()})
+		}
+		sort.Slice(reactions, func(a, b int) bool {
+			if reactions[a].Count != reactions[b].Count {
+				return reactions[a].Count > reactions[b].Count
+			}
+			return reactions[a].Emoji < reactions[b].Emoji
+		})
+		result[id] = reactions
+	}
+	return result, nil
+}
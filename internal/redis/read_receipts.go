@@ -0,0 +1,102 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// markReadScript moves the user's read marker of a room forward, but never
+// past the newest message ID. Returns 1 if the marker moved.
+var markReadScript = redis.NewScript(`
+local id = tonumber(ARGV[2])
+if not id then return 0 end
+local newest = tonumber(redis.call('GET', KEYS[2]) or '0') or 0
+if id > newest then return 0 end
+local current = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0') or 0
+if id <= current then return 0 end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// initLastReadScript starts a read marker at the newest message if the user has none for the room
+var initLastReadScript = redis.NewScript(`
+return redis.call('HSETNX', KEYS[1], ARGV[1], redis.call('GET', KEYS[2]) or '0')
+`)
+
+func lastReadKey(username string) string { return "last_read:" + username }
+
+// MarkRead records messageID as the last message the user has read in room.
+// It reports whether the read marker moved forward.
+func (r *RedisClient) MarkRead(ctx context.Context, username, room, messageID string) (bool, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username":   username,
+		"room":       room,
+		"message_id": messageID,
+		"action":     "mark_read",
+	})
+
+	moved, err := markReadScript.Run(ctx, r.client, []string{lastReadKey(username), messageSeqKey}, room, messageID).Int()
+	if err != nil {
+		log.Errorf("Failed to mark message as read: %v", err)
+		return false, err
+	}
+	return moved == 1, nil
+}
+
+// InitLastRead starts the user's read marker of a room at the newest message,
+// so history from before the user first joined does not count as unread.
+func (r *RedisClient) InitLastRead(ctx context.Context, username, room string) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"room":     room,
+		"action":   "init_last_read",
+	})
+
+	if err := initLastReadScript.Run(ctx, r.client, []string{lastReadKey(username), messageSeqKey}, room).Err(); err != nil {
+		log.Errorf("Failed to initialize read marker: %v", err)
+		return err
+	}
+	return nil
+}
+
+// UnreadCounts returns the number of stored messages after the user's read marker for each room.
+// Rooms the user has no read marker for have no unread messages.
+func (r *RedisClient) UnreadCounts(ctx context.Context, username string, rooms []string) (map[string]int64, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"action":   "unread_counts",
+	})
+
+	counts := make(map[string]int64, len(rooms))
+	if len(rooms) == 0 {
+		return counts, nil
+	}
+
+	markers, err := r.client.HMGet(ctx, lastReadKey(username), rooms...).Result()
+	if err != nil {
+		log.Errorf("Failed to read read markers: %v", err)
+		return nil, err
+	}
+
+	pipe := r.client.Pipeline()
+	cmds := make(map[string]*redis.IntCmd, len(rooms))
+	for i, room := range rooms {
+		lastRead, ok := markers[i].(string)
+		if !ok {
+			counts[room] = 0
+			continue
+		}
+		cmds[room] = pipe.ZCount(ctx, historyKey(room), "("+lastRead, "+inf")
+	}
+	if len(cmds) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Errorf("Failed to count unread messages: %v", err)
+			return nil, err
+		}
+	}
+	for room, cmd := range cmds {
+		counts[room] = cmd.Val()
+	}
+	return counts, nil
+}
@@ -0,0 +1,56 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+func roomRolesKey(room string) string { return "room_roles:" + room }
+
+// GetRoomRole returns a user's role in a room; users without one are members
+func (r *RedisClient) GetRoomRole(ctx context.Context, room, username string) (string, error) {
+	role, err := r.client.HGet(ctx, roomRolesKey(room), username).Result()
+	if err == redis.Nil {
+		return domain.RoleMember, nil
+	}
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to get room role: %v", err)
+		return "", err
+	}
+	return role, nil
+}
+
+// GetRoomRoles returns the users of a room with a role other than member
+func (r *RedisClient) GetRoomRoles(ctx context.Context, room string) (map[string]string, error) {
+	roles, err := r.client.HGetAll(ctx, roomRolesKey(room)).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to get room roles: %v", err)
+		return nil, err
+	}
+	return roles, nil
+}
+
+// SetRoomRole gives a user a role in a room. Members are not stored, so setting
+// the member role removes any other.
+func (r *RedisClient) SetRoomRole(ctx context.Context, room, username, role string) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     room,
+		"username": username,
+		"role":     role,
+		"action":   "set_room_role",
+	})
+
+	var err error
+	if role == domain.RoleMember {
+		err = r.client.HDel(ctx, roomRolesKey(room), username).Err()
+	} else {
+		err = r.client.HSet(ctx, roomRolesKey(room), username, role).Err()
+	}
+	if err != nil {
+		log.Errorf("Failed to set room role: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+// setRoomFieldScript sets a field of an existing room record. Returns 0 if there is no record.
+var setRoomFieldScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// createRoomScript makes a room persistent, creating its record if needed and taking
+// over an ad-hoc room of the same name, and sets its visibility, password hash,
+// whether it is announcement-only and its capacity.
+// The room's creator is its owner. Returns 0 if the room is already persistent.
+var createRoomScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'persistent') == '1' then return 0 end
+redis.call('HSET', KEYS[1], 'persistent', '1')
+redis.call('HSETNX', KEYS[1], 'created_by', ARGV[2])
+redis.call('HSETNX', KEYS[1], 'created_at', ARGV[3])
+local creator = redis.call('HGET', KEYS[1], 'created_by')
+if creator ~= '' then redis.call('HSETNX', KEYS[5], creator, 'owner') end
+if ARGV[4] ~= '' then redis.call('HSET', KEYS[1], 'topic', ARGV[4]) end
+if ARGV[5] ~= '' then redis.call('HSET', KEYS[1], 'description', ARGV[5]) end
+redis.call('HSET', KEYS[1], 'visibility', ARGV[6], 'password_hash', ARGV[7], 'announcement_only', ARGV[8], 'max_members', ARGV[9])
+redis.call('SADD', KEYS[2], ARGV[1])
+return 1
+`)
+
+// deleteRoomScript turns a persistent room back into a public ad-hoc one, dropping
+// it right away if it has no members. Returns 0 if the room is not persistent,
+// 2 if it was dropped.
+var deleteRoomScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'persistent') ~= '1' then return 0 end
+redis.call('HDEL', KEYS[1], 'persistent', 'visibility', 'password_hash', 'announcement_only', 'max_members')
+redis.call('DEL', KEYS[4])
+if redis.call('SCARD', KEYS[3]) > 0 then return 1 end
+redis.call('SREM', KEYS[2], ARGV[1])
+redis.call('DEL', KEYS[1], KEYS[5])
+return 2
+`)
+
+// expireRoomScript takes a room whose idle deadline in the idle_rooms set KEYS[6] is not
+// after ARGV[2] out of the set, and drops it if it is still an empty ad-hoc room.
+// A room that idled again since has a later deadline and is left alone.
+// Returns 1 if the room was dropped.
+var expireRoomScript = redis.NewScript(`
+local deadline = redis.call('ZSCORE', KEYS[6], ARGV[1])
+if not deadline or tonumber(deadline) > tonumber(ARGV[2]) then return 0 end
+redis.call('ZREM', KEYS[6], ARGV[1])
+if redis.call('SCARD', KEYS[3]) > 0 or redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+if redis.call('HGET', KEYS[1], 'persistent') == '1' then return 0 end
+redis.call('SREM', KEYS[2], ARGV[1])
+redis.call('DEL', KEYS[1], KEYS[5])
+return 1
+`)
+
+// slowModeScript starts the cooldown KEYS[2] of a user in room KEYS[1] if the room is in
+// slow mode and the user is not cooling down already. Returns the milliseconds left
+// of the user's cooldown, 0 if they may post.
+var slowModeScript = redis.NewScript(`
+local seconds = tonumber(redis.call('HGET', KEYS[1], 'slow_mode') or '0') or 0
+if seconds <= 0 then return 0 end
+if redis.call('SET', KEYS[2], '1', 'EX', seconds, 'NX') then return 0 end
+local left = redis.call('PTTL', KEYS[2])
+if left < 1 then return 1 end
+return left
+`)
+
+// idleRoomsKey holds the empty ad-hoc rooms, scored by when they expire in Unix milliseconds
+const idleRoomsKey = "idle_rooms"
+
+func roomInfoKey(room string) string           { return "room_info:" + room }
+func slowModeKey(room, username string) string { return "slow_mode:" + room + ":" + username }
+
+func roomKeys(room string) []string {
+	return []string{roomInfoKey(room), "all_rooms", "room:" + room, roomAllowedKey(room), roomRolesKey(room)}
+}
+
+// GetRoom returns the record of a room with its member count,
+// or domain.ErrRoomNotFound if the room does not exist
+func (r *RedisClient) GetRoom(ctx context.Context, room string) (domain.Room, error) {
+	rooms, err := r.GetRooms(ctx, []string{room})
+	if err != nil {
+		return domain.Room{}, err
+	}
+	if rooms[0].Members > 0 {
+		return rooms[0], nil
+	}
+
+	// Persistent and idle rooms exist without members
+	exists, err := r.client.Exists(ctx, roomInfoKey(room)).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to check room record: %v", err)
+		return domain.Room{}, err
+	}
+	if exists == 0 {
+		return domain.Room{}, domain.ErrRoomNotFound
+	}
+	return rooms[0], nil
+}
+
+// GetRooms returns the records of rooms, in the given order, with their member counts
+func (r *RedisClient) GetRooms(ctx context.Context, rooms []string) ([]domain.Room, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"action": "get_rooms",
+	})
+
+	if len(rooms) == 0 {
+		return nil, nil
+	}
+
+	pipe := r.client.Pipeline()
+	records := make([]*redis.MapStringStringCmd, len(rooms))
+	members := make([]*redis.IntCmd, len(rooms))
+	for i, room := range rooms {
+		records[i] = pipe.HGetAll(ctx, roomInfoKey(room))
+		members[i] = pipe.SCard(ctx, "room:"+room)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to load rooms: %v", err)
+		return nil, err
+	}
+
+	result := make([]domain.Room, len(rooms))
+	for i, room := range rooms {
+		record := records[i].Val()
+		slowMode, _ := strconv.ParseInt(record["slow_mode"], 10, 64)
+		maxMembers, _ := strconv.ParseInt(record["max_members"], 10, 64)
+		result[i] = domain.Room{
+			Name:             room,
+			Topic:            record["topic"],
+			Description:      record["description"],
+			CreatedBy:        record["created_by"],
+			CreatedAt:        record["created_at"],
+			Persistent:       record["persistent"] == "1",
+			Visibility:       record["visibility"],
+			Members:          members[i].Val(),
+			AnnouncementOnly: record["announcement_only"] == "1",
+			SlowMode:         slowMode,
+			MaxMembers:       maxMembers,
+		}
+	}
+	return result, nil
+}
+
+// SetRoomTopic changes the topic of a room, or returns domain.ErrRoomNotFound
+func (r *RedisClient) SetRoomTopic(ctx context.Context, room, topic string) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":   room,
+		"action": "set_room_topic",
+	})
+
+	set, err := setRoomFieldScript.Run(ctx, r.client, []string{roomInfoKey(room)}, "topic", topic).Int()
+	if err != nil {
+		log.Errorf("Failed to set room topic: %v", err)
+		return err
+	}
+	if set == 0 {
+		return domain.ErrRoomNotFound
+	}
+	return nil
+}
+
+// SetRoomSlowMode sets the seconds users must wait between messages in a room, 0 for none.
+// It returns domain.ErrRoomNotFound if there is no such room.
+func (r *RedisClient) SetRoomSlowMode(ctx context.Context, room string, seconds int64) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":   room,
+		"action": "set_room_slow_mode",
+	})
+
+	set, err := setRoomFieldScript.Run(ctx, r.client, []string{roomInfoKey(room)}, "slow_mode", seconds).Int()
+	if err != nil {
+		log.Errorf("Failed to set slow mode: %v", err)
+		return err
+	}
+	if set == 0 {
+		return domain.ErrRoomNotFound
+	}
+	return nil
+}
+
+// SetRoomAnnouncementOnly sets whether only owners and moderators can post to a room.
+// It returns domain.ErrRoomNotFound if there is no such room.
+func (r *RedisClient) SetRoomAnnouncementOnly(ctx context.Context, room string, announcementOnly bool) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":   room,
+		"action": "set_room_announcement_only",
+	})
+
+	flag := ""
+	if announcementOnly {
+		flag = "1"
+	}
+	set, err := setRoomFieldScript.Run(ctx, r.client, []string{roomInfoKey(room)}, "announcement_only", flag).Int()
+	if err != nil {
+		log.Errorf("Failed to set announcement-only: %v", err)
+		return err
+	}
+	if set == 0 {
+		return domain.ErrRoomNotFound
+	}
+	return nil
+}
+
+// StartSlowModeCooldown starts a user's cooldown in a room that is in slow mode.
+// If the user is still cooling down it returns the time left instead, 0 otherwise.
+func (r *RedisClient) StartSlowModeCooldown(ctx context.Context, room, username string) (time.Duration, error) {
+	left, err := slowModeScript.Run(ctx, r.client, []string{roomInfoKey(room), slowModeKey(room, username)}).Int64()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to check slow mode: %v", err)
+		return 0, err
+	}
+	return time.Duration(left) * time.Millisecond, nil
+}
+
+// IsRoomMember reports whether a user is in a room
+func (r *RedisClient) IsRoomMember(ctx context.Context, room, username string) (bool, error) {
+	member, err := r.client.SIsMember(ctx, "room:"+room, username).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to check room membership: %v", err)
+		return false, err
+	}
+	return member, nil
+}
+
+// CreateRoom makes a room persistent so it survives having no members. The creator, topic,
+// description, visibility, password hash, announcement-only flag and capacity are recorded; an existing ad-hoc
+// room keeps its creator. It returns domain.ErrRoomExists if the room is already persistent.
+func (r *RedisClient) CreateRoom(ctx context.Context, room domain.Room, passwordHash string) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":   room.Name,
+		"action": "create_room",
+	})
+
+	announcementOnly := ""
+	if room.AnnouncementOnly {
+		announcementOnly = "1"
+	}
+
+	log.Infof("Creating persistent room")
+	created, err := createRoomScript.Run(ctx, r.client, roomKeys(room.Name),
+		room.Name, room.CreatedBy, room.CreatedAt, room.Topic, room.Description, room.Visibility, passwordHash, announcementOnly, room.MaxMembers).Int()
+	if err != nil {
+		log.Errorf("Failed to create room: %v", err)
+		return err
+	}
+	if created == 0 {
+		return domain.ErrRoomExists
+	}
+	return nil
+}
+
+// DeleteRoom makes a persistent room ad-hoc again; it is dropped once it has no members.
+// It reports whether the room was empty and dropped right away, and returns
+// domain.ErrRoomNotFound if there is no such persistent room.
+func (r *RedisClient) DeleteRoom(ctx context.Context, room string) (bool, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":   room,
+		"action": "delete_room",
+	})
+
+	log.Infof("Deleting persistent room")
+	deleted, err := deleteRoomScript.Run(ctx, r.client, roomKeys(room), room).Int()
+	if err != nil {
+		log.Errorf("Failed to delete room: %v", err)
+		return false, err
+	}
+	if deleted == 0 {
+		return false, domain.ErrRoomNotFound
+	}
+	return deleted == 2, nil
+}
+
+// ExpireIdleRooms drops the ad-hoc rooms that have been idle past their deadline at now
+// and are still empty. Any server can run it, so rooms idled on a server that went away
+// still expire. It returns the names of the dropped rooms.
+func (r *RedisClient) ExpireIdleRooms(ctx context.Context, now time.Time) ([]string, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"action": "expire_idle_rooms",
+	})
+
+	nowArg := strconv.FormatInt(now.UnixMilli(), 10)
+	rooms, err := r.client.ZRangeByScore(ctx, idleRoomsKey, &redis.ZRangeBy{Min: "-inf", Max: nowArg}).Result()
+	if err != nil {
+		log.Errorf("Failed to list idle rooms: %v", err)
+		return nil, err
+	}
+
+	var expired []string
+	for _, room := range rooms {
+		dropped, err := expireRoomScript.Run(ctx, r.client, append(roomKeys(room), idleRoomsKey), room, nowArg).Int()
+		if err != nil {
+			log.Errorf("Failed to expire room %s: %v", room, err)
+			return expired, err
+		}
+		if dropped == 1 {
+			expired = append(expired, room)
+		}
+	}
+	return expired, nil
+}
+
+// idleDeadline is the idle_rooms score of a room left empty for timeout from now,
+// "0" if it is dropped right away
+func idleDeadline(timeout time.Duration) string {
+	if timeout <= 0 {
+		return "0"
+	}
+	return strconv.FormatInt(time.Now().Add(timeout).UnixMilli(), 10)
+}
+
+// IsAnnouncementOnly reports whether only owners and moderators can post to a room
+func (r *RedisClient) IsAnnouncementOnly(ctx context.Context, room string) (bool, error) {
+	flag, err := r.client.HGet(ctx, roomInfoKey(room), "announcement_only").Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to check announcement-only room: %v", err)
+		return false, err
+	}
+	return flag == "1", nil
+}
+
+// RoomPasswordHash returns the password hash of a room, empty if it has none
+func (r *RedisClient) RoomPasswordHash(ctx context.Context, room string) (string, error) {
+	hash, err := r.client.HGet(ctx, roomInfoKey(room), "password_hash").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to get room password: %v", err)
+		return "", err
+	}
+	return hash, nil
+}
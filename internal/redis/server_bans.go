@@ -0,0 +1,56 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func serverUserBanKey(username string) string { return "server_ban:user:" + username }
+func serverIPBanKey(ip string) string         { return "server_ban:ip:" + ip }
+
+// BanFromServer bans a username, or an IP address if username is empty, from the
+// whole server for ttl, or until lifted if ttl is 0
+func (r *RedisClient) BanFromServer(ctx context.Context, username, ip, reason string, ttl time.Duration) error {
+	key := serverUserBanKey(username)
+	if username == "" {
+		key = serverIPBanKey(ip)
+	}
+	if err := r.client.Set(ctx, key, reason, ttl).Err(); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to ban from server: %v", err)
+		return err
+	}
+	return nil
+}
+
+// LiftServerBan lifts the server ban of a username, or of an IP address if username
+// is empty. It reports whether there was such a ban.
+func (r *RedisClient) LiftServerBan(ctx context.Context, username, ip string) (bool, error) {
+	key := serverUserBanKey(username)
+	if username == "" {
+		key = serverIPBanKey(ip)
+	}
+	n, err := r.client.Del(ctx, key).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to lift server ban: %v", err)
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ServerBanReason reports whether a username or an IP address is banned from the
+// server, with the reason of the ban. A username ban takes precedence.
+func (r *RedisClient) ServerBanReason(ctx context.Context, username, ip string) (string, bool, error) {
+	values, err := r.client.MGet(ctx, serverUserBanKey(username), serverIPBanKey(ip)).Result()
+	if err != nil && err != redis.Nil {
+		r.logger.WithContext(ctx).Errorf("Failed to check server ban: %v", err)
+		return "", false, err
+	}
+	for _, v := range values {
+		if reason, ok := v.(string); ok {
+			return reason, true, nil
+		}
+	}
+	return "", false, nil
+}
@@ -0,0 +1,336 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	sessionAttached = "attached"
+	sessionDetached = "detached"
+)
+
+// claimSessionScript re-attaches a detached session if it belongs to ARGV[1] and is
+// still on node ARGV[2], whose connections are in KEYS[2], moving its connection to
+// node ARGV[3] with the connections in KEYS[3]. The session is no longer idle.
+var claimSessionScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'state') ~= 'detached' then return nil end
+if redis.call('HGET', KEYS[1], 'username') ~= ARGV[1] then return nil end
+if (redis.call('HGET', KEYS[1], 'node') or '') ~= ARGV[2] then return nil end
+local conn_id = redis.call('HGET', KEYS[1], 'conn_id')
+redis.call('HDEL', KEYS[2], conn_id)
+if ARGV[3] ~= '' then
+	redis.call('HSET', KEYS[3], conn_id, ARGV[4])
+end
+redis.call('HSET', KEYS[1], 'state', 'attached', 'node', ARGV[3])
+redis.call('HDEL', KEYS[1], 'idle')
+redis.call('PERSIST', KEYS[1])
+return redis.call('HGETALL', KEYS[1])
+`)
+
+// releaseSessionScript deletes a session that is still detached since detach number ARGV[1]
+var releaseSessionScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'state') ~= 'detached' then return nil end
+if redis.call('HGET', KEYS[1], 'epoch') ~= ARGV[1] then return nil end
+local fields = redis.call('HGETALL', KEYS[1])
+redis.call('DEL', KEYS[1])
+return fields
+`)
+
+// endDetachedSessionScript deletes a session if it is detached. Returns 0 if it is gone.
+var endDetachedSessionScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+if redis.call('HGET', KEYS[1], 'state') ~= 'detached' then return nil end
+local fields = redis.call('HGETALL', KEYS[1])
+redis.call('DEL', KEYS[1])
+return fields
+`)
+
+// moveDetachedSessionScript moves a session to room ARGV[2] if it is detached in room ARGV[1]
+var moveDetachedSessionScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'state') ~= 'detached' then return nil end
+if redis.call('HGET', KEYS[1], 'room') ~= ARGV[1] then return nil end
+redis.call('HSET', KEYS[1], 'room', ARGV[2])
+return redis.call('HGETALL', KEYS[1])
+`)
+
+// ackMessageScript only ever moves last_ack forward
+var ackMessageScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+local id = tonumber(ARGV[1])
+if not id then return 0 end
+local current = tonumber(redis.call('HGET', KEYS[1], 'last_ack') or '0') or 0
+if id <= current then return 0 end
+redis.call('HSET', KEYS[1], 'last_ack', ARGV[1])
+return 1
+`)
+
+func sessionKey(token string) string         { return "session:" + token }
+func userSessionsKey(username string) string { return "user_sessions:" + username }
+
+// CreateSession stores a new attached session and indexes it under its user and,
+// if it has one, its node.
+func (r *RedisClient) CreateSession(ctx context.Context, session domain.Session) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": session.Username,
+		"action":   "create_session",
+	})
+
+	log.Infof("Creating session")
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sessionKey(session.Token),
+			"username", session.Username,
+			"conn_id", session.ConnID,
+			"room", session.Room,
+			"last_ack", session.LastAck,
+			"state", sessionAttached,
+			"node", session.Node,
+		)
+		pipe.SAdd(ctx, userSessionsKey(session.Username), session.Token)
+		if session.Node != "" {
+			pipe.HSet(ctx, nodeConnsKey(session.Node), session.ConnID, nodeConnValue(session.Token, session.Username))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to create session: %v", err)
+		return err
+	}
+	return nil
+}
+
+// DetachSession marks a session as resumable for ttl and records the room it was in.
+// It returns the detach number that ReleaseSession must present to expire it.
+func (r *RedisClient) DetachSession(ctx context.Context, token, room string, ttl time.Duration) (int64, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":   room,
+		"action": "detach_session",
+	})
+
+	log.Infof("Detaching session")
+	key := sessionKey(token)
+	pipe := r.client.TxPipeline()
+	pipe.HSet(ctx, key, "room", room, "state", sessionDetached)
+	epoch := pipe.HIncrBy(ctx, key, "epoch", 1)
+	pipe.Expire(ctx, key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to detach session: %v", err)
+		return 0, err
+	}
+	return epoch.Val(), nil
+}
+
+// ClaimSession re-attaches a detached session owned by username to a connection on
+// node. It returns domain.ErrSessionNotFound if there is no such session, or if it is
+// being cleaned up after the node it dropped from went away.
+func (r *RedisClient) ClaimSession(ctx context.Context, token, username, node string) (domain.Session, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"action":   "claim_session",
+	})
+
+	log.Infof("Claiming session")
+	prev, err := r.client.HGet(ctx, sessionKey(token), "node").Result()
+	if err != nil && err != redis.Nil {
+		log.Errorf("Failed to read session node: %v", err)
+		return domain.Session{}, err
+	}
+	keys := []string{sessionKey(token), nodeConnsKey(prev), nodeConnsKey(node)}
+	res, err := claimSessionScript.Run(ctx, r.client, keys, username, prev, node, nodeConnValue(token, username)).Result()
+	if err == redis.Nil {
+		return domain.Session{}, domain.ErrSessionNotFound
+	}
+	if err != nil {
+		log.Errorf("Failed to claim session: %v", err)
+		return domain.Session{}, err
+	}
+	return parseSession(token, res)
+}
+
+// ReleaseSession deletes a session that has stayed detached since the given detach.
+// It returns domain.ErrSessionNotFound if the session was resumed or is already gone.
+func (r *RedisClient) ReleaseSession(ctx context.Context, token string, epoch int64) (domain.Session, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"action": "release_session",
+	})
+
+	res, err := releaseSessionScript.Run(ctx, r.client, []string{sessionKey(token)}, epoch).Result()
+	if err == redis.Nil {
+		return domain.Session{}, domain.ErrSessionNotFound
+	}
+	if err != nil {
+		log.Errorf("Failed to release session: %v", err)
+		return domain.Session{}, err
+	}
+	session, err := parseSession(token, res)
+	if err != nil {
+		return domain.Session{}, err
+	}
+	log.Infof("Released expired session")
+	r.unindexSessions(ctx, session.Username, token)
+	return session, nil
+}
+
+// EndDetachedSessions deletes every detached session of a user and returns them.
+// Attached sessions are left to their connections.
+func (r *RedisClient) EndDetachedSessions(ctx context.Context, username string) ([]domain.Session, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"action":   "end_detached_sessions",
+	})
+
+	tokens, err := r.client.SMembers(ctx, userSessionsKey(username)).Result()
+	if err != nil {
+		log.Errorf("Failed to list sessions: %v", err)
+		return nil, err
+	}
+
+	var ended []domain.Session
+	var gone []string
+	for _, token := range tokens {
+		res, err := endDetachedSessionScript.Run(ctx, r.client, []string{sessionKey(token)}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to end session: %v", err)
+			return ended, err
+		}
+		if _, expired := res.(int64); expired {
+			gone = append(gone, token)
+			continue
+		}
+		session, err := parseSession(token, res)
+		if err != nil {
+			return ended, err
+		}
+		ended = append(ended, session)
+		gone = append(gone, token)
+	}
+	r.unindexSessions(ctx, username, gone...)
+	return ended, nil
+}
+
+// MoveDetachedSessions moves every session of a user that is detached in fromRoom to
+// toRoom, so it resumes there, and returns the moved sessions as they were. The
+// sessions' room memberships are left to the caller.
+func (r *RedisClient) MoveDetachedSessions(ctx context.Context, username, fromRoom, toRoom string) ([]domain.Session, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"room":     fromRoom,
+		"action":   "move_detached_sessions",
+	})
+
+	tokens, err := r.client.SMembers(ctx, userSessionsKey(username)).Result()
+	if err != nil {
+		log.Errorf("Failed to list sessions: %v", err)
+		return nil, err
+	}
+
+	var moved []domain.Session
+	for _, token := range tokens {
+		res, err := moveDetachedSessionScript.Run(ctx, r.client, []string{sessionKey(token)}, fromRoom, toRoom).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to move session: %v", err)
+			return moved, err
+		}
+		session, err := parseSession(token, res)
+		if err != nil {
+			return moved, err
+		}
+		session.Room = fromRoom
+		moved = append(moved, session)
+	}
+	return moved, nil
+}
+
+// GetSession returns a session regardless of its state.
+// It returns domain.ErrSessionNotFound if there is no such session.
+func (r *RedisClient) GetSession(ctx context.Context, token string) (domain.Session, error) {
+	res, err := r.client.HGetAll(ctx, sessionKey(token)).Result()
+	if err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to get session: %v", err)
+		return domain.Session{}, err
+	}
+	if len(res) == 0 {
+		return domain.Session{}, domain.ErrSessionNotFound
+	}
+	return sessionFromFields(token, res), nil
+}
+
+// DeleteSession removes a session of username regardless of its state.
+func (r *RedisClient) DeleteSession(ctx context.Context, token, username string) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"action": "delete_session",
+	})
+
+	log.Infof("Deleting session")
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(token))
+		pipe.SRem(ctx, userSessionsKey(username), token)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to delete session: %v", err)
+		return err
+	}
+	return nil
+}
+
+// unindexSessions drops deleted sessions from their user's index
+func (r *RedisClient) unindexSessions(ctx context.Context, username string, tokens ...string) {
+	if len(tokens) == 0 {
+		return
+	}
+	if err := r.client.SRem(ctx, userSessionsKey(username), tokens).Err(); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to unindex sessions: %v", err)
+	}
+}
+
+// AckMessage records messageID as acknowledged if it is newer than the last acknowledged one.
+func (r *RedisClient) AckMessage(ctx context.Context, token, messageID string) error {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"message_id": messageID,
+		"action":     "ack_message",
+	})
+
+	if err := ackMessageScript.Run(ctx, r.client, []string{sessionKey(token)}, messageID).Err(); err != nil {
+		log.Errorf("Failed to acknowledge message: %v", err)
+		return err
+	}
+	return nil
+}
+
+// parseSession converts an HGETALL reply into a session
+func parseSession(token string, res interface{}) (domain.Session, error) {
+	values, ok := res.([]interface{})
+	if !ok || len(values)%2 != 0 {
+		return domain.Session{}, fmt.Errorf("unexpected session reply: %v", res)
+	}
+
+	fields := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		k, _ := values[i].(string)
+		v, _ := values[i+1].(string)
+		fields[k] = v
+	}
+	return sessionFromFields(token, fields), nil
+}
+
+func sessionFromFields(token string, fields map[string]string) domain.Session {
+	return domain.Session{
+		Token:    token,
+		ConnID:   fields["conn_id"],
+		Username: fields["username"],
+		Room:     fields["room"],
+		LastAck:  fields["last_ack"],
+		Node:     fields["node"],
+	}
+}
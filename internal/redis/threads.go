@@ -0,0 +1,60 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+// threadKey holds the IDs of the replies to a root message; replies are added by AppendHistory
+func threadKey(room, rootID string) string { return "thread:" + room + ":" + rootID }
+
+// ThreadReplies returns up to limit replies to a root message, oldest first
+func (r *RedisClient) ThreadReplies(ctx context.Context, room, rootID string, limit int) ([]domain.ChatMessage, error) {
+	log := r.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":      room,
+		"thread_id": rootID,
+		"action":    "thread_replies",
+	})
+
+	ids, err := r.client.ZRange(ctx, threadKey(room, rootID), 0, int64(limit)-1).Result()
+	if err != nil {
+		log.Errorf("Failed to retrieve thread replies: %v", err)
+		return nil, err
+	}
+	return r.loadMessages(ctx, room, ids)
+}
+
+// RemoveReply takes a deleted reply out of its thread, so it is no longer listed or counted
+func (r *RedisClient) RemoveReply(ctx context.Context, room, rootID, messageID string) error {
+	if err := r.client.ZRem(ctx, threadKey(room, rootID), messageID).Err(); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to remove thread reply: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ReplyCounts returns the number of live replies to each of the given messages. Deleted
+// replies are removed from their thread, and replies are trimmed from the history only
+// after their root, whose thread goes with it.
+func (r *RedisClient) ReplyCounts(ctx context.Context, room string, messageIDs []string) (map[string]int64, error) {
+	counts := make(map[string]int64, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(messageIDs))
+	for i, id := range messageIDs {
+		cmds[i] = pipe.ZCard(ctx, threadKey(room, id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		r.logger.WithContext(ctx).Errorf("Failed to count thread replies: %v", err)
+		return nil, err
+	}
+	for i, id := range messageIDs {
+		counts[id] = cmds[i].Val()
+	}
+	return counts, nil
+}
@@ -2,28 +2,136 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
 	"github.com/SphrGhfri/chatroom_golang_nats/internal/nats"
 	"github.com/SphrGhfri/chatroom_golang_nats/internal/redis"
 	"github.com/SphrGhfri/chatroom_golang_nats/pkg/logger"
+	"github.com/google/uuid"
 )
 
 // ChatService defines the interface
 type ChatService interface {
 	PublishMessage(ctx context.Context, msg domain.ChatMessage) error
-	AddActiveUser(ctx context.Context, username string) error
-	RemoveActiveUser(ctx context.Context, username string) error
+	AddActiveUser(ctx context.Context, username, connID string) error
+	RemoveActiveUser(ctx context.Context, username, connID string) error
 	ListActiveUsers(ctx context.Context) ([]string, error)
+	SubscribeUser(ctx context.Context, username, connID string, msgHandler func(domain.ChatMessage)) error
+	UnsubscribeUser(ctx context.Context, username, connID string) error
+	WatchPresence(ctx context.Context, username, connID string, msgHandler func(domain.ChatMessage)) (domain.Presence, error)
+	UnwatchPresence(ctx context.Context, username, connID string) error
+	WatchGlobalPresence(ctx context.Context, connID string, msgHandler func(domain.ChatMessage)) error
+	UnwatchGlobalPresence(ctx context.Context, connID string) error
+	SetStatus(ctx context.Context, username string, status domain.Presence) (domain.Presence, error)
+	UserStatuses(ctx context.Context, viewer string, usernames []string) ([]domain.Presence, error)
 
-	JoinRoom(ctx context.Context, roomName, username string, msgHandler func(domain.ChatMessage)) error
-	LeaveRoom(ctx context.Context, roomName, username string) error
+	JoinRoom(ctx context.Context, roomName, username, connID string, msgHandler func(domain.ChatMessage)) error
+	LeaveRoom(ctx context.Context, roomName, username, connID string) error
 	ListRoomMembers(ctx context.Context, roomName string) ([]string, error)
-	ListAllRooms(ctx context.Context) ([]string, error)
-	SwitchRoom(ctx context.Context, oldRoom, newRoom, username string, msgHandler func(domain.ChatMessage)) error
+	ListAllRooms(ctx context.Context, username string) ([]string, error)
+	ListRooms(ctx context.Context, username string) ([]domain.RoomSummary, error)
+	GetRoomInfo(ctx context.Context, roomName, username string) (domain.Room, error)
+	CreateRoom(ctx context.Context, room domain.Room, password string) (domain.Room, error)
+	CheckRoomAccess(ctx context.Context, roomName, username, password string) error
+	InviteUser(ctx context.Context, roomName, inviter, invitee string) error
+	CreateInvite(ctx context.Context, roomName, inviter string, maxUses int64, expiresIn time.Duration) (domain.Invite, error)
+	RedeemInvite(ctx context.Context, roomName, username, token string) (bool, error)
+	ReturnInvite(ctx context.Context, roomName, username, token string) error
+	DeleteRoom(ctx context.Context, roomName string) error
+	SetTopic(ctx context.Context, roomName, username, connID, topic string) error
+	SetSlowMode(ctx context.Context, roomName, username, connID string, seconds int64) error
+	SetRole(ctx context.Context, roomName, username, connID string, grant domain.RoleGrant) error
+	AssignRole(ctx context.Context, roomName, username, role string) error
+	SetAnnouncementOnly(ctx context.Context, roomName string, announcementOnly bool) error
+	Kick(ctx context.Context, roomName, username, connID string, m domain.Moderation) error
+	Ban(ctx context.Context, roomName, username, connID string, m domain.Moderation) error
+	Mute(ctx context.Context, roomName, username, connID string, m domain.Moderation) error
+	Unban(ctx context.Context, roomName, username, connID string, m domain.Moderation) error
+	Unmute(ctx context.Context, roomName, username, connID string, m domain.Moderation) error
+	CheckServerBan(ctx context.Context, username, ip string) error
+	BanFromServer(ctx context.Context, ban domain.ServerBan) (domain.ServerBan, error)
+	LiftServerBan(ctx context.Context, username, ip string) error
+	DisconnectUser(ctx context.Context, username, reason string) error
+	SwitchRoom(ctx context.Context, oldRoom, newRoom, username, connID, password string, msgHandler func(domain.ChatMessage)) error
 	IsUserActive(ctx context.Context, username string) (bool, error)
+
+	StartSession(ctx context.Context, username, ip string) (domain.Session, error)
+	ResumeSession(ctx context.Context, token, username, ip string) (domain.Session, error)
+	RestoreSession(ctx context.Context, session domain.Session, msgHandler func(domain.ChatMessage)) error
+	DetachSession(ctx context.Context, session domain.Session) error
+	EndSession(ctx context.Context, session domain.Session) error
+	AckMessage(ctx context.Context, token, messageID string) error
+	TouchSession(ctx context.Context, session domain.Session)
+
+	MarkRead(ctx context.Context, roomName, username, connID, messageID string) error
+	EditMessage(ctx context.Context, roomName, username, connID, messageID, content string) error
+	DeleteMessage(ctx context.Context, roomName, username, connID, messageID string) error
+	AddReaction(ctx context.Context, roomName, username, connID, messageID, emoji string) error
+	RemoveReaction(ctx context.Context, roomName, username, connID, messageID, emoji string) error
+	GetHistory(ctx context.Context, roomName, username, beforeID string) ([]domain.ChatMessage, error)
+	GetThread(ctx context.Context, roomName, username, messageID string) ([]domain.ChatMessage, error)
+
+	StartTyping(ctx context.Context, roomName, username, connID string) error
+	StopTyping(ctx context.Context, roomName, username, connID string) error
+}
+
+const (
+	// historyLimit is the number of chat messages kept per room for replay
+	historyLimit = 200
+
+	defaultResumeGracePeriod = 30 * time.Second
+	defaultTypingTimeout     = 5 * time.Second
+	defaultTypingThrottle    = 2 * time.Second
+	defaultReceiptThrottle   = 2 * time.Second
+	defaultPresenceDelay     = 2 * time.Second
+	defaultAwayTimeout       = 5 * time.Minute
+	defaultNodeTimeout       = 15 * time.Second
+)
+
+// ChatConfig holds the tunable behaviour of the chat service.
+// Zero values fall back to sensible defaults.
+type ChatConfig struct {
+	// ResumeGracePeriod is how long a dropped connection can be resumed
+	// before the user is removed from their room and from presence
+	ResumeGracePeriod time.Duration
+
+	// TypingTimeout is how long a typing indicator lasts without being renewed
+	TypingTimeout time.Duration
+
+	// TypingThrottle is the minimum interval between relayed typing_start frames of a connection
+	TypingThrottle time.Duration
+
+	// ReceiptThrottle is the minimum interval between relayed read receipts of a user
+	// in a room; receipts in between are merged into one for the latest message
+	ReceiptThrottle time.Duration
+
+	// RoomIdleTimeout is how long an empty ad-hoc room is kept before it is dropped.
+	// Zero drops it as soon as its last member leaves.
+	RoomIdleTimeout time.Duration
+
+	// PresenceDelay is how long a presence change waits before it is announced.
+	// A user who flaps within it is announced once, with the status they end up in.
+	PresenceDelay time.Duration
+
+	// AwayTimeout is how long a connection can go without frames before it is idle.
+	// A user whose attached connections are all idle is away.
+	AwayTimeout time.Duration
+
+	// RoomCapacity is the most members a room can have unless it sets its own limit.
+	// Zero is unlimited. The global room has no limit.
+	RoomCapacity int64
+
+	// NodeID identifies this server among those sharing Redis; empty picks a new one
+	NodeID string
+
+	// NodeTimeout is how long this server stays known as alive without a heartbeat.
+	// Once another server's heartbeat has lapsed for that long its connections are
+	// cleaned up as if they had closed.
+	NodeTimeout time.Duration
 }
 
 type chatService struct {
@@ -31,19 +139,67 @@ type chatService struct {
 	redisClient *redis.RedisClient
 	logger      logger.Logger
 	ctx         context.Context // Add context
+	cfg         ChatConfig
+	typing      *typingTracker
+	receipts    *receiptTracker
+	presence    *presenceTracker
+	idle        *idleTracker
+	addresses   *addressTracker
 }
 
-func NewChatService(ctx context.Context, nc *nats.NATSClient, rc *redis.RedisClient) ChatService {
+func NewChatService(ctx context.Context, nc *nats.NATSClient, rc *redis.RedisClient, cfg ChatConfig) ChatService {
 	log := logger.FromContext(ctx).WithModule("chat")
-	return &chatService{
+	if cfg.ResumeGracePeriod <= 0 {
+		cfg.ResumeGracePeriod = defaultResumeGracePeriod
+	}
+	if cfg.TypingTimeout <= 0 {
+		cfg.TypingTimeout = defaultTypingTimeout
+	}
+	if cfg.TypingThrottle <= 0 {
+		cfg.TypingThrottle = defaultTypingThrottle
+	}
+	if cfg.ReceiptThrottle <= 0 {
+		cfg.ReceiptThrottle = defaultReceiptThrottle
+	}
+	if cfg.PresenceDelay <= 0 {
+		cfg.PresenceDelay = defaultPresenceDelay
+	}
+	if cfg.AwayTimeout <= 0 {
+		cfg.AwayTimeout = defaultAwayTimeout
+	}
+	if cfg.NodeID == "" {
+		cfg.NodeID = uuid.New().String()
+	}
+	if cfg.NodeTimeout <= 0 {
+		cfg.NodeTimeout = defaultNodeTimeout
+	}
+	c := &chatService{
 		natsClient:  nc,
 		redisClient: rc,
 		logger:      log,
 		ctx:         ctx,
+		cfg:         cfg,
+		typing:      newTypingTracker(),
+		receipts:    newReceiptTracker(),
+		presence:    newPresenceTracker(),
+		idle:        newIdleTracker(),
+		addresses:   newAddressTracker(),
+	}
+
+	// Kicks and bans reach the connections of a user on whichever server they are on
+	if err := nc.SubscribeControl(ctx, "chat", c.handleControl); err != nil {
+		log.Errorf("Failed to subscribe to control messages: %v", err)
+	}
+	if cfg.RoomIdleTimeout > 0 {
+		go c.sweepIdleRooms()
 	}
+	go c.runNode()
+	return c
 }
 
-// publish to chat.events.<room>
+// PublishMessage publishes a message to its room on chat.room.<room>. Chat messages
+// are checked against the room's rules and stored first; only members of the room
+// who are not banned from it may post.
 func (c *chatService) PublishMessage(ctx context.Context, msg domain.ChatMessage) error {
 	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
 		"room":   msg.Room,
@@ -51,20 +207,98 @@ func (c *chatService) PublishMessage(ctx context.Context, msg domain.ChatMessage
 		"type":   msg.Type,
 	})
 
+	// Chat messages are stored so they can be replayed to resumed sessions
+	if msg.Type == domain.MessageTypeChat {
+		if err := c.checkMember(ctx, msg.Room, msg.Sender); err != nil {
+			log.Warnf("Sender may not post: %v", err)
+			return err
+		}
+		if err := c.authorizePost(ctx, msg.Room, msg.Sender); err != nil {
+			log.Warnf("Sender may not post: %v", err)
+			return err
+		}
+		if err := c.checkMuted(ctx, msg.Room, msg.Sender); err != nil {
+			log.Warnf("Sender may not post: %v", err)
+			return err
+		}
+		if err := c.checkSlowMode(ctx, msg.Room, msg.Sender); err != nil {
+			log.Warnf("Sender may not post yet: %v", err)
+			return err
+		}
+		if err := c.resolveThread(ctx, &msg); err != nil {
+			log.Errorf("Failed to resolve replied-to message: %v", err)
+			return err
+		}
+		if err := c.resolveAttachments(ctx, &msg); err != nil {
+			log.Errorf("Failed to resolve attachments: %v", err)
+			return err
+		}
+		msg.Mentions = parseMentions(msg.Content)
+
+		stored, err := c.redisClient.AppendHistory(ctx, msg, historyLimit)
+		if err != nil {
+			log.Errorf("Failed to store message: %v", err)
+			return err
+		}
+		msg = stored
+
+		// Sending a message ends the sender's typing indicator and marks the room read for them
+		c.clearTyping(msg.Room, msg.ConnID)
+		if _, err := c.redisClient.MarkRead(ctx, msg.Sender, msg.Room, msg.ID); err != nil {
+			log.Errorf("Failed to mark own message as read: %v", err)
+		}
+	}
+
+	// A room record sent to everyone in the room counts nobody invisible
+	if msg.RoomInfo != nil {
+		rooms := []domain.Room{*msg.RoomInfo}
+		if err := c.hideInvisible(ctx, "", rooms); err != nil {
+			log.Errorf("Failed to hide invisible members: %v", err)
+			return err
+		}
+		msg.RoomInfo = &rooms[0]
+	}
+
 	log.Infof("Publishing message to room")
 	if err := c.natsClient.PublishRoom(ctx, msg.Room, msg); err != nil {
 		log.Errorf("Failed to publish message: %v", err)
 		return err
 	}
+
+	if msg.Type == domain.MessageTypeChat {
+		c.notifyMentions(ctx, msg)
+	}
 	return nil
 }
 
 // Presence
-func (c *chatService) AddActiveUser(ctx context.Context, username string) error {
-	return c.redisClient.AddActiveUser(ctx, username)
+// A user can be connected several times; presence is tracked per connection and
+// the user stays in active_users until their last connection is removed.
+func (c *chatService) AddActiveUser(ctx context.Context, username, connID string) error {
+	first, err := c.redisClient.AddUserConnection(ctx, username, connID)
+	if err != nil {
+		return err
+	}
+	if first {
+		if !c.invisible(ctx, username) {
+			c.publishEvent(ctx, domain.Event{Type: domain.EventUserConnected, Username: username})
+		}
+		c.schedulePresence(ctx, username)
+	}
+	return nil
 }
-func (c *chatService) RemoveActiveUser(ctx context.Context, username string) error {
-	return c.redisClient.RemoveActiveUser(ctx, username)
+func (c *chatService) RemoveActiveUser(ctx context.Context, username, connID string) error {
+	last, err := c.redisClient.RemoveUserConnection(ctx, username, connID)
+	if err != nil {
+		return err
+	}
+	if last {
+		if !c.invisible(ctx, username) {
+			c.publishEvent(ctx, domain.Event{Type: domain.EventUserDisconnected, Username: username})
+		}
+		c.schedulePresence(ctx, username)
+	}
+	return nil
 }
 func (c *chatService) ListActiveUsers(ctx context.Context) ([]string, error) {
 	return c.redisClient.GetActiveUsers(ctx)
@@ -78,58 +312,89 @@ func (c *chatService) IsUserActive(ctx context.Context, username string) (bool,
 	return exists, nil
 }
 
+// SubscribeUser delivers messages addressed to a user to one of their connections.
+// Every connection of the user subscribes, so all sessions receive them.
+func (c *chatService) SubscribeUser(ctx context.Context, username, connID string, msgHandler func(domain.ChatMessage)) error {
+	if err := c.natsClient.SubscribeUser(ctx, username, connID, msgHandler); err != nil {
+		c.logger.WithContext(ctx).Errorf("Failed to subscribe to user messages: %v", err)
+		return fmt.Errorf("failed to subscribe to user messages: %w", err)
+	}
+	return nil
+}
+func (c *chatService) UnsubscribeUser(ctx context.Context, username, connID string) error {
+	return c.natsClient.UnsubscribeUser(ctx, username, connID)
+}
+
 // Rooms
-func (c *chatService) JoinRoom(ctx context.Context, roomName, username string, msgHandler func(domain.ChatMessage)) error {
+// JoinRoom adds a user's connection to a room. Every room message is delivered to
+// msgHandler, including the connection's own; echo suppression is up to the caller.
+// The room must admit the user as with CheckRoomAccess; password rooms only admit
+// their members, others join them with SwitchRoom and the password.
+func (c *chatService) JoinRoom(ctx context.Context, roomName, username, connID string, msgHandler func(domain.ChatMessage)) error {
 	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
 		"room":     roomName,
 		"username": username,
+		"conn_id":  connID,
 	})
 
-	if roomName == "" || username == "" {
-		log.Errorf("Invalid room name or username")
-		return fmt.Errorf("room name and username cannot be empty")
+	if !validRoomName(roomName) || !domain.ValidName(username) {
+		log.Warnf("Invalid room name or username")
+		return domain.ErrInvalidRequest
+	}
+
+	// Banned users are kept out, private and invite-only rooms admit only invited users
+	// and full rooms no new members
+	if err := c.CheckRoomAccess(ctx, roomName, username, ""); err != nil {
+		log.Warnf("Join refused: %v", err)
+		return err
 	}
 
 	log.Infof("User joining room")
 
-	// Add user to Redis room
-	if err := c.redisClient.SAdd(ctx, "room:"+roomName, username); err != nil {
+	// Subscribe first, so the user receives the room's messages as soon as they are in it.
+	// If the Redis join fails, a subscription opened here is dropped again.
+	subscribed := c.natsClient.IsRoomSubscriber(roomName, connID)
+	if err := c.natsClient.SubscribeRoom(ctx, roomName, connID, msgHandler); err != nil {
+		log.Errorf("Failed to subscribe to NATS: %v", err)
+		return fmt.Errorf("failed to subscribe to NATS: %w", err)
+	}
+
+	// Add the connection to the Redis room, tracking the room in all_rooms
+	change, err := c.redisClient.AddRoomConnection(ctx, roomName, username, connID, c.defaultCapacity(roomName), ownedRoom(roomName))
+	if err != nil {
+		if !subscribed {
+			if err := c.natsClient.UnsubscribeRoom(ctx, roomName, connID); err != nil {
+				log.Errorf("Failed to drop room subscription: %v", err)
+			}
+		}
+		if errors.Is(err, domain.ErrRoomFull) {
+			log.Warnf("Join refused: %v", err)
+			return err
+		}
 		log.Errorf("Failed to add user to room: %v", err)
 		return fmt.Errorf("failed to add user to room: %w", err)
 	}
 
-	// Track room in all_rooms
-	if err := c.redisClient.SAdd(ctx, "all_rooms", roomName); err != nil {
-		log.Errorf("Failed to track room: %v", err)
-		return fmt.Errorf("failed to track room: %w", err)
+	// Messages from before the user's first visit do not count as unread
+	if err := c.redisClient.InitLastRead(ctx, username, roomName); err != nil {
+		log.Errorf("Failed to initialize read marker: %v", err)
 	}
 
-	// Subscribe to NATS topic with the provided message handler
-	if err := c.natsClient.SubscribeRoom(ctx, roomName, username, func(msg domain.ChatMessage) {
-		// Don't send the message back to the sender
-		if msg.Sender != username {
-			msgHandler(msg)
-		}
-	}); err != nil {
-		log.Errorf("Failed to subscribe to NATS: %v", err)
-		return fmt.Errorf("failed to subscribe to NATS: %w", err)
-	}
+	c.publishRoomChange(ctx, roomName, username, change)
 
-	// Notify room members
-	c.PublishMessage(ctx, domain.ChatMessage{
-		Type:      domain.MessageTypeSystem,
-		Content:   fmt.Sprintf("%s joined the room %s", username, roomName),
-		Room:      roomName,
-		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
-	})
+	// Notify room members, unless the user was already in the room on another connection
+	if change.Joined {
+		c.announceJoin(ctx, roomName, username, connID)
+	}
 
 	return nil
 }
 
-func (c *chatService) LeaveRoom(ctx context.Context, roomName, username string) error {
+func (c *chatService) LeaveRoom(ctx context.Context, roomName, username, connID string) error {
 	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
 		"room":     roomName,
 		"username": username,
+		"conn_id":  connID,
 	})
 
 	if roomName == "" || username == "" {
@@ -137,36 +402,28 @@ func (c *chatService) LeaveRoom(ctx context.Context, roomName, username string)
 		return fmt.Errorf("room name and username cannot be empty")
 	}
 
-	// Notify room members before leaving
-	c.PublishMessage(ctx, domain.ChatMessage{
-		Type:      domain.MessageTypeSystem,
-		Content:   fmt.Sprintf("%s left the room", username),
-		Room:      roomName,
-		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
-	})
+	if err := c.StopTyping(ctx, roomName, username, connID); err != nil {
+		log.Errorf("Failed to stop typing indicator: %v", err)
+	}
 
 	// First unsubscribe from NATS
-	if err := c.natsClient.UnsubscribeRoom(ctx, roomName, username); err != nil {
+	if err := c.natsClient.UnsubscribeRoom(ctx, roomName, connID); err != nil {
 		log.Errorf("failed to unsubscribe from room %s: %v", roomName, err)
 		// Continue execution - we still want to remove from Redis
 	}
 
-	// Remove user from the Redis room set
-	key := "room:" + roomName
-	if err := c.redisClient.SRem(ctx, key, username); err != nil {
+	// Remove the connection from the Redis room; an empty ad-hoc room is removed from
+	// all_rooms, right away or once it has been idle for RoomIdleTimeout
+	change, err := c.redisClient.RemoveRoomConnection(ctx, roomName, username, connID, c.cfg.RoomIdleTimeout)
+	if err != nil {
 		log.Errorf("Failed to remove user from room in Redis: %v", err)
 		return fmt.Errorf("failed to remove user from room in Redis: %w", err)
 	}
+	c.publishRoomChange(ctx, roomName, username, change)
 
-	// Check if room is empty
-	members, err := c.redisClient.SMembers(ctx, key)
-	if err != nil {
-		log.Errorf("failed to get room members: %v", err)
-	} else if len(members) == 0 {
-		// Room is empty, remove it from all_rooms
-		if err := c.redisClient.SRem(ctx, "all_rooms", roomName); err != nil {
-			log.Errorf("failed to remove empty room from all_rooms: %v", err)
-		}
+	// Notify room members once the user's last connection has left
+	if change.Left {
+		c.announceLeave(ctx, roomName, username, connID)
 	}
 
 	log.Infof("%s left room %s", username, roomName)
@@ -176,20 +433,189 @@ func (c *chatService) LeaveRoom(ctx context.Context, roomName, username string)
 func (c *chatService) ListRoomMembers(ctx context.Context, roomName string) ([]string, error) {
 	return c.redisClient.SMembers(ctx, "room:"+roomName)
 }
-func (c *chatService) ListAllRooms(ctx context.Context) ([]string, error) {
-	return c.redisClient.SMembers(ctx, "all_rooms")
+
+// ListAllRooms returns the names of the rooms the user can see
+func (c *chatService) ListAllRooms(ctx context.Context, username string) ([]string, error) {
+	rooms, err := c.visibleRooms(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(rooms))
+	for i, room := range rooms {
+		names[i] = room.Name
+	}
+	return names, nil
 }
 
-func (c *chatService) SwitchRoom(ctx context.Context, oldRoom, newRoom, username string, msgHandler func(domain.ChatMessage)) error {
-	if err := c.LeaveRoom(ctx, oldRoom, username); err != nil {
-		return fmt.Errorf("failed to leave old room: %w", err)
+// ListRooms returns the record of every room the user can see with the number of
+// messages the user has not read yet
+func (c *chatService) ListRooms(ctx context.Context, username string) ([]domain.RoomSummary, error) {
+	rooms, err := c.visibleRooms(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(rooms))
+	for i, room := range rooms {
+		names[i] = room.Name
+	}
+	unread, err := c.redisClient.UnreadCounts(ctx, username, names)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := c.JoinRoom(ctx, newRoom, username, msgHandler); err != nil {
-		// Try to rejoin old room on failure
-		_ = c.JoinRoom(ctx, oldRoom, username, msgHandler)
-		return fmt.Errorf("failed to join new room: %w", err)
+	summaries := make([]domain.RoomSummary, 0, len(rooms))
+	for _, room := range rooms {
+		summaries = append(summaries, domain.RoomSummary{Room: room, Unread: unread[room.Name]})
+	}
+	return summaries, nil
+}
+
+// visibleRooms returns the records of all rooms sorted by name, leaving out
+// private rooms the user cannot see and other invisible users from member counts
+func (c *chatService) visibleRooms(ctx context.Context, username string) ([]domain.Room, error) {
+	names, err := c.redisClient.SMembers(ctx, "all_rooms")
+	if err != nil {
+		return nil, err
 	}
+	sort.Strings(names)
+
+	rooms, err := c.redisClient.GetRooms(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	visible := rooms[:0]
+	for _, room := range rooms {
+		ok, err := c.canSeeRoom(ctx, room, username)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			visible = append(visible, room)
+		}
+	}
+	if err := c.hideInvisible(ctx, username, visible); err != nil {
+		return nil, err
+	}
+	return visible, nil
+}
+
+// MarkRead moves the user's read marker of a room to messageID and tells the
+// room, unless the user had already read that far, is muted there or is invisible.
+// Receipts are throttled per user.
+func (c *chatService) MarkRead(ctx context.Context, roomName, username, connID, messageID string) error {
+	if err := c.checkMember(ctx, roomName, username); err != nil {
+		return err
+	}
+	moved, err := c.redisClient.MarkRead(ctx, username, roomName, messageID)
+	if err != nil || !moved {
+		return err
+	}
+	muted, err := c.redisClient.IsMuted(ctx, roomName, username)
+	if err != nil || muted {
+		return err
+	}
+	if c.invisible(ctx, username) {
+		return nil
+	}
+	return c.queueReceipt(ctx, roomName, username, connID, messageID)
+}
+
+// SwitchRoom moves a user's connection from oldRoom to newRoom. The connection
+// subscribes to newRoom first, then its membership moves in one Redis step, and only
+// then is oldRoom unsubscribed, so the user is never seen in both rooms or in neither.
+// If the move fails, the new subscription is dropped and the user stays in oldRoom.
+// newRoom must admit the user as with CheckRoomAccess, given password.
+func (c *chatService) SwitchRoom(ctx context.Context, oldRoom, newRoom, username, connID, password string, msgHandler func(domain.ChatMessage)) error {
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"old_room": oldRoom,
+		"new_room": newRoom,
+		"username": username,
+		"conn_id":  connID,
+	})
 
+	if oldRoom == "" || !validRoomName(newRoom) || !domain.ValidName(username) {
+		log.Warnf("Invalid room name or username")
+		return domain.ErrInvalidRequest
+	}
+	if oldRoom == newRoom {
+		return nil
+	}
+
+	if err := c.CheckRoomAccess(ctx, newRoom, username, password); err != nil {
+		log.Warnf("Join refused: %v", err)
+		return err
+	}
+
+	log.Infof("User switching rooms")
+
+	if err := c.natsClient.SubscribeRoom(ctx, newRoom, connID, msgHandler); err != nil {
+		log.Errorf("Failed to subscribe to NATS: %v", err)
+		return fmt.Errorf("failed to subscribe to NATS: %w", err)
+	}
+
+	left, joined, err := c.redisClient.SwitchRoomConnection(ctx, oldRoom, newRoom, username, connID,
+		c.defaultCapacity(newRoom), ownedRoom(newRoom), c.cfg.RoomIdleTimeout)
+	if err != nil {
+		if err := c.natsClient.UnsubscribeRoom(ctx, newRoom, connID); err != nil {
+			log.Errorf("Failed to drop room subscription: %v", err)
+		}
+		if errors.Is(err, domain.ErrRoomFull) {
+			log.Warnf("Join refused: %v", err)
+			return err
+		}
+		log.Errorf("Failed to move user to room: %v", err)
+		return fmt.Errorf("failed to move user to room: %w", err)
+	}
+
+	if err := c.StopTyping(ctx, oldRoom, username, connID); err != nil {
+		log.Errorf("Failed to stop typing indicator: %v", err)
+	}
+	// The local subscriber is gone even if closing the shared NATS subscription fails
+	if err := c.natsClient.UnsubscribeRoom(ctx, oldRoom, connID); err != nil {
+		log.Errorf("failed to unsubscribe from room %s: %v", oldRoom, err)
+	}
+
+	if err := c.redisClient.InitLastRead(ctx, username, newRoom); err != nil {
+		log.Errorf("Failed to initialize read marker: %v", err)
+	}
+	c.publishRoomChange(ctx, oldRoom, username, left)
+	c.publishRoomChange(ctx, newRoom, username, joined)
+
+	if left.Left {
+		c.announceLeave(ctx, oldRoom, username, connID)
+	}
+	if joined.Joined {
+		c.announceJoin(ctx, newRoom, username, connID)
+	}
+
+	log.Infof("%s moved from room %s to %s", username, oldRoom, newRoom)
 	return nil
 }
+
+// announceJoin tells a room that a user joined it, unless the user is invisible
+func (c *chatService) announceJoin(ctx context.Context, roomName, username, connID string) {
+	if c.invisible(ctx, username) {
+		return
+	}
+	c.PublishMessage(ctx, domain.ChatMessage{
+		Type:      domain.MessageTypeSystem,
+		Content:   fmt.Sprintf("%s joined the room %s", username, roomName),
+		Room:      roomName,
+		ConnID:    connID,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// announceLeave tells a room that a user left it, unless the user is invisible
+func (c *chatService) announceLeave(ctx context.Context, roomName, username, connID string) {
+	if c.invisible(ctx, username) {
+		return
+	}
+	c.PublishMessage(ctx, domain.ChatMessage{
+		Type:      domain.MessageTypeSystem,
+		Content:   fmt.Sprintf("%s left the room", username),
+		Room:      roomName,
+		ConnID:    connID,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/redis"
+	"github.com/google/uuid"
+)
+
+// publishEvent stamps a domain event and publishes it. Events are best effort:
+// a failure is logged and never fails the change that caused it.
+func (c *chatService) publishEvent(ctx context.Context, event domain.Event) {
+	event.Version = domain.EventVersion
+	event.ID = uuid.New().String()
+	event.Timestamp = time.Now().Format("2006-01-02 15:04:05")
+	if err := c.natsClient.PublishEvent(ctx, event); err != nil {
+		c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+			"event": event.Type,
+			"room":  event.Room,
+		}).Errorf("Failed to publish event: %v", err)
+	}
+}
+
+// publishRoomChange publishes the events of a user's connection joining or leaving a room.
+// An invisible user's joins and leaves are left out, and rooms they create have no creator.
+func (c *chatService) publishRoomChange(ctx context.Context, roomName, username string, change redis.RoomChange) {
+	if (change.Created || change.Joined || change.Left) && c.invisible(ctx, username) {
+		change.Joined, change.Left = false, false
+		username = ""
+	}
+	if change.Created {
+		c.publishEvent(ctx, domain.Event{Type: domain.EventRoomCreated, Room: roomName, Username: username})
+	}
+	if change.Joined {
+		c.publishEvent(ctx, domain.Event{Type: domain.EventUserJoinedRoom, Room: roomName, Username: username})
+	}
+	if change.Left {
+		c.publishEvent(ctx, domain.Event{Type: domain.EventUserLeftRoom, Room: roomName, Username: username})
+	}
+	if change.Dropped {
+		c.publishEvent(ctx, domain.Event{Type: domain.EventRoomDeleted, Room: roomName})
+	}
+}
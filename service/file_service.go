@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/redis"
+	"github.com/SphrGhfri/chatroom_golang_nats/pkg/logger"
+	"github.com/google/uuid"
+)
+
+// FileService stores uploaded files and serves them to room members
+type FileService interface {
+	Authenticate(ctx context.Context, token string) (string, error)
+	Upload(ctx context.Context, username, room, name string, content io.Reader) (domain.Attachment, error)
+	Open(ctx context.Context, username, id string) (domain.Attachment, *os.File, error)
+	MaxSize() int64
+}
+
+const defaultMaxUploadSize = 10 << 20
+
+// defaultAllowedTypes are the MIME types accepted when none are configured
+var defaultAllowedTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain"}
+
+// FileConfig holds where uploads are stored and what is accepted.
+// Zero values fall back to sensible defaults.
+type FileConfig struct {
+	Dir          string
+	MaxSize      int64
+	AllowedTypes []string
+}
+
+type fileService struct {
+	redisClient *redis.RedisClient
+	logger      logger.Logger
+	cfg         FileConfig
+	allowed     map[string]bool
+}
+
+func NewFileService(ctx context.Context, rc *redis.RedisClient, cfg FileConfig) (FileService, error) {
+	log := logger.FromContext(ctx).WithModule("files")
+	if cfg.Dir == "" {
+		cfg.Dir = "uploads"
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultMaxUploadSize
+	}
+	if len(cfg.AllowedTypes) == 0 {
+		cfg.AllowedTypes = defaultAllowedTypes
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	allowed := make(map[string]bool, len(cfg.AllowedTypes))
+	for _, t := range cfg.AllowedTypes {
+		allowed[t] = true
+	}
+	return &fileService{
+		redisClient: rc,
+		logger:      log,
+		cfg:         cfg,
+		allowed:     allowed,
+	}, nil
+}
+
+func (f *fileService) MaxSize() int64 { return f.cfg.MaxSize }
+
+// Authenticate returns the user a session token belongs to. Detached sessions
+// still count, so a client can keep transferring files while it reconnects.
+func (f *fileService) Authenticate(ctx context.Context, token string) (string, error) {
+	session, err := f.redisClient.GetSession(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	return session.Username, nil
+}
+
+// Upload stores a file for a room the user is in. Files are stored once per content
+// hash, however often they are uploaded; each upload gets its own attachment ID.
+func (f *fileService) Upload(ctx context.Context, username, room, name string, content io.Reader) (domain.Attachment, error) {
+	log := f.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"room":     room,
+	})
+
+	if err := f.checkMember(ctx, username, room); err != nil {
+		return domain.Attachment{}, err
+	}
+
+	tmp, err := os.CreateTemp(f.cfg.Dir, "upload-*")
+	if err != nil {
+		log.Errorf("Failed to create temporary file: %v", err)
+		return domain.Attachment{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Hash while copying, reading one byte past the limit to detect oversized files
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(content, f.cfg.MaxSize+1))
+	if err != nil {
+		log.Errorf("Failed to store upload: %v", err)
+		return domain.Attachment{}, err
+	}
+	if size > f.cfg.MaxSize {
+		return domain.Attachment{}, domain.ErrFileTooLarge
+	}
+
+	// The type is sniffed from the content; the client's claim is not trusted
+	head := make([]byte, 512)
+	n, _ := tmp.ReadAt(head, 0)
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if !f.allowed[mimeType] {
+		return domain.Attachment{}, domain.ErrFileTypeBlocked
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if _, err := os.Stat(f.blobPath(sum)); os.IsNotExist(err) {
+		if err := os.Rename(tmp.Name(), f.blobPath(sum)); err != nil {
+			log.Errorf("Failed to move upload into place: %v", err)
+			return domain.Attachment{}, err
+		}
+	}
+
+	att := domain.Attachment{
+		ID:       uuid.New().String(),
+		Name:     filepath.Base(name),
+		MimeType: mimeType,
+		Size:     size,
+		Hash:     sum,
+		Room:     room,
+		Uploader: username,
+	}
+	if err := f.redisClient.SaveAttachment(ctx, att); err != nil {
+		return domain.Attachment{}, err
+	}
+	log.Infof("Stored attachment %s (%d bytes)", att.ID, size)
+	return att, nil
+}
+
+// Open returns an attachment and its content if the user is in the room it was uploaded to
+func (f *fileService) Open(ctx context.Context, username, id string) (domain.Attachment, *os.File, error) {
+	att, err := f.redisClient.GetAttachment(ctx, id)
+	if err != nil {
+		return domain.Attachment{}, nil, err
+	}
+	if err := f.checkMember(ctx, username, att.Room); err != nil {
+		return domain.Attachment{}, nil, err
+	}
+
+	file, err := os.Open(f.blobPath(att.Hash))
+	if err != nil {
+		f.logger.WithContext(ctx).Errorf("Failed to open stored file %s: %v", att.Hash, err)
+		return domain.Attachment{}, nil, err
+	}
+	return att, file, nil
+}
+
+// checkMember allows access to a room's files only to its members
+func (f *fileService) checkMember(ctx context.Context, username, room string) error {
+	member, err := f.redisClient.IsRoomMember(ctx, room, username)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return domain.ErrNotPermitted
+	}
+	return nil
+}
+
+func (f *fileService) blobPath(hash string) string { return filepath.Join(f.cfg.Dir, hash) }
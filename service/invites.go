@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultInviteTTL is how long an invite token lasts if no lifetime is requested
+	defaultInviteTTL = 24 * time.Hour
+
+	// maxInviteTTL bounds the lifetime of an invite token
+	maxInviteTTL = 30 * 24 * time.Hour
+)
+
+// InviteUser puts a user on the allowlist of a private or invite-only room and notifies them
+func (c *chatService) InviteUser(ctx context.Context, roomName, inviter, invitee string) error {
+	if !domain.ValidName(invitee) {
+		return domain.ErrInvalidRequest
+	}
+	if err := c.authorizeInvite(ctx, roomName, inviter); err != nil {
+		return err
+	}
+	if err := c.redisClient.AllowRoomMember(ctx, roomName, invitee); err != nil {
+		return err
+	}
+
+	c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":    roomName,
+		"inviter": inviter,
+		"invitee": invitee,
+	}).Infof("User invited to room")
+	return c.natsClient.PublishUser(ctx, invitee, domain.ChatMessage{
+		Type:      domain.MessageTypeInvite,
+		Sender:    inviter,
+		Room:      roomName,
+		Content:   fmt.Sprintf("%s invited you to %s", inviter, roomName),
+		Invite:    &domain.Invite{Username: invitee},
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// CreateInvite creates a shareable invite token for a private or invite-only room. It expires after
+// expiresIn, or a day if that is zero, and can be redeemed maxUses times, or any number if zero.
+func (c *chatService) CreateInvite(ctx context.Context, roomName, inviter string, maxUses int64, expiresIn time.Duration) (domain.Invite, error) {
+	if expiresIn == 0 {
+		expiresIn = defaultInviteTTL
+	}
+	if maxUses < 0 || expiresIn < 0 || expiresIn > maxInviteTTL {
+		return domain.Invite{}, domain.ErrInvalidRequest
+	}
+	if err := c.authorizeInvite(ctx, roomName, inviter); err != nil {
+		return domain.Invite{}, err
+	}
+
+	invite := domain.Invite{
+		Token:     uuid.New().String(),
+		MaxUses:   maxUses,
+		ExpiresIn: int64(expiresIn / time.Second),
+		ExpiresAt: time.Now().Add(expiresIn).Format("2006-01-02 15:04:05"),
+	}
+	if err := c.redisClient.CreateInvite(ctx, invite.Token, roomName, inviter, maxUses, expiresIn); err != nil {
+		return domain.Invite{}, err
+	}
+	return invite, nil
+}
+
+// RedeemInvite uses an invite token to let the user into a private or invite-only room.
+// It reports whether a redemption was used up; if the user then fails to join, ReturnInvite
+// gives it back.
+func (c *chatService) RedeemInvite(ctx context.Context, roomName, username, token string) (bool, error) {
+	return c.redisClient.RedeemInvite(ctx, token, roomName, username)
+}
+
+// ReturnInvite undoes a redemption of an invite token by a user who could not join the room
+func (c *chatService) ReturnInvite(ctx context.Context, roomName, username, token string) error {
+	return c.redisClient.ReturnInvite(ctx, token, roomName, username)
+}
+
+// authorizeInvite allows the room's owners and moderators to invite to a private or invite-only room
+func (c *chatService) authorizeInvite(ctx context.Context, roomName, username string) error {
+	room, err := c.redisClient.GetRoom(ctx, roomName)
+	if err != nil {
+		return err
+	}
+	if room.Visibility != domain.RoomPrivate && room.Visibility != domain.RoomInvite {
+		return domain.ErrInvalidRequest
+	}
+	return c.authorize(ctx, roomName, username, permInvite)
+}
+
+// checkInvited returns domain.ErrNotPermitted if the room is private or invite-only
+// and the user is neither in it nor on its allowlist
+func (c *chatService) checkInvited(ctx context.Context, roomName, username string) error {
+	room, err := c.redisClient.GetRoom(ctx, roomName)
+	if errors.Is(err, domain.ErrRoomNotFound) {
+		return nil
+	}
+	if err != nil || (room.Visibility != domain.RoomPrivate && room.Visibility != domain.RoomInvite) {
+		return err
+	}
+
+	member, err := c.redisClient.IsRoomMember(ctx, roomName, username)
+	if err != nil || member {
+		return err
+	}
+	allowed, err := c.redisClient.IsRoomAllowed(ctx, roomName, username)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return domain.ErrNotPermitted
+	}
+	return nil
+}
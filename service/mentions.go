@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+)
+
+// mentionPattern matches @name tokens that are not part of a word, e.g. an e-mail address
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([\w.-]+)`)
+
+// parseMentions returns the distinct names mentioned in content, in order of appearance
+func parseMentions(content string) []string {
+	var mentions []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		// Trailing punctuation ends a sentence, not a name
+		name := strings.TrimRight(match[1], ".-")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		mentions = append(mentions, name)
+	}
+	return mentions
+}
+
+// notifyMentions sends a mention notification to every online user mentioned in a
+// stored chat message, and tells the sender about mentioned users outside the room.
+// @room and @here address everyone currently in the room. Only users who may enter
+// the room get the message's content.
+func (c *chatService) notifyMentions(ctx context.Context, msg domain.ChatMessage) {
+	if len(msg.Mentions) == 0 {
+		return
+	}
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":   msg.Room,
+		"sender": msg.Sender,
+	})
+
+	members, err := c.ListRoomMembers(ctx, msg.Room)
+	if err != nil {
+		log.Errorf("Failed to list room members for mentions: %v", err)
+		return
+	}
+	inRoom := make(map[string]bool, len(members))
+	for _, member := range members {
+		inRoom[member] = true
+	}
+
+	recipients := make(map[string]bool)
+	var notInRoom []string
+	for _, mention := range msg.Mentions {
+		if mention == domain.MentionRoom || mention == domain.MentionHere {
+			for _, member := range members {
+				recipients[member] = true
+			}
+			continue
+		}
+
+		if !inRoom[mention] {
+			notInRoom = append(notInRoom, mention)
+		}
+		active, err := c.IsUserActive(ctx, mention)
+		if err != nil {
+			continue
+		}
+		if active {
+			recipients[mention] = true
+		}
+	}
+	delete(recipients, msg.Sender)
+
+	notification := msg
+	notification.Type = domain.MessageTypeMention
+	notification.ConnID = ""
+	// Users who may not enter the room, or are banned from it, only learn who
+	// mentioned them where
+	withheld := domain.ChatMessage{
+		Type:      domain.MessageTypeMention,
+		ID:        msg.ID,
+		Sender:    msg.Sender,
+		Room:      msg.Room,
+		Timestamp: msg.Timestamp,
+	}
+	for username := range recipients {
+		notification := notification
+		if c.CheckRoomAccess(ctx, msg.Room, username, "") != nil {
+			notification = withheld
+		}
+		if err := c.natsClient.PublishUser(ctx, username, notification); err != nil {
+			log.Errorf("Failed to notify %s of mention: %v", username, err)
+		}
+	}
+
+	if len(notInRoom) > 0 {
+		warning := domain.ChatMessage{
+			Type:     domain.MessageTypeMentionWarning,
+			ID:       msg.ID,
+			Room:     msg.Room,
+			Mentions: notInRoom,
+			Content:  fmt.Sprintf("Not in room %s: %s", msg.Room, strings.Join(notInRoom, ", ")),
+		}
+		if err := c.natsClient.PublishUser(ctx, msg.Sender, warning); err != nil {
+			log.Errorf("Failed to warn sender about mentions: %v", err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+)
+
+const (
+	// historyPageSize is the number of messages returned per get_history request
+	historyPageSize = 50
+
+	// maxEmojiLength bounds the size of a reaction in bytes
+	maxEmojiLength = 32
+
+	// maxAttachments is the number of files a single message can carry
+	maxAttachments = 10
+)
+
+// GetHistory returns the stored messages of a room before beforeID, or the most recent
+// ones if beforeID is empty, with reaction tallies as seen by username. Only members
+// of the room can read it.
+func (c *chatService) GetHistory(ctx context.Context, roomName, username, beforeID string) ([]domain.ChatMessage, error) {
+	if err := c.checkMember(ctx, roomName, username); err != nil {
+		return nil, err
+	}
+	messages, err := c.redisClient.HistoryBefore(ctx, roomName, beforeID, historyPageSize)
+	if err != nil {
+		return nil, err
+	}
+	return c.withDetails(ctx, roomName, username, messages)
+}
+
+// GetThread returns the root of the thread a message belongs to, followed by all its replies
+func (c *chatService) GetThread(ctx context.Context, roomName, username, messageID string) ([]domain.ChatMessage, error) {
+	if err := c.checkMember(ctx, roomName, username); err != nil {
+		return nil, err
+	}
+	root, err := c.redisClient.GetMessage(ctx, roomName, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if root.ThreadID != "" {
+		if root, err = c.redisClient.GetMessage(ctx, roomName, root.ThreadID); err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := c.redisClient.ThreadReplies(ctx, roomName, root.ID, historyLimit)
+	if err != nil {
+		return nil, err
+	}
+	return c.withDetails(ctx, roomName, username, append([]domain.ChatMessage{root}, replies...))
+}
+
+// resolveThread places a reply in the thread of the message it replies to
+func (c *chatService) resolveThread(ctx context.Context, msg *domain.ChatMessage) error {
+	msg.ThreadID = ""
+	msg.ReplyCount = 0
+	if msg.ReplyTo == "" {
+		return nil
+	}
+
+	parent, err := c.redisClient.GetMessage(ctx, msg.Room, msg.ReplyTo)
+	if err != nil {
+		return err
+	}
+	if parent.Deleted {
+		return domain.ErrMessageNotFound
+	}
+	msg.ThreadID = parent.ID
+	if parent.ThreadID != "" {
+		msg.ThreadID = parent.ThreadID
+	}
+	return nil
+}
+
+// resolveAttachments replaces the attachment IDs of a message with the stored metadata.
+// Only files the sender uploaded to the message's room can be attached.
+func (c *chatService) resolveAttachments(ctx context.Context, msg *domain.ChatMessage) error {
+	if len(msg.Attachments) > maxAttachments {
+		return domain.ErrInvalidRequest
+	}
+	for i, requested := range msg.Attachments {
+		att, err := c.redisClient.GetAttachment(ctx, requested.ID)
+		if err != nil {
+			return err
+		}
+		if att.Room != msg.Room || att.Uploader != msg.Sender {
+			return domain.ErrAttachmentNotFound
+		}
+		msg.Attachments[i] = att
+	}
+	return nil
+}
+
+// EditMessage replaces the content of a stored message and sends the edited
+// message to the room as an edit_message event. Editing counts as posting, so
+// read-only and muted users cannot edit.
+func (c *chatService) EditMessage(ctx context.Context, roomName, username, connID, messageID, content string) error {
+	if err := c.checkMember(ctx, roomName, username); err != nil {
+		return err
+	}
+	if err := c.authorizePost(ctx, roomName, username); err != nil {
+		return err
+	}
+	if err := c.checkMuted(ctx, roomName, username); err != nil {
+		return err
+	}
+	updated, err := c.redisClient.UpdateMessage(ctx, roomName, messageID, func(msg *domain.ChatMessage) error {
+		if msg.Deleted {
+			return domain.ErrMessageNotFound
+		}
+		if err := c.authorizeMessageChange(ctx, domain.MessageTypeEdit, roomName, username, msg); err != nil {
+			return err
+		}
+		msg.Content = content
+		msg.Edited = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.publishMessageUpdate(ctx, domain.MessageTypeEdit, updated, connID)
+}
+
+// DeleteMessage replaces a stored message with a tombstone and sends it to the
+// room as a delete_message event
+func (c *chatService) DeleteMessage(ctx context.Context, roomName, username, connID, messageID string) error {
+	if err := c.checkMember(ctx, roomName, username); err != nil {
+		return err
+	}
+	updated, err := c.redisClient.UpdateMessage(ctx, roomName, messageID, func(msg *domain.ChatMessage) error {
+		if msg.Deleted {
+			return domain.ErrMessageNotFound
+		}
+		if err := c.authorizeMessageChange(ctx, domain.MessageTypeDelete, roomName, username, msg); err != nil {
+			return err
+		}
+		msg.Content = ""
+		msg.Attachments = nil
+		msg.Edited = false
+		msg.Deleted = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.redisClient.ClearReactions(ctx, roomName, messageID); err != nil {
+		c.logger.WithContext(ctx).Errorf("Failed to clear reactions of deleted message: %v", err)
+	}
+	if updated.ThreadID != "" {
+		if err := c.redisClient.RemoveReply(ctx, roomName, updated.ThreadID, messageID); err != nil {
+			c.logger.WithContext(ctx).Errorf("Failed to remove deleted reply from its thread: %v", err)
+		}
+	}
+	return c.publishMessageUpdate(ctx, domain.MessageTypeDelete, updated, connID)
+}
+
+// AddReaction adds the user's emoji reaction to a stored message and sends
+// the new tallies to the room. Muted users cannot react.
+func (c *chatService) AddReaction(ctx context.Context, roomName, username, connID, messageID, emoji string) error {
+	if !validEmoji(emoji) {
+		return domain.ErrInvalidRequest
+	}
+	if err := c.checkMember(ctx, roomName, username); err != nil {
+		return err
+	}
+	if err := c.checkMuted(ctx, roomName, username); err != nil {
+		return err
+	}
+	added, err := c.redisClient.AddReaction(ctx, roomName, messageID, emoji, username)
+	if err != nil || !added {
+		return err
+	}
+	return c.publishReactions(ctx, domain.MessageTypeAddReaction, roomName, username, connID, messageID, emoji)
+}
+
+// RemoveReaction takes back the user's emoji reaction and sends the new tallies to the room.
+// Muted users cannot take back reactions either.
+func (c *chatService) RemoveReaction(ctx context.Context, roomName, username, connID, messageID, emoji string) error {
+	if err := c.checkMember(ctx, roomName, username); err != nil {
+		return err
+	}
+	if err := c.checkMuted(ctx, roomName, username); err != nil {
+		return err
+	}
+	removed, err := c.redisClient.RemoveReaction(ctx, roomName, messageID, emoji, username)
+	if err != nil || !removed {
+		return err
+	}
+	return c.publishReactions(ctx, domain.MessageTypeRemoveReaction, roomName, username, connID, messageID, emoji)
+}
+
+// publishReactions relays a reaction change together with the message's current tallies
+func (c *chatService) publishReactions(ctx context.Context, msgType domain.MessageType, roomName, username, connID, messageID, emoji string) error {
+	reactions, err := c.redisClient.Reactions(ctx, roomName, []string{messageID}, "")
+	if err != nil {
+		return err
+	}
+	return c.PublishMessage(ctx, domain.ChatMessage{
+		Type:      msgType,
+		ID:        messageID,
+		ConnID:    connID,
+		Sender:    username,
+		Room:      roomName,
+		Emoji:     emoji,
+		Reactions: reactions[messageID],
+	})
+}
+
+// withDetails attaches reaction tallies, as seen by username, and reply counts to stored messages
+func (c *chatService) withDetails(ctx context.Context, roomName, username string, messages []domain.ChatMessage) ([]domain.ChatMessage, error) {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	reactions, err := c.redisClient.Reactions(ctx, roomName, ids, username)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := c.redisClient.ReplyCounts(ctx, roomName, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+		messages[i].ReplyCount = replies[messages[i].ID]
+	}
+	return messages, nil
+}
+
+// validEmoji accepts short reactions without whitespace
+func validEmoji(emoji string) bool {
+	return emoji != "" && len(emoji) <= maxEmojiLength && !strings.ContainsFunc(emoji, unicode.IsSpace)
+}
+
+// authorizeMessageChange allows only the original sender to edit a message;
+// the room's moderators can also delete it
+func (c *chatService) authorizeMessageChange(ctx context.Context, msgType domain.MessageType, roomName, username string, msg *domain.ChatMessage) error {
+	if msg.Sender == username {
+		return nil
+	}
+	if msgType == domain.MessageTypeDelete {
+		return c.authorize(ctx, roomName, username, permModerate)
+	}
+	return domain.ErrNotPermitted
+}
+
+// publishMessageUpdate relays a changed message to the room; it is already stored
+func (c *chatService) publishMessageUpdate(ctx context.Context, msgType domain.MessageType, msg domain.ChatMessage, connID string) error {
+	msg.Type = msgType
+	msg.ConnID = connID
+	return c.PublishMessage(ctx, msg)
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+)
+
+const (
+	// defaultMuteDuration is how long a mute lasts if no duration is given
+	defaultMuteDuration = 10 * time.Minute
+
+	// maxModerationDuration bounds how long a ban or mute can last
+	maxModerationDuration = 365 * 24 * time.Hour
+
+	// maxReasonLength bounds the size of a moderation reason in bytes
+	maxReasonLength = 256
+)
+
+// Kick removes a user from a room on whichever server they are connected to
+func (c *chatService) Kick(ctx context.Context, roomName, username, connID string, m domain.Moderation) error {
+	if err := validateModeration(roomName, m); err != nil {
+		return err
+	}
+	if _, err := c.authorizeOver(ctx, roomName, username, m.Username, permKick); err != nil {
+		return err
+	}
+	member, err := c.redisClient.IsRoomMember(ctx, roomName, m.Username)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return domain.ErrInvalidRequest
+	}
+
+	if err := c.announceModeration(ctx, domain.MessageTypeKick, roomName, username, connID, m); err != nil {
+		return err
+	}
+	return c.removeFromRoom(ctx, domain.MessageTypeKick, roomName, username, m)
+}
+
+// Ban keeps a user out of a room for the given duration, or until lifted if it is
+// zero, and removes them from it if they are in it
+func (c *chatService) Ban(ctx context.Context, roomName, username, connID string, m domain.Moderation) error {
+	if err := validateModeration(roomName, m); err != nil {
+		return err
+	}
+	if _, err := c.authorizeOver(ctx, roomName, username, m.Username, permBan); err != nil {
+		return err
+	}
+
+	duration := time.Duration(m.Duration) * time.Second
+	if err := c.redisClient.BanUser(ctx, roomName, m.Username, m.Reason, duration); err != nil {
+		return err
+	}
+	if duration > 0 {
+		m.Until = time.Now().Add(duration).Format("2006-01-02 15:04:05")
+	}
+
+	if err := c.announceModeration(ctx, domain.MessageTypeBan, roomName, username, connID, m); err != nil {
+		return err
+	}
+	return c.removeFromRoom(ctx, domain.MessageTypeBan, roomName, username, m)
+}
+
+// Mute stops a user from posting to a room for the given duration, or
+// defaultMuteDuration if it is zero
+func (c *chatService) Mute(ctx context.Context, roomName, username, connID string, m domain.Moderation) error {
+	if m.Duration == 0 {
+		m.Duration = int64(defaultMuteDuration / time.Second)
+	}
+	if err := validateModeration("", m); err != nil {
+		return err
+	}
+	if _, err := c.authorizeOver(ctx, roomName, username, m.Username, permMute); err != nil {
+		return err
+	}
+
+	duration := time.Duration(m.Duration) * time.Second
+	if err := c.redisClient.MuteUser(ctx, roomName, m.Username, duration); err != nil {
+		return err
+	}
+	m.Until = time.Now().Add(duration).Format("2006-01-02 15:04:05")
+	return c.announceModeration(ctx, domain.MessageTypeMute, roomName, username, connID, m)
+}
+
+// Unban lifts a user's ban from a room and tells the user, who can then join it again
+func (c *chatService) Unban(ctx context.Context, roomName, username, connID string, m domain.Moderation) error {
+	if err := validateLift(roomName, m); err != nil {
+		return err
+	}
+	if _, err := c.authorizeOver(ctx, roomName, username, m.Username, permBan); err != nil {
+		return err
+	}
+	lifted, err := c.redisClient.UnbanUser(ctx, roomName, m.Username)
+	if err != nil {
+		return err
+	}
+	if !lifted {
+		return domain.ErrInvalidRequest
+	}
+
+	if err := c.announceModeration(ctx, domain.MessageTypeUnban, roomName, username, connID, m); err != nil {
+		return err
+	}
+	return c.natsClient.PublishUser(ctx, m.Username, domain.ChatMessage{
+		Type:       domain.MessageTypeUnban,
+		Sender:     username,
+		Room:       roomName,
+		Moderation: &m,
+		Timestamp:  time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// Unmute lets a muted user post to a room again before the mute expires
+func (c *chatService) Unmute(ctx context.Context, roomName, username, connID string, m domain.Moderation) error {
+	if err := validateLift("", m); err != nil {
+		return err
+	}
+	if _, err := c.authorizeOver(ctx, roomName, username, m.Username, permMute); err != nil {
+		return err
+	}
+	lifted, err := c.redisClient.UnmuteUser(ctx, roomName, m.Username)
+	if err != nil {
+		return err
+	}
+	if !lifted {
+		return domain.ErrInvalidRequest
+	}
+	return c.announceModeration(ctx, domain.MessageTypeUnmute, roomName, username, connID, m)
+}
+
+// validateLift checks a request to lift a ban or mute, which takes no duration
+func validateLift(roomName string, m domain.Moderation) error {
+	if m.Duration != 0 {
+		return domain.ErrInvalidRequest
+	}
+	return validateModeration(roomName, m)
+}
+
+// validateModeration checks the duration and reason of a moderation request. Nobody
+// can be removed from the global room, where everyone else is sent.
+func validateModeration(roomName string, m domain.Moderation) error {
+	if roomName == "global" || m.Duration < 0 || len(m.Reason) > maxReasonLength {
+		return domain.ErrInvalidRequest
+	}
+	if time.Duration(m.Duration)*time.Second > maxModerationDuration {
+		return domain.ErrInvalidRequest
+	}
+	return nil
+}
+
+// announceModeration tells the room about a kick, ban or mute, or a lifted ban or mute
+func (c *chatService) announceModeration(ctx context.Context, msgType domain.MessageType, roomName, username, connID string, m domain.Moderation) error {
+	verbs := map[domain.MessageType]string{
+		domain.MessageTypeKick:   "kicked",
+		domain.MessageTypeBan:    "banned",
+		domain.MessageTypeMute:   "muted",
+		domain.MessageTypeUnban:  "unbanned",
+		domain.MessageTypeUnmute: "unmuted",
+	}
+	content := fmt.Sprintf("%s %s %s", username, verbs[msgType], m.Username)
+	if m.Until != "" {
+		content += " until " + m.Until
+	}
+	if m.Reason != "" {
+		content += ": " + m.Reason
+	}
+
+	c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     roomName,
+		"username": username,
+		"target":   m.Username,
+		"action":   msgType,
+	}).Infof("User moderated")
+	return c.PublishMessage(ctx, domain.ChatMessage{
+		Type:       domain.MessageTypeSystem,
+		Sender:     username,
+		Content:    content,
+		Room:       roomName,
+		ConnID:     connID,
+		Moderation: &m,
+		Timestamp:  time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// removeFromRoom has every server drop the user's connections from the room and
+// tells the user, whose connections in the room then move to the global room.
+// Sessions detached in the room move to the global room right away.
+func (c *chatService) removeFromRoom(ctx context.Context, msgType domain.MessageType, roomName, username string, m domain.Moderation) error {
+	msg := domain.ChatMessage{
+		Type:       msgType,
+		Sender:     username,
+		Room:       roomName,
+		Moderation: &m,
+		Timestamp:  time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if err := c.natsClient.PublishControl(ctx, msg); err != nil {
+		return err
+	}
+	if err := c.natsClient.PublishUser(ctx, m.Username, msg); err != nil {
+		return err
+	}
+	return c.evictDetached(ctx, roomName, m.Username)
+}
+
+// handleControl acts on control messages from any server, including this one
+func (c *chatService) handleControl(msg domain.ChatMessage) {
+	switch msg.Type {
+	case domain.MessageTypeKick, domain.MessageTypeBan:
+		if msg.Moderation == nil {
+			return
+		}
+		username := msg.Moderation.Username
+		for _, connID := range c.natsClient.RoomConnections(msg.Room, username) {
+			if err := c.LeaveRoom(c.ctx, msg.Room, username, connID); err != nil {
+				c.logger.Errorf("Failed to remove %s from %s: %v", username, msg.Room, err)
+			}
+		}
+	case domain.MessageTypeDisconnect:
+		if msg.ServerBan != nil {
+			c.disconnectAddress(msg)
+		}
+	}
+}
+
+// checkBanned returns domain.ErrBanned if the user is banned from the room
+func (c *chatService) checkBanned(ctx context.Context, roomName, username string) error {
+	banned, err := c.redisClient.IsBanned(ctx, roomName, username)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return domain.ErrBanned
+	}
+	return nil
+}
+
+// checkMuted returns domain.ErrMuted if the user is muted in the room
+func (c *chatService) checkMuted(ctx context.Context, roomName, username string) error {
+	muted, err := c.redisClient.IsMuted(ctx, roomName, username)
+	if err != nil {
+		return err
+	}
+	if muted {
+		return domain.ErrMuted
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/redis"
+)
+
+// runNode keeps this server's heartbeat alive and cleans up after the servers whose
+// heartbeat has lapsed, until the service's context ends
+func (c *chatService) runNode() {
+	ticker := time.NewTicker(c.cfg.NodeTimeout / 3)
+	defer ticker.Stop()
+	for {
+		if err := c.redisClient.Heartbeat(c.ctx, c.cfg.NodeID, c.cfg.NodeTimeout); err == nil {
+			c.sweepNodes()
+		}
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepNodes cleans up after every expired node no other server is sweeping
+func (c *chatService) sweepNodes() {
+	nodes, err := c.redisClient.ExpiredNodes(c.ctx)
+	if err != nil {
+		return
+	}
+	for _, node := range nodes {
+		claimed, err := c.redisClient.ClaimNodeSweep(c.ctx, node, c.cfg.NodeTimeout)
+		if err != nil || !claimed {
+			continue
+		}
+		c.sweepNode(node)
+	}
+}
+
+// sweepNode removes the connections an expired node left behind from presence and
+// their rooms, and ends their sessions. Sessions resumed on another node meanwhile are
+// left alone. If it fails, the node is swept again once the claim on it lapses.
+func (c *chatService) sweepNode(node string) {
+	log := c.logger.WithFields(map[string]interface{}{"node": node})
+
+	conns, err := c.redisClient.NodeConnections(c.ctx, node)
+	if err != nil {
+		return
+	}
+	log.Infof("Cleaning up %d connections of expired node", len(conns))
+	for _, conn := range conns {
+		taken, err := c.redisClient.TakeNodeConnection(c.ctx, node, conn)
+		if err != nil {
+			return
+		}
+		if taken {
+			c.dropConnection(conn)
+		}
+	}
+	c.redisClient.ForgetNode(c.ctx, node)
+}
+
+// dropConnection removes a connection of an expired node from presence and its rooms
+func (c *chatService) dropConnection(conn redis.NodeConn) {
+	log := c.logger.WithFields(map[string]interface{}{
+		"username": conn.Username,
+		"conn_id":  conn.ConnID,
+	})
+
+	if err := c.RemoveActiveUser(c.ctx, conn.Username, conn.ConnID); err != nil {
+		log.Errorf("Failed to remove user: %v", err)
+	}
+	rooms, err := c.redisClient.ConnectionRooms(c.ctx, conn.Username, conn.ConnID)
+	if err != nil {
+		log.Errorf("Failed to list rooms of connection: %v", err)
+		return
+	}
+	for _, roomName := range rooms {
+		if err := c.LeaveRoom(c.ctx, roomName, conn.Username, conn.ConnID); err != nil {
+			log.Errorf("Failed to remove user from room %s: %v", roomName, err)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxStatusTextLength bounds the custom text of a status in characters
+	maxStatusTextLength = 128
+
+	// maxStatusExpiry bounds how long a status set with set_status can be kept for
+	maxStatusExpiry = 7 * 24 * time.Hour
+)
+
+// presenceTracker remembers the users of this node with a presence change
+// waiting to be announced, and the rooms to tell about it
+type presenceTracker struct {
+	mu      sync.Mutex
+	pending map[string]map[string]struct{} // username -> rooms
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{pending: make(map[string]map[string]struct{})}
+}
+
+// idleState is a session of this node and when it last sent a frame
+type idleState struct {
+	mu         sync.Mutex // Serializes the session's idle changes, including their Redis writes
+	lastActive time.Time
+	idle       bool
+	timer      *time.Timer
+}
+
+// idleTracker remembers the sessions of this node so they can be marked idle
+// after AwayTimeout without frames
+type idleTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*idleState // token -> state
+}
+
+func newIdleTracker() *idleTracker {
+	return &idleTracker{sessions: make(map[string]*idleState)}
+}
+
+// SetStatus chooses the user's status and custom text. They lapse after
+// status.ExpiresIn seconds unless it is zero; online without text clears them.
+// Returns the user's resulting presence as they see it.
+func (c *chatService) SetStatus(ctx context.Context, username string, status domain.Presence) (domain.Presence, error) {
+	switch status.Status {
+	case domain.PresenceOnline, domain.PresenceAway, domain.PresenceBusy, domain.PresenceInvisible:
+	default:
+		return domain.Presence{}, domain.ErrInvalidRequest
+	}
+	status.Text = strings.TrimSpace(status.Text)
+	ttl := time.Duration(status.ExpiresIn) * time.Second
+	if utf8.RuneCountInString(status.Text) > maxStatusTextLength || status.ExpiresIn < 0 || ttl > maxStatusExpiry {
+		return domain.Presence{}, domain.ErrInvalidRequest
+	}
+
+	if err := c.redisClient.SetUserStatus(ctx, username, status.Status, status.Text, ttl); err != nil {
+		return domain.Presence{}, err
+	}
+	c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"status":   status.Status,
+	}).Infof("Status set")
+
+	c.schedulePresence(ctx, username)
+	if ttl > 0 {
+		time.AfterFunc(ttl, func() {
+			c.schedulePresence(c.ctx, username)
+		})
+	}
+	return c.redisClient.UserPresence(ctx, username)
+}
+
+// UserStatuses returns the presence of each user as the viewer sees it.
+// Invisible users are left out, except the viewer themselves.
+func (c *chatService) UserStatuses(ctx context.Context, viewer string, usernames []string) ([]domain.Presence, error) {
+	presences, err := c.redisClient.UserPresences(ctx, usernames)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]domain.Presence, 0, len(presences))
+	for _, presence := range presences {
+		if presence.Status == domain.PresenceInvisible && presence.Username != viewer {
+			continue
+		}
+		statuses = append(statuses, presence)
+	}
+	return statuses, nil
+}
+
+// invisible reports whether a user chose to appear offline, so their joins, leaves,
+// typing, read receipts and connection events are not told to anyone. If the status
+// cannot be read, the user is taken as invisible.
+func (c *chatService) invisible(ctx context.Context, username string) bool {
+	hidden, err := c.redisClient.IsInvisible(ctx, username)
+	return hidden || err != nil
+}
+
+// hideInvisible leaves invisible users other than viewer out of the member counts
+// and roles of rooms. An empty viewer sees no invisible users.
+func (c *chatService) hideInvisible(ctx context.Context, viewer string, rooms []domain.Room) error {
+	names := make([]string, len(rooms))
+	for i, room := range rooms {
+		names[i] = room.Name
+	}
+	invisible, err := c.redisClient.InvisibleMembers(ctx, names)
+	if err != nil {
+		return err
+	}
+	for i := range rooms {
+		for _, username := range invisible[rooms[i].Name] {
+			if username == viewer {
+				continue
+			}
+			rooms[i].Members--
+			delete(rooms[i].Roles, username)
+		}
+	}
+	return nil
+}
+
+// TouchSession records a frame from a session. A session without frames for
+// AwayTimeout is marked idle, and its next frame makes it active again.
+func (c *chatService) TouchSession(ctx context.Context, session domain.Session) {
+	c.idle.mu.Lock()
+	state, tracked := c.idle.sessions[session.Token]
+	if !tracked {
+		state = &idleState{}
+		c.idle.sessions[session.Token] = state
+	}
+	c.idle.mu.Unlock()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.timer == nil {
+		state.timer = time.AfterFunc(c.cfg.AwayTimeout, func() {
+			c.checkIdle(session, state)
+		})
+	}
+	state.lastActive = time.Now()
+	if !state.idle {
+		return
+	}
+	state.idle = false
+	state.timer.Reset(c.cfg.AwayTimeout)
+	if err := c.redisClient.SetSessionIdle(ctx, session.Token, false); err != nil {
+		return
+	}
+	c.schedulePresence(ctx, session.Username)
+}
+
+// checkIdle marks a session idle once AwayTimeout has passed since its last frame
+func (c *chatService) checkIdle(session domain.Session, state *idleState) {
+	c.idle.mu.Lock()
+	tracked := c.idle.sessions[session.Token] == state
+	c.idle.mu.Unlock()
+	if !tracked {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if left := c.cfg.AwayTimeout - time.Since(state.lastActive); left > 0 {
+		state.timer.Reset(left)
+		return
+	}
+	state.idle = true
+	if err := c.redisClient.SetSessionIdle(c.ctx, session.Token, true); err != nil {
+		return
+	}
+	c.logger.WithFields(map[string]interface{}{"username": session.Username}).Infof("Session idle")
+	c.schedulePresence(c.ctx, session.Username)
+}
+
+// forgetIdle stops tracking a session that was detached or ended
+func (c *chatService) forgetIdle(token string) {
+	c.idle.mu.Lock()
+	state, tracked := c.idle.sessions[token]
+	delete(c.idle.sessions, token)
+	c.idle.mu.Unlock()
+	if !tracked {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.timer != nil {
+		state.timer.Stop()
+	}
+}
+
+// WatchPresence delivers the presence frames of a user to one of the watcher's
+// connections and returns the user's current presence as others see it
+func (c *chatService) WatchPresence(ctx context.Context, username, connID string, msgHandler func(domain.ChatMessage)) (domain.Presence, error) {
+	if !domain.ValidName(username) {
+		return domain.Presence{}, domain.ErrInvalidRequest
+	}
+	if err := c.natsClient.SubscribePresence(ctx, username, connID, msgHandler); err != nil {
+		c.logger.WithContext(ctx).Errorf("Failed to subscribe to presence of %s: %v", username, err)
+		return domain.Presence{}, err
+	}
+	presence, err := c.redisClient.UserPresence(ctx, username)
+	if err != nil {
+		c.natsClient.UnsubscribePresence(ctx, username, connID)
+		return domain.Presence{}, err
+	}
+	return presence.Public(), nil
+}
+
+// UnwatchPresence stops delivering the presence frames of a user to a connection
+func (c *chatService) UnwatchPresence(ctx context.Context, username, connID string) error {
+	return c.natsClient.UnsubscribePresence(ctx, username, connID)
+}
+
+// WatchGlobalPresence delivers the presence frames of the users in the global room
+// to a connection. Everyone starts in the global room, so its presence frames would
+// reach every connection; only those that ask for them get them.
+func (c *chatService) WatchGlobalPresence(ctx context.Context, connID string, msgHandler func(domain.ChatMessage)) error {
+	if err := c.natsClient.SubscribeRoomPresence(ctx, "global", connID, msgHandler); err != nil {
+		c.logger.WithContext(ctx).Errorf("Failed to subscribe to presence of the global room: %v", err)
+		return err
+	}
+	return nil
+}
+
+// UnwatchGlobalPresence stops delivering the presence frames of the global room to a connection
+func (c *chatService) UnwatchGlobalPresence(ctx context.Context, connID string) error {
+	return c.natsClient.UnsubscribeRoomPresence(ctx, "global", connID)
+}
+
+// schedulePresence announces the user's presence once PresenceDelay has passed.
+// Changes within the delay are coalesced: only the status at its end is announced,
+// and only if it differs from the last one announced on any server. The rooms the
+// user is in now are told even if the user has left them by then. The global room
+// is only told through WatchGlobalPresence.
+func (c *chatService) schedulePresence(ctx context.Context, username string) {
+	rooms, err := c.redisClient.UserRooms(ctx, username)
+	if err != nil {
+		c.logger.WithContext(ctx).Errorf("Failed to list rooms of %s: %v", username, err)
+	}
+
+	c.presence.mu.Lock()
+	defer c.presence.mu.Unlock()
+
+	pending, scheduled := c.presence.pending[username]
+	if !scheduled {
+		pending = make(map[string]struct{})
+		c.presence.pending[username] = pending
+		time.AfterFunc(c.cfg.PresenceDelay, func() {
+			c.announcePresence(username)
+		})
+	}
+	for _, room := range rooms {
+		pending[room] = struct{}{}
+	}
+}
+
+// announcePresence sends a presence frame with the user's current presence, as others
+// see it, to their rooms and watchers, unless that presence was announced already
+func (c *chatService) announcePresence(username string) {
+	c.presence.mu.Lock()
+	rooms := c.presence.pending[username]
+	delete(c.presence.pending, username)
+	c.presence.mu.Unlock()
+
+	log := c.logger.WithFields(map[string]interface{}{"username": username})
+
+	presence, err := c.redisClient.UserPresence(c.ctx, username)
+	if err != nil {
+		log.Errorf("Failed to read presence: %v", err)
+		return
+	}
+	presence = presence.Public()
+	changed, err := c.redisClient.AnnouncePresence(c.ctx, presence)
+	if err != nil || !changed {
+		return
+	}
+	current, err := c.redisClient.UserRooms(c.ctx, username)
+	if err != nil {
+		log.Errorf("Failed to list rooms: %v", err)
+	}
+	for _, room := range current {
+		rooms[room] = struct{}{}
+	}
+
+	log.Infof("User is %s", presence.Status)
+	msg := domain.ChatMessage{
+		Type:      domain.MessageTypePresence,
+		ID:        uuid.New().String(),
+		Sender:    username,
+		Presence:  &presence,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	for room := range rooms {
+		msg.Room = room
+		publish := c.natsClient.PublishRoom
+		if room == "global" {
+			publish = c.natsClient.PublishRoomPresence
+		}
+		if err := publish(c.ctx, room, msg); err != nil {
+			log.Errorf("Failed to publish presence to room %s: %v", room, err)
+		}
+	}
+	msg.Room = ""
+	if err := c.natsClient.PublishPresence(c.ctx, username, msg); err != nil {
+		log.Errorf("Failed to publish presence to watchers: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+)
+
+// receiptState is a user whose read receipts in a room are being throttled
+type receiptState struct {
+	pending string // Latest message read since the last receipt, if any
+	connID  string
+	timer   *time.Timer
+}
+
+// receiptTracker coalesces the read receipts of this node, so a user reading
+// quickly through a room sends at most one receipt per ReceiptThrottle
+type receiptTracker struct {
+	mu     sync.Mutex
+	active map[string]*receiptState // room + "/" + username
+}
+
+func newReceiptTracker() *receiptTracker {
+	return &receiptTracker{active: make(map[string]*receiptState)}
+}
+
+func receiptKey(roomName, username string) string { return roomName + "/" + username }
+
+// queueReceipt tells the room that the user read up to messageID. The first receipt
+// goes out right away; later ones within ReceiptThrottle are merged into one for the
+// latest message, sent when the interval ends.
+func (c *chatService) queueReceipt(ctx context.Context, roomName, username, connID, messageID string) error {
+	key := receiptKey(roomName, username)
+
+	c.receipts.mu.Lock()
+	if state, throttled := c.receipts.active[key]; throttled {
+		state.pending, state.connID = messageID, connID
+		c.receipts.mu.Unlock()
+		return nil
+	}
+	state := &receiptState{}
+	c.receipts.active[key] = state
+	state.timer = time.AfterFunc(c.cfg.ReceiptThrottle, func() {
+		c.flushReceipt(key, state, roomName, username)
+	})
+	c.receipts.mu.Unlock()
+
+	return c.publishReceipt(ctx, roomName, username, connID, messageID)
+}
+
+// flushReceipt sends the receipt merged during a throttle interval, if any,
+// and starts the next interval; otherwise the user is no longer throttled
+func (c *chatService) flushReceipt(key string, state *receiptState, roomName, username string) {
+	c.receipts.mu.Lock()
+	messageID, connID := state.pending, state.connID
+	if messageID == "" {
+		delete(c.receipts.active, key)
+		c.receipts.mu.Unlock()
+		return
+	}
+	state.pending = ""
+	state.timer = time.AfterFunc(c.cfg.ReceiptThrottle, func() {
+		c.flushReceipt(key, state, roomName, username)
+	})
+	c.receipts.mu.Unlock()
+
+	if err := c.publishReceipt(c.ctx, roomName, username, connID, messageID); err != nil {
+		c.logger.WithFields(map[string]interface{}{"room": roomName, "username": username}).Errorf("Failed to publish read receipt: %v", err)
+	}
+}
+
+func (c *chatService) publishReceipt(ctx context.Context, roomName, username, connID, messageID string) error {
+	return c.PublishMessage(ctx, domain.ChatMessage{
+		Type:      domain.MessageTypeReadReceipt,
+		ID:        messageID,
+		Sender:    username,
+		Room:      roomName,
+		ConnID:    connID,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+)
+
+// permission is something a user can do in a room depending on their role
+type permission int
+
+const (
+	permPost        permission = iota // send chat messages
+	permSetTopic                      // change the room's topic
+	permModerate                      // delete other users' messages
+	permInvite                        // invite users to a private or invite-only room
+	permKick                          // remove users from the room
+	permBan                           // keep users out of the room
+	permMute                          // stop users from posting for a while
+	permGrantRole                     // change other users' roles
+	permAnnounce                      // post in announcement-only rooms
+	permSetSlowMode                   // change the room's slow mode, which does not apply to them
+)
+
+// rolePermissions is what each role may do in a room
+var rolePermissions = map[string][]permission{
+	domain.RoleOwner:     {permPost, permSetTopic, permModerate, permInvite, permKick, permBan, permMute, permGrantRole, permAnnounce, permSetSlowMode},
+	domain.RoleModerator: {permPost, permSetTopic, permModerate, permInvite, permKick, permBan, permMute, permGrantRole, permAnnounce, permSetSlowMode},
+	domain.RoleMember:    {permPost},
+}
+
+// authorize returns domain.ErrNotPermitted unless the user's role in the room grants perm
+func (c *chatService) authorize(ctx context.Context, roomName, username string, perm permission) error {
+	role, err := c.redisClient.GetRoomRole(ctx, roomName, username)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(rolePermissions[role], perm) {
+		return domain.ErrNotPermitted
+	}
+	return nil
+}
+
+// authorizePost returns domain.ErrNotPermitted unless the user may post to the room.
+// Announcement-only rooms take posts from owners and moderators only.
+func (c *chatService) authorizePost(ctx context.Context, roomName, username string) error {
+	if err := c.authorize(ctx, roomName, username, permPost); err != nil {
+		return err
+	}
+	announcementOnly, err := c.redisClient.IsAnnouncementOnly(ctx, roomName)
+	if err != nil || !announcementOnly {
+		return err
+	}
+	return c.authorize(ctx, roomName, username, permAnnounce)
+}
+
+// authorizeOver checks that the user may act with perm on another user of the room:
+// owners can act on anyone else, everyone else only on users with a lower role.
+// It returns the acting user's role.
+func (c *chatService) authorizeOver(ctx context.Context, roomName, username, target string, perm permission) (string, error) {
+	if !domain.ValidName(target) {
+		return "", domain.ErrInvalidRequest
+	}
+	if target == username {
+		return "", domain.ErrNotPermitted
+	}
+	if err := c.authorize(ctx, roomName, username, perm); err != nil {
+		return "", err
+	}
+
+	role, err := c.redisClient.GetRoomRole(ctx, roomName, username)
+	if err != nil {
+		return "", err
+	}
+	if role == domain.RoleOwner {
+		return role, nil
+	}
+	targetRole, err := c.redisClient.GetRoomRole(ctx, roomName, target)
+	if err != nil {
+		return "", err
+	}
+	if domain.RoleRank(targetRole) >= domain.RoleRank(role) {
+		return "", domain.ErrNotPermitted
+	}
+	return role, nil
+}
+
+// SetRole gives a user a role in a room and tells the room. Owners can give any role
+// to anyone else; moderators can only move users below them between the roles below them.
+func (c *chatService) SetRole(ctx context.Context, roomName, username, connID string, grant domain.RoleGrant) error {
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     roomName,
+		"username": username,
+		"target":   grant.Username,
+		"role":     grant.Role,
+	})
+
+	if !domain.ValidRole(grant.Role) {
+		return domain.ErrInvalidRequest
+	}
+	if _, err := c.redisClient.GetRoom(ctx, roomName); err != nil {
+		return err
+	}
+	role, err := c.authorizeOver(ctx, roomName, username, grant.Username, permGrantRole)
+	if err != nil {
+		return err
+	}
+	if role != domain.RoleOwner && domain.RoleRank(grant.Role) >= domain.RoleRank(role) {
+		return domain.ErrNotPermitted
+	}
+
+	current, err := c.redisClient.GetRoomRole(ctx, roomName, grant.Username)
+	if err != nil {
+		return err
+	}
+	if current == grant.Role {
+		return nil
+	}
+
+	if err := c.redisClient.SetRoomRole(ctx, roomName, grant.Username, grant.Role); err != nil {
+		return err
+	}
+	log.Infof("Room role changed from %s", current)
+	return c.PublishMessage(ctx, domain.ChatMessage{
+		Type:      domain.MessageTypeSystem,
+		Sender:    username,
+		Content:   fmt.Sprintf("%s made %s %s", username, grant.Username, roleDescription(grant.Role)),
+		Room:      roomName,
+		ConnID:    connID,
+		Role:      &grant,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// AssignRole gives a user a role in an existing room without any permission check,
+// for administrators. The room is told as with SetRole.
+func (c *chatService) AssignRole(ctx context.Context, roomName, username, role string) error {
+	if username == "" || !domain.ValidRole(role) {
+		return domain.ErrInvalidRequest
+	}
+	if _, err := c.redisClient.GetRoom(ctx, roomName); err != nil {
+		return err
+	}
+
+	current, err := c.redisClient.GetRoomRole(ctx, roomName, username)
+	if err != nil {
+		return err
+	}
+	if current == role {
+		return nil
+	}
+
+	if err := c.redisClient.SetRoomRole(ctx, roomName, username, role); err != nil {
+		return err
+	}
+	c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     roomName,
+		"username": username,
+		"role":     role,
+	}).Infof("Room role assigned, was %s", current)
+	return c.PublishMessage(ctx, domain.ChatMessage{
+		Type:      domain.MessageTypeSystem,
+		Content:   fmt.Sprintf("An administrator made %s %s", username, roleDescription(role)),
+		Room:      roomName,
+		Role:      &domain.RoleGrant{Username: username, Role: role},
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// roleDescription names a role in announcements
+func roleDescription(role string) string {
+	switch role {
+	case domain.RoleOwner:
+		return "an owner"
+	case domain.RoleModerator:
+		return "a moderator"
+	case domain.RoleReadOnly:
+		return "read-only"
+	default:
+		return "a member"
+	}
+}
@@ -0,0 +1,400 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// maxTopicLength bounds the size of a room topic in bytes
+	maxTopicLength = 256
+
+	// maxDescriptionLength bounds the size of a room description in bytes
+	maxDescriptionLength = 1024
+
+	// maxRoomNameLength bounds the size of a room name in bytes
+	maxRoomNameLength = 64
+
+	// maxPasswordLength is the longest password bcrypt can hash
+	maxPasswordLength = 72
+
+	// maxSlowMode bounds the time users must wait between messages in a room
+	maxSlowMode = 6 * time.Hour
+
+	// maxRoomSweepInterval bounds how long an idle room can outlive its timeout
+	maxRoomSweepInterval = time.Minute
+)
+
+// GetRoomInfo returns the record of a room with its member count and roles. Private rooms
+// are not found for users who cannot see them, and other invisible users are left out
+// of the count and roles; pass "" as username to skip both.
+func (c *chatService) GetRoomInfo(ctx context.Context, roomName, username string) (domain.Room, error) {
+	room, err := c.redisClient.GetRoom(ctx, roomName)
+	if err != nil {
+		return domain.Room{}, err
+	}
+	if username != "" {
+		visible, err := c.canSeeRoom(ctx, room, username)
+		if err != nil {
+			return domain.Room{}, err
+		}
+		if !visible {
+			return domain.Room{}, domain.ErrRoomNotFound
+		}
+	}
+
+	room.Roles, err = c.redisClient.GetRoomRoles(ctx, roomName)
+	if err != nil {
+		return domain.Room{}, err
+	}
+	if username != "" {
+		rooms := []domain.Room{room}
+		if err := c.hideInvisible(ctx, username, rooms); err != nil {
+			return domain.Room{}, err
+		}
+		room = rooms[0]
+	}
+	return room, nil
+}
+
+// SetTopic changes the topic of a room if the user's role allows it and tells the room.
+// An empty topic clears it.
+func (c *chatService) SetTopic(ctx context.Context, roomName, username, connID, topic string) error {
+	topic = strings.TrimSpace(topic)
+	if len(topic) > maxTopicLength {
+		return domain.ErrInvalidRequest
+	}
+
+	if err := c.authorize(ctx, roomName, username, permSetTopic); err != nil {
+		return err
+	}
+
+	if err := c.redisClient.SetRoomTopic(ctx, roomName, topic); err != nil {
+		return err
+	}
+	c.publishEvent(ctx, domain.Event{Type: domain.EventTopicChanged, Room: roomName, Username: username, Topic: topic})
+	room, err := c.redisClient.GetRoom(ctx, roomName)
+	if err != nil {
+		return err
+	}
+
+	content := fmt.Sprintf("%s changed the topic to: %s", username, topic)
+	if topic == "" {
+		content = fmt.Sprintf("%s cleared the topic", username)
+	}
+	return c.PublishMessage(ctx, domain.ChatMessage{
+		Type:      domain.MessageTypeSystem,
+		Sender:    username,
+		Content:   content,
+		Room:      roomName,
+		ConnID:    connID,
+		RoomInfo:  &room,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// SetSlowMode makes users wait the given seconds between messages in a room, or turns
+// slow mode off if it is zero, and tells the room. Owners and moderators are exempt.
+func (c *chatService) SetSlowMode(ctx context.Context, roomName, username, connID string, seconds int64) error {
+	if seconds < 0 || time.Duration(seconds)*time.Second > maxSlowMode {
+		return domain.ErrInvalidRequest
+	}
+	if err := c.authorize(ctx, roomName, username, permSetSlowMode); err != nil {
+		return err
+	}
+
+	if err := c.redisClient.SetRoomSlowMode(ctx, roomName, seconds); err != nil {
+		return err
+	}
+	room, err := c.redisClient.GetRoom(ctx, roomName)
+	if err != nil {
+		return err
+	}
+
+	content := fmt.Sprintf("%s turned on slow mode: one message every %s", username, time.Duration(seconds)*time.Second)
+	if seconds == 0 {
+		content = fmt.Sprintf("%s turned off slow mode", username)
+	}
+	return c.PublishMessage(ctx, domain.ChatMessage{
+		Type:      domain.MessageTypeSystem,
+		Sender:    username,
+		Content:   content,
+		Room:      roomName,
+		ConnID:    connID,
+		RoomInfo:  &room,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// SetAnnouncementOnly makes an existing room announcement-only, or lets everyone post to
+// it again, without any permission check, for administrators. The room is told.
+func (c *chatService) SetAnnouncementOnly(ctx context.Context, roomName string, announcementOnly bool) error {
+	room, err := c.redisClient.GetRoom(ctx, roomName)
+	if err != nil {
+		return err
+	}
+	if room.AnnouncementOnly == announcementOnly {
+		return nil
+	}
+	if err := c.redisClient.SetRoomAnnouncementOnly(ctx, roomName, announcementOnly); err != nil {
+		return err
+	}
+	room.AnnouncementOnly = announcementOnly
+
+	c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":              roomName,
+		"announcement_only": announcementOnly,
+	}).Infof("Room announcement-only changed")
+	content := "An administrator made the room announcement-only"
+	if !announcementOnly {
+		content = "An administrator let everyone post to the room again"
+	}
+	return c.PublishMessage(ctx, domain.ChatMessage{
+		Type:      domain.MessageTypeSystem,
+		Content:   content,
+		Room:      roomName,
+		RoomInfo:  &room,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// checkSlowMode returns a *domain.SlowModeError if the user has to wait before posting
+// to the room again, and otherwise starts their next cooldown
+func (c *chatService) checkSlowMode(ctx context.Context, roomName, username string) error {
+	err := c.authorize(ctx, roomName, username, permSetSlowMode)
+	if err == nil || !errors.Is(err, domain.ErrNotPermitted) {
+		return err
+	}
+	left, err := c.redisClient.StartSlowModeCooldown(ctx, roomName, username)
+	if err != nil {
+		return err
+	}
+	if left > 0 {
+		return &domain.SlowModeError{RetryAfter: left}
+	}
+	return nil
+}
+
+// CreateRoom creates a persistent room, which is kept even when nobody is in it.
+// An ad-hoc room of the same name becomes persistent. Password rooms need a password,
+// which is stored as a bcrypt hash; other rooms must not have one.
+func (c *chatService) CreateRoom(ctx context.Context, room domain.Room, password string) (domain.Room, error) {
+	room.Topic = strings.TrimSpace(room.Topic)
+	room.Description = strings.TrimSpace(room.Description)
+	if room.Visibility == "" {
+		room.Visibility = domain.RoomPublic
+	}
+	if !validRoomName(room.Name) || len(room.Topic) > maxTopicLength || len(room.Description) > maxDescriptionLength || room.MaxMembers < 0 {
+		return domain.Room{}, domain.ErrInvalidRequest
+	}
+	if err := validateVisibility(room, password); err != nil {
+		return domain.Room{}, err
+	}
+	if room.Name == "global" && room.MaxMembers > 0 {
+		return domain.Room{}, domain.ErrInvalidRequest
+	}
+	if !ownedRoom(room.Name) {
+		room.CreatedBy = ""
+	}
+	room.CreatedAt = time.Now().Format("2006-01-02 15:04:05")
+
+	var passwordHash string
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return domain.Room{}, err
+		}
+		passwordHash = string(hash)
+	}
+
+	if err := c.redisClient.CreateRoom(ctx, room, passwordHash); err != nil {
+		return domain.Room{}, err
+	}
+	if (room.Visibility == domain.RoomPrivate || room.Visibility == domain.RoomInvite) && room.CreatedBy != "" {
+		if err := c.redisClient.AllowRoomMember(ctx, room.Name, room.CreatedBy); err != nil {
+			return domain.Room{}, err
+		}
+	}
+	c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":       room.Name,
+		"created_by": room.CreatedBy,
+	}).Infof("Persistent room created")
+
+	created, err := c.redisClient.GetRoom(ctx, room.Name)
+	if err != nil {
+		return domain.Room{}, err
+	}
+	c.publishEvent(ctx, domain.Event{Type: domain.EventRoomCreated, Room: room.Name, Username: room.CreatedBy, RoomInfo: &created})
+	return created, nil
+}
+
+// CheckRoomAccess returns domain.ErrBanned if the user is banned from a room,
+// domain.ErrRoomFull if it is full and domain.ErrNotPermitted if they may not join it
+// otherwise: password rooms need their password and private and invite-only rooms an
+// invitation, unless the user is in the room already. JoinRoom and SwitchRoom check
+// it themselves; calling it first lets a client learn why it cannot join.
+func (c *chatService) CheckRoomAccess(ctx context.Context, roomName, username, password string) error {
+	if err := c.checkBanned(ctx, roomName, username); err != nil {
+		return err
+	}
+	if err := c.checkCapacity(ctx, roomName, username); err != nil {
+		return err
+	}
+	if err := c.checkInvited(ctx, roomName, username); err != nil {
+		return err
+	}
+	hash, err := c.redisClient.RoomPasswordHash(ctx, roomName)
+	if err != nil || hash == "" {
+		return err
+	}
+	member, err := c.redisClient.IsRoomMember(ctx, roomName, username)
+	if err != nil || member {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return domain.ErrNotPermitted
+	}
+	return nil
+}
+
+// canSeeRoom reports whether a user can see a room. Private rooms are shown to their
+// members and to users on their allowlist, such as their owner, who are not banned.
+func (c *chatService) canSeeRoom(ctx context.Context, room domain.Room, username string) (bool, error) {
+	if room.Visibility != domain.RoomPrivate {
+		return true, nil
+	}
+	member, err := c.redisClient.IsRoomMember(ctx, room.Name, username)
+	if err != nil || member {
+		return member, err
+	}
+	allowed, err := c.redisClient.IsRoomAllowed(ctx, room.Name, username)
+	if err != nil || !allowed {
+		return false, err
+	}
+	banned, err := c.redisClient.IsBanned(ctx, room.Name, username)
+	if err != nil {
+		return false, err
+	}
+	return !banned, nil
+}
+
+// checkMember returns domain.ErrBanned if the user is banned from the room and
+// domain.ErrNotPermitted if they are not in it. Reading and changing a room's
+// messages is open to its members only.
+func (c *chatService) checkMember(ctx context.Context, roomName, username string) error {
+	if err := c.checkBanned(ctx, roomName, username); err != nil {
+		return err
+	}
+	member, err := c.redisClient.IsRoomMember(ctx, roomName, username)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return domain.ErrNotPermitted
+	}
+	return nil
+}
+
+// checkCapacity returns domain.ErrRoomFull if the room is full and the user not in it.
+// It lets a join fail early; the join itself enforces the limit atomically.
+func (c *chatService) checkCapacity(ctx context.Context, roomName, username string) error {
+	room, err := c.redisClient.GetRoom(ctx, roomName)
+	if errors.Is(err, domain.ErrRoomNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	limit := room.MaxMembers
+	if limit <= 0 {
+		limit = c.defaultCapacity(roomName)
+	}
+	if limit <= 0 || room.Members < limit {
+		return nil
+	}
+	member, err := c.redisClient.IsRoomMember(ctx, roomName, username)
+	if err != nil || member {
+		return err
+	}
+	return domain.ErrRoomFull
+}
+
+// defaultCapacity is the member limit of a room that sets none. Everyone can always
+// be in the global room.
+func (c *chatService) defaultCapacity(roomName string) int64 {
+	if roomName == "global" {
+		return 0
+	}
+	return c.cfg.RoomCapacity
+}
+
+// ownedRoom reports whether whoever creates a room becomes its owner. Nobody owns the
+// global room.
+func ownedRoom(roomName string) bool {
+	return roomName != "global"
+}
+
+// DeleteRoom makes a persistent room ad-hoc again, so it goes away once it is empty
+func (c *chatService) DeleteRoom(ctx context.Context, roomName string) error {
+	dropped, err := c.redisClient.DeleteRoom(ctx, roomName)
+	if err != nil {
+		return err
+	}
+	if dropped {
+		c.publishEvent(ctx, domain.Event{Type: domain.EventRoomDeleted, Room: roomName})
+	}
+	return nil
+}
+
+// sweepIdleRooms drops ad-hoc rooms that are still empty after their idle timeout,
+// until the service's context ends. Every server sweeps, so rooms left to idle on
+// a server that has gone away expire too.
+func (c *chatService) sweepIdleRooms() {
+	ticker := time.NewTicker(min(c.cfg.RoomIdleTimeout/2, maxRoomSweepInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case now := <-ticker.C:
+			// Failures are logged, and the rooms are retried on the next tick
+			expired, _ := c.redisClient.ExpireIdleRooms(c.ctx, now)
+			for _, roomName := range expired {
+				c.logger.WithFields(map[string]interface{}{"room": roomName}).Infof("Idle room expired")
+				c.publishEvent(c.ctx, domain.Event{Type: domain.EventRoomDeleted, Room: roomName})
+			}
+		}
+	}
+}
+
+// validateVisibility checks that a room has a known visibility with a password
+// exactly if it is a password room. The default room stays public.
+func validateVisibility(room domain.Room, password string) error {
+	switch room.Visibility {
+	case domain.RoomPublic, domain.RoomPrivate, domain.RoomInvite:
+		if password != "" {
+			return domain.ErrInvalidRequest
+		}
+	case domain.RoomPassword:
+		if password == "" || len(password) > maxPasswordLength {
+			return domain.ErrInvalidRequest
+		}
+	default:
+		return domain.ErrInvalidRequest
+	}
+	if room.Name == "global" && room.Visibility != domain.RoomPublic {
+		return domain.ErrInvalidRequest
+	}
+	return nil
+}
+
+// validRoomName accepts short room names that are valid names
+func validRoomName(name string) bool {
+	return domain.ValidName(name) && len(name) <= maxRoomNameLength
+}
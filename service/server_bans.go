@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+)
+
+// addressTracker remembers the IP addresses of this node's connections, so that
+// an IP ban can close them
+type addressTracker struct {
+	mu    sync.Mutex
+	conns map[string]connAddress // conn ID -> address
+}
+
+// connAddress is the user of a connection and the IP address it came from
+type connAddress struct {
+	username string
+	ip       net.IP
+}
+
+func newAddressTracker() *addressTracker {
+	return &addressTracker{conns: make(map[string]connAddress)}
+}
+
+func (t *addressTracker) track(connID, username, ip string) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[connID] = connAddress{username: username, ip: addr}
+}
+
+func (t *addressTracker) forget(connID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, connID)
+}
+
+// from returns the connections from an IP address by conn ID
+func (t *addressTracker) from(ip net.IP) map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := make(map[string]string)
+	for connID, addr := range t.conns {
+		if addr.ip.Equal(ip) {
+			conns[connID] = addr.username
+		}
+	}
+	return conns
+}
+
+// CheckServerBan returns domain.ErrServerBanned, wrapped with the reason, if the
+// username or the IP address is banned from the server
+func (c *chatService) CheckServerBan(ctx context.Context, username, ip string) error {
+	reason, banned, err := c.redisClient.ServerBanReason(ctx, username, ip)
+	if err != nil {
+		return err
+	}
+	if !banned {
+		return nil
+	}
+	if reason == "" {
+		return domain.ErrServerBanned
+	}
+	return fmt.Errorf("%w: %s", domain.ErrServerBanned, reason)
+}
+
+// BanFromServer bans a username or an IP address from the whole server. Existing
+// connections of a banned user, or from a banned address, are closed on every server;
+// a banned user's detached sessions are ended as well.
+func (c *chatService) BanFromServer(ctx context.Context, ban domain.ServerBan) (domain.ServerBan, error) {
+	if (ban.Username == "") == (ban.IP == "") || ban.Duration < 0 || len(ban.Reason) > maxReasonLength {
+		return domain.ServerBan{}, domain.ErrInvalidRequest
+	}
+	if ban.Username != "" && !domain.ValidName(ban.Username) {
+		return domain.ServerBan{}, domain.ErrInvalidRequest
+	}
+	if ban.IP != "" && net.ParseIP(ban.IP) == nil {
+		return domain.ServerBan{}, domain.ErrInvalidRequest
+	}
+	duration := time.Duration(ban.Duration) * time.Second
+	if duration > maxModerationDuration {
+		return domain.ServerBan{}, domain.ErrInvalidRequest
+	}
+
+	if err := c.redisClient.BanFromServer(ctx, ban.Username, ban.IP, ban.Reason, duration); err != nil {
+		return domain.ServerBan{}, err
+	}
+	if duration > 0 {
+		ban.Until = time.Now().Add(duration).Format("2006-01-02 15:04:05")
+	}
+	c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": ban.Username,
+		"ip":       ban.IP,
+		"until":    ban.Until,
+	}).Infof("Banned from server")
+
+	reason := "You are banned from this server"
+	if ban.Reason != "" {
+		reason += ": " + ban.Reason
+	}
+	if ban.Username != "" {
+		if err := c.disconnect(ctx, ban.Username, reason); err != nil {
+			return domain.ServerBan{}, err
+		}
+		return ban, nil
+	}
+	// Every server closes its own connections from the address
+	if err := c.natsClient.PublishControl(ctx, domain.ChatMessage{
+		Type:      domain.MessageTypeDisconnect,
+		Content:   reason,
+		ServerBan: &ban,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	}); err != nil {
+		return domain.ServerBan{}, err
+	}
+	return ban, nil
+}
+
+// LiftServerBan lifts the server ban of a username or an IP address,
+// or returns domain.ErrBanNotFound if there is none
+func (c *chatService) LiftServerBan(ctx context.Context, username, ip string) error {
+	if (username == "") == (ip == "") {
+		return domain.ErrInvalidRequest
+	}
+	lifted, err := c.redisClient.LiftServerBan(ctx, username, ip)
+	if err != nil {
+		return err
+	}
+	if !lifted {
+		return domain.ErrBanNotFound
+	}
+	c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+		"ip":       ip,
+	}).Infof("Server ban lifted")
+	return nil
+}
+
+// DisconnectUser ends every session of a user. Connections on any server close
+// with the reason; detached sessions are ended right away so they cannot be resumed.
+func (c *chatService) DisconnectUser(ctx context.Context, username, reason string) error {
+	if !domain.ValidName(username) || len(reason) > maxReasonLength {
+		return domain.ErrInvalidRequest
+	}
+	return c.disconnect(ctx, username, reason)
+}
+
+// disconnect closes the user's connections on every server and ends their detached sessions
+func (c *chatService) disconnect(ctx context.Context, username, reason string) error {
+	if err := c.natsClient.PublishUser(ctx, username, domain.ChatMessage{
+		Type:      domain.MessageTypeDisconnect,
+		Content:   reason,
+		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+	}); err != nil {
+		return err
+	}
+
+	sessions, err := c.redisClient.EndDetachedSessions(ctx, username)
+	for _, session := range sessions {
+		c.dropPresence(session)
+	}
+	if err != nil {
+		return err
+	}
+	c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"username": username,
+	}).Infof("User disconnected, %d detached sessions ended", len(sessions))
+	return nil
+}
+
+// disconnectAddress closes this node's connections from the address of an IP ban
+func (c *chatService) disconnectAddress(msg domain.ChatMessage) {
+	ip := net.ParseIP(msg.ServerBan.IP)
+	if ip == nil {
+		return
+	}
+	for connID, username := range c.addresses.from(ip) {
+		if err := c.natsClient.PublishUser(c.ctx, username, domain.ChatMessage{
+			Type:      domain.MessageTypeDisconnect,
+			ConnID:    connID,
+			Content:   msg.Content,
+			Timestamp: msg.Timestamp,
+		}); err != nil {
+			c.logger.Errorf("Failed to disconnect %s from banned address: %v", username, err)
+		}
+	}
+}
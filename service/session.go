@@ -0,0 +1,281 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/google/uuid"
+)
+
+// StartSession creates a resumable session for a freshly connected user coming
+// from ip. Messages stored before this point are not considered missed.
+func (c *chatService) StartSession(ctx context.Context, username, ip string) (domain.Session, error) {
+	lastID, err := c.redisClient.CurrentMessageID(ctx)
+	if err != nil {
+		return domain.Session{}, fmt.Errorf("failed to read current message ID: %w", err)
+	}
+
+	session := domain.Session{
+		Token:    uuid.New().String(),
+		ConnID:   uuid.New().String(),
+		Username: username,
+		Room:     "global",
+		LastAck:  lastID,
+		Node:     c.cfg.NodeID,
+	}
+	if err := c.redisClient.CreateSession(ctx, session); err != nil {
+		return domain.Session{}, fmt.Errorf("failed to create session: %w", err)
+	}
+	c.addresses.track(session.ConnID, username, ip)
+	return session, nil
+}
+
+// ResumeSession re-attaches a detached session of username identified by token
+// to a connection from ip.
+// The user's presence and room membership were kept while detached, so only their
+// return from away is announced. A user banned from their room meanwhile resumes in
+// the global room.
+func (c *chatService) ResumeSession(ctx context.Context, token, username, ip string) (domain.Session, error) {
+	session, err := c.redisClient.ClaimSession(ctx, token, username, c.cfg.NodeID)
+	if err != nil {
+		return domain.Session{}, err
+	}
+	c.addresses.track(session.ConnID, username, ip)
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     session.Room,
+		"username": username,
+	})
+
+	if session.Room != "global" {
+		if err := c.checkBanned(ctx, session.Room, username); err != nil {
+			if !errors.Is(err, domain.ErrBanned) {
+				log.Errorf("Failed to check ban, resuming in global room: %v", err)
+			}
+			if err := c.moveToGlobal(ctx, session.Room, username, session.ConnID); err != nil {
+				c.EndSession(ctx, session)
+				return domain.Session{}, err
+			}
+			session.Room = "global"
+		}
+	}
+
+	log.Infof("Session resumed in room %s", session.Room)
+	c.schedulePresence(ctx, username)
+	return session, nil
+}
+
+// RestoreSession re-subscribes a resumed session to its room and delivers
+// every message stored after the session's last acknowledged message.
+func (c *chatService) RestoreSession(ctx context.Context, session domain.Session, msgHandler func(domain.ChatMessage)) error {
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     session.Room,
+		"username": session.Username,
+	})
+
+	gate := newReplayGate(msgHandler)
+	if err := c.natsClient.SubscribeRoom(ctx, session.Room, session.ConnID, gate.handle); err != nil {
+		log.Errorf("Failed to subscribe to NATS: %v", err)
+		return fmt.Errorf("failed to subscribe to NATS: %w", err)
+	}
+
+	missed, err := c.redisClient.HistorySince(ctx, session.Room, session.LastAck, historyLimit)
+	if err == nil {
+		missed, err = c.withDetails(ctx, session.Room, session.Username, missed)
+	}
+	if err != nil {
+		log.Errorf("Failed to load missed messages: %v", err)
+		gate.replay(nil)
+		return fmt.Errorf("failed to load missed messages: %w", err)
+	}
+
+	log.Infof("Replaying %d missed messages", len(missed))
+	gate.replay(missed)
+	return nil
+}
+
+// DetachSession stops delivery to a dropped connection but keeps the user in
+// their room until the grace period runs out without the session being resumed.
+func (c *chatService) DetachSession(ctx context.Context, session domain.Session) error {
+	log := c.logger.WithContext(ctx).WithFields(map[string]interface{}{
+		"room":     session.Room,
+		"username": session.Username,
+	})
+
+	c.forgetIdle(session.Token)
+	c.addresses.forget(session.ConnID)
+	if err := c.StopTyping(ctx, session.Room, session.Username, session.ConnID); err != nil {
+		log.Errorf("Failed to stop typing indicator: %v", err)
+	}
+	if err := c.natsClient.UnsubscribeRoom(ctx, session.Room, session.ConnID); err != nil {
+		log.Errorf("Failed to unsubscribe detached session: %v", err)
+	}
+	if err := c.UnsubscribeUser(ctx, session.Username, session.ConnID); err != nil {
+		log.Errorf("Failed to unsubscribe detached session from user messages: %v", err)
+	}
+
+	// Keep the key around past the grace period so a late expiry still finds it
+	epoch, err := c.redisClient.DetachSession(ctx, session.Token, session.Room, 2*c.cfg.ResumeGracePeriod)
+	if err != nil {
+		log.Errorf("Failed to detach session, ending it: %v", err)
+		return c.EndSession(ctx, session)
+	}
+
+	log.Infof("Session detached, resumable for %s", c.cfg.ResumeGracePeriod)
+	c.schedulePresence(ctx, session.Username)
+	time.AfterFunc(c.cfg.ResumeGracePeriod, func() {
+		c.expireSession(session.Token, epoch)
+	})
+	return nil
+}
+
+// evictDetached moves the user's sessions that are detached in a room to the global
+// room, together with their membership, so they do not resume in the room
+func (c *chatService) evictDetached(ctx context.Context, roomName, username string) error {
+	sessions, err := c.redisClient.MoveDetachedSessions(ctx, username, roomName, "global")
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err := c.moveToGlobal(ctx, roomName, username, session.ConnID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveToGlobal moves the membership of a connection that is not subscribed to any
+// room from roomName to the global room
+func (c *chatService) moveToGlobal(ctx context.Context, roomName, username, connID string) error {
+	left, joined, err := c.redisClient.SwitchRoomConnection(ctx, roomName, "global", username, connID,
+		c.defaultCapacity("global"), ownedRoom("global"), c.cfg.RoomIdleTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to move user to global room: %w", err)
+	}
+	c.publishRoomChange(ctx, roomName, username, left)
+	c.publishRoomChange(ctx, "global", username, joined)
+	if left.Left {
+		c.announceLeave(ctx, roomName, username, connID)
+	}
+	if joined.Joined {
+		c.announceJoin(ctx, "global", username, connID)
+	}
+	return nil
+}
+
+// EndSession removes the session and the user's presence immediately.
+func (c *chatService) EndSession(ctx context.Context, session domain.Session) error {
+	c.forgetIdle(session.Token)
+	c.addresses.forget(session.ConnID)
+	if err := c.redisClient.DeleteSession(ctx, session.Token, session.Username); err != nil {
+		c.logger.WithContext(ctx).Errorf("Failed to delete session: %v", err)
+	}
+	if err := c.UnsubscribeUser(ctx, session.Username, session.ConnID); err != nil {
+		c.logger.WithContext(ctx).Errorf("Failed to unsubscribe from user messages: %v", err)
+	}
+	if err := c.RemoveActiveUser(ctx, session.Username, session.ConnID); err != nil {
+		return err
+	}
+	if err := c.LeaveRoom(ctx, session.Room, session.Username, session.ConnID); err != nil {
+		return err
+	}
+	return c.redisClient.UntrackConnection(ctx, session.Node, session.ConnID)
+}
+
+// AckMessage records the last message a session has received.
+func (c *chatService) AckMessage(ctx context.Context, token, messageID string) error {
+	return c.redisClient.AckMessage(ctx, token, messageID)
+}
+
+// expireSession ends a detached session unless it was resumed meanwhile
+func (c *chatService) expireSession(token string, epoch int64) {
+	session, err := c.redisClient.ReleaseSession(c.ctx, token, epoch)
+	if err != nil {
+		// Resumed, re-detached or already gone
+		return
+	}
+
+	log := c.logger.WithFields(map[string]interface{}{
+		"room":     session.Room,
+		"username": session.Username,
+	})
+	log.Infof("Resume grace period expired")
+	c.dropPresence(session)
+}
+
+// dropPresence removes the presence and room membership of a session that was
+// deleted while detached
+func (c *chatService) dropPresence(session domain.Session) {
+	log := c.logger.WithFields(map[string]interface{}{
+		"room":     session.Room,
+		"username": session.Username,
+	})
+
+	if err := c.RemoveActiveUser(c.ctx, session.Username, session.ConnID); err != nil {
+		log.Errorf("Failed to remove user: %v", err)
+	}
+	if err := c.LeaveRoom(c.ctx, session.Room, session.Username, session.ConnID); err != nil {
+		log.Errorf("Failed to remove user from room: %v", err)
+		return
+	}
+	c.redisClient.UntrackConnection(c.ctx, session.Node, session.ConnID)
+}
+
+// replayGate holds back live messages while missed messages are replayed,
+// so a resumed client receives history first and without duplicates
+type replayGate struct {
+	mu       sync.Mutex
+	open     bool
+	pending  []domain.ChatMessage
+	replayed map[string]struct{}
+	deliver  func(domain.ChatMessage)
+}
+
+func newReplayGate(deliver func(domain.ChatMessage)) *replayGate {
+	return &replayGate{
+		replayed: make(map[string]struct{}),
+		deliver:  deliver,
+	}
+}
+
+// handle delivers a live message, or buffers it until the replay is done
+func (g *replayGate) handle(msg domain.ChatMessage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.open {
+		g.pending = append(g.pending, msg)
+		return
+	}
+	g.deliverOnce(msg)
+}
+
+// replay delivers missed messages followed by the buffered live ones and opens the gate
+func (g *replayGate) replay(missed []domain.ChatMessage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, msg := range missed {
+		g.replayed[msg.ID] = struct{}{}
+		g.deliver(msg)
+	}
+	for _, msg := range g.pending {
+		g.deliverOnce(msg)
+	}
+	g.pending = nil
+	g.open = true
+}
+
+// deliverOnce skips live messages that were already part of the replay.
+// Only chat messages are replayed; other frames may refer to their IDs.
+func (g *replayGate) deliverOnce(msg domain.ChatMessage) {
+	if msg.Type == domain.MessageTypeChat {
+		if _, seen := g.replayed[msg.ID]; seen {
+			return
+		}
+	}
+	g.deliver(msg)
+}
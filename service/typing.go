@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+)
+
+// typingState is a connection that is currently typing in a room
+type typingState struct {
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+// typingTracker remembers who is typing on this node so repeated
+// typing_start frames can be throttled and stale ones expired
+type typingTracker struct {
+	mu     sync.Mutex
+	active map[string]*typingState // room + "/" + connID
+}
+
+func newTypingTracker() *typingTracker {
+	return &typingTracker{active: make(map[string]*typingState)}
+}
+
+func typingKey(roomName, connID string) string { return roomName + "/" + connID }
+
+// StartTyping tells the room that the user is typing. Repeats within the throttle
+// interval only extend the indicator; it expires unless renewed or stopped. Muted
+// users get domain.ErrMuted, and invisible users are not shown typing.
+func (c *chatService) StartTyping(ctx context.Context, roomName, username, connID string) error {
+	if err := c.checkMuted(ctx, roomName, username); err != nil {
+		return err
+	}
+	if c.invisible(ctx, username) {
+		return nil
+	}
+	key := typingKey(roomName, connID)
+	now := time.Now()
+
+	c.typing.mu.Lock()
+	state, typing := c.typing.active[key]
+	if typing && !state.timer.Stop() {
+		// Expiry is already under way, start a new indicator
+		typing = false
+	}
+	if !typing {
+		state = &typingState{}
+		c.typing.active[key] = state
+		state.timer = time.AfterFunc(c.cfg.TypingTimeout, func() {
+			c.expireTyping(key, state, roomName, username, connID)
+		})
+	} else {
+		state.timer.Reset(c.cfg.TypingTimeout)
+	}
+	throttled := typing && now.Sub(state.lastSent) < c.cfg.TypingThrottle
+	if !throttled {
+		state.lastSent = now
+	}
+	c.typing.mu.Unlock()
+
+	if throttled {
+		return nil
+	}
+	return c.publishTyping(ctx, domain.MessageTypeTypingStart, roomName, username, connID)
+}
+
+// StopTyping tells the room that the user stopped typing, if they were
+func (c *chatService) StopTyping(ctx context.Context, roomName, username, connID string) error {
+	if !c.clearTyping(roomName, connID) {
+		return nil
+	}
+	return c.publishTyping(ctx, domain.MessageTypeTypingStop, roomName, username, connID)
+}
+
+// clearTyping forgets a typing connection without telling the room.
+// It reports whether the connection was typing.
+func (c *chatService) clearTyping(roomName, connID string) bool {
+	key := typingKey(roomName, connID)
+
+	c.typing.mu.Lock()
+	defer c.typing.mu.Unlock()
+
+	state, typing := c.typing.active[key]
+	if !typing {
+		return false
+	}
+	state.timer.Stop()
+	delete(c.typing.active, key)
+	return true
+}
+
+// expireTyping sends typing_stop for a connection whose indicator was not renewed in time
+func (c *chatService) expireTyping(key string, state *typingState, roomName, username, connID string) {
+	c.typing.mu.Lock()
+	if c.typing.active[key] != state {
+		// Stopped, or restarted with a new indicator
+		c.typing.mu.Unlock()
+		return
+	}
+	delete(c.typing.active, key)
+	c.typing.mu.Unlock()
+
+	c.publishTyping(c.ctx, domain.MessageTypeTypingStop, roomName, username, connID)
+}
+
+func (c *chatService) publishTyping(ctx context.Context, msgType domain.MessageType, roomName, username, connID string) error {
+	return c.PublishMessage(ctx, domain.ChatMessage{
+		Type:   msgType,
+		Sender: username,
+		Room:   roomName,
+		ConnID: connID,
+	})
+}
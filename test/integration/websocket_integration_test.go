@@ -1,8 +1,14 @@
 package integration
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,10 +23,25 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// testResumeGrace keeps session expiry tests short
+const testResumeGrace = time.Second
+
+// testUploadLimit is the largest file accepted by the test server
+const testUploadLimit = 1024
+
+// testAdminToken authenticates admin API requests to the test server
+const testAdminToken = "test-admin-token"
+
+// testPresenceDelay keeps presence tests short
+const testPresenceDelay = 100 * time.Millisecond
+
 type testClient struct {
-	conn     *websocket.Conn
-	username string
-	t        *testing.T // Added t for assertions
+	conn        *websocket.Conn
+	username    string
+	resumeToken string
+	pending     []domain.ChatMessage // Received while waiting for the client to be ready
+	presence    bool                 // Receive presence frames; they arrive at any time and are dropped otherwise
+	t           *testing.T           // Added t for assertions
 }
 
 // Simple setup with single responsibility
@@ -36,9 +57,21 @@ func setupTest(t *testing.T) (*httptest.Server, *testClient) {
 	require.NoError(t, err)
 	redisClient.FlushAll(ctx)
 
-	chatService := service.NewChatService(ctx, natsClient, redisClient)
+	chatService := service.NewChatService(ctx, natsClient, redisClient, service.ChatConfig{
+		ResumeGracePeriod: testResumeGrace,
+		PresenceDelay:     testPresenceDelay,
+	})
+	fileService, err := service.NewFileService(ctx, redisClient, service.FileConfig{
+		Dir:          t.TempDir(),
+		MaxSize:      testUploadLimit,
+		AllowedTypes: []string{"text/plain"},
+	})
+	require.NoError(t, err)
 	server := httptest.NewServer(ws.SetupWebSocketRoutes(ws.WSConfig{
 		ChatService: chatService,
+		FileService: fileService,
+		AdminToken:  testAdminToken,
+		IPHeader:    "X-Forwarded-For",
 		RootCtx:     ctx,
 	}))
 
@@ -57,10 +90,46 @@ func setupTest(t *testing.T) (*httptest.Server, *testClient) {
 
 // Simple client connection
 func connectClient(t *testing.T, server *httptest.Server, username string) *testClient {
-	wsURL := "ws" + server.URL[4:] + "/ws?username=" + username
+	return resumeClient(t, server, username, "")
+}
+
+// resumeClient connects with a resume token and consumes the session frame
+func resumeClient(t *testing.T, server *httptest.Server, username, token string) *testClient {
+	query := ""
+	if token != "" {
+		query = "&resume_token=" + token
+	}
+	return dialClient(t, server, username, query)
+}
+
+// dialClient connects with extra query parameters and consumes the session frame
+func dialClient(t *testing.T, server *httptest.Server, username, query string) *testClient {
+	wsURL := "ws" + server.URL[4:] + "/ws?username=" + username + query
 	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
 	require.NoError(t, err)
-	return &testClient{conn: conn, username: username, t: t}
+
+	client := &testClient{conn: conn, username: username, t: t}
+	session := client.receive()
+	require.Equal(t, domain.MessageTypeSession, session.Type)
+	client.resumeToken = session.ResumeToken
+
+	// A new session is ready once it has joined its room; until then its own room
+	// subscription may not exist yet and other users' messages could be missed
+	if !strings.Contains(query, "resume_token="+session.ResumeToken) {
+		client.waitJoined()
+	}
+	return client
+}
+
+// waitJoined blocks until the room join is confirmed, keeping every frame for receive
+func (c *testClient) waitJoined() {
+	for {
+		msg := c.read()
+		c.pending = append(c.pending, msg)
+		if msg.Type == domain.MessageTypeJoined {
+			return
+		}
+	}
 }
 
 // Basic send and receive
@@ -75,12 +144,63 @@ func (c *testClient) send(msgType domain.MessageType, content, room string) {
 	require.NoError(c.t, c.conn.WriteJSON(msg))
 }
 
+// receiveType skips messages until one of the given type arrives.
+// Room traffic published just before a join may still be in flight, so exact ordering is not assumed.
+func (c *testClient) receiveType(msgType domain.MessageType) domain.ChatMessage {
+	for {
+		msg := c.receive()
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// expectNoMessage asserts nothing arrives for a while; the connection is unusable afterwards
+func (c *testClient) expectNoMessage() {
+	c.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		var msg domain.ChatMessage
+		err := c.conn.ReadJSON(&msg)
+		if err == nil && msg.Type == domain.MessageTypePresence && !c.presence {
+			continue
+		}
+		require.Error(c.t, err, "unexpected message: %+v", msg)
+		return
+	}
+}
+
+// expectNoPresence asserts no presence frame arrives for a while, skipping other
+// messages; the connection is unusable afterwards
+func (c *testClient) expectNoPresence() {
+	c.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		var msg domain.ChatMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		require.NotEqual(c.t, domain.MessageTypePresence, msg.Type, "unexpected presence: %+v", msg.Presence)
+	}
+}
+
 func (c *testClient) receive() domain.ChatMessage {
-	var msg domain.ChatMessage
-	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	err := c.conn.ReadJSON(&msg)
-	require.NoError(c.t, err)
-	return msg
+	if len(c.pending) > 0 {
+		msg := c.pending[0]
+		c.pending = c.pending[1:]
+		return msg
+	}
+	return c.read()
+}
+
+func (c *testClient) read() domain.ChatMessage {
+	for {
+		var msg domain.ChatMessage
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err := c.conn.ReadJSON(&msg)
+		require.NoError(c.t, err)
+		if msg.Type != domain.MessageTypePresence || c.presence {
+			return msg
+		}
+	}
 }
 
 func TestMultiUserInteraction(t *testing.T) {
@@ -110,13 +230,13 @@ func TestMultiUserInteraction(t *testing.T) {
 		testMsg1 := "Hello from user1"
 		client1.send(domain.MessageTypeChat, testMsg1, "")
 
-		msg1 := client2.receive() // client2 gets client1's message
+		msg1 := client2.receiveType(domain.MessageTypeChat) // client2 gets client1's message
 		require.Equal(t, testMsg1, msg1.Content)
 
 		testMsg2 := "Hello from user2"
 		client2.send(domain.MessageTypeChat, testMsg2, "")
 
-		msg2 := client1.receive() // client1 gets client2's message
+		msg2 := client1.receiveType(domain.MessageTypeChat) // client1 gets client2's message
 		require.Equal(t, testMsg2, msg2.Content)
 
 	})
@@ -147,3 +267,1199 @@ func TestRoomOperations(t *testing.T) {
 		require.Contains(t, msg.Content, "user1")
 	})
 }
+
+func TestSessionResume(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	client2 := connectClient(t, server, "user2")
+	_ = client1.receiveType(domain.MessageTypeSystem) // Drain user2 join message
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	// client2 acknowledges the first message before its connection drops
+	client1.send(domain.MessageTypeChat, "before drop", "")
+	msg := client2.receiveType(domain.MessageTypeChat)
+	require.Equal(t, "before drop", msg.Content)
+	require.NotEmpty(t, msg.ID)
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeAck, ID: msg.ID}))
+	time.Sleep(100 * time.Millisecond)
+	client2.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	client1.send(domain.MessageTypeChat, "while away", "")
+	time.Sleep(100 * time.Millisecond)
+
+	resumed := resumeClient(t, server, "user2", client2.resumeToken)
+	defer resumed.conn.Close()
+	require.Equal(t, client2.resumeToken, resumed.resumeToken)
+
+	// Only the unacknowledged message is replayed
+	msg = resumed.receiveType(domain.MessageTypeChat)
+	require.Equal(t, "while away", msg.Content)
+	resumed.expectNoMessage()
+
+	// No leave or join announcements were made
+	client1.expectNoMessage()
+}
+
+func TestSessionResumeExpired(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	client2 := connectClient(t, server, "user2")
+	_ = client1.receiveType(domain.MessageTypeSystem) // Drain user2 join message
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	client2.conn.Close()
+
+	// After the grace period the user is removed from the room
+	msg := client1.receiveType(domain.MessageTypeSystem)
+	require.Contains(t, msg.Content, "user2 left")
+
+	// The old token no longer resumes, a new session is issued instead
+	fresh := resumeClient(t, server, "user2", client2.resumeToken)
+	defer fresh.conn.Close()
+	require.NotEqual(t, client2.resumeToken, fresh.resumeToken)
+}
+
+func TestEchoOptIn(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	client2 := dialClient(t, server, "user2", "&echo=true")
+	defer client2.conn.Close()
+	_ = client1.receiveType(domain.MessageTypeSystem) // Drain user2 join message
+
+	// The opted-in connection gets its own message back as confirmation
+	client2.send(domain.MessageTypeChat, "echoed", "")
+	own := client2.receiveType(domain.MessageTypeChat)
+	require.Equal(t, "echoed", own.Content)
+	require.NotEmpty(t, own.ConnID)
+	require.Equal(t, own.ConnID, client1.receiveType(domain.MessageTypeChat).ConnID)
+
+	// Connections without the flag never see their own messages
+	client1.send(domain.MessageTypeChat, "not echoed", "")
+	require.Equal(t, "not echoed", client2.receiveType(domain.MessageTypeChat).Content)
+	client1.expectNoMessage()
+}
+
+func TestMultiDeviceSessions(t *testing.T) {
+	server, laptop := setupTest(t)
+	defer server.Close()
+
+	// A second connection with the same username is accepted
+	browser := connectClient(t, server, "user1")
+	defer browser.conn.Close()
+	_ = browser.receiveType(domain.MessageTypeJoined)
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	// Room messages reach every session of the user
+	client2.send(domain.MessageTypeChat, "hello user1", "")
+	require.Equal(t, "hello user1", laptop.receiveType(domain.MessageTypeChat).Content)
+	require.Equal(t, "hello user1", browser.receiveType(domain.MessageTypeChat).Content)
+
+	// The user sees their own message on the other device
+	laptop.send(domain.MessageTypeChat, "from laptop", "")
+	require.Equal(t, "from laptop", browser.receiveType(domain.MessageTypeChat).Content)
+
+	// Closing one session keeps the user present
+	laptop.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	laptop.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	client2.send(domain.MessageTypeList, "", "")
+	msg := client2.receiveType(domain.MessageTypeSystem)
+	require.Contains(t, msg.Content, "user1")
+	require.NotContains(t, msg.Content, "left")
+}
+
+func TestTypingIndicators(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client1.receiveType(domain.MessageTypeSystem) // Drain user2 join message
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	client2.send(domain.MessageTypeTypingStart, "", "")
+	msg := client1.receiveType(domain.MessageTypeTypingStart)
+	require.Equal(t, "user2", msg.Sender)
+	require.Equal(t, "global", msg.Room)
+
+	client2.send(domain.MessageTypeTypingStop, "", "")
+	msg = client1.receiveType(domain.MessageTypeTypingStop)
+	require.Equal(t, "user2", msg.Sender)
+
+	// The typist never sees their own indicator
+	client2.expectNoMessage()
+}
+
+// receiveRooms skips messages until a list_rooms response arrives
+func (c *testClient) receiveRooms() []domain.RoomSummary {
+	for {
+		msg := c.receiveType(domain.MessageTypeSystem)
+		if msg.Rooms != nil {
+			return msg.Rooms
+		}
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client1.receiveType(domain.MessageTypeSystem) // Drain user2 join message
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	client2.send(domain.MessageTypeChat, "one", "")
+	first := client1.receiveType(domain.MessageTypeChat)
+	client2.send(domain.MessageTypeChat, "two", "")
+	_ = client1.receiveType(domain.MessageTypeChat)
+
+	client1.send(domain.MessageTypeRooms, "", "")
+	rooms := client1.receiveRooms()
+	require.Len(t, rooms, 1)
+	require.Equal(t, "global", rooms[0].Name)
+	require.Equal(t, int64(2), rooms[0].Unread)
+
+	// Marking a message read is broadcast to the room
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeMarkRead, ID: first.ID}))
+	receipt := client2.receiveType(domain.MessageTypeReadReceipt)
+	require.Equal(t, "user1", receipt.Sender)
+	require.Equal(t, first.ID, receipt.ID)
+	require.Equal(t, "global", receipt.Room)
+
+	client1.send(domain.MessageTypeRooms, "", "")
+	rooms = client1.receiveRooms()
+	require.Equal(t, int64(1), rooms[0].Unread)
+
+	// The sender has read their own messages
+	client2.send(domain.MessageTypeRooms, "", "")
+	rooms = client2.receiveRooms()
+	require.Equal(t, int64(0), rooms[0].Unread)
+}
+
+func TestEditAndDeleteMessage(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client1.receiveType(domain.MessageTypeSystem) // Drain user2 join message
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	client2.send(domain.MessageTypeChat, "helo", "")
+	original := client1.receiveType(domain.MessageTypeChat)
+
+	// Only the sender may change a message
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeEdit, ID: original.ID, Content: "hijacked"}))
+	errMsg := client1.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotPermitted, errMsg.Code)
+
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeEdit, ID: original.ID, Content: "hello"}))
+	edited := client1.receiveType(domain.MessageTypeEdit)
+	require.Equal(t, original.ID, edited.ID)
+	require.Equal(t, "hello", edited.Content)
+	require.Equal(t, "user2", edited.Sender)
+	require.True(t, edited.Edited)
+
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeDelete, ID: original.ID}))
+	deleted := client1.receiveType(domain.MessageTypeDelete)
+	require.Equal(t, original.ID, deleted.ID)
+	require.True(t, deleted.Deleted)
+	require.Empty(t, deleted.Content)
+
+	// A deleted message can no longer be edited
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeEdit, ID: original.ID, Content: "back"}))
+	errMsg = client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotFound, errMsg.Code)
+}
+
+func TestReactionsAndHistory(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client1.receiveType(domain.MessageTypeSystem) // Drain user2 join message
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	client2.send(domain.MessageTypeChat, "ship it?", "")
+	msg := client1.receiveType(domain.MessageTypeChat)
+
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeAddReaction, ID: msg.ID, Emoji: "👍"}))
+	update := client2.receiveType(domain.MessageTypeAddReaction)
+	require.Equal(t, msg.ID, update.ID)
+	require.Equal(t, "user1", update.Sender)
+	require.Equal(t, []domain.Reaction{{Emoji: "👍", Count: 1}}, update.Reactions)
+
+	// History includes the tallies and whether the requesting user reacted
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeGetHistory}))
+	history := client1.receiveType(domain.MessageTypeHistory)
+	require.Len(t, history.Messages, 1)
+	require.Equal(t, "ship it?", history.Messages[0].Content)
+	require.Equal(t, []domain.Reaction{{Emoji: "👍", Count: 1, Reacted: true}}, history.Messages[0].Reactions)
+
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeGetHistory}))
+	history = client2.receiveType(domain.MessageTypeHistory)
+	require.Equal(t, []domain.Reaction{{Emoji: "👍", Count: 1}}, history.Messages[0].Reactions)
+
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeRemoveReaction, ID: msg.ID, Emoji: "👍"}))
+	update = client2.receiveType(domain.MessageTypeRemoveReaction)
+	require.Empty(t, update.Reactions)
+}
+
+func TestThreadedReplies(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client1.receiveType(domain.MessageTypeSystem) // Drain user2 join message
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	client2.send(domain.MessageTypeChat, "lunch?", "")
+	root := client1.receiveType(domain.MessageTypeChat)
+
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeChat, Content: "sure", ReplyTo: root.ID}))
+	reply := client2.receiveType(domain.MessageTypeChat)
+	require.Equal(t, root.ID, reply.ReplyTo)
+	require.Equal(t, root.ID, reply.ThreadID)
+
+	// A reply to a reply stays in the root's thread
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeChat, Content: "12:30", ReplyTo: reply.ID}))
+	nested := client1.receiveType(domain.MessageTypeChat)
+	require.Equal(t, reply.ID, nested.ReplyTo)
+	require.Equal(t, root.ID, nested.ThreadID)
+
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeGetThread, ID: reply.ID}))
+	thread := client1.receiveType(domain.MessageTypeThread)
+	require.Equal(t, root.ID, thread.ThreadID)
+	require.Len(t, thread.Messages, 3)
+	require.Equal(t, "lunch?", thread.Messages[0].Content)
+	require.Equal(t, int64(2), thread.Messages[0].ReplyCount)
+	require.Equal(t, "12:30", thread.Messages[2].Content)
+
+	// Replies must refer to a stored message
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeChat, Content: "hm", ReplyTo: "999999"}))
+	require.Equal(t, domain.ErrorCodeNotFound, client1.receiveType(domain.MessageTypeError).Code)
+}
+
+func TestMentions(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined)
+	client2.send(domain.MessageTypeJoin, "", "side-room")
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	client1.send(domain.MessageTypeChat, "@user2, see this (cc @ghost) but not mail@example.com", "")
+
+	// The mentioned user is notified in their own room
+	mention := client2.receiveType(domain.MessageTypeMention)
+	require.Equal(t, "user1", mention.Sender)
+	require.Equal(t, "global", mention.Room)
+	require.NotEmpty(t, mention.ID)
+	require.Equal(t, []string{"user2", "ghost"}, mention.Mentions)
+
+	// The sender learns who is not in the room
+	warning := client1.receiveType(domain.MessageTypeMentionWarning)
+	require.Equal(t, mention.ID, warning.ID)
+	require.Equal(t, []string{"user2", "ghost"}, warning.Mentions)
+
+	// @room reaches everyone in the room
+	client1.send(domain.MessageTypeJoin, "", "side-room")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+	client2.send(domain.MessageTypeChat, "@room hello", "")
+	mention = client1.receiveType(domain.MessageTypeMention)
+	require.Equal(t, "side-room", mention.Room)
+	require.Equal(t, []string{domain.MentionRoom}, mention.Mentions)
+
+	// Users who may not enter the room are not shown what was said there
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeCreateRoom,
+		Room:     "hideout",
+		RoomInfo: &domain.Room{Visibility: domain.RoomPrivate},
+	}))
+	_ = client1.receiveType(domain.MessageTypeRoomInfo)
+	client1.send(domain.MessageTypeJoin, "", "hideout")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+	client1.send(domain.MessageTypeChat, "@user2 the plan is in the safe", "")
+	mention = client2.receiveType(domain.MessageTypeMention)
+	require.Equal(t, "hideout", mention.Room)
+	require.Equal(t, "user1", mention.Sender)
+	require.Empty(t, mention.Content)
+	require.Empty(t, mention.Mentions)
+}
+
+// upload posts a file for a room with the given session token
+func upload(t *testing.T, server *httptest.Server, token, room, name, content string) *http.Response {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("room", room)
+	part, err := form.CreateFormFile("file", name)
+	require.NoError(t, err)
+	part.Write([]byte(content))
+	form.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/upload", &body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// download fetches an attachment with the given session token
+func download(t *testing.T, server *httptest.Server, token, id string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/files/"+id, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestFileAttachments(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	client3 := connectClient(t, server, "user3")
+	defer client3.conn.Close()
+	client3.send(domain.MessageTypeJoin, "", "side-room")
+	_ = client3.receiveType(domain.MessageTypeJoined)
+
+	// Uploads need a session and are limited in size and type
+	require.Equal(t, http.StatusUnauthorized, upload(t, server, "bogus", "global", "a.txt", "hi").StatusCode)
+	require.Equal(t, http.StatusForbidden, upload(t, server, client3.resumeToken, "global", "a.txt", "hi").StatusCode)
+	require.Equal(t, http.StatusRequestEntityTooLarge,
+		upload(t, server, client1.resumeToken, "global", "a.txt", strings.Repeat("a", testUploadLimit+1)).StatusCode)
+	require.Equal(t, http.StatusUnsupportedMediaType,
+		upload(t, server, client1.resumeToken, "global", "a.gif", "GIF89a").StatusCode)
+
+	resp := upload(t, server, client1.resumeToken, "global", "notes.txt", "meeting at noon")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var att domain.Attachment
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&att))
+	require.NotEmpty(t, att.ID)
+
+	// Members of the room receive the attachment metadata with the message
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:        domain.MessageTypeChat,
+		Content:     "see attached",
+		Attachments: []domain.Attachment{{ID: att.ID}},
+	}))
+	msg := client2.receiveType(domain.MessageTypeChat)
+	require.Len(t, msg.Attachments, 1)
+	require.Equal(t, att.ID, msg.Attachments[0].ID)
+	require.Equal(t, "notes.txt", msg.Attachments[0].Name)
+	require.Equal(t, int64(len("meeting at noon")), msg.Attachments[0].Size)
+
+	// Only files the sender uploaded can be attached
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{
+		Type:        domain.MessageTypeChat,
+		Attachments: []domain.Attachment{{ID: att.ID}},
+	}))
+	errMsg := client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotFound, errMsg.Code)
+
+	// Downloads are limited to members of the room the file was shared in
+	resp = download(t, server, client2.resumeToken, att.ID)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("Content-Disposition"), "notes.txt")
+
+	// Files other than images are never displayed in place or sniffed as another type
+	require.True(t, strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment"))
+	require.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+	content, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "meeting at noon", string(content))
+
+	require.Equal(t, http.StatusForbidden, download(t, server, client3.resumeToken, att.ID).StatusCode)
+	require.Equal(t, http.StatusNotFound, download(t, server, client2.resumeToken, "missing").StatusCode)
+}
+
+func TestRoomMetadata(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	_ = client1.receiveType(domain.MessageTypeJoined) // global
+	client1.send(domain.MessageTypeJoin, "", "dev")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined) // global
+	client2.send(domain.MessageTypeJoin, "", "dev")
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	// The room record names the user who created the room
+	client2.send(domain.MessageTypeRoomInfo, "", "")
+	info := client2.receiveType(domain.MessageTypeRoomInfo)
+	require.NotNil(t, info.RoomInfo)
+	require.Equal(t, "dev", info.RoomInfo.Name)
+	require.Equal(t, "user1", info.RoomInfo.CreatedBy)
+	require.NotEmpty(t, info.RoomInfo.CreatedAt)
+	require.Equal(t, int64(2), info.RoomInfo.Members)
+
+	// Topic changes are announced to the room
+	client1.send(domain.MessageTypeSetTopic, "release planning", "")
+	announcement := client2.receiveType(domain.MessageTypeSystem)
+	for announcement.RoomInfo == nil {
+		announcement = client2.receiveType(domain.MessageTypeSystem)
+	}
+	require.Equal(t, "release planning", announcement.RoomInfo.Topic)
+	require.Contains(t, announcement.Content, "user1 changed the topic")
+
+	// Only owners and moderators can change the topic
+	client2.send(domain.MessageTypeSetTopic, "hijacked", "global")
+	errMsg := client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotPermitted, errMsg.Code)
+
+	client2.send(domain.MessageTypeRoomInfo, "", "missing-room")
+	errMsg = client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotFound, errMsg.Code)
+
+	// The room list carries the records
+	client2.send(domain.MessageTypeRooms, "", "")
+	rooms := client2.receiveRooms()
+	require.Len(t, rooms, 1)
+	require.Equal(t, "dev", rooms[0].Name)
+	require.Equal(t, "release planning", rooms[0].Topic)
+	require.Equal(t, int64(2), rooms[0].Members)
+}
+
+// adminRequest calls the admin API with the given token
+func adminRequest(t *testing.T, server *httptest.Server, token, method, path, body string) *http.Response {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestPersistentRooms(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	// Rooms can be created over the websocket
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeCreateRoom,
+		Room:     "oncall",
+		RoomInfo: &domain.Room{Description: "Pager rotation"},
+	}))
+	info := client1.receiveType(domain.MessageTypeRoomInfo)
+	require.True(t, info.RoomInfo.Persistent)
+	require.Equal(t, "user1", info.RoomInfo.CreatedBy)
+	require.Equal(t, "Pager rotation", info.RoomInfo.Description)
+
+	client1.send(domain.MessageTypeCreateRoom, "", "oncall")
+	errMsg := client1.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeAlreadyExists, errMsg.Code)
+
+	// ...and through the admin API
+	require.Equal(t, http.StatusUnauthorized,
+		adminRequest(t, server, "wrong", http.MethodPost, "/admin/rooms", `{"name":"standup"}`).StatusCode)
+	resp := adminRequest(t, server, testAdminToken, http.MethodPost, "/admin/rooms", `{"name":"standup","topic":"daily"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var created domain.Room
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	require.Equal(t, "daily", created.Topic)
+	require.Equal(t, http.StatusConflict,
+		adminRequest(t, server, testAdminToken, http.MethodPost, "/admin/rooms", `{"name":"standup"}`).StatusCode)
+
+	// Persistent rooms survive their last member leaving
+	client1.send(domain.MessageTypeJoin, "", "oncall")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+	client1.send(domain.MessageTypeLeave, "", "")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+
+	client1.send(domain.MessageTypeRooms, "", "")
+	rooms := client1.receiveRooms()
+	names := make([]string, len(rooms))
+	for i, room := range rooms {
+		names[i] = room.Name
+	}
+	require.Equal(t, []string{"global", "oncall", "standup"}, names)
+
+	// Deleting an empty persistent room removes it
+	require.Equal(t, http.StatusNoContent,
+		adminRequest(t, server, testAdminToken, http.MethodDelete, "/admin/rooms/oncall", "").StatusCode)
+	require.Equal(t, http.StatusNotFound,
+		adminRequest(t, server, testAdminToken, http.MethodGet, "/admin/rooms/oncall", "").StatusCode)
+	require.Equal(t, http.StatusOK,
+		adminRequest(t, server, testAdminToken, http.MethodGet, "/admin/rooms/standup", "").StatusCode)
+}
+
+func TestAnnouncementRoom(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	_ = client1.receiveType(domain.MessageTypeJoined) // global
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeCreateRoom,
+		Room:     "announcements",
+		RoomInfo: &domain.Room{AnnouncementOnly: true},
+	}))
+	info := client1.receiveType(domain.MessageTypeRoomInfo)
+	require.True(t, info.RoomInfo.AnnouncementOnly)
+	client1.send(domain.MessageTypeJoin, "", "announcements")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined) // global
+	client2.send(domain.MessageTypeJoin, "", "announcements")
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	// Readers cannot post, the owner can
+	client2.send(domain.MessageTypeChat, "me too", "")
+	errMsg := client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotPermitted, errMsg.Code)
+	client1.send(domain.MessageTypeChat, "release on friday", "")
+	msg := client2.receiveType(domain.MessageTypeChat)
+	require.Equal(t, "release on friday", msg.Content)
+
+	// An administrator can let others post
+	require.Equal(t, http.StatusNoContent, adminRequest(t, server, testAdminToken, http.MethodPut,
+		"/admin/rooms/announcements/roles/user2", `{"role":"moderator"}`).StatusCode)
+	require.Equal(t, http.StatusBadRequest, adminRequest(t, server, testAdminToken, http.MethodPut,
+		"/admin/rooms/announcements/roles/user2", `{"role":"king"}`).StatusCode)
+	client2.send(domain.MessageTypeChat, "and on monday", "")
+	msg = client1.receiveType(domain.MessageTypeChat)
+	require.Equal(t, "and on monday", msg.Content)
+	msg = client2.receiveType(domain.MessageTypeSystem)
+	for msg.Role == nil {
+		msg = client2.receiveType(domain.MessageTypeSystem)
+	}
+	require.Equal(t, domain.RoleModerator, msg.Role.Role)
+
+	// And can turn announcement-only off for an existing room
+	require.Equal(t, http.StatusNoContent, adminRequest(t, server, testAdminToken, http.MethodPut,
+		"/admin/rooms/announcements/announcement_only", `{"announcement_only":false}`).StatusCode)
+	require.Equal(t, http.StatusNotFound, adminRequest(t, server, testAdminToken, http.MethodPut,
+		"/admin/rooms/missing/announcement_only", `{"announcement_only":true}`).StatusCode)
+	msg = client2.receiveType(domain.MessageTypeSystem)
+	for msg.RoomInfo == nil {
+		msg = client2.receiveType(domain.MessageTypeSystem)
+	}
+	require.False(t, msg.RoomInfo.AnnouncementOnly)
+}
+
+func TestSlowMode(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	_ = client1.receiveType(domain.MessageTypeJoined) // global
+	client1.send(domain.MessageTypeJoin, "", "busy")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined) // global
+	client2.send(domain.MessageTypeJoin, "", "busy")
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeSetSlowMode,
+		RoomInfo: &domain.Room{SlowMode: 60},
+	}))
+	announcement := client2.receiveType(domain.MessageTypeSystem)
+	for announcement.RoomInfo == nil {
+		announcement = client2.receiveType(domain.MessageTypeSystem)
+	}
+	require.Equal(t, int64(60), announcement.RoomInfo.SlowMode)
+
+	// The second message within the interval is rejected with the time left
+	client2.send(domain.MessageTypeChat, "first", "")
+	require.Equal(t, "first", client1.receiveType(domain.MessageTypeChat).Content)
+	client2.send(domain.MessageTypeChat, "second", "")
+	errMsg := client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeSlowMode, errMsg.Code)
+	require.InDelta(t, 60, errMsg.RetryAfter, 2)
+
+	// Members cannot change slow mode
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeSetSlowMode,
+		RoomInfo: &domain.Room{SlowMode: 0},
+	}))
+	errMsg = client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotPermitted, errMsg.Code)
+}
+
+func TestRoomCapacity(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	_ = client1.receiveType(domain.MessageTypeJoined) // global
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeCreateRoom,
+		Room:     "booth",
+		RoomInfo: &domain.Room{MaxMembers: 1},
+	}))
+	info := client1.receiveType(domain.MessageTypeRoomInfo)
+	require.Equal(t, int64(1), info.RoomInfo.MaxMembers)
+	client1.send(domain.MessageTypeJoin, "", "booth")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined) // global
+
+	// The join is refused and user2 stays in the global room
+	client2.send(domain.MessageTypeJoin, "", "booth")
+	errMsg := client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeRoomFull, errMsg.Code)
+	client2.send(domain.MessageTypeRoomInfo, "", "")
+	info = client2.receiveType(domain.MessageTypeRoomInfo)
+	require.Equal(t, "global", info.Room)
+}
+
+func TestPasswordRoomJoin(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeCreateRoom,
+		Room:     "vault",
+		RoomInfo: &domain.Room{Visibility: domain.RoomPassword},
+		Password: "hunter2",
+	}))
+	info := client1.receiveType(domain.MessageTypeRoomInfo)
+	require.Equal(t, domain.RoomPassword, info.RoomInfo.Visibility)
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	// A wrong password is rejected and the client stays where it is
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeJoin, Room: "vault", Password: "guess"}))
+	errMsg := client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotPermitted, errMsg.Code)
+
+	client2.send(domain.MessageTypeChat, "still here", "")
+	msg := client1.receiveType(domain.MessageTypeChat)
+	require.Equal(t, "still here", msg.Content)
+
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeJoin, Room: "vault", Password: "hunter2"}))
+	joined := client2.receiveType(domain.MessageTypeJoined)
+	require.Equal(t, "vault", joined.Room)
+}
+
+func TestPrivateRoomJoin(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeCreateRoom,
+		Room:     "hideout",
+		RoomInfo: &domain.Room{Visibility: domain.RoomPrivate},
+	}))
+	_ = client1.receiveType(domain.MessageTypeRoomInfo)
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeJoin, Room: "hideout"}))
+	require.Equal(t, "hideout", client1.receiveType(domain.MessageTypeJoined).Room)
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	// Knowing the name is not enough to get in or to see who is there
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeJoin, Room: "hideout"}))
+	require.Equal(t, domain.ErrorCodeNotPermitted, client2.receiveType(domain.MessageTypeError).Code)
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeList, Room: "hideout"}))
+	require.Equal(t, domain.ErrorCodeNotFound, client2.receiveType(domain.MessageTypeError).Code)
+}
+
+func TestInviteOnlyRoomJoin(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeCreateRoom,
+		Room:     "club",
+		RoomInfo: &domain.Room{Visibility: domain.RoomInvite},
+	}))
+	info := client1.receiveType(domain.MessageTypeRoomInfo)
+	require.Equal(t, domain.RoomInvite, info.RoomInfo.Visibility)
+
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined)
+	client3 := connectClient(t, server, "user3")
+	defer client3.conn.Close()
+	_ = client3.receiveType(domain.MessageTypeJoined)
+
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeJoin, Room: "club"}))
+	errMsg := client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotPermitted, errMsg.Code)
+
+	// A named invite reaches the invitee, who can then join
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:   domain.MessageTypeInvite,
+		Room:   "club",
+		Invite: &domain.Invite{Username: "user2"},
+	}))
+	invite := client2.receiveType(domain.MessageTypeInvite)
+	require.Equal(t, "club", invite.Room)
+	require.Equal(t, "user1", invite.Sender)
+
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeJoin, Room: "club"}))
+	joined := client2.receiveType(domain.MessageTypeJoined)
+	require.Equal(t, "club", joined.Room)
+
+	// A shareable token lets anyone holding it in
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:   domain.MessageTypeInvite,
+		Room:   "club",
+		Invite: &domain.Invite{MaxUses: 1},
+	}))
+	link := client1.receiveType(domain.MessageTypeInvite)
+	require.NotEmpty(t, link.Invite.Token)
+
+	require.NoError(t, client3.conn.WriteJSON(domain.ChatMessage{
+		Type:   domain.MessageTypeJoin,
+		Room:   "club",
+		Invite: &domain.Invite{Token: link.Invite.Token},
+	}))
+	joined = client3.receiveType(domain.MessageTypeJoined)
+	require.Equal(t, "club", joined.Room)
+}
+
+func TestRoomRoles(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	_ = client1.receiveType(domain.MessageTypeJoined) // global
+	client1.send(domain.MessageTypeJoin, "", "dev")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined) // global
+	client2.send(domain.MessageTypeJoin, "", "dev")
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	// Role changes are announced to the room
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type: domain.MessageTypeSetRole,
+		Role: &domain.RoleGrant{Username: "user2", Role: domain.RoleReadOnly},
+	}))
+	announcement := client2.receiveType(domain.MessageTypeSystem)
+	for announcement.Role == nil {
+		announcement = client2.receiveType(domain.MessageTypeSystem)
+	}
+	require.Equal(t, "user2", announcement.Role.Username)
+	require.Equal(t, domain.RoleReadOnly, announcement.Role.Role)
+	require.Equal(t, "user1", announcement.Sender)
+
+	// Read-only users can follow the room but not post to it
+	client2.send(domain.MessageTypeChat, "let me talk", "")
+	errMsg := client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotPermitted, errMsg.Code)
+
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{
+		Type: domain.MessageTypeSetRole,
+		Role: &domain.RoleGrant{Username: "user1", Role: domain.RoleMember},
+	}))
+	errMsg = client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotPermitted, errMsg.Code)
+
+	client2.send(domain.MessageTypeRoomInfo, "", "")
+	info := client2.receiveType(domain.MessageTypeRoomInfo)
+	require.Equal(t, domain.RoleOwner, info.RoomInfo.Roles["user1"])
+	require.Equal(t, domain.RoleReadOnly, info.RoomInfo.Roles["user2"])
+}
+
+func TestModeration(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+
+	_ = client1.receiveType(domain.MessageTypeJoined) // global
+	client1.send(domain.MessageTypeJoin, "", "dev")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+	client2 := connectClient(t, server, "user2")
+	defer client2.conn.Close()
+	_ = client2.receiveType(domain.MessageTypeJoined) // global
+	client2.send(domain.MessageTypeJoin, "", "dev")
+	_ = client2.receiveType(domain.MessageTypeJoined)
+
+	// Muted users get an error instead of reaching the room
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:       domain.MessageTypeMute,
+		Moderation: &domain.Moderation{Username: "user2", Duration: 60},
+	}))
+	announcement := client2.receiveType(domain.MessageTypeSystem)
+	for announcement.Moderation == nil {
+		announcement = client2.receiveType(domain.MessageTypeSystem)
+	}
+	require.Equal(t, "user2", announcement.Moderation.Username)
+	require.NotEmpty(t, announcement.Moderation.Until)
+
+	client2.send(domain.MessageTypeChat, "can you hear me", "")
+	errMsg := client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotPermitted, errMsg.Code)
+
+	// Kicked users are told and moved to the global room
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:       domain.MessageTypeKick,
+		Moderation: &domain.Moderation{Username: "user2", Reason: "cool off"},
+	}))
+	kick := client2.receiveType(domain.MessageTypeKick)
+	require.Equal(t, "dev", kick.Room)
+	require.Equal(t, "user1", kick.Sender)
+	require.Equal(t, "cool off", kick.Moderation.Reason)
+	joined := client2.receiveType(domain.MessageTypeJoined)
+	require.Equal(t, "global", joined.Room)
+
+	// A kick is not a ban
+	client2.send(domain.MessageTypeJoin, "", "dev")
+	joined = client2.receiveType(domain.MessageTypeJoined)
+	require.Equal(t, "dev", joined.Room)
+
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{
+		Type:       domain.MessageTypeBan,
+		Moderation: &domain.Moderation{Username: "user2"},
+	}))
+	_ = client2.receiveType(domain.MessageTypeBan)
+	joined = client2.receiveType(domain.MessageTypeJoined)
+	require.Equal(t, "global", joined.Room)
+
+	client2.send(domain.MessageTypeJoin, "", "dev")
+	errMsg = client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeNotPermitted, errMsg.Code)
+}
+
+// expectClosed reads until the server closes the connection and returns the close frame
+func (c *testClient) expectClosed() *websocket.CloseError {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg domain.ChatMessage
+		err := c.conn.ReadJSON(&msg)
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		require.ErrorAs(c.t, err, &closeErr)
+		return closeErr
+	}
+}
+
+// dialStatus attempts a connection and returns the HTTP status of a refused handshake
+func dialStatus(t *testing.T, server *httptest.Server, username, query string) int {
+	wsURL := "ws" + server.URL[4:] + "/ws?username=" + username + query
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		conn.Close()
+		return http.StatusSwitchingProtocols
+	}
+	require.NotNil(t, resp, "dial failed: %v", err)
+	return resp.StatusCode
+}
+
+// A server shutting down closes its connections and ends their sessions, although
+// the clients' contexts are cancelled
+func TestShutdown(t *testing.T) {
+	config := config.MustReadConfig("../../config_test.json")
+	ctx := logger.NewContext(context.Background(), logger.NewLogger(config.LogLevel, config.LogFile))
+	natsClient, err := nats.NewNATSClient(ctx, config.NATSURL)
+	require.NoError(t, err)
+	defer natsClient.Close()
+	redisClient, err := redis.NewRedisClient(ctx, config.RedisURL)
+	require.NoError(t, err)
+	defer redisClient.Close()
+	redisClient.FlushAll(ctx)
+
+	chatService := service.NewChatService(ctx, natsClient, redisClient, service.ChatConfig{})
+	rootCtx, cancel := context.WithCancel(ctx)
+	connections := ws.NewConnections()
+	server := httptest.NewServer(ws.SetupWebSocketRoutes(ws.WSConfig{
+		ChatService: chatService,
+		Connections: connections,
+		RootCtx:     rootCtx,
+	}))
+	defer server.Close()
+
+	client := connectClient(t, server, "user1")
+	client.send(domain.MessageTypeJoin, "", "lobby")
+	_ = client.receiveType(domain.MessageTypeJoined)
+
+	cancel()
+	closeCtx, closeCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer closeCancel()
+	require.NoError(t, connections.Close(closeCtx))
+	require.Equal(t, websocket.CloseGoingAway, client.expectClosed().Code)
+
+	users, err := chatService.ListActiveUsers(ctx)
+	require.NoError(t, err)
+	require.Empty(t, users)
+	members, err := chatService.ListRoomMembers(ctx, "lobby")
+	require.NoError(t, err)
+	require.Empty(t, members)
+	require.Equal(t, http.StatusServiceUnavailable, dialStatus(t, server, "user2", ""))
+}
+
+func TestServerBans(t *testing.T) {
+	server, _ := setupTest(t)
+	defer server.Close()
+
+	phone := connectClient(t, server, "user2")
+	laptop := connectClient(t, server, "user2")
+
+	// Banning a user closes every one of their connections with the reason
+	resp := adminRequest(t, server, testAdminToken, http.MethodPost, "/admin/bans", `{"username":"user2","reason":"spam"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	for _, client := range []*testClient{phone, laptop} {
+		closed := client.expectClosed()
+		require.Equal(t, websocket.ClosePolicyViolation, closed.Code)
+		require.Contains(t, closed.Text, "spam")
+	}
+
+	// Banned users cannot connect or resume
+	require.Equal(t, http.StatusForbidden, dialStatus(t, server, "user2", ""))
+	require.Equal(t, http.StatusForbidden, dialStatus(t, server, "user2", "&resume_token="+phone.resumeToken))
+
+	require.Equal(t, http.StatusNoContent,
+		adminRequest(t, server, testAdminToken, http.MethodDelete, "/admin/bans/users/user2", "").StatusCode)
+	require.Equal(t, http.StatusNotFound,
+		adminRequest(t, server, testAdminToken, http.MethodDelete, "/admin/bans/users/user2", "").StatusCode)
+
+	// The ended session is gone, so reconnecting starts a new one
+	back := resumeClient(t, server, "user2", phone.resumeToken)
+	require.NotEqual(t, phone.resumeToken, back.resumeToken)
+
+	// An admin can disconnect a user without banning them
+	require.Equal(t, http.StatusNoContent,
+		adminRequest(t, server, testAdminToken, http.MethodPost, "/admin/users/user2/disconnect", `{"reason":"maintenance"}`).StatusCode)
+	closed := back.expectClosed()
+	require.Equal(t, "maintenance", closed.Text)
+	fresh := resumeClient(t, server, "user2", back.resumeToken)
+	defer fresh.conn.Close()
+	require.NotEqual(t, back.resumeToken, fresh.resumeToken)
+
+	// IP bans close connections from the address, also those behind the trusted proxy
+	// header, and keep new ones out
+	header := http.Header{"X-Forwarded-For": {"127.0.0.1, 203.0.113.7"}}
+	proxied, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?username=user4", header)
+	require.NoError(t, err)
+	defer proxied.Close()
+	proxiedClient := &testClient{conn: proxied, username: "user4", t: t}
+	proxiedClient.waitJoined()
+	resp = adminRequest(t, server, testAdminToken, http.MethodPost, "/admin/bans", `{"ip":"203.0.113.7"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	closed = proxiedClient.expectClosed()
+	require.Equal(t, websocket.ClosePolicyViolation, closed.Code)
+	_, resp, err = websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?username=user5", header)
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = adminRequest(t, server, testAdminToken, http.MethodPost, "/admin/bans", `{"ip":"127.0.0.1"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Contains(t, fresh.expectClosed().Text, "banned")
+	require.Equal(t, http.StatusForbidden, dialStatus(t, server, "user3", ""))
+	require.Equal(t, http.StatusNoContent,
+		adminRequest(t, server, testAdminToken, http.MethodDelete, "/admin/bans/ips/127.0.0.1", "").StatusCode)
+	require.Equal(t, http.StatusSwitchingProtocols, dialStatus(t, server, "user3", ""))
+
+	require.Equal(t, http.StatusBadRequest,
+		adminRequest(t, server, testAdminToken, http.MethodPost, "/admin/bans", `{"reason":"nobody"}`).StatusCode)
+}
+
+func TestSubjectSafeUsernames(t *testing.T) {
+	server, _ := setupTest(t)
+	defer server.Close()
+
+	for _, username := range []string{"a.b", "%2A", "%3E"} {
+		require.Equal(t, http.StatusBadRequest, dialStatus(t, server, username, ""), username)
+	}
+	require.Equal(t, http.StatusSwitchingProtocols, dialStatus(t, server, "a-b_c", ""))
+}
+
+// receivePresence returns the next presence frame about a user
+func (c *testClient) receivePresence(username string) string {
+	for {
+		msg := c.receiveType(domain.MessageTypePresence)
+		require.NotNil(c.t, msg.Presence)
+		if msg.Presence.Username == username {
+			return msg.Presence.Status
+		}
+	}
+}
+
+func TestPresence(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+	client1.presence = true
+	client1.send(domain.MessageTypeJoin, "", "lobby")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+
+	// Users sharing a room other than the global one learn who comes online
+	client2 := connectClient(t, server, "user2")
+	client2.send(domain.MessageTypeJoin, "", "lobby")
+	_ = client2.receiveType(domain.MessageTypeJoined)
+	require.Equal(t, domain.PresenceOnline, client1.receivePresence("user2"))
+
+	// Watchers get the current presence right away, and changes from any room
+	watcher := connectClient(t, server, "watcher")
+	watcher.presence = true
+	watcher.send(domain.MessageTypeJoin, "", "elsewhere")
+	_ = watcher.receiveType(domain.MessageTypeJoined)
+	require.NoError(t, watcher.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeWatchPresence,
+		Presence: &domain.Presence{Username: "user2"},
+	}))
+	require.Equal(t, domain.PresenceOnline, watcher.receivePresence("user2"))
+
+	// A dropped connection makes the user away until it is resumed
+	client2.conn.Close()
+	require.Equal(t, domain.PresenceAway, watcher.receivePresence("user2"))
+	resumed := resumeClient(t, server, "user2", client2.resumeToken)
+	require.Equal(t, domain.PresenceOnline, watcher.receivePresence("user2"))
+
+	// Going offline and back within the delay is not announced
+	require.NoError(t, resumed.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	second := connectClient(t, server, "user2")
+	time.Sleep(3 * testPresenceDelay)
+
+	// Going offline is announced once, even to a user who shares a room and watches
+	second.send(domain.MessageTypeJoin, "", "lobby")
+	_ = second.receiveType(domain.MessageTypeJoined)
+	roommate := connectClient(t, server, "roommate")
+	roommate.presence = true
+	roommate.send(domain.MessageTypeJoin, "", "lobby")
+	_ = roommate.receiveType(domain.MessageTypeJoined)
+	require.NoError(t, roommate.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeWatchPresence,
+		Presence: &domain.Presence{Username: "user2"},
+	}))
+	require.Equal(t, domain.PresenceOnline, roommate.receivePresence("user2"))
+	require.NoError(t, second.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	require.Equal(t, domain.PresenceOffline, watcher.receivePresence("user2"))
+	require.Equal(t, domain.PresenceOffline, roommate.receivePresence("user2"))
+	watcher.expectNoMessage()
+	roommate.expectNoMessage()
+}
+
+// Users who share only the global room get each other's presence once they ask for it
+func TestGlobalPresence(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+	client1.presence = true
+	bystander := connectClient(t, server, "bystander")
+	defer bystander.conn.Close()
+	bystander.presence = true
+
+	require.NoError(t, client1.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeWatchPresence, Room: "global"}))
+	var users []domain.Presence
+	for users == nil {
+		users = client1.receiveType(domain.MessageTypeSystem).Users
+	}
+	require.Contains(t, users, domain.Presence{Username: "bystander", Status: domain.PresenceOnline})
+
+	client2 := connectClient(t, server, "user2")
+	require.Equal(t, domain.PresenceOnline, client1.receivePresence("user2"))
+	require.NoError(t, client2.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	require.Equal(t, domain.PresenceOffline, client1.receivePresence("user2"))
+
+	// Connections that did not ask, or have left the global room, get none
+	bystander.expectNoPresence()
+	client1.send(domain.MessageTypeJoin, "", "lobby")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+	client3 := connectClient(t, server, "user3")
+	defer client3.conn.Close()
+	time.Sleep(3 * testPresenceDelay)
+	client1.expectNoPresence()
+}
+
+// setStatus sends a set_status frame and returns the presence it is answered with
+func (c *testClient) setStatus(status domain.Presence) domain.Presence {
+	require.NoError(c.t, c.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeSetStatus, Presence: &status}))
+	for {
+		// Announcements of the user's own presence carry an ID, the answer does not
+		msg := c.receiveType(domain.MessageTypePresence)
+		if msg.ID == "" {
+			return *msg.Presence
+		}
+	}
+}
+
+// listUsers requests the active users and returns them with their statuses
+func (c *testClient) listUsers() []domain.Presence {
+	c.send(domain.MessageTypeList, "", "")
+	for {
+		msg := c.receiveType(domain.MessageTypeSystem)
+		if msg.Users != nil {
+			return msg.Users
+		}
+	}
+}
+
+func TestUserStatus(t *testing.T) {
+	server, client1 := setupTest(t)
+	defer server.Close()
+	client1.presence = true
+	client1.send(domain.MessageTypeJoin, "", "lobby")
+	_ = client1.receiveType(domain.MessageTypeJoined)
+
+	client2 := connectClient(t, server, "user2")
+	client2.send(domain.MessageTypeJoin, "", "lobby")
+	_ = client2.receiveType(domain.MessageTypeJoined)
+	require.Equal(t, domain.PresenceOnline, client1.receivePresence("user2"))
+	client2.presence = true
+
+	// The setter is answered with their status, and others hear of it with its text
+	reply := client2.setStatus(domain.Presence{Status: domain.PresenceBusy, Text: "in a meeting", ExpiresIn: 3600})
+	require.Equal(t, domain.PresenceBusy, reply.Status)
+	require.NotEmpty(t, reply.ExpiresAt)
+	require.Equal(t, domain.PresenceBusy, client1.receivePresence("user2"))
+
+	users := client1.listUsers()
+	require.Len(t, users, 2)
+	for _, user := range users {
+		if user.Username == "user2" {
+			require.Equal(t, domain.PresenceBusy, user.Status)
+			require.Equal(t, "in a meeting", user.Text)
+		} else {
+			require.Equal(t, domain.PresenceOnline, user.Status)
+		}
+	}
+
+	// Invisible users appear offline and are left out of others' lists
+	reply = client2.setStatus(domain.Presence{Status: domain.PresenceInvisible})
+	require.Equal(t, domain.PresenceInvisible, reply.Status)
+	require.Equal(t, domain.PresenceOffline, client1.receivePresence("user2"))
+	require.Equal(t, []domain.Presence{{Username: "user1", Status: domain.PresenceOnline}}, client1.listUsers())
+	require.Contains(t, client2.listUsers(), domain.Presence{Username: "user2", Status: domain.PresenceInvisible})
+
+	// Unknown statuses are rejected
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{
+		Type:     domain.MessageTypeSetStatus,
+		Presence: &domain.Presence{Status: "sleeping"},
+	}))
+	errMsg := client2.receiveType(domain.MessageTypeError)
+	require.Equal(t, domain.ErrorCodeInvalidRequest, errMsg.Code)
+
+	// Invisible users' typing, read receipts and leaving are not told to the room
+	client1.send(domain.MessageTypeChat, "anyone here?", "")
+	chat := client2.receiveType(domain.MessageTypeChat)
+	client2.send(domain.MessageTypeTypingStart, "", "")
+	require.NoError(t, client2.conn.WriteJSON(domain.ChatMessage{Type: domain.MessageTypeMarkRead, ID: chat.ID}))
+	client2.send(domain.MessageTypeJoin, "", "hideout")
+	_ = client2.receiveType(domain.MessageTypeJoined)
+	client1.expectNoMessage()
+}
@@ -2,7 +2,12 @@ package unit
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/SphrGhfri/chatroom_golang_nats/config"
 	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
@@ -14,6 +19,16 @@ import (
 )
 
 func setupChatService(t *testing.T) (service.ChatService, context.Context) {
+	return setupChatServiceWithConfig(t, service.ChatConfig{})
+}
+
+func setupChatServiceWithConfig(t *testing.T, cfg service.ChatConfig) (service.ChatService, context.Context) {
+	chatService, _, _, ctx := setupChatServiceClients(t, cfg)
+	return chatService, ctx
+}
+
+// setupChatServiceClients also returns the service's clients, for tests that inspect or break them
+func setupChatServiceClients(t *testing.T, cfg service.ChatConfig) (service.ChatService, *nats.NATSClient, *redis.RedisClient, context.Context) {
 	config := config.MustReadConfig("../../config_test.json")
 	baseLogger := logger.NewLogger(config.LogLevel, config.LogFile)
 	ctx := logger.NewContext(context.Background(), baseLogger)
@@ -25,7 +40,7 @@ func setupChatService(t *testing.T) (service.ChatService, context.Context) {
 	assert.NoError(t, err)
 	redisClient.FlushAll(ctx)
 
-	chatService := service.NewChatService(ctx, natsClient, redisClient)
+	chatService := service.NewChatService(ctx, natsClient, redisClient, cfg)
 
 	t.Cleanup(func() {
 		redisClient.FlushAll(ctx)
@@ -33,7 +48,7 @@ func setupChatService(t *testing.T) (service.ChatService, context.Context) {
 		natsClient.Close()
 	})
 
-	return chatService, ctx
+	return chatService, natsClient, redisClient, ctx
 }
 
 // Test AddActiveUser and ListActiveUsers
@@ -41,8 +56,8 @@ func TestActiveUserManagement(t *testing.T) {
 	chatService, ctx := setupChatService(t)
 
 	// Add users
-	assert.NoError(t, chatService.AddActiveUser(ctx, "user1"))
-	assert.NoError(t, chatService.AddActiveUser(ctx, "user2"))
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user1", "conn1"))
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user2", "conn2"))
 
 	// Check active users
 	users, err := chatService.ListActiveUsers(ctx)
@@ -50,7 +65,7 @@ func TestActiveUserManagement(t *testing.T) {
 	assert.ElementsMatch(t, []string{"user1", "user2"}, users)
 
 	// Remove user
-	assert.NoError(t, chatService.RemoveActiveUser(ctx, "user1"))
+	assert.NoError(t, chatService.RemoveActiveUser(ctx, "user1", "conn1"))
 
 	// Check remaining users
 	users, err = chatService.ListActiveUsers(ctx)
@@ -68,8 +83,8 @@ func TestRoomManagement(t *testing.T) {
 		msgChan <- msg
 	}
 
-	assert.NoError(t, chatService.JoinRoom(ctx, "roomA", "user1", handler))
-	assert.NoError(t, chatService.JoinRoom(ctx, "roomA", "user2", handler))
+	assert.NoError(t, chatService.JoinRoom(ctx, "roomA", "user1", "conn1", handler))
+	assert.NoError(t, chatService.JoinRoom(ctx, "roomA", "user2", "conn2", handler))
 
 	// Verify room members
 	members, err := chatService.ListRoomMembers(ctx, "roomA")
@@ -77,7 +92,7 @@ func TestRoomManagement(t *testing.T) {
 	assert.ElementsMatch(t, []string{"user1", "user2"}, members)
 
 	// Leave room
-	assert.NoError(t, chatService.LeaveRoom(ctx, "roomA", "user1"))
+	assert.NoError(t, chatService.LeaveRoom(ctx, "roomA", "user1", "conn1"))
 
 	// Verify updated members
 	members, err = chatService.ListRoomMembers(ctx, "roomA")
@@ -85,10 +100,10 @@ func TestRoomManagement(t *testing.T) {
 	assert.ElementsMatch(t, []string{"user2"}, members)
 
 	// Clean up final room
-	assert.NoError(t, chatService.LeaveRoom(ctx, "roomA", "user2"))
+	assert.NoError(t, chatService.LeaveRoom(ctx, "roomA", "user2", "conn2"))
 
 	// Verify room is removed
-	rooms, err := chatService.ListAllRooms(ctx)
+	rooms, err := chatService.ListAllRooms(ctx, "")
 	assert.NoError(t, err)
 	assert.Empty(t, rooms)
 }
@@ -102,18 +117,55 @@ func TestIsUserActive(t *testing.T) {
 	assert.False(t, exists)
 
 	// Add user and check
-	assert.NoError(t, chatService.AddActiveUser(ctx, "testuser"))
+	assert.NoError(t, chatService.AddActiveUser(ctx, "testuser", "conn1"))
 	exists, err = chatService.IsUserActive(ctx, "testuser")
 	assert.NoError(t, err)
 	assert.True(t, exists)
 
 	// Remove user and check again
-	assert.NoError(t, chatService.RemoveActiveUser(ctx, "testuser"))
+	assert.NoError(t, chatService.RemoveActiveUser(ctx, "testuser", "conn1"))
 	exists, err = chatService.IsUserActive(ctx, "testuser")
 	assert.NoError(t, err)
 	assert.False(t, exists)
 }
 
+func TestMultipleSessionsPerUser(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+	handler := func(msg domain.ChatMessage) {}
+
+	// Same user connected twice, both connections in the same room
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user1", "laptop"))
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user1", "browser"))
+	assert.NoError(t, chatService.JoinRoom(ctx, "roomA", "user1", "laptop", handler))
+	assert.NoError(t, chatService.JoinRoom(ctx, "roomA", "user1", "browser", handler))
+
+	users, err := chatService.ListActiveUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user1"}, users)
+
+	// Closing one session keeps the user present and in the room
+	assert.NoError(t, chatService.LeaveRoom(ctx, "roomA", "user1", "laptop"))
+	assert.NoError(t, chatService.RemoveActiveUser(ctx, "user1", "laptop"))
+
+	exists, err := chatService.IsUserActive(ctx, "user1")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	members, err := chatService.ListRoomMembers(ctx, "roomA")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user1"}, members)
+
+	// The last session removes the user
+	assert.NoError(t, chatService.LeaveRoom(ctx, "roomA", "user1", "browser"))
+	assert.NoError(t, chatService.RemoveActiveUser(ctx, "user1", "browser"))
+
+	exists, err = chatService.IsUserActive(ctx, "user1")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	rooms, err := chatService.ListAllRooms(ctx, "")
+	assert.NoError(t, err)
+	assert.Empty(t, rooms)
+}
+
 func TestSwitchRoom(t *testing.T) {
 	chatService, ctx := setupChatService(t)
 
@@ -121,11 +173,11 @@ func TestSwitchRoom(t *testing.T) {
 	messageHandler := func(msg domain.ChatMessage) {}
 
 	// Initial room join
-	err := chatService.JoinRoom(ctx, "room1", "user1", messageHandler)
+	err := chatService.JoinRoom(ctx, "room1", "user1", "conn1", messageHandler)
 	assert.NoError(t, err)
 
 	// Switch to new room
-	err = chatService.SwitchRoom(ctx, "room1", "room2", "user1", messageHandler)
+	err = chatService.SwitchRoom(ctx, "room1", "room2", "user1", "conn1", "", messageHandler)
 	assert.NoError(t, err)
 
 	// Verify user is no longer in old room
@@ -138,3 +190,979 @@ func TestSwitchRoom(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Contains(t, members2, "user1")
 }
+
+// The connections of a server whose heartbeat lapsed are cleaned up by the others
+func TestExpiredNodeCleanup(t *testing.T) {
+	chatService, _, redisClient, ctx := setupChatServiceClients(t, service.ChatConfig{NodeTimeout: 300 * time.Millisecond})
+
+	// A server that went away left a user in a room, with a second connection on a live server
+	assert.NoError(t, redisClient.CreateSession(ctx, domain.Session{Token: "t1", ConnID: "gone1", Username: "user1", Room: "lobby", Node: "gone"}))
+	_, err := redisClient.AddUserConnection(ctx, "user1", "gone1")
+	assert.NoError(t, err)
+	_, err = redisClient.AddRoomConnection(ctx, "lobby", "user1", "gone1", 0, true)
+	assert.NoError(t, err)
+	assert.NoError(t, redisClient.CreateSession(ctx, domain.Session{Token: "t2", ConnID: "gone2", Username: "user2", Room: "global", Node: "gone"}))
+	_, err = redisClient.AddUserConnection(ctx, "user2", "gone2")
+	assert.NoError(t, err)
+	_, err = redisClient.AddRoomConnection(ctx, "global", "user2", "gone2", 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user2", "live"))
+	assert.NoError(t, chatService.JoinRoom(ctx, "global", "user2", "live", func(domain.ChatMessage) {}))
+	assert.NoError(t, redisClient.Heartbeat(ctx, "gone", time.Millisecond))
+
+	assert.Eventually(t, func() bool {
+		members, err := chatService.ListRoomMembers(ctx, "lobby")
+		return err == nil && len(members) == 0
+	}, 2*time.Second, 50*time.Millisecond)
+	users, err := chatService.ListActiveUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user2"}, users)
+	members, err := chatService.ListRoomMembers(ctx, "global")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user2"}, members)
+	_, err = redisClient.GetSession(ctx, "t1")
+	assert.ErrorIs(t, err, domain.ErrSessionNotFound)
+	conns, err := redisClient.NodeConnections(ctx, "gone")
+	assert.NoError(t, err)
+	assert.Empty(t, conns)
+}
+
+// Lifecycle changes are published as versioned events on their own subjects
+func TestDomainEvents(t *testing.T) {
+	chatService, natsClient, _, ctx := setupChatServiceClients(t, service.ChatConfig{})
+
+	sub, err := natsClient.Conn.SubscribeSync("chat.events.v1.>")
+	assert.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user1", "conn1"))
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user1", "conn2"))
+	assert.NoError(t, chatService.JoinRoom(ctx, "lobby", "user1", "conn1", func(domain.ChatMessage) {}))
+	assert.NoError(t, chatService.SetTopic(ctx, "lobby", "user1", "conn1", "plans"))
+	assert.NoError(t, chatService.SwitchRoom(ctx, "lobby", "dev", "user1", "conn1", "", func(domain.ChatMessage) {}))
+	_, err = chatService.CreateRoom(ctx, domain.Room{Name: "ops", CreatedBy: "admin"}, "")
+	assert.NoError(t, err)
+	assert.NoError(t, chatService.DeleteRoom(ctx, "ops"))
+	assert.NoError(t, chatService.RemoveActiveUser(ctx, "user1", "conn1"))
+	assert.NoError(t, chatService.RemoveActiveUser(ctx, "user1", "conn2"))
+
+	want := []struct {
+		subject string
+		event   domain.Event
+	}{
+		{"chat.events.v1.user.user1.user_connected", domain.Event{Type: domain.EventUserConnected, Username: "user1"}},
+		{"chat.events.v1.room.lobby.room_created", domain.Event{Type: domain.EventRoomCreated, Room: "lobby", Username: "user1"}},
+		{"chat.events.v1.room.lobby.user_joined_room", domain.Event{Type: domain.EventUserJoinedRoom, Room: "lobby", Username: "user1"}},
+		{"chat.events.v1.room.lobby.topic_changed", domain.Event{Type: domain.EventTopicChanged, Room: "lobby", Username: "user1", Topic: "plans"}},
+		{"chat.events.v1.room.lobby.user_left_room", domain.Event{Type: domain.EventUserLeftRoom, Room: "lobby", Username: "user1"}},
+		{"chat.events.v1.room.lobby.room_deleted", domain.Event{Type: domain.EventRoomDeleted, Room: "lobby"}},
+		{"chat.events.v1.room.dev.room_created", domain.Event{Type: domain.EventRoomCreated, Room: "dev", Username: "user1"}},
+		{"chat.events.v1.room.dev.user_joined_room", domain.Event{Type: domain.EventUserJoinedRoom, Room: "dev", Username: "user1"}},
+		{"chat.events.v1.room.ops.room_created", domain.Event{Type: domain.EventRoomCreated, Room: "ops", Username: "admin"}},
+		{"chat.events.v1.room.ops.room_deleted", domain.Event{Type: domain.EventRoomDeleted, Room: "ops"}},
+		{"chat.events.v1.user.user1.user_disconnected", domain.Event{Type: domain.EventUserDisconnected, Username: "user1"}},
+	}
+	for _, w := range want {
+		msg, err := sub.NextMsg(2 * time.Second)
+		if !assert.NoError(t, err, "missing %s", w.subject) {
+			return
+		}
+		assert.Equal(t, w.subject, msg.Subject)
+
+		checkEventSchema(t, msg.Data)
+		var event domain.Event
+		assert.NoError(t, json.Unmarshal(msg.Data, &event))
+		assert.Equal(t, domain.EventVersion, event.Version)
+		assert.NotEmpty(t, event.ID)
+		assert.NotEmpty(t, event.Timestamp)
+		if w.event.Type == domain.EventRoomCreated && w.event.Room == "ops" {
+			assert.NotNil(t, event.RoomInfo)
+			assert.True(t, event.RoomInfo.Persistent)
+		}
+		event.ID, event.Timestamp, event.Version, event.RoomInfo = "", "", 0, nil
+		assert.Equal(t, w.event, event)
+	}
+}
+
+// checkEventSchema validates an emitted event against the JSON Schema of its type in
+// schemas/events. Only the keywords those schemas use are supported.
+func checkEventSchema(t *testing.T, data []byte) {
+	t.Helper()
+	var event map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal(data, &event)) {
+		return
+	}
+	path := fmt.Sprintf("../../schemas/events/v%v/%v.json", event["version"], event["type"])
+	raw, err := os.ReadFile(path)
+	if !assert.NoError(t, err, "no schema for event %s", data) {
+		return
+	}
+	var schema map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal(raw, &schema)) {
+		return
+	}
+
+	for _, field := range schema["required"].([]interface{}) {
+		assert.Contains(t, event, field, "%s: missing %s", path, field)
+	}
+	properties := schema["properties"].(map[string]interface{})
+	for field, value := range event {
+		property, ok := properties[field].(map[string]interface{})
+		if !assert.True(t, ok, "%s: undeclared field %s", path, field) {
+			continue
+		}
+		if want, ok := property["const"]; ok {
+			assert.Equal(t, want, value, "%s: %s", path, field)
+		}
+		switch property["type"] {
+		case "string":
+			str, ok := value.(string)
+			if !assert.True(t, ok, "%s: %s is not a string", path, field) {
+				continue
+			}
+			if min, ok := property["minLength"].(float64); ok {
+				assert.GreaterOrEqual(t, len(str), int(min), "%s: %s too short", path, field)
+			}
+			if pattern, ok := property["pattern"].(string); ok {
+				assert.Regexp(t, pattern, str, "%s: %s", path, field)
+			}
+		case "object":
+			_, ok := value.(map[string]interface{})
+			assert.True(t, ok, "%s: %s is not an object", path, field)
+		}
+	}
+}
+
+// Every event type has a schema for the current version
+func TestEventSchemas(t *testing.T) {
+	for _, eventType := range []domain.EventType{
+		domain.EventUserConnected, domain.EventUserDisconnected, domain.EventUserJoinedRoom,
+		domain.EventUserLeftRoom, domain.EventRoomCreated, domain.EventRoomDeleted, domain.EventTopicChanged,
+	} {
+		raw, err := os.ReadFile(fmt.Sprintf("../../schemas/events/v%d/%s.json", domain.EventVersion, eventType))
+		if !assert.NoError(t, err, "no schema for %s", eventType) {
+			continue
+		}
+		var schema struct {
+			Title      string                     `json:"title"`
+			Properties map[string]json.RawMessage `json:"properties"`
+		}
+		assert.NoError(t, json.Unmarshal(raw, &schema))
+		assert.Equal(t, string(eventType), schema.Title)
+		assert.JSONEq(t, fmt.Sprintf(`{"const":%q}`, eventType), string(schema.Properties["type"]))
+	}
+}
+
+// Invisible users' connections, joins and leaves are not published as events
+func TestInvisibleUserEvents(t *testing.T) {
+	chatService, natsClient, _, ctx := setupChatServiceClients(t, service.ChatConfig{})
+
+	sub, err := natsClient.Conn.SubscribeSync("chat.events.v1.>")
+	assert.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	_, err = chatService.SetStatus(ctx, "user1", domain.Presence{Status: domain.PresenceInvisible})
+	assert.NoError(t, err)
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user1", "conn1"))
+	assert.NoError(t, chatService.JoinRoom(ctx, "lobby", "user1", "conn1", func(domain.ChatMessage) {}))
+	assert.NoError(t, chatService.LeaveRoom(ctx, "lobby", "user1", "conn1"))
+	assert.NoError(t, chatService.RemoveActiveUser(ctx, "user1", "conn1"))
+
+	// The room still comes and goes, but without a creator
+	for _, want := range []domain.Event{
+		{Type: domain.EventRoomCreated, Room: "lobby"},
+		{Type: domain.EventRoomDeleted, Room: "lobby"},
+	} {
+		msg, err := sub.NextMsg(2 * time.Second)
+		if !assert.NoError(t, err, "missing %s", want.Type) {
+			return
+		}
+		checkEventSchema(t, msg.Data)
+		var event domain.Event
+		assert.NoError(t, json.Unmarshal(msg.Data, &event))
+		assert.Equal(t, want.Type, event.Type)
+		assert.Equal(t, want.Room, event.Room)
+		assert.Empty(t, event.Username)
+	}
+	_, err = sub.NextMsg(300 * time.Millisecond)
+	assert.Error(t, err)
+}
+
+// Presence frames reach the user's rooms and watchers, and flaps are coalesced
+func TestPresenceFrames(t *testing.T) {
+	chatService, ctx := setupChatServiceWithConfig(t, service.ChatConfig{PresenceDelay: 100 * time.Millisecond})
+
+	inRoom := make(chan domain.Presence, 10)
+	assert.NoError(t, chatService.JoinRoom(ctx, "lobby", "roommate", "conn2", func(msg domain.ChatMessage) {
+		if msg.Type == domain.MessageTypePresence && msg.Presence.Username == "user1" {
+			inRoom <- *msg.Presence
+		}
+	}))
+	watched := make(chan domain.Presence, 10)
+	presence, err := chatService.WatchPresence(ctx, "user1", "conn3", func(msg domain.ChatMessage) {
+		watched <- *msg.Presence
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, domain.PresenceOffline, presence.Status)
+
+	expect := func(ch chan domain.Presence, status string) {
+		t.Helper()
+		select {
+		case p := <-ch:
+			assert.Equal(t, status, p.Status)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s presence", status)
+		}
+	}
+	expectNone := func(ch chan domain.Presence) {
+		t.Helper()
+		select {
+		case p := <-ch:
+			t.Fatalf("unexpected presence: %+v", p)
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user1", "conn1"))
+	assert.NoError(t, chatService.JoinRoom(ctx, "lobby", "user1", "conn1", func(domain.ChatMessage) {}))
+	expect(inRoom, domain.PresenceOnline)
+	expect(watched, domain.PresenceOnline)
+
+	// Disconnecting and reconnecting within the delay announces nothing
+	assert.NoError(t, chatService.RemoveActiveUser(ctx, "user1", "conn1"))
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user1", "conn1"))
+	expectNone(watched)
+
+	// The rooms the user was in hear of them going offline
+	assert.NoError(t, chatService.RemoveActiveUser(ctx, "user1", "conn1"))
+	assert.NoError(t, chatService.LeaveRoom(ctx, "lobby", "user1", "conn1"))
+	expect(inRoom, domain.PresenceOffline)
+	expect(watched, domain.PresenceOffline)
+
+	// Unwatched users are not delivered any more
+	assert.NoError(t, chatService.UnwatchPresence(ctx, "user1", "conn3"))
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user1", "conn1"))
+	expectNone(watched)
+}
+
+// Read receipts within the throttle interval are merged into one for the latest message
+func TestReadReceiptThrottle(t *testing.T) {
+	chatService, ctx := setupChatServiceWithConfig(t, service.ChatConfig{ReceiptThrottle: 300 * time.Millisecond})
+
+	chats := make(chan domain.ChatMessage, 10)
+	receipts := make(chan domain.ChatMessage, 10)
+	assert.NoError(t, chatService.JoinRoom(ctx, "reading", "user1", "conn1", func(domain.ChatMessage) {}))
+	assert.NoError(t, chatService.JoinRoom(ctx, "reading", "user2", "conn2", func(msg domain.ChatMessage) {
+		switch msg.Type {
+		case domain.MessageTypeChat:
+			chats <- msg
+		case domain.MessageTypeReadReceipt:
+			receipts <- msg
+		}
+	}))
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, chatService.PublishMessage(ctx, domain.ChatMessage{
+			Type: domain.MessageTypeChat, Sender: "user2", Room: "reading", Content: fmt.Sprint(i),
+		}))
+		ids = append(ids, (<-chats).ID)
+	}
+
+	expect := func(id string) {
+		t.Helper()
+		select {
+		case receipt := <-receipts:
+			assert.Equal(t, id, receipt.ID)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no receipt for %s", id)
+		}
+	}
+	for _, id := range ids {
+		assert.NoError(t, chatService.MarkRead(ctx, "reading", "user1", "conn1", id))
+	}
+	expect(ids[0])
+	expect(ids[2])
+	select {
+	case receipt := <-receipts:
+		t.Fatalf("unexpected receipt: %+v", receipt)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestSetStatus(t *testing.T) {
+	chatService, ctx := setupChatServiceWithConfig(t, service.ChatConfig{
+		PresenceDelay: 100 * time.Millisecond,
+		AwayTimeout:   300 * time.Millisecond,
+	})
+
+	watched := make(chan domain.Presence, 10)
+	_, err := chatService.WatchPresence(ctx, "user1", "conn3", func(msg domain.ChatMessage) {
+		watched <- *msg.Presence
+	})
+	assert.NoError(t, err)
+	expect := func(status, text string) {
+		t.Helper()
+		select {
+		case p := <-watched:
+			assert.Equal(t, status, p.Status)
+			assert.Equal(t, text, p.Text)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s presence", status)
+		}
+	}
+
+	session, err := chatService.StartSession(ctx, "user1", "")
+	assert.NoError(t, err)
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user1", session.ConnID))
+	assert.NoError(t, chatService.AddActiveUser(ctx, "user2", "conn2"))
+	expect(domain.PresenceOnline, "")
+
+	_, err = chatService.SetStatus(ctx, "user1", domain.Presence{Status: "sleeping"})
+	assert.ErrorIs(t, err, domain.ErrInvalidRequest)
+	_, err = chatService.SetStatus(ctx, "user1", domain.Presence{Status: domain.PresenceBusy, ExpiresIn: -1})
+	assert.ErrorIs(t, err, domain.ErrInvalidRequest)
+
+	presence, err := chatService.SetStatus(ctx, "user1", domain.Presence{Status: domain.PresenceBusy, Text: "in a meeting"})
+	assert.NoError(t, err)
+	assert.Equal(t, domain.PresenceBusy, presence.Status)
+	expect(domain.PresenceBusy, "in a meeting")
+
+	// Invisible users appear offline and only list themselves
+	presence, err = chatService.SetStatus(ctx, "user1", domain.Presence{Status: domain.PresenceInvisible})
+	assert.NoError(t, err)
+	assert.Equal(t, domain.PresenceInvisible, presence.Status)
+	expect(domain.PresenceOffline, "")
+	statuses, err := chatService.UserStatuses(ctx, "user2", []string{"user1", "user2"})
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Presence{{Username: "user2", Status: domain.PresenceOnline}}, statuses)
+	statuses, err = chatService.UserStatuses(ctx, "user1", []string{"user1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Presence{{Username: "user1", Status: domain.PresenceInvisible}}, statuses)
+
+	// Without frames the user turns away, and back online with the next one
+	_, err = chatService.SetStatus(ctx, "user1", domain.Presence{Status: domain.PresenceOnline})
+	assert.NoError(t, err)
+	expect(domain.PresenceOnline, "")
+	chatService.TouchSession(ctx, session)
+	expect(domain.PresenceAway, "")
+	chatService.TouchSession(ctx, session)
+	expect(domain.PresenceOnline, "")
+	assert.NoError(t, chatService.EndSession(ctx, session))
+	expect(domain.PresenceOffline, "")
+}
+
+// Invisible members are left out of room member counts and roles, except for themselves
+func TestInvisibleRoomMembers(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+	noop := func(domain.ChatMessage) {}
+
+	_, err := chatService.CreateRoom(ctx, domain.Room{Name: "dev", CreatedBy: "owner"}, "")
+	assert.NoError(t, err)
+	assert.NoError(t, chatService.JoinRoom(ctx, "dev", "owner", "conn1", noop))
+	assert.NoError(t, chatService.JoinRoom(ctx, "dev", "ghost", "conn2", noop))
+	assert.NoError(t, chatService.SetRole(ctx, "dev", "owner", "conn1", domain.RoleGrant{Username: "ghost", Role: domain.RoleModerator}))
+	_, err = chatService.SetStatus(ctx, "ghost", domain.Presence{Status: domain.PresenceInvisible})
+	assert.NoError(t, err)
+
+	info, err := chatService.GetRoomInfo(ctx, "dev", "viewer")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), info.Members)
+	assert.NotContains(t, info.Roles, "ghost")
+	rooms, err := chatService.ListRooms(ctx, "viewer")
+	assert.NoError(t, err)
+	assert.Len(t, rooms, 1)
+	assert.Equal(t, int64(1), rooms[0].Members)
+
+	info, err = chatService.GetRoomInfo(ctx, "dev", "ghost")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), info.Members)
+	assert.Equal(t, domain.RoleModerator, info.Roles["ghost"])
+	rooms, err = chatService.ListRooms(ctx, "ghost")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), rooms[0].Members)
+}
+
+// A failed switch leaves the user in the old room with only its subscription
+func TestSwitchRoomFaults(t *testing.T) {
+	cfg := config.MustReadConfig("../../config_test.json")
+
+	t.Run("room full", func(t *testing.T) {
+		chatService, natsClient, _, ctx := setupChatServiceClients(t, service.ChatConfig{RoomCapacity: 1})
+
+		received := make(chan domain.ChatMessage, 10)
+		handler := func(msg domain.ChatMessage) {
+			if msg.Type == domain.MessageTypeChat {
+				received <- msg
+			}
+		}
+		assert.NoError(t, chatService.JoinRoom(ctx, "full", "user2", "conn2", func(domain.ChatMessage) {}))
+		assert.NoError(t, chatService.JoinRoom(ctx, "lobby", "user1", "conn1", handler))
+
+		err := chatService.SwitchRoom(ctx, "lobby", "full", "user1", "conn1", "", handler)
+		assert.ErrorIs(t, err, domain.ErrRoomFull)
+		assert.True(t, natsClient.IsRoomSubscriber("lobby", "conn1"))
+		assert.False(t, natsClient.IsRoomSubscriber("full", "conn1"))
+
+		members, err := chatService.ListRoomMembers(ctx, "lobby")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user1"}, members)
+		members, err = chatService.ListRoomMembers(ctx, "full")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user2"}, members)
+
+		// Only messages of the old room still arrive
+		assert.NoError(t, chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: "user2", Room: "full", Content: "no"}))
+		assert.NoError(t, chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: "user1", Room: "lobby", Content: "yes"}))
+		select {
+		case msg := <-received:
+			assert.Equal(t, "lobby", msg.Room)
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message from the old room")
+		}
+		select {
+		case msg := <-received:
+			t.Fatalf("unexpected message from %s", msg.Room)
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	t.Run("redis down", func(t *testing.T) {
+		chatService, natsClient, redisClient, ctx := setupChatServiceClients(t, service.ChatConfig{})
+		assert.NoError(t, chatService.JoinRoom(ctx, "lobby", "user1", "conn1", func(domain.ChatMessage) {}))
+
+		observer, err := redis.NewRedisClient(ctx, cfg.RedisURL)
+		assert.NoError(t, err)
+		defer observer.Close()
+
+		redisClient.Close()
+		err = chatService.SwitchRoom(ctx, "lobby", "dev", "user1", "conn1", "", func(domain.ChatMessage) {})
+		assert.Error(t, err)
+
+		// The new room's subscription is rolled back and the membership is unchanged
+		assert.True(t, natsClient.IsRoomSubscriber("lobby", "conn1"))
+		assert.Zero(t, natsClient.Subscribers("dev"))
+		isMember, err := observer.IsRoomMember(ctx, "lobby", "user1")
+		assert.NoError(t, err)
+		assert.True(t, isMember)
+		isMember, err = observer.IsRoomMember(ctx, "dev", "user1")
+		assert.NoError(t, err)
+		assert.False(t, isMember)
+	})
+
+	t.Run("nats down", func(t *testing.T) {
+		chatService, natsClient, _, ctx := setupChatServiceClients(t, service.ChatConfig{})
+		assert.NoError(t, chatService.JoinRoom(ctx, "lobby", "user1", "conn1", func(domain.ChatMessage) {}))
+
+		natsClient.Conn.Close()
+		err := chatService.SwitchRoom(ctx, "lobby", "dev", "user1", "conn1", "", func(domain.ChatMessage) {})
+		assert.Error(t, err)
+
+		// Redis is never touched when the subscription cannot be opened
+		members, err := chatService.ListRoomMembers(ctx, "lobby")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user1"}, members)
+		members, err = chatService.ListRoomMembers(ctx, "dev")
+		assert.NoError(t, err)
+		assert.Empty(t, members)
+		assert.True(t, natsClient.IsRoomSubscriber("lobby", "conn1"))
+	})
+}
+
+func TestTypingIndicator(t *testing.T) {
+	chatService, ctx := setupChatServiceWithConfig(t, service.ChatConfig{
+		TypingTimeout:  300 * time.Millisecond,
+		TypingThrottle: time.Second,
+	})
+
+	received := make(chan domain.ChatMessage, 10)
+	assert.NoError(t, chatService.JoinRoom(ctx, "roomT", "watcher", "conn1", func(msg domain.ChatMessage) {
+		if msg.Type == domain.MessageTypeTypingStart || msg.Type == domain.MessageTypeTypingStop {
+			received <- msg
+		}
+	}))
+
+	// Repeated starts within the throttle interval are relayed once
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, chatService.StartTyping(ctx, "roomT", "typist", "conn2"))
+	}
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, domain.MessageTypeTypingStart, msg.Type)
+		assert.Equal(t, "typist", msg.Sender)
+		assert.Empty(t, msg.ID, "typing indicators are not stored")
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for typing_start")
+	}
+
+	// Without a stop the indicator expires
+	select {
+	case msg := <-received:
+		assert.Equal(t, domain.MessageTypeTypingStop, msg.Type)
+		assert.Equal(t, "typist", msg.Sender)
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for typing_stop")
+	}
+
+	// Stopping when not typing sends nothing
+	assert.NoError(t, chatService.StopTyping(ctx, "roomT", "typist", "conn2"))
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message: %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRoomIdleExpiry(t *testing.T) {
+	chatService, ctx := setupChatServiceWithConfig(t, service.ChatConfig{
+		RoomIdleTimeout: 200 * time.Millisecond,
+	})
+	noop := func(domain.ChatMessage) {}
+
+	_, err := chatService.CreateRoom(ctx, domain.Room{Name: "standing", CreatedBy: "admin"}, "")
+	assert.NoError(t, err)
+	for _, room := range []string{"standing", "adhoc"} {
+		assert.NoError(t, chatService.JoinRoom(ctx, room, "user1", "conn1", noop))
+		assert.NoError(t, chatService.LeaveRoom(ctx, room, "user1", "conn1"))
+	}
+
+	// Empty ad-hoc rooms are kept while idle
+	rooms, err := chatService.ListAllRooms(ctx, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"standing", "adhoc"}, rooms)
+
+	time.Sleep(400 * time.Millisecond)
+	rooms, err = chatService.ListAllRooms(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"standing"}, rooms)
+
+	_, err = chatService.CreateRoom(ctx, domain.Room{Name: "has space"}, "")
+	assert.ErrorIs(t, err, domain.ErrInvalidRequest)
+}
+
+func TestSubjectSafeNames(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+	noop := func(domain.ChatMessage) {}
+
+	// Names go into NATS subjects, so dots and wildcards are turned away
+	for _, name := range []string{"a.b", "all*", "rest>", ">"} {
+		_, err := chatService.CreateRoom(ctx, domain.Room{Name: name}, "")
+		assert.ErrorIs(t, err, domain.ErrInvalidRequest, name)
+		assert.ErrorIs(t, chatService.JoinRoom(ctx, name, "user1", "conn1", noop), domain.ErrInvalidRequest, name)
+		assert.ErrorIs(t, chatService.JoinRoom(ctx, "dev", name, "conn1", noop), domain.ErrInvalidRequest, name)
+		_, err = chatService.WatchPresence(ctx, name, "conn1", noop)
+		assert.ErrorIs(t, err, domain.ErrInvalidRequest, name)
+	}
+
+	assert.NoError(t, chatService.JoinRoom(ctx, "dev", "user1", "conn1", noop))
+	assert.ErrorIs(t, chatService.SwitchRoom(ctx, "dev", "a.b", "user1", "conn1", "", noop), domain.ErrInvalidRequest)
+	assert.ErrorIs(t, chatService.Kick(ctx, "dev", "user1", "conn1", domain.Moderation{Username: "*"}), domain.ErrInvalidRequest)
+	rooms, err := chatService.ListAllRooms(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dev"}, rooms)
+}
+
+func TestRoomVisibility(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+	noop := func(domain.ChatMessage) {}
+
+	_, err := chatService.CreateRoom(ctx, domain.Room{Name: "secret", CreatedBy: "insider", Visibility: domain.RoomPrivate}, "")
+	assert.NoError(t, err)
+	_, err = chatService.CreateRoom(ctx, domain.Room{Name: "vault", Visibility: domain.RoomPassword}, "hunter2")
+	assert.NoError(t, err)
+	_, err = chatService.CreateRoom(ctx, domain.Room{Name: "nopass", Visibility: domain.RoomPassword}, "")
+	assert.ErrorIs(t, err, domain.ErrInvalidRequest)
+
+	// Owners and invited users see a private room before they join it
+	rooms, err := chatService.ListAllRooms(ctx, "insider")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"secret", "vault"}, rooms)
+	info, err := chatService.GetRoomInfo(ctx, "secret", "insider")
+	assert.NoError(t, err)
+	assert.Equal(t, "insider", info.CreatedBy)
+	assert.NoError(t, chatService.InviteUser(ctx, "secret", "insider", "guest"))
+	rooms, err = chatService.ListAllRooms(ctx, "guest")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"secret", "vault"}, rooms)
+	assert.NoError(t, chatService.JoinRoom(ctx, "secret", "insider", "conn1", noop))
+
+	// Private rooms are listed only to their members
+	rooms, err = chatService.ListAllRooms(ctx, "outsider")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"vault"}, rooms)
+	rooms, err = chatService.ListAllRooms(ctx, "insider")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"secret", "vault"}, rooms)
+	_, err = chatService.GetRoomInfo(ctx, "secret", "outsider")
+	assert.ErrorIs(t, err, domain.ErrRoomNotFound)
+
+	// Private rooms admit only invited users, however they come in
+	assert.ErrorIs(t, chatService.CheckRoomAccess(ctx, "secret", "outsider", ""), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.JoinRoom(ctx, "secret", "outsider", "conn2", noop), domain.ErrNotPermitted)
+	assert.NoError(t, chatService.InviteUser(ctx, "secret", "insider", "friend"))
+	assert.NoError(t, chatService.JoinRoom(ctx, "secret", "friend", "conn3", noop))
+
+	// Password rooms need the password, also when switching rooms directly
+	assert.ErrorIs(t, chatService.CheckRoomAccess(ctx, "vault", "outsider", ""), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.CheckRoomAccess(ctx, "vault", "outsider", "wrong"), domain.ErrNotPermitted)
+	assert.NoError(t, chatService.CheckRoomAccess(ctx, "vault", "outsider", "hunter2"))
+	assert.NoError(t, chatService.JoinRoom(ctx, "lobby", "outsider", "conn2", noop))
+	assert.ErrorIs(t, chatService.SwitchRoom(ctx, "lobby", "vault", "outsider", "conn2", "wrong", noop), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.JoinRoom(ctx, "vault", "outsider", "conn4", noop), domain.ErrNotPermitted)
+	assert.NoError(t, chatService.SwitchRoom(ctx, "lobby", "vault", "outsider", "conn2", "hunter2", noop))
+}
+
+func TestInviteOnlyRooms(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+	noop := func(domain.ChatMessage) {}
+
+	_, err := chatService.CreateRoom(ctx, domain.Room{Name: "club", CreatedBy: "owner", Visibility: domain.RoomInvite}, "")
+	assert.NoError(t, err)
+	assert.NoError(t, chatService.JoinRoom(ctx, "club", "owner", "conn1", noop))
+
+	// Uninvited users are turned away, whichever way they come in
+	assert.ErrorIs(t, chatService.CheckRoomAccess(ctx, "club", "guest", ""), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.JoinRoom(ctx, "club", "guest", "conn2", noop), domain.ErrNotPermitted)
+
+	// Only the owner invites
+	assert.ErrorIs(t, chatService.InviteUser(ctx, "club", "guest", "guest"), domain.ErrNotPermitted)
+	assert.NoError(t, chatService.InviteUser(ctx, "club", "owner", "guest"))
+	assert.NoError(t, chatService.JoinRoom(ctx, "club", "guest", "conn2", noop))
+
+	invite, err := chatService.CreateInvite(ctx, "club", "owner", 1, 0)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, invite.Token)
+	redeemed, err := chatService.RedeemInvite(ctx, "club", "friend", invite.Token)
+	assert.NoError(t, err)
+	assert.True(t, redeemed)
+	assert.NoError(t, chatService.CheckRoomAccess(ctx, "club", "friend", ""))
+	_, err = chatService.RedeemInvite(ctx, "club", "stranger", invite.Token)
+	assert.ErrorIs(t, err, domain.ErrInviteInvalid)
+
+	// A redemption given back can be used by someone else
+	assert.NoError(t, chatService.ReturnInvite(ctx, "club", "friend", invite.Token))
+	assert.ErrorIs(t, chatService.CheckRoomAccess(ctx, "club", "friend", ""), domain.ErrNotPermitted)
+	_, err = chatService.RedeemInvite(ctx, "club", "stranger", invite.Token)
+	assert.NoError(t, err)
+
+	// Invites are for invite-only rooms
+	_, err = chatService.CreateRoom(ctx, domain.Room{Name: "lobby", CreatedBy: "owner"}, "")
+	assert.NoError(t, err)
+	_, err = chatService.CreateInvite(ctx, "lobby", "owner", 0, 0)
+	assert.ErrorIs(t, err, domain.ErrInvalidRequest)
+}
+
+func TestAnnouncementRooms(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+	noop := func(domain.ChatMessage) {}
+
+	_, err := chatService.CreateRoom(ctx, domain.Room{Name: "announcements", CreatedBy: "owner", AnnouncementOnly: true}, "")
+	assert.NoError(t, err)
+	for _, user := range []string{"owner", "reader"} {
+		assert.NoError(t, chatService.JoinRoom(ctx, "announcements", user, "conn-"+user, noop))
+	}
+	info, err := chatService.GetRoomInfo(ctx, "announcements", "reader")
+	assert.NoError(t, err)
+	assert.True(t, info.AnnouncementOnly)
+
+	post := func(sender string) error {
+		return chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: sender, Room: "announcements", Content: "news"})
+	}
+	assert.NoError(t, post("owner"))
+	assert.ErrorIs(t, post("reader"), domain.ErrNotPermitted)
+
+	// Moderators can post too, whether made by the owner or an administrator
+	assert.NoError(t, chatService.SetRole(ctx, "announcements", "owner", "conn-owner", domain.RoleGrant{Username: "reader", Role: domain.RoleModerator}))
+	assert.NoError(t, post("reader"))
+	assert.NoError(t, chatService.AssignRole(ctx, "announcements", "reader", domain.RoleMember))
+	assert.ErrorIs(t, post("reader"), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.AssignRole(ctx, "missing", "reader", domain.RoleModerator), domain.ErrRoomNotFound)
+
+	// System messages such as joins still reach the room
+	assert.NoError(t, chatService.JoinRoom(ctx, "announcements", "latecomer", "conn-late", noop))
+
+	// Administrators can convert an existing room either way, and the room is told
+	// of that and of roles they give
+	system := make(chan domain.ChatMessage, 10)
+	assert.NoError(t, chatService.JoinRoom(ctx, "announcements", "watcher", "conn-watcher", func(msg domain.ChatMessage) {
+		if msg.Type == domain.MessageTypeSystem && (msg.Role != nil || msg.RoomInfo != nil) {
+			system <- msg
+		}
+	}))
+	assert.NoError(t, chatService.AssignRole(ctx, "announcements", "latecomer", domain.RoleReadOnly))
+	select {
+	case msg := <-system:
+		assert.Equal(t, &domain.RoleGrant{Username: "latecomer", Role: domain.RoleReadOnly}, msg.Role)
+	case <-time.After(time.Second):
+		t.Fatal("role change was not announced")
+	}
+
+	assert.NoError(t, chatService.SetAnnouncementOnly(ctx, "announcements", false))
+	select {
+	case msg := <-system:
+		assert.False(t, msg.RoomInfo.AnnouncementOnly)
+	case <-time.After(time.Second):
+		t.Fatal("announcement-only change was not announced")
+	}
+	assert.NoError(t, post("reader"))
+	assert.NoError(t, chatService.SetAnnouncementOnly(ctx, "announcements", true))
+	assert.ErrorIs(t, post("reader"), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.SetAnnouncementOnly(ctx, "missing", true), domain.ErrRoomNotFound)
+}
+
+func TestSlowMode(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+	noop := func(domain.ChatMessage) {}
+
+	for _, user := range []string{"owner", "chatty"} {
+		assert.NoError(t, chatService.JoinRoom(ctx, "busy", user, "conn-"+user, noop))
+	}
+	assert.ErrorIs(t, chatService.SetSlowMode(ctx, "busy", "chatty", "conn-chatty", 10), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.SetSlowMode(ctx, "busy", "owner", "conn-owner", -1), domain.ErrInvalidRequest)
+	assert.NoError(t, chatService.SetSlowMode(ctx, "busy", "owner", "conn-owner", 10))
+
+	post := func(sender string) error {
+		return chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: sender, Room: "busy", Content: "hi"})
+	}
+	assert.NoError(t, post("chatty"))
+	err := post("chatty")
+	assert.ErrorIs(t, err, domain.ErrSlowMode)
+	var slowMode *domain.SlowModeError
+	assert.ErrorAs(t, err, &slowMode)
+	assert.Greater(t, slowMode.RetryAfter, 9*time.Second)
+
+	// Owners and moderators are exempt
+	assert.NoError(t, post("owner"))
+	assert.NoError(t, post("owner"))
+
+	assert.NoError(t, chatService.SetSlowMode(ctx, "busy", "owner", "conn-owner", 0))
+	assert.NoError(t, post("chatty"))
+}
+
+func TestRoomCapacity(t *testing.T) {
+	chatService, ctx := setupChatServiceWithConfig(t, service.ChatConfig{RoomCapacity: 2})
+	noop := func(domain.ChatMessage) {}
+
+	assert.NoError(t, chatService.JoinRoom(ctx, "small", "user1", "conn1", noop))
+	assert.NoError(t, chatService.JoinRoom(ctx, "small", "user2", "conn2", noop))
+	assert.ErrorIs(t, chatService.CheckRoomAccess(ctx, "small", "user3", ""), domain.ErrRoomFull)
+	assert.ErrorIs(t, chatService.JoinRoom(ctx, "small", "user3", "conn3", noop), domain.ErrRoomFull)
+
+	// Members can still connect to the room from another device
+	assert.NoError(t, chatService.CheckRoomAccess(ctx, "small", "user1", ""))
+	assert.NoError(t, chatService.JoinRoom(ctx, "small", "user1", "conn1b", noop))
+
+	// The global room has no limit
+	for _, user := range []string{"user1", "user2", "user3"} {
+		assert.NoError(t, chatService.JoinRoom(ctx, "global", user, "g-"+user, noop))
+	}
+	_, err := chatService.CreateRoom(ctx, domain.Room{Name: "global", MaxMembers: 10}, "")
+	assert.ErrorIs(t, err, domain.ErrInvalidRequest)
+
+	// Rooms can set their own capacity
+	_, err = chatService.CreateRoom(ctx, domain.Room{Name: "stage", CreatedBy: "user1", MaxMembers: 3}, "")
+	assert.NoError(t, err)
+	for _, user := range []string{"user1", "user2", "user3"} {
+		assert.NoError(t, chatService.JoinRoom(ctx, "stage", user, "s-"+user, noop))
+	}
+	assert.ErrorIs(t, chatService.JoinRoom(ctx, "stage", "user4", "s-user4", noop), domain.ErrRoomFull)
+}
+
+func TestRoomRoles(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+	noop := func(domain.ChatMessage) {}
+
+	for _, user := range []string{"owner", "mod", "member", "viewer"} {
+		assert.NoError(t, chatService.JoinRoom(ctx, "dev", user, "conn-"+user, noop))
+	}
+
+	// Members cannot change roles or the topic
+	assert.ErrorIs(t, chatService.SetRole(ctx, "dev", "member", "conn-member", domain.RoleGrant{Username: "viewer", Role: domain.RoleReadOnly}), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.SetTopic(ctx, "dev", "member", "conn-member", "mine"), domain.ErrNotPermitted)
+
+	assert.NoError(t, chatService.SetRole(ctx, "dev", "owner", "conn-owner", domain.RoleGrant{Username: "mod", Role: domain.RoleModerator}))
+	assert.ErrorIs(t, chatService.SetRole(ctx, "dev", "owner", "conn-owner", domain.RoleGrant{Username: "mod", Role: "admin"}), domain.ErrInvalidRequest)
+	assert.ErrorIs(t, chatService.SetRole(ctx, "dev", "owner", "conn-owner", domain.RoleGrant{Username: "owner", Role: domain.RoleMember}), domain.ErrNotPermitted)
+
+	// Moderators manage the roles below their own
+	assert.NoError(t, chatService.SetRole(ctx, "dev", "mod", "conn-mod", domain.RoleGrant{Username: "viewer", Role: domain.RoleReadOnly}))
+	assert.ErrorIs(t, chatService.SetRole(ctx, "dev", "mod", "conn-mod", domain.RoleGrant{Username: "member", Role: domain.RoleModerator}), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.SetRole(ctx, "dev", "mod", "conn-mod", domain.RoleGrant{Username: "owner", Role: domain.RoleMember}), domain.ErrNotPermitted)
+	assert.NoError(t, chatService.SetTopic(ctx, "dev", "mod", "conn-mod", "triage"))
+
+	info, err := chatService.GetRoomInfo(ctx, "dev", "member")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": domain.RoleOwner, "mod": domain.RoleModerator, "viewer": domain.RoleReadOnly}, info.Roles)
+
+	// Read-only users cannot post; moderators can delete other users' messages but not edit them
+	err = chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: "viewer", Room: "dev", Content: "hi"})
+	assert.ErrorIs(t, err, domain.ErrNotPermitted)
+	assert.NoError(t, chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: "member", Room: "dev", Content: "spam"}))
+	history, err := chatService.GetHistory(ctx, "dev", "mod", "")
+	assert.NoError(t, err)
+	id := history[len(history)-1].ID
+	assert.ErrorIs(t, chatService.EditMessage(ctx, "dev", "mod", "conn-mod", id, "ham"), domain.ErrNotPermitted)
+	assert.NoError(t, chatService.DeleteMessage(ctx, "dev", "mod", "conn-mod", id))
+}
+
+func TestMessageAccess(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+	noop := func(domain.ChatMessage) {}
+
+	assert.NoError(t, chatService.JoinRoom(ctx, "secret", "member", "conn-member", noop))
+	assert.NoError(t, chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: "member", Room: "secret", Content: "hush"}))
+	history, err := chatService.GetHistory(ctx, "secret", "member", "")
+	assert.NoError(t, err)
+	id := history[len(history)-1].ID
+
+	// Users outside the room can neither read nor touch its messages
+	_, err = chatService.GetHistory(ctx, "secret", "outsider", "")
+	assert.ErrorIs(t, err, domain.ErrNotPermitted)
+	_, err = chatService.GetThread(ctx, "secret", "outsider", id)
+	assert.ErrorIs(t, err, domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.AddReaction(ctx, "secret", "outsider", "conn-outsider", id, "👍"), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.RemoveReaction(ctx, "secret", "outsider", "conn-outsider", id, "👍"), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.MarkRead(ctx, "secret", "outsider", "conn-outsider", id), domain.ErrNotPermitted)
+
+	// Nor can members once they have left
+	assert.NoError(t, chatService.LeaveRoom(ctx, "secret", "member", "conn-member"))
+	_, err = chatService.GetHistory(ctx, "secret", "member", "")
+	assert.ErrorIs(t, err, domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.EditMessage(ctx, "secret", "member", "conn-member", id, "loud"), domain.ErrNotPermitted)
+}
+
+func TestModeration(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+	noop := func(domain.ChatMessage) {}
+
+	for _, user := range []string{"owner", "mod", "troll"} {
+		assert.NoError(t, chatService.SubscribeUser(ctx, user, "conn-"+user, noop))
+		assert.NoError(t, chatService.JoinRoom(ctx, "dev", user, "conn-"+user, noop))
+	}
+	assert.NoError(t, chatService.SetRole(ctx, "dev", "owner", "conn-owner", domain.RoleGrant{Username: "mod", Role: domain.RoleModerator}))
+
+	// Moderators act only on users below them, and nobody is removed from global
+	assert.ErrorIs(t, chatService.Kick(ctx, "dev", "troll", "conn-troll", domain.Moderation{Username: "mod"}), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.Kick(ctx, "dev", "mod", "conn-mod", domain.Moderation{Username: "owner"}), domain.ErrNotPermitted)
+	assert.ErrorIs(t, chatService.Ban(ctx, "global", "mod", "conn-mod", domain.Moderation{Username: "troll"}), domain.ErrInvalidRequest)
+
+	// Muted users cannot post, edit, react or type until the mute expires or is lifted
+	assert.NoError(t, chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: "troll", Room: "dev", Content: "early"}))
+	history, err := chatService.GetHistory(ctx, "dev", "troll", "")
+	assert.NoError(t, err)
+	early := history[len(history)-1].ID
+	assert.NoError(t, chatService.Mute(ctx, "dev", "mod", "conn-mod", domain.Moderation{Username: "troll", Duration: 60}))
+	err = chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: "troll", Room: "dev", Content: "spam"})
+	assert.ErrorIs(t, err, domain.ErrMuted)
+	assert.ErrorIs(t, chatService.EditMessage(ctx, "dev", "troll", "conn-troll", early, "spam"), domain.ErrMuted)
+	assert.ErrorIs(t, chatService.AddReaction(ctx, "dev", "troll", "conn-troll", early, "👍"), domain.ErrMuted)
+	assert.ErrorIs(t, chatService.StartTyping(ctx, "dev", "troll", "conn-troll"), domain.ErrMuted)
+	assert.NoError(t, chatService.MarkRead(ctx, "dev", "troll", "conn-troll", early))
+
+	assert.ErrorIs(t, chatService.Unmute(ctx, "dev", "troll", "conn-troll", domain.Moderation{Username: "mod"}), domain.ErrNotPermitted)
+	assert.NoError(t, chatService.Unmute(ctx, "dev", "mod", "conn-mod", domain.Moderation{Username: "troll"}))
+	assert.ErrorIs(t, chatService.Unmute(ctx, "dev", "mod", "conn-mod", domain.Moderation{Username: "troll"}), domain.ErrInvalidRequest)
+	assert.NoError(t, chatService.AddReaction(ctx, "dev", "troll", "conn-troll", early, "👍"))
+
+	// Kicked users are dropped from the room by the server holding their connection
+	assert.NoError(t, chatService.Kick(ctx, "dev", "mod", "conn-mod", domain.Moderation{Username: "troll", Reason: "spam"}))
+	assert.Eventually(t, func() bool {
+		members, err := chatService.ListRoomMembers(ctx, "dev")
+		return err == nil && !slices.Contains(members, "troll")
+	}, time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, chatService.Kick(ctx, "dev", "mod", "conn-mod", domain.Moderation{Username: "troll"}), domain.ErrInvalidRequest)
+	err = chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: "troll", Room: "dev", Content: "still here"})
+	assert.ErrorIs(t, err, domain.ErrNotPermitted)
+
+	// Banned users cannot come back or post
+	assert.NoError(t, chatService.Ban(ctx, "dev", "mod", "conn-mod", domain.Moderation{Username: "troll", Duration: 3600}))
+	assert.ErrorIs(t, chatService.CheckRoomAccess(ctx, "dev", "troll", ""), domain.ErrBanned)
+	assert.ErrorIs(t, chatService.JoinRoom(ctx, "dev", "troll", "conn-troll", noop), domain.ErrBanned)
+	err = chatService.PublishMessage(ctx, domain.ChatMessage{Type: domain.MessageTypeChat, Sender: "troll", Room: "dev", Content: "spam"})
+	assert.ErrorIs(t, err, domain.ErrBanned)
+
+	// Until the ban is lifted
+	assert.NoError(t, chatService.Unban(ctx, "dev", "mod", "conn-mod", domain.Moderation{Username: "troll"}))
+	assert.ErrorIs(t, chatService.Unban(ctx, "dev", "mod", "conn-mod", domain.Moderation{Username: "troll"}), domain.ErrInvalidRequest)
+	assert.NoError(t, chatService.JoinRoom(ctx, "dev", "troll", "conn-troll", noop))
+}
+
+func TestModerationOfDetachedSessions(t *testing.T) {
+	chatService, _, redisClient, ctx := setupChatServiceClients(t, service.ChatConfig{ResumeGracePeriod: time.Minute})
+	noop := func(domain.ChatMessage) {}
+
+	// detach puts a new session of the user in the room and drops its connection
+	detach := func(username, room string) domain.Session {
+		session, err := chatService.StartSession(ctx, username, "")
+		assert.NoError(t, err)
+		assert.NoError(t, chatService.JoinRoom(ctx, room, username, session.ConnID, noop))
+		session.Room = room
+		assert.NoError(t, chatService.DetachSession(ctx, session))
+		return session
+	}
+
+	assert.NoError(t, chatService.JoinRoom(ctx, "dev", "owner", "conn-owner", noop))
+
+	// A user kicked while detached resumes in the global room
+	kicked := detach("troll", "dev")
+	assert.NoError(t, chatService.Kick(ctx, "dev", "owner", "conn-owner", domain.Moderation{Username: "troll"}))
+	members, err := chatService.ListRoomMembers(ctx, "dev")
+	assert.NoError(t, err)
+	assert.NotContains(t, members, "troll")
+	resumed, err := chatService.ResumeSession(ctx, kicked.Token, "troll", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "global", resumed.Room)
+
+	// So does one banned from the room while detached, however the ban came about
+	banned := detach("spammer", "dev")
+	assert.NoError(t, redisClient.BanUser(ctx, "dev", "spammer", "", time.Hour))
+	resumed, err = chatService.ResumeSession(ctx, banned.Token, "spammer", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "global", resumed.Room)
+	members, err = chatService.ListRoomMembers(ctx, "dev")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"owner"}, members)
+	members, err = chatService.ListRoomMembers(ctx, "global")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"troll", "spammer"}, members)
+}
+
+func TestServerBans(t *testing.T) {
+	chatService, ctx := setupChatService(t)
+
+	received := make(chan domain.ChatMessage, 1)
+	assert.NoError(t, chatService.SubscribeUser(ctx, "troll", "conn-troll", func(msg domain.ChatMessage) {
+		received <- msg
+	}))
+
+	_, err := chatService.BanFromServer(ctx, domain.ServerBan{Username: "troll", IP: "10.0.0.1"})
+	assert.ErrorIs(t, err, domain.ErrInvalidRequest)
+	_, err = chatService.BanFromServer(ctx, domain.ServerBan{IP: "not-an-ip"})
+	assert.ErrorIs(t, err, domain.ErrInvalidRequest)
+
+	// Banning a user disconnects their connections with the reason
+	ban, err := chatService.BanFromServer(ctx, domain.ServerBan{Username: "troll", Reason: "spam", Duration: 60})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, ban.Until)
+	select {
+	case msg := <-received:
+		assert.Equal(t, domain.MessageTypeDisconnect, msg.Type)
+		assert.Contains(t, msg.Content, "spam")
+	case <-time.After(time.Second):
+		t.Fatal("disconnect was not delivered")
+	}
+
+	err = chatService.CheckServerBan(ctx, "troll", "127.0.0.1")
+	assert.ErrorIs(t, err, domain.ErrServerBanned)
+	assert.Contains(t, err.Error(), "spam")
+	assert.NoError(t, chatService.CheckServerBan(ctx, "user1", "127.0.0.1"))
+
+	_, err = chatService.BanFromServer(ctx, domain.ServerBan{IP: "10.0.0.1"})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, chatService.CheckServerBan(ctx, "user1", "10.0.0.1"), domain.ErrServerBanned)
+
+	assert.NoError(t, chatService.LiftServerBan(ctx, "troll", ""))
+	assert.NoError(t, chatService.CheckServerBan(ctx, "troll", "127.0.0.1"))
+	assert.ErrorIs(t, chatService.LiftServerBan(ctx, "troll", ""), domain.ErrBanNotFound)
+}
@@ -0,0 +1,62 @@
+package unit
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
+	"github.com/SphrGhfri/chatroom_golang_nats/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileUploadAndOpen(t *testing.T) {
+	clearRedis()
+	dir := t.TempDir()
+	files, err := service.NewFileService(testCtx, redisClient, service.FileConfig{
+		Dir:          dir,
+		MaxSize:      64,
+		AllowedTypes: []string{"text/plain"},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, redisClient.SAdd(testCtx, "room:room1", "user1"))
+
+	// The same content uploaded twice is stored once under two attachment IDs
+	first, err := files.Upload(testCtx, "user1", "room1", "../notes.txt", strings.NewReader("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "notes.txt", first.Name)
+	assert.Equal(t, "text/plain", first.MimeType)
+	assert.Equal(t, int64(5), first.Size)
+
+	second, err := files.Upload(testCtx, "user1", "room1", "copy.txt", strings.NewReader("hello"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.ID, second.ID)
+	assert.Equal(t, first.Hash, second.Hash)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Limits and membership
+	_, err = files.Upload(testCtx, "user1", "room1", "big.txt", strings.NewReader(strings.Repeat("a", 65)))
+	assert.ErrorIs(t, err, domain.ErrFileTooLarge)
+	_, err = files.Upload(testCtx, "user1", "room1", "image.png", strings.NewReader("\x89PNG\r\n\x1a\n"))
+	assert.ErrorIs(t, err, domain.ErrFileTypeBlocked)
+	_, err = files.Upload(testCtx, "user2", "room1", "notes.txt", strings.NewReader("hello"))
+	assert.ErrorIs(t, err, domain.ErrNotPermitted)
+
+	att, file, err := files.Open(testCtx, "user1", first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "room1", att.Room)
+	file.Close()
+
+	_, _, err = files.Open(testCtx, "user2", first.ID)
+	assert.ErrorIs(t, err, domain.ErrNotPermitted)
+	_, _, err = files.Open(testCtx, "user1", "missing")
+	assert.ErrorIs(t, err, domain.ErrAttachmentNotFound)
+
+	// Rejected uploads leave nothing behind
+	entries, err = os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	natsio "github.com/nats-io/nats.go"
+
 	"github.com/stretchr/testify/assert"
 
 	"github.com/SphrGhfri/chatroom_golang_nats/config"
@@ -81,9 +85,128 @@ func TestUnsubscribeRoom(t *testing.T) {
 	assert.NoError(t, err, "Failed to unsubscribe from room")
 
 	// Verify subscription is removed
-	subKey := fmt.Sprintf("%s:%s", room, username)
-	_, exists := natsClient.SubMapping[subKey]
-	assert.False(t, exists, "Subscription should be removed")
+	assert.Empty(t, natsClient.SubMapping, "Subscription should be removed")
+	assert.Equal(t, 0, natsClient.Subscribers(room))
+}
+
+func TestSharedRoomSubscription(t *testing.T) {
+	natsClient, ctx := setupNATSClient(t)
+	defer natsClient.Close()
+
+	room := "test_shared_room"
+	msgChan := make(chan string, 2)
+	for _, username := range []string{"user1", "user2"} {
+		username := username
+		err := natsClient.SubscribeRoom(ctx, room, username, func(msg domain.ChatMessage) {
+			msgChan <- username
+		})
+		assert.NoError(t, err)
+	}
+
+	// Both local subscribers share one NATS subscription
+	assert.Len(t, natsClient.SubMapping, 1)
+	assert.Equal(t, 2, natsClient.Subscribers(room))
+
+	// The remaining subscriber keeps the room subscription open
+	assert.NoError(t, natsClient.UnsubscribeRoom(ctx, room, "user1"))
+	assert.Len(t, natsClient.SubMapping, 1)
+
+	err := natsClient.PublishRoom(ctx, room, domain.ChatMessage{
+		Type:    domain.MessageTypeChat,
+		Sender:  "other",
+		Content: "shared",
+		Room:    room,
+	})
+	assert.NoError(t, err)
+
+	select {
+	case username := <-msgChan:
+		assert.Equal(t, "user2", username)
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive message within timeout")
+	}
+
+	assert.NoError(t, natsClient.UnsubscribeRoom(ctx, room, "user2"))
+	assert.Empty(t, natsClient.SubMapping)
+}
+
+func TestSubscribeUser(t *testing.T) {
+	natsClient, ctx := setupNATSClient(t)
+	defer natsClient.Close()
+
+	msgChan := make(chan string, 2)
+	for _, connID := range []string{"laptop", "browser"} {
+		connID := connID
+		err := natsClient.SubscribeUser(ctx, "test_user_direct", connID, func(msg domain.ChatMessage) {
+			msgChan <- connID
+		})
+		assert.NoError(t, err)
+	}
+
+	err := natsClient.PublishUser(ctx, "test_user_direct", domain.ChatMessage{
+		Type:    domain.MessageTypeSystem,
+		Content: "to every session",
+	})
+	assert.NoError(t, err)
+
+	// Every connection of the user receives the message
+	received := make(map[string]bool)
+	timeout := time.After(2 * time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case connID := <-msgChan:
+			received[connID] = true
+		case <-timeout:
+			t.Fatal("Timeout waiting for messages")
+		}
+	}
+	assert.True(t, received["laptop"])
+	assert.True(t, received["browser"])
+
+	assert.NoError(t, natsClient.UnsubscribeUser(ctx, "test_user_direct", "laptop"))
+	assert.NoError(t, natsClient.UnsubscribeUser(ctx, "test_user_direct", "browser"))
+	assert.Empty(t, natsClient.SubMapping)
+}
+
+// A slow subscriber misses room messages and is told so, but gets every user message
+func TestSlowSubscriber(t *testing.T) {
+	natsClient, ctx := setupNATSClient(t)
+	defer natsClient.Close()
+
+	const sent = 200
+	release := make(chan struct{})
+	var roomMsgs, userMsgs atomic.Int64
+	notices := make(chan domain.ChatMessage, 1)
+	assert.NoError(t, natsClient.SubscribeRoom(ctx, "test_room_slow", "conn1", func(msg domain.ChatMessage) {
+		<-release
+		if msg.Type == domain.MessageTypeError {
+			notices <- msg
+			return
+		}
+		roomMsgs.Add(1)
+	}))
+	assert.NoError(t, natsClient.SubscribeUser(ctx, "test_user_slow", "conn1", func(msg domain.ChatMessage) {
+		<-release
+		userMsgs.Add(1)
+	}))
+
+	for i := 0; i < sent; i++ {
+		assert.NoError(t, natsClient.PublishRoom(ctx, "test_room_slow", domain.ChatMessage{Type: domain.MessageTypeChat, Content: fmt.Sprint(i)}))
+		assert.NoError(t, natsClient.PublishUser(ctx, "test_user_slow", domain.ChatMessage{Type: domain.MessageTypeSystem, Content: fmt.Sprint(i)}))
+	}
+	assert.NoError(t, natsClient.Conn.Flush())
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+
+	select {
+	case notice := <-notices:
+		assert.Equal(t, domain.ErrorCodeMessagesDropped, notice.Code)
+		assert.Equal(t, "test_room_slow", notice.Room)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no drop notice")
+	}
+	assert.Eventually(t, func() bool { return userMsgs.Load() == sent }, 2*time.Second, 10*time.Millisecond)
+	assert.Less(t, roomMsgs.Load(), int64(sent))
 }
 
 func TestMultipleUsersInRoom(t *testing.T) {
@@ -191,3 +314,117 @@ func TestPublishRoom(t *testing.T) {
 	assert.Equal(t, room, received.Room, "Room should match")
 	assert.Equal(t, domain.MessageTypeChat, received.Type, "Message type should match")
 }
+
+func TestPublishEvent(t *testing.T) {
+	natsClient, ctx := setupNATSClient(t)
+	defer natsClient.Close()
+
+	sub, err := natsClient.Conn.SubscribeSync("chat.events.v1.>")
+	assert.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	// Room events are filed under their room, user events under their user
+	events := []domain.Event{
+		{Version: domain.EventVersion, ID: "1", Type: domain.EventUserJoinedRoom, Room: "ops", Username: "alice"},
+		{Version: domain.EventVersion, ID: "2", Type: domain.EventUserConnected, Username: "alice"},
+	}
+	subjects := []string{"chat.events.v1.room.ops.user_joined_room", "chat.events.v1.user.alice.user_connected"}
+	for _, event := range events {
+		assert.NoError(t, natsClient.PublishEvent(ctx, event))
+	}
+	for i, event := range events {
+		msg, err := sub.NextMsg(2 * time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, subjects[i], msg.Subject)
+
+		var received domain.Event
+		assert.NoError(t, json.Unmarshal(msg.Data, &received))
+		assert.Equal(t, event, received)
+	}
+}
+
+// BenchmarkRoomFanOut compares delivering room messages to many local users
+// through one NATS subscription per user (the previous design) against one
+// shared subscription per room with in-process fan-out.
+func BenchmarkRoomFanOut(b *testing.B) {
+	const users = 1000
+	const batch = 32 // Stays below the per-subscriber buffer
+
+	run := func(b *testing.B, subscribe func(natsClient *nats.NATSClient, ctx context.Context, room string, handle func(domain.ChatMessage))) {
+		cfg := config.MustReadConfig("../../config_test.json")
+		ctx := logger.NewContext(context.Background(), logger.NewLogger(cfg.LogLevel, cfg.LogFile))
+		natsClient, err := nats.NewNATSClient(ctx, cfg.NATSURL)
+		if err != nil {
+			b.Fatalf("Failed to connect to NATS: %v", err)
+		}
+		defer natsClient.Close()
+
+		room := fmt.Sprintf("bench_fanout_%d", time.Now().UnixNano())
+		var delivered atomic.Int64
+		handle := func(domain.ChatMessage) { delivered.Add(1) }
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		subscribe(natsClient, ctx, room, handle)
+		natsClient.Conn.Flush()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		// Both designs run a goroutine per user, so stacks are counted too
+		memPerUser := float64(int64(after.HeapAlloc+after.StackInuse)-int64(before.HeapAlloc+before.StackInuse)) / users
+
+		msg := domain.ChatMessage{Type: domain.MessageTypeChat, Sender: "bench", Content: "hello", Room: room}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for sent := 0; sent < b.N; {
+			n := batch
+			if b.N-sent < n {
+				n = b.N - sent
+			}
+			for i := 0; i < n; i++ {
+				natsClient.PublishRoom(ctx, room, msg)
+			}
+			sent += n
+
+			// Wait for the batch to reach every user so neither design drops messages
+			want := int64(sent) * users
+			deadline := time.Now().Add(10 * time.Second)
+			for delivered.Load() < want {
+				if time.Now().After(deadline) {
+					b.Fatalf("Delivered %d of %d messages", delivered.Load(), want)
+				}
+				runtime.Gosched()
+			}
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(b.N*users)/b.Elapsed().Seconds(), "deliveries/s")
+		b.ReportMetric(memPerUser, "mem-B/user")
+	}
+
+	b.Run("per_user_subscriptions", func(b *testing.B) {
+		run(b, func(natsClient *nats.NATSClient, ctx context.Context, room string, handle func(domain.ChatMessage)) {
+			subject := fmt.Sprintf("chat.room.%s", room)
+			for i := 0; i < users; i++ {
+				_, err := natsClient.Conn.Subscribe(subject, func(m *natsio.Msg) {
+					var chatMsg domain.ChatMessage
+					if err := json.Unmarshal(m.Data, &chatMsg); err == nil {
+						handle(chatMsg)
+					}
+				})
+				if err != nil {
+					b.Fatalf("Failed to subscribe: %v", err)
+				}
+			}
+		})
+	})
+
+	b.Run("shared_room_subscription", func(b *testing.B) {
+		run(b, func(natsClient *nats.NATSClient, ctx context.Context, room string, handle func(domain.ChatMessage)) {
+			for i := 0; i < users; i++ {
+				if err := natsClient.SubscribeRoom(ctx, room, fmt.Sprintf("user%d", i), handle); err != nil {
+					b.Fatalf("Failed to subscribe: %v", err)
+				}
+			}
+		})
+	})
+}
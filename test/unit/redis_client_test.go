@@ -1,12 +1,16 @@
 package unit
 
 import (
+	"fmt"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"context"
 
 	"github.com/SphrGhfri/chatroom_golang_nats/config"
+	"github.com/SphrGhfri/chatroom_golang_nats/internal/domain"
 	"github.com/SphrGhfri/chatroom_golang_nats/internal/redis"
 	"github.com/SphrGhfri/chatroom_golang_nats/pkg/logger"
 	"github.com/stretchr/testify/assert"
@@ -115,3 +119,770 @@ func TestFlushAll(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Empty(t, members)
 }
+
+func TestAppendHistoryAndHistorySince(t *testing.T) {
+	clearRedis()
+	var ids []string
+	for _, content := range []string{"first", "second", "third"} {
+		msg, err := redisClient.AppendHistory(testCtx, domain.ChatMessage{
+			Type:    domain.MessageTypeChat,
+			Content: content,
+			Room:    "historyroom",
+		}, 2)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, msg.ID)
+		ids = append(ids, msg.ID)
+	}
+
+	// Only the two most recent messages are kept
+	history, err := redisClient.HistorySince(testCtx, "historyroom", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, "second", history[0].Content)
+
+	history, err = redisClient.HistorySince(testCtx, "historyroom", ids[1], 10)
+	assert.Nil(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "third", history[0].Content)
+}
+
+func TestMarkReadAndUnreadCounts(t *testing.T) {
+	clearRedis()
+	assert.Nil(t, redisClient.InitLastRead(testCtx, "reader", "readroom"))
+
+	var ids []string
+	for _, content := range []string{"first", "second", "third"} {
+		msg, err := redisClient.AppendHistory(testCtx, domain.ChatMessage{
+			Type:    domain.MessageTypeChat,
+			Content: content,
+			Room:    "readroom",
+		}, 10)
+		assert.Nil(t, err)
+		ids = append(ids, msg.ID)
+	}
+
+	counts, err := redisClient.UnreadCounts(testCtx, "reader", []string{"readroom", "otherroom"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), counts["readroom"])
+	assert.Equal(t, int64(0), counts["otherroom"], "rooms never joined have no unread messages")
+
+	moved, err := redisClient.MarkRead(testCtx, "reader", "readroom", ids[1])
+	assert.Nil(t, err)
+	assert.True(t, moved)
+
+	// The marker never moves backwards or past the newest message
+	moved, err = redisClient.MarkRead(testCtx, "reader", "readroom", ids[0])
+	assert.Nil(t, err)
+	assert.False(t, moved)
+	moved, err = redisClient.MarkRead(testCtx, "reader", "readroom", "999999")
+	assert.Nil(t, err)
+	assert.False(t, moved)
+
+	counts, err = redisClient.UnreadCounts(testCtx, "reader", []string{"readroom"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), counts["readroom"])
+}
+
+func TestUpdateMessage(t *testing.T) {
+	clearRedis()
+	stored, err := redisClient.AppendHistory(testCtx, domain.ChatMessage{
+		Type:    domain.MessageTypeChat,
+		Sender:  "author",
+		Content: "tpyo",
+		Room:    "editroom",
+	}, 10)
+	assert.Nil(t, err)
+
+	updated, err := redisClient.UpdateMessage(testCtx, "editroom", stored.ID, func(msg *domain.ChatMessage) error {
+		msg.Content = "typo"
+		msg.Edited = true
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "typo", updated.Content)
+
+	history, err := redisClient.HistorySince(testCtx, "editroom", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "typo", history[0].Content)
+	assert.True(t, history[0].Edited)
+
+	// A rejected update leaves the message untouched
+	_, err = redisClient.UpdateMessage(testCtx, "editroom", stored.ID, func(msg *domain.ChatMessage) error {
+		msg.Content = "hijacked"
+		return domain.ErrNotPermitted
+	})
+	assert.ErrorIs(t, err, domain.ErrNotPermitted)
+	history, err = redisClient.HistorySince(testCtx, "editroom", "", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "typo", history[0].Content)
+
+	_, err = redisClient.UpdateMessage(testCtx, "editroom", "999999", func(msg *domain.ChatMessage) error { return nil })
+	assert.ErrorIs(t, err, domain.ErrMessageNotFound)
+}
+
+func TestReactions(t *testing.T) {
+	clearRedis()
+	stored, err := redisClient.AppendHistory(testCtx, domain.ChatMessage{
+		Type:    domain.MessageTypeChat,
+		Content: "react to me",
+		Room:    "reactroom",
+	}, 10)
+	assert.Nil(t, err)
+
+	for _, r := range []struct{ emoji, user string }{{"👍", "alice"}, {"👍", "bob"}, {"🎉", "bob"}} {
+		added, err := redisClient.AddReaction(testCtx, "reactroom", stored.ID, r.emoji, r.user)
+		assert.Nil(t, err)
+		assert.True(t, added)
+	}
+
+	// Reacting twice with the same emoji counts once
+	added, err := redisClient.AddReaction(testCtx, "reactroom", stored.ID, "👍", "alice")
+	assert.Nil(t, err)
+	assert.False(t, added)
+
+	_, err = redisClient.AddReaction(testCtx, "reactroom", "999999", "👍", "alice")
+	assert.ErrorIs(t, err, domain.ErrMessageNotFound)
+
+	reactions, err := redisClient.Reactions(testCtx, "reactroom", []string{stored.ID}, "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, []domain.Reaction{
+		{Emoji: "👍", Count: 2, Reacted: true},
+		{Emoji: "🎉", Count: 1},
+	}, reactions[stored.ID])
+
+	removed, err := redisClient.RemoveReaction(testCtx, "reactroom", stored.ID, "🎉", "bob")
+	assert.Nil(t, err)
+	assert.True(t, removed)
+
+	reactions, err = redisClient.Reactions(testCtx, "reactroom", []string{stored.ID}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []domain.Reaction{{Emoji: "👍", Count: 2}}, reactions[stored.ID])
+
+	// Deleted messages take no reactions
+	_, err = redisClient.UpdateMessage(testCtx, "reactroom", stored.ID, func(msg *domain.ChatMessage) error {
+		msg.Deleted = true
+		return nil
+	})
+	assert.Nil(t, err)
+	_, err = redisClient.AddReaction(testCtx, "reactroom", stored.ID, "🎉", "carol")
+	assert.ErrorIs(t, err, domain.ErrMessageNotFound)
+}
+
+func TestThreadReplies(t *testing.T) {
+	clearRedis()
+	root, err := redisClient.AppendHistory(testCtx, domain.ChatMessage{
+		Type:    domain.MessageTypeChat,
+		Content: "root",
+		Room:    "threadroom",
+	}, 10)
+	assert.Nil(t, err)
+
+	for _, content := range []string{"first reply", "second reply"} {
+		_, err := redisClient.AppendHistory(testCtx, domain.ChatMessage{
+			Type:     domain.MessageTypeChat,
+			Content:  content,
+			Room:     "threadroom",
+			ReplyTo:  root.ID,
+			ThreadID: root.ID,
+		}, 10)
+		assert.Nil(t, err)
+	}
+
+	replies, err := redisClient.ThreadReplies(testCtx, "threadroom", root.ID, 10)
+	assert.Nil(t, err)
+	assert.Len(t, replies, 2)
+	assert.Equal(t, "first reply", replies[0].Content)
+
+	counts, err := redisClient.ReplyCounts(testCtx, "threadroom", []string{root.ID, replies[0].ID})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), counts[root.ID])
+	assert.Equal(t, int64(0), counts[replies[0].ID])
+
+	// Deleted replies no longer count
+	assert.Nil(t, redisClient.RemoveReply(testCtx, "threadroom", root.ID, replies[1].ID))
+	counts, err = redisClient.ReplyCounts(testCtx, "threadroom", []string{root.ID})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), counts[root.ID])
+
+	// Replies to a root that is gone are not stored and start no thread
+	_, err = redisClient.AppendHistory(testCtx, domain.ChatMessage{
+		Type:     domain.MessageTypeChat,
+		Content:  "orphan",
+		Room:     "threadroom",
+		ThreadID: "999999",
+	}, 10)
+	assert.ErrorIs(t, err, domain.ErrMessageNotFound)
+	counts, err = redisClient.ReplyCounts(testCtx, "threadroom", []string{"999999"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), counts["999999"])
+}
+
+func TestRoomRecords(t *testing.T) {
+	clearRedis()
+	change, err := redisClient.AddRoomConnection(testCtx, "recordroom", "creator", "conn1", 0, true)
+	assert.Nil(t, err)
+	assert.True(t, change.Created)
+	change, err = redisClient.AddRoomConnection(testCtx, "recordroom", "other", "conn2", 0, true)
+	assert.Nil(t, err)
+	assert.True(t, change.Joined)
+	assert.False(t, change.Created)
+
+	assert.Nil(t, redisClient.SetRoomTopic(testCtx, "recordroom", "planning"))
+	room, err := redisClient.GetRoom(testCtx, "recordroom")
+	assert.Nil(t, err)
+	assert.Equal(t, "creator", room.CreatedBy)
+	assert.Equal(t, "planning", room.Topic)
+	assert.Equal(t, int64(2), room.Members)
+
+	// The record goes with the room's last member
+	change, err = redisClient.RemoveRoomConnection(testCtx, "recordroom", "creator", "conn1", 0)
+	assert.Nil(t, err)
+	assert.False(t, change.Dropped)
+	change, err = redisClient.RemoveRoomConnection(testCtx, "recordroom", "other", "conn2", 0)
+	assert.Nil(t, err)
+	assert.True(t, change.Left)
+	assert.True(t, change.Dropped)
+	_, err = redisClient.GetRoom(testCtx, "recordroom")
+	assert.ErrorIs(t, err, domain.ErrRoomNotFound)
+	assert.ErrorIs(t, redisClient.SetRoomTopic(testCtx, "recordroom", "late"), domain.ErrRoomNotFound)
+
+	// A room created without an owner records no creator either
+	_, err = redisClient.AddRoomConnection(testCtx, "global", "user1", "conn1", 0, false)
+	assert.Nil(t, err)
+	_, _, err = redisClient.SwitchRoomConnection(testCtx, "elsewhere", "lobby", "user1", "conn2", 0, false, 0)
+	assert.Nil(t, err)
+	for _, name := range []string{"global", "lobby"} {
+		roles, err := redisClient.GetRoomRoles(testCtx, name)
+		assert.Nil(t, err)
+		assert.Empty(t, roles)
+		room, err = redisClient.GetRoom(testCtx, name)
+		assert.Nil(t, err)
+		assert.Empty(t, room.CreatedBy)
+	}
+}
+
+func TestPersistentAndIdleRooms(t *testing.T) {
+	clearRedis()
+	assert.Nil(t, redisClient.CreateRoom(testCtx, domain.Room{Name: "oncall", CreatedBy: "admin", Topic: "pager"}, ""))
+	assert.ErrorIs(t, redisClient.CreateRoom(testCtx, domain.Room{Name: "oncall"}, ""), domain.ErrRoomExists)
+
+	// A persistent room stays when its last member leaves
+	_, err := redisClient.AddRoomConnection(testCtx, "oncall", "user1", "conn1", 0, true)
+	assert.Nil(t, err)
+	change, err := redisClient.RemoveRoomConnection(testCtx, "oncall", "user1", "conn1", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, change.Idle)
+	assert.False(t, change.Dropped)
+	room, err := redisClient.GetRoom(testCtx, "oncall")
+	assert.Nil(t, err)
+	assert.True(t, room.Persistent)
+	assert.Equal(t, "admin", room.CreatedBy)
+	assert.Equal(t, "pager", room.Topic)
+
+	// Deleting an empty persistent room drops it
+	dropped, err := redisClient.DeleteRoom(testCtx, "oncall")
+	assert.Nil(t, err)
+	assert.True(t, dropped)
+	_, err = redisClient.GetRoom(testCtx, "oncall")
+	assert.ErrorIs(t, err, domain.ErrRoomNotFound)
+	_, err = redisClient.DeleteRoom(testCtx, "oncall")
+	assert.ErrorIs(t, err, domain.ErrRoomNotFound)
+
+	// An idle ad-hoc room expires only once its latest idle period is over
+	_, err = redisClient.AddRoomConnection(testCtx, "adhoc", "user1", "conn1", 0, true)
+	assert.Nil(t, err)
+	change, err = redisClient.RemoveRoomConnection(testCtx, "adhoc", "user1", "conn1", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, change.Idle)
+	assert.False(t, change.Dropped)
+	_, err = redisClient.AddRoomConnection(testCtx, "adhoc", "user1", "conn1", 0, true)
+	assert.Nil(t, err)
+	change, err = redisClient.RemoveRoomConnection(testCtx, "adhoc", "user1", "conn1", time.Hour)
+	assert.Nil(t, err)
+
+	expired, err := redisClient.ExpireIdleRooms(testCtx, time.Now().Add(2*time.Minute))
+	assert.Nil(t, err)
+	assert.Empty(t, expired)
+	expired, err = redisClient.ExpireIdleRooms(testCtx, time.Now().Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"adhoc"}, expired)
+	rooms, err := redisClient.SMembers(testCtx, "all_rooms")
+	assert.Nil(t, err)
+	assert.NotContains(t, rooms, "adhoc")
+}
+
+func TestRoomPasswordHash(t *testing.T) {
+	clearRedis()
+	assert.Nil(t, redisClient.CreateRoom(testCtx, domain.Room{Name: "locked", Visibility: domain.RoomPassword}, "hash"))
+
+	hash, err := redisClient.RoomPasswordHash(testCtx, "locked")
+	assert.Nil(t, err)
+	assert.Equal(t, "hash", hash)
+	hash, err = redisClient.RoomPasswordHash(testCtx, "unknown")
+	assert.Nil(t, err)
+	assert.Empty(t, hash)
+
+	room, err := redisClient.GetRoom(testCtx, "locked")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.RoomPassword, room.Visibility)
+}
+
+func TestInvites(t *testing.T) {
+	clearRedis()
+	assert.Nil(t, redisClient.CreateInvite(testCtx, "token", "club", "owner", 2, time.Hour))
+
+	// Tokens only open the room they were created for
+	_, err := redisClient.RedeemInvite(testCtx, "token", "other", "user1")
+	assert.ErrorIs(t, err, domain.ErrInviteInvalid)
+	_, err = redisClient.RedeemInvite(testCtx, "unknown", "club", "user1")
+	assert.ErrorIs(t, err, domain.ErrInviteInvalid)
+
+	for _, user := range []string{"user1", "user2"} {
+		redeemed, err := redisClient.RedeemInvite(testCtx, "token", "club", user)
+		assert.Nil(t, err)
+		assert.True(t, redeemed)
+	}
+	_, err = redisClient.RedeemInvite(testCtx, "token", "club", "user3")
+	assert.ErrorIs(t, err, domain.ErrInviteInvalid)
+
+	allowed, err := redisClient.IsRoomAllowed(testCtx, "club", "user2")
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+	allowed, err = redisClient.IsRoomAllowed(testCtx, "club", "user3")
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+
+	// Allowed users use nothing up, and a returned redemption can be used again
+	redeemed, err := redisClient.RedeemInvite(testCtx, "token", "club", "user1")
+	assert.Nil(t, err)
+	assert.False(t, redeemed)
+	assert.Nil(t, redisClient.ReturnInvite(testCtx, "token", "club", "user1"))
+	redeemed, err = redisClient.RedeemInvite(testCtx, "token", "club", "user3")
+	assert.Nil(t, err)
+	assert.True(t, redeemed)
+}
+
+func TestRoomRoleStorage(t *testing.T) {
+	clearRedis()
+
+	// The user who brings a room into being owns it
+	_, err := redisClient.AddRoomConnection(testCtx, "dev", "user1", "conn1", 0, true)
+	assert.Nil(t, err)
+	_, err = redisClient.AddRoomConnection(testCtx, "dev", "user2", "conn2", 0, true)
+	assert.Nil(t, err)
+	role, err := redisClient.GetRoomRole(testCtx, "dev", "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.RoleOwner, role)
+	role, err = redisClient.GetRoomRole(testCtx, "dev", "user2")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.RoleMember, role)
+
+	assert.Nil(t, redisClient.SetRoomRole(testCtx, "dev", "user2", domain.RoleModerator))
+	roles, err := redisClient.GetRoomRoles(testCtx, "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"user1": domain.RoleOwner, "user2": domain.RoleModerator}, roles)
+	assert.Nil(t, redisClient.SetRoomRole(testCtx, "dev", "user2", domain.RoleMember))
+	roles, err = redisClient.GetRoomRoles(testCtx, "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"user1": domain.RoleOwner}, roles)
+
+	// Roles go away with the room
+	_, err = redisClient.RemoveRoomConnection(testCtx, "dev", "user2", "conn2", 0)
+	assert.Nil(t, err)
+	_, err = redisClient.RemoveRoomConnection(testCtx, "dev", "user1", "conn1", 0)
+	assert.Nil(t, err)
+	roles, err = redisClient.GetRoomRoles(testCtx, "dev")
+	assert.Nil(t, err)
+	assert.Empty(t, roles)
+
+	// Persistent rooms are owned by their creator
+	assert.Nil(t, redisClient.CreateRoom(testCtx, domain.Room{Name: "oncall", CreatedBy: "admin"}, ""))
+	role, err = redisClient.GetRoomRole(testCtx, "oncall", "admin")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.RoleOwner, role)
+}
+
+func TestBansAndMutes(t *testing.T) {
+	clearRedis()
+	assert.Nil(t, redisClient.BanUser(testCtx, "dev", "user1", "spam", 0))
+	assert.Nil(t, redisClient.MuteUser(testCtx, "dev", "user2", time.Minute))
+
+	banned, err := redisClient.IsBanned(testCtx, "dev", "user1")
+	assert.Nil(t, err)
+	assert.True(t, banned)
+	banned, err = redisClient.IsBanned(testCtx, "other", "user1")
+	assert.Nil(t, err)
+	assert.False(t, banned)
+
+	muted, err := redisClient.IsMuted(testCtx, "dev", "user2")
+	assert.Nil(t, err)
+	assert.True(t, muted)
+	muted, err = redisClient.IsMuted(testCtx, "dev", "user1")
+	assert.Nil(t, err)
+	assert.False(t, muted)
+
+	// Lifting reports whether there was anything to lift
+	lifted, err := redisClient.UnmuteUser(testCtx, "dev", "user2")
+	assert.Nil(t, err)
+	assert.True(t, lifted)
+	muted, err = redisClient.IsMuted(testCtx, "dev", "user2")
+	assert.Nil(t, err)
+	assert.False(t, muted)
+	lifted, err = redisClient.UnmuteUser(testCtx, "dev", "user2")
+	assert.Nil(t, err)
+	assert.False(t, lifted)
+	lifted, err = redisClient.UnbanUser(testCtx, "dev", "user3")
+	assert.Nil(t, err)
+	assert.False(t, lifted)
+}
+
+func TestServerBanStorage(t *testing.T) {
+	clearRedis()
+	assert.Nil(t, redisClient.BanFromServer(testCtx, "troll", "", "spam", 0))
+	assert.Nil(t, redisClient.BanFromServer(testCtx, "", "10.0.0.1", "", time.Minute))
+
+	reason, banned, err := redisClient.ServerBanReason(testCtx, "troll", "127.0.0.1")
+	assert.Nil(t, err)
+	assert.True(t, banned)
+	assert.Equal(t, "spam", reason)
+	_, banned, err = redisClient.ServerBanReason(testCtx, "user1", "10.0.0.1")
+	assert.Nil(t, err)
+	assert.True(t, banned)
+	_, banned, err = redisClient.ServerBanReason(testCtx, "user1", "127.0.0.1")
+	assert.Nil(t, err)
+	assert.False(t, banned)
+
+	lifted, err := redisClient.LiftServerBan(testCtx, "troll", "")
+	assert.Nil(t, err)
+	assert.True(t, lifted)
+	lifted, err = redisClient.LiftServerBan(testCtx, "troll", "")
+	assert.Nil(t, err)
+	assert.False(t, lifted)
+}
+
+func TestEndDetachedSessions(t *testing.T) {
+	clearRedis()
+	for _, token := range []string{"t1", "t2"} {
+		assert.Nil(t, redisClient.CreateSession(testCtx, domain.Session{Token: token, ConnID: "c-" + token, Username: "user1", Room: "global"}))
+	}
+	_, err := redisClient.DetachSession(testCtx, "t1", "dev", time.Minute)
+	assert.Nil(t, err)
+
+	// Only the detached session is ended; the attached one is left to its connection
+	ended, err := redisClient.EndDetachedSessions(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Len(t, ended, 1)
+	assert.Equal(t, "c-t1", ended[0].ConnID)
+	assert.Equal(t, "dev", ended[0].Room)
+
+	_, err = redisClient.GetSession(testCtx, "t1")
+	assert.ErrorIs(t, err, domain.ErrSessionNotFound)
+	_, err = redisClient.GetSession(testCtx, "t2")
+	assert.Nil(t, err)
+}
+
+func TestNodeConnections(t *testing.T) {
+	clearRedis()
+	assert.Nil(t, redisClient.CreateSession(testCtx, domain.Session{Token: "t1", ConnID: "c-t1", Username: "user1", Room: "global", Node: "n1"}))
+	assert.Nil(t, redisClient.CreateSession(testCtx, domain.Session{Token: "t2", ConnID: "c-t2", Username: "user2", Room: "global", Node: "n1"}))
+	conns, err := redisClient.NodeConnections(testCtx, "n1")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []redis.NodeConn{
+		{ConnID: "c-t1", Token: "t1", Username: "user1"},
+		{ConnID: "c-t2", Token: "t2", Username: "user2"},
+	}, conns)
+
+	// A node is expired once its heartbeat lapses, and only one node sweeps it
+	assert.Nil(t, redisClient.Heartbeat(testCtx, "n1", 50*time.Millisecond))
+	assert.Nil(t, redisClient.Heartbeat(testCtx, "n2", time.Minute))
+	expired, err := redisClient.ExpiredNodes(testCtx)
+	assert.Nil(t, err)
+	assert.Empty(t, expired)
+	time.Sleep(100 * time.Millisecond)
+	expired, err = redisClient.ExpiredNodes(testCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"n1"}, expired)
+	claimed, err := redisClient.ClaimNodeSweep(testCtx, "n1", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	claimed, err = redisClient.ClaimNodeSweep(testCtx, "n1", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, claimed)
+
+	// A session resumed on another node moves its connection there and is not taken
+	_, err = redisClient.DetachSession(testCtx, "t1", "global", time.Minute)
+	assert.Nil(t, err)
+	session, err := redisClient.ClaimSession(testCtx, "t1", "user1", "n2")
+	assert.Nil(t, err)
+	assert.Equal(t, "n2", session.Node)
+	taken, err := redisClient.TakeNodeConnection(testCtx, "n1", redis.NodeConn{ConnID: "c-t1", Token: "t1", Username: "user1"})
+	assert.Nil(t, err)
+	assert.False(t, taken)
+	conns, err = redisClient.NodeConnections(testCtx, "n2")
+	assert.Nil(t, err)
+	assert.Equal(t, []redis.NodeConn{{ConnID: "c-t1", Token: "t1", Username: "user1"}}, conns)
+
+	// The others are taken with their sessions
+	taken, err = redisClient.TakeNodeConnection(testCtx, "n1", redis.NodeConn{ConnID: "c-t2", Token: "t2", Username: "user2"})
+	assert.Nil(t, err)
+	assert.True(t, taken)
+	_, err = redisClient.GetSession(testCtx, "t2")
+	assert.ErrorIs(t, err, domain.ErrSessionNotFound)
+	assert.Nil(t, redisClient.ForgetNode(testCtx, "n1"))
+	expired, err = redisClient.ExpiredNodes(testCtx)
+	assert.Nil(t, err)
+	assert.Empty(t, expired)
+
+	// The rooms of a connection are those it is in, not all of its user's
+	_, err = redisClient.AddRoomConnection(testCtx, "dev", "user1", "c-t1", 0, true)
+	assert.Nil(t, err)
+	_, err = redisClient.AddRoomConnection(testCtx, "ops", "user1", "c-t3", 0, true)
+	assert.Nil(t, err)
+	rooms, err := redisClient.ConnectionRooms(testCtx, "user1", "c-t1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dev"}, rooms)
+}
+
+func TestUserPresence(t *testing.T) {
+	clearRedis()
+	presence, err := redisClient.UserPresence(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.PresenceOffline, presence.Status)
+
+	// Online while any session is attached and active, away once all are detached or idle
+	_, err = redisClient.AddUserConnection(testCtx, "user1", "c-t1")
+	assert.Nil(t, err)
+	assert.Nil(t, redisClient.CreateSession(testCtx, domain.Session{Token: "t1", ConnID: "c-t1", Username: "user1", Room: "global"}))
+	presence, err = redisClient.UserPresence(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.PresenceOnline, presence.Status)
+	assert.Nil(t, redisClient.SetSessionIdle(testCtx, "t1", true))
+	presence, err = redisClient.UserPresence(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.PresenceAway, presence.Status)
+	assert.Nil(t, redisClient.SetSessionIdle(testCtx, "t1", false))
+	presence, err = redisClient.UserPresence(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.PresenceOnline, presence.Status)
+	_, err = redisClient.DetachSession(testCtx, "t1", "global", time.Minute)
+	assert.Nil(t, err)
+	presence, err = redisClient.UserPresence(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.PresenceAway, presence.Status)
+
+	// Only changes of the announced presence are reported
+	changed, err := redisClient.AnnouncePresence(testCtx, domain.Presence{Username: "user1", Status: domain.PresenceOffline})
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	changed, err = redisClient.AnnouncePresence(testCtx, domain.Presence{Username: "user1", Status: domain.PresenceOnline})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	changed, err = redisClient.AnnouncePresence(testCtx, domain.Presence{Username: "user1", Status: domain.PresenceOnline})
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	changed, err = redisClient.AnnouncePresence(testCtx, domain.Presence{Username: "user1", Status: domain.PresenceOnline, Text: "lunch"})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	_, err = redisClient.AddRoomConnection(testCtx, "dev", "user1", "c-t1", 0, true)
+	assert.Nil(t, err)
+	_, err = redisClient.AddRoomConnection(testCtx, "ops", "user2", "c-t2", 0, true)
+	assert.Nil(t, err)
+	rooms, err := redisClient.UserRooms(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dev"}, rooms)
+
+	// The index follows switches and the last connection leaving
+	_, _, err = redisClient.SwitchRoomConnection(testCtx, "dev", "ops", "user1", "c-t1", 0, true, 0)
+	assert.Nil(t, err)
+	rooms, err = redisClient.UserRooms(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ops"}, rooms)
+	_, err = redisClient.RemoveRoomConnection(testCtx, "ops", "user1", "c-t1", 0)
+	assert.Nil(t, err)
+	rooms, err = redisClient.UserRooms(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Empty(t, rooms)
+}
+
+func TestUserStatus(t *testing.T) {
+	clearRedis()
+	_, err := redisClient.AddUserConnection(testCtx, "user1", "c-t1")
+	assert.Nil(t, err)
+	assert.Nil(t, redisClient.CreateSession(testCtx, domain.Session{Token: "t1", ConnID: "c-t1", Username: "user1", Room: "global"}))
+
+	// A chosen status wins over the connections' state
+	assert.Nil(t, redisClient.SetUserStatus(testCtx, "user1", domain.PresenceBusy, "in a meeting", 0))
+	presence, err := redisClient.UserPresence(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.Presence{Username: "user1", Status: domain.PresenceBusy, Text: "in a meeting"}, presence)
+
+	// Online keeps the text but follows the connections
+	assert.Nil(t, redisClient.SetUserStatus(testCtx, "user1", domain.PresenceOnline, "lunch", 0))
+	assert.Nil(t, redisClient.SetSessionIdle(testCtx, "t1", true))
+	presence, err = redisClient.UserPresence(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.PresenceAway, presence.Status)
+	assert.Equal(t, "lunch", presence.Text)
+
+	// Statuses with an expiry tell when they lapse
+	assert.Nil(t, redisClient.SetUserStatus(testCtx, "user1", domain.PresenceInvisible, "", time.Minute))
+	presence, err = redisClient.UserPresence(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.PresenceInvisible, presence.Status)
+	assert.NotEmpty(t, presence.ExpiresAt)
+	invisible, err := redisClient.IsInvisible(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.True(t, invisible)
+	invisible, err = redisClient.IsInvisible(testCtx, "user2")
+	assert.Nil(t, err)
+	assert.False(t, invisible)
+
+	// Several users are read at once, in order
+	_, err = redisClient.AddUserConnection(testCtx, "user2", "c-t2")
+	assert.Nil(t, err)
+	assert.Nil(t, redisClient.CreateSession(testCtx, domain.Session{Token: "t2", ConnID: "c-t2", Username: "user2", Room: "global"}))
+	presences, err := redisClient.UserPresences(testCtx, []string{"user2", "nobody", "user1"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{domain.PresenceOnline, domain.PresenceOffline, domain.PresenceInvisible},
+		[]string{presences[0].Status, presences[1].Status, presences[2].Status})
+	assert.Equal(t, "nobody", presences[1].Username)
+
+	// Invisible room members are found per room
+	_, err = redisClient.AddRoomConnection(testCtx, "dev", "user1", "c-t1", 0, false)
+	assert.Nil(t, err)
+	_, err = redisClient.AddRoomConnection(testCtx, "dev", "user2", "c-t2", 0, false)
+	assert.Nil(t, err)
+	members, err := redisClient.InvisibleMembers(testCtx, []string{"dev", "empty"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"dev": {"user1"}}, members)
+
+	// Disconnected users are offline whatever they chose
+	_, err = redisClient.RemoveUserConnection(testCtx, "user1", "c-t1")
+	assert.Nil(t, err)
+	presence, err = redisClient.UserPresence(testCtx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.Presence{Username: "user1", Status: domain.PresenceOffline}, presence)
+}
+
+func TestSlowModeCooldown(t *testing.T) {
+	clearRedis()
+	_, err := redisClient.AddRoomConnection(testCtx, "slow", "user1", "conn1", 0, true)
+	assert.Nil(t, err)
+
+	// Without slow mode there is no cooldown
+	left, err := redisClient.StartSlowModeCooldown(testCtx, "slow", "user1")
+	assert.Nil(t, err)
+	assert.Zero(t, left)
+
+	assert.Nil(t, redisClient.SetRoomSlowMode(testCtx, "slow", 30))
+	room, err := redisClient.GetRoom(testCtx, "slow")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(30), room.SlowMode)
+
+	left, err = redisClient.StartSlowModeCooldown(testCtx, "slow", "user1")
+	assert.Nil(t, err)
+	assert.Zero(t, left)
+	left, err = redisClient.StartSlowModeCooldown(testCtx, "slow", "user1")
+	assert.Nil(t, err)
+	assert.InDelta(t, 30*time.Second, left, float64(time.Second))
+
+	// Cooldowns are per user
+	left, err = redisClient.StartSlowModeCooldown(testCtx, "slow", "user2")
+	assert.Nil(t, err)
+	assert.Zero(t, left)
+
+	assert.ErrorIs(t, redisClient.SetRoomSlowMode(testCtx, "missing", 30), domain.ErrRoomNotFound)
+}
+
+func TestRoomCapacityLimit(t *testing.T) {
+	clearRedis()
+
+	// Concurrent joins never take a room past its capacity
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := fmt.Sprintf("user%d", i)
+			redisClient.AddRoomConnection(testCtx, "crowded", user, "conn-"+user, 5, true)
+		}(i)
+	}
+	wg.Wait()
+	room, err := redisClient.GetRoom(testCtx, "crowded")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), room.Members)
+
+	members, err := redisClient.SMembers(testCtx, "room:crowded")
+	assert.Nil(t, err)
+	_, err = redisClient.AddRoomConnection(testCtx, "crowded", "late", "conn-late", 5, true)
+	assert.ErrorIs(t, err, domain.ErrRoomFull)
+
+	// Members can add connections to a full room
+	change, err := redisClient.AddRoomConnection(testCtx, "crowded", members[0], "another", 5, true)
+	assert.Nil(t, err)
+	assert.False(t, change.Joined)
+
+	// A room's own capacity overrides the default
+	assert.Nil(t, redisClient.CreateRoom(testCtx, domain.Room{Name: "cozy", CreatedBy: "user1", Visibility: domain.RoomPublic, MaxMembers: 1}, ""))
+	_, err = redisClient.AddRoomConnection(testCtx, "cozy", "user1", "conn1", 5, true)
+	assert.Nil(t, err)
+	_, err = redisClient.AddRoomConnection(testCtx, "cozy", "user2", "conn2", 5, true)
+	assert.ErrorIs(t, err, domain.ErrRoomFull)
+}
+
+func TestSwitchRoomConnection(t *testing.T) {
+	clearRedis()
+
+	_, err := redisClient.AddRoomConnection(testCtx, "from", "user1", "conn1", 0, true)
+	assert.Nil(t, err)
+	_, err = redisClient.AddRoomConnection(testCtx, "from", "user1", "conn2", 0, true)
+	assert.Nil(t, err)
+
+	// The user stays in the old room while another connection is left there
+	left, joined, err := redisClient.SwitchRoomConnection(testCtx, "from", "to", "user1", "conn1", 0, true, 0)
+	assert.Nil(t, err)
+	assert.True(t, joined.Joined)
+	assert.True(t, joined.Created)
+	assert.False(t, left.Left)
+	assert.False(t, left.Idle)
+	isMember, _ := redisClient.IsRoomMember(testCtx, "from", "user1")
+	assert.True(t, isMember)
+	room, err := redisClient.GetRoom(testCtx, "to")
+	assert.Nil(t, err)
+	assert.Equal(t, "user1", room.CreatedBy)
+
+	// Moving the last connection leaves the old room, which is dropped or left to idle
+	left, joined, err = redisClient.SwitchRoomConnection(testCtx, "from", "to", "user1", "conn2", 0, true, time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, joined.Joined)
+	assert.True(t, left.Left)
+	assert.True(t, left.Idle)
+	assert.False(t, left.Dropped)
+	left, _, err = redisClient.SwitchRoomConnection(testCtx, "to", "other", "user1", "conn1", 0, true, 0)
+	assert.Nil(t, err)
+	assert.False(t, left.Left)
+	assert.False(t, left.Idle)
+	left, _, err = redisClient.SwitchRoomConnection(testCtx, "to", "other", "user1", "conn2", 0, true, 0)
+	assert.Nil(t, err)
+	assert.True(t, left.Left)
+	assert.True(t, left.Dropped)
+	_, err = redisClient.GetRoom(testCtx, "to")
+	assert.ErrorIs(t, err, domain.ErrRoomNotFound)
+
+	// A full room leaves both rooms untouched
+	_, err = redisClient.AddRoomConnection(testCtx, "full", "user2", "conn3", 0, true)
+	assert.Nil(t, err)
+	_, _, err = redisClient.SwitchRoomConnection(testCtx, "other", "full", "user1", "conn1", 1, true, 0)
+	assert.ErrorIs(t, err, domain.ErrRoomFull)
+	members, err := redisClient.SMembers(testCtx, "room:other")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user1"}, members)
+	members, err = redisClient.SMembers(testCtx, "room:full")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user2"}, members)
+	conns, err := redisClient.SMembers(testCtx, "room_conns:other:user1")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"conn1", "conn2"}, conns)
+}